@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// actionTimeout bounds how long a container action may take, stop and restart wait for the
+// container to exit
+const actionTimeout = 5 * time.Minute
+
+// containerActions lists the actions of containerAction
+var containerActions = []string{
+	protocol.ActionStart,
+	protocol.ActionStop,
+	protocol.ActionRestart,
+	protocol.ActionPause,
+	protocol.ActionUnpause,
+	protocol.ActionKill,
+}
+
+var (
+	// errActionsDisabled is returned if the agent's configuration allows no action at all
+	errActionsDisabled = errors.New("container actions are disabled")
+	// errActionNotAllowed is returned for actions the agent's configuration doesn't allow
+	errActionNotAllowed = errors.New("action not allowed for this container")
+)
+
+// containerController is the part of the Docker client running container actions
+type containerController interface {
+	containerInspector
+	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error
+	ContainerRestart(ctx context.Context, containerID string, options container.StopOptions) error
+	ContainerPause(ctx context.Context, containerID string) error
+	ContainerUnpause(ctx context.Context, containerID string) error
+	ContainerKill(ctx context.Context, containerID, signal string) error
+}
+
+// actionPolicy allows each action for the containers its selector matches.
+// Actions without a selector are not allowed.
+type actionPolicy map[string]*containerSelector
+
+// parseActionPolicy parses rules like "restart=^web-", allowing an action for the containers
+// whose name matches the regular expression, or whose full ID is the pattern. An action can have
+// several rules.
+func parseActionPolicy(rules []string) (actionPolicy, error) {
+	patterns := map[string][]string{}
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		action, pattern, found := strings.Cut(rule, "=")
+		if !found || strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("invalid container action rule %q, expected action=pattern", rule)
+		}
+		action = strings.TrimSpace(action)
+		if !isContainerAction(action) {
+			return nil, fmt.Errorf("invalid container action rule %q, unknown action %q", rule, action)
+		}
+		patterns[action] = append(patterns[action], pattern)
+	}
+
+	policy := actionPolicy{}
+	for action, actionPatterns := range patterns {
+		selector, err := newContainerSelector(actionPatterns)
+		if err != nil {
+			return nil, err
+		}
+		policy[action] = selector
+	}
+	return policy, nil
+}
+
+// Allows reports whether the action may be run on the container
+func (p actionPolicy) Allows(action, id string, names []string) bool {
+	return p[action].MatchStrict(id, names)
+}
+
+func isContainerAction(action string) bool {
+	for _, a := range containerActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// runContainerAction checks the action against the policy and runs it
+func runContainerAction(ctx context.Context, source containerController, policy actionPolicy, req protocol.ContainerActionRequest) (protocol.ContainerActionResult, error) {
+	if req.ContainerId == "" {
+		return protocol.ContainerActionResult{}, errors.New("containerId is required")
+	}
+	if !isContainerAction(req.Action) {
+		return protocol.ContainerActionResult{}, fmt.Errorf("unknown action %q", req.Action)
+	}
+	if req.Timeout != nil && *req.Timeout < 0 {
+		return protocol.ContainerActionResult{}, errors.New("timeout must not be negative")
+	}
+
+	// Requests may name the container, the policy is checked against its ID and name
+	info, err := source.ContainerInspect(ctx, req.ContainerId)
+	if err != nil {
+		return protocol.ContainerActionResult{}, err
+	}
+	if info.ContainerJSONBase == nil {
+		return protocol.ContainerActionResult{}, fmt.Errorf("container %s not found", req.ContainerId)
+	}
+	if !policy.Allows(req.Action, info.ID, []string{info.Name}) {
+		return protocol.ContainerActionResult{}, errActionNotAllowed
+	}
+
+	stopOptions := container.StopOptions{Timeout: req.Timeout}
+	switch req.Action {
+	case protocol.ActionStart:
+		err = source.ContainerStart(ctx, info.ID, types.ContainerStartOptions{})
+	case protocol.ActionStop:
+		err = source.ContainerStop(ctx, info.ID, stopOptions)
+	case protocol.ActionRestart:
+		err = source.ContainerRestart(ctx, info.ID, stopOptions)
+	case protocol.ActionPause:
+		err = source.ContainerPause(ctx, info.ID)
+	case protocol.ActionUnpause:
+		err = source.ContainerUnpause(ctx, info.ID)
+	case protocol.ActionKill:
+		signal := req.Signal
+		if signal == "" {
+			signal = "SIGKILL"
+		}
+		err = source.ContainerKill(ctx, info.ID, signal)
+	}
+	if err != nil {
+		return protocol.ContainerActionResult{}, err
+	}
+
+	result := protocol.ContainerActionResult{
+		ContainerId: info.ID,
+		Name:        strings.TrimPrefix(info.Name, "/"),
+		Action:      req.Action,
+		CompletedAt: time.Now(),
+	}
+
+	// The container may be removed by now, if it was started with --rm
+	if after, err := source.ContainerInspect(ctx, info.ID); err == nil && after.ContainerJSONBase != nil && after.State != nil {
+		result.State = after.State.Status
+	}
+	return result, nil
+}
+
+// handleContainerAction runs a containerAction request in the background, answers with its
+// result and records it in the audit log
+func (a *Agent) handleContainerAction(msg protocol.Message, log Logger) error {
+	var req protocol.ContainerActionRequest
+	if err := a.codec().Unmarshal(msg, &req); err != nil {
+		return a.send(protocol.NewError(protocol.EventContainerAction, msg.MessageId, err))
+	}
+
+	// Bind the reply to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+
+	go func() {
+		result, err := a.containerAction(req)
+
+		if err := a.AuditLog.Record(actionAuditEntry(req, result, err)); err != nil {
+			log.Error("agent", "Error writing audit log: "+err.Error())
+		}
+
+		if err != nil {
+			log.Warn("agent", fmt.Sprintf("Container action %s on %s failed: %s", req.Action, req.ContainerId, err))
+			err = a.write(conn, protocol.NewError(protocol.EventContainerAction, msg.MessageId, err))
+		} else {
+			log.Info("agent", fmt.Sprintf("Ran container action %s on %s", req.Action, result.Name))
+			err = a.writeSealed(conn, codec, protocol.EventContainerAction, msg.MessageId, result)
+		}
+		if err != nil {
+			log.Error("agent", "Error sending containerAction: "+err.Error())
+		}
+	}()
+	return nil
+}
+
+// containerAction runs a container action through the Docker API. Without any allowed
+// action Docker isn't even contacted.
+func (a *Agent) containerAction(req protocol.ContainerActionRequest) (protocol.ContainerActionResult, error) {
+	if len(a.ContainerActions) == 0 {
+		return protocol.ContainerActionResult{}, errActionsDisabled
+	}
+
+	cli, err := a.runtimeClient()
+	if err != nil {
+		return protocol.ContainerActionResult{}, err
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+	defer cancel()
+
+	return runContainerAction(ctx, cli, a.ContainerActions, req)
+}
+
+// actionAuditEntry describes the outcome of a container action for the audit log
+func actionAuditEntry(req protocol.ContainerActionRequest, result protocol.ContainerActionResult, err error) auditEntry {
+	entry := auditEntry{
+		Operation:   "container." + req.Action,
+		ContainerId: req.ContainerId,
+		Name:        result.Name,
+		Details:     map[string]string{},
+		Result:      auditAllowed,
+	}
+	if req.Signal != "" {
+		entry.Details["signal"] = req.Signal
+	}
+	if req.Timeout != nil {
+		entry.Details["timeout"] = strconv.Itoa(*req.Timeout)
+	}
+
+	switch {
+	case errors.Is(err, errActionsDisabled), errors.Is(err, errActionNotAllowed):
+		entry.Result = auditDenied
+		entry.Error = err.Error()
+	case err != nil:
+		entry.Result = auditFailed
+		entry.Error = err.Error()
+	}
+	return entry
+}
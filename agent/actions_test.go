@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// fakeController records the actions run on containers served by a fakeInspector
+type fakeController struct {
+	fakeInspector
+	calls []string
+}
+
+func (c *fakeController) run(call, containerId string) error {
+	c.calls = append(c.calls, call+" "+containerId)
+	info := c.containers[containerId]
+	info.State.Status = call
+	c.containers[containerId] = info
+	return nil
+}
+
+func (c *fakeController) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return c.run("start", containerID)
+}
+
+func (c *fakeController) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	return c.run("stop", containerID)
+}
+
+func (c *fakeController) ContainerRestart(ctx context.Context, containerID string, options container.StopOptions) error {
+	return c.run("restart", containerID)
+}
+
+func (c *fakeController) ContainerPause(ctx context.Context, containerID string) error {
+	return c.run("pause", containerID)
+}
+
+func (c *fakeController) ContainerUnpause(ctx context.Context, containerID string) error {
+	return c.run("unpause", containerID)
+}
+
+func (c *fakeController) ContainerKill(ctx context.Context, containerID, signal string) error {
+	return c.run("kill "+signal, containerID)
+}
+
+func TestParseActionPolicy(t *testing.T) {
+	policy, err := parseActionPolicy([]string{"restart=^web-", " restart = ^api$", "", "kill=abc123db", "stop=db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		action string
+		names  []string
+		allows bool
+	}{
+		{"restart", []string{"/web-1"}, true},
+		{"restart", []string{"/api"}, true},
+		{"restart", []string{"/db"}, false},
+		{"kill", []string{"/db"}, true},
+		{"stop", []string{"/db-1"}, true},
+		// Patterns only match the full ID, not the "db" within it
+		{"stop", []string{"/web-1"}, false},
+	}
+	for _, test := range tests {
+		if allows := policy.Allows(test.action, "abc123db", test.names); allows != test.allows {
+			t.Errorf("%s of %v allowed %t", test.action, test.names, allows)
+		}
+	}
+
+	if policy.Allows("kill", "abc123", []string{"/web-1"}) {
+		t.Error("kill allowed for a prefix of the ID")
+	}
+
+	for _, rules := range [][]string{{"restart"}, {"restart="}, {"delete=.*"}, {"stop=("}} {
+		if _, err := parseActionPolicy(rules); err == nil {
+			t.Error("invalid rules accepted", rules)
+		}
+	}
+	if policy, _ := parseActionPolicy(nil); len(policy) != 0 {
+		t.Fatal("actions allowed by default")
+	}
+}
+
+func TestRunContainerAction(t *testing.T) {
+	web := inspectedContainer("abc", "web-1", 0)
+	db := inspectedContainer("def", "db", 0)
+	source := &fakeController{fakeInspector: fakeInspector{containers: map[string]types.ContainerJSON{"abc": web, "def": db}}}
+	policy, _ := parseActionPolicy([]string{"restart=^web-", "kill=^web-"})
+	ctx := context.Background()
+
+	result, err := runContainerAction(ctx, source, policy, protocol.ContainerActionRequest{ContainerId: "abc", Action: "restart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ContainerId != "abc" || result.Name != "web-1" || result.Action != "restart" || result.State != "restart" || result.CompletedAt.IsZero() {
+		t.Fatal("unexpected result", result)
+	}
+	if _, err := runContainerAction(ctx, source, policy, protocol.ContainerActionRequest{ContainerId: "abc", Action: "kill"}); err != nil {
+		t.Fatal(err)
+	}
+
+	denied := []protocol.ContainerActionRequest{
+		{ContainerId: "def", Action: "restart"},
+		{ContainerId: "abc", Action: "stop"},
+	}
+	for _, req := range denied {
+		if _, err := runContainerAction(ctx, source, policy, req); !errors.Is(err, errActionNotAllowed) {
+			t.Error("denied action returned", err)
+		}
+	}
+
+	negative := -1
+	invalid := []protocol.ContainerActionRequest{
+		{Action: "restart"},
+		{ContainerId: "abc", Action: "delete"},
+		{ContainerId: "abc", Action: "stop", Timeout: &negative},
+		{ContainerId: "gone", Action: "restart"},
+	}
+	for _, req := range invalid {
+		if _, err := runContainerAction(ctx, source, policy, req); err == nil || errors.Is(err, errActionNotAllowed) {
+			t.Error("invalid action returned", err)
+		}
+	}
+
+	if len(source.calls) != 2 || source.calls[0] != "restart abc" || source.calls[1] != "kill SIGKILL abc" {
+		t.Fatal("unexpected calls", source.calls)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), auditFile)
+	audit := newAuditLog(path)
+	timeout := 5
+
+	req := protocol.ContainerActionRequest{ContainerId: "abc", Action: "stop", Timeout: &timeout}
+	entries := []auditEntry{
+		actionAuditEntry(req, protocol.ContainerActionResult{Name: "web-1"}, nil),
+		actionAuditEntry(req, protocol.ContainerActionResult{}, errActionNotAllowed),
+		actionAuditEntry(req, protocol.ContainerActionResult{}, errActionsDisabled),
+		actionAuditEntry(req, protocol.ContainerActionResult{}, errors.New("no such container")),
+	}
+	for _, entry := range entries {
+		if err := audit.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if stat, _ := f.Stat(); stat.Mode().Perm() != 0600 {
+		t.Fatal("audit log readable by others", stat.Mode())
+	}
+
+	var results []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Operation != "container.stop" || entry.ContainerId != "abc" || entry.Details["timeout"] != "5" || entry.Time.IsZero() {
+			t.Fatal("unexpected entry", entry)
+		}
+		results = append(results, entry.Result)
+	}
+	expected := []string{auditAllowed, auditDenied, auditDenied, auditFailed}
+	if len(results) != len(expected) {
+		t.Fatal("unexpected results", results)
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Fatal("unexpected results", results)
+		}
+	}
+
+	// Agents without an audit log record nothing
+	var disabled *auditLog
+	if err := disabled.Record(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+}
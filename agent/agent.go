@@ -4,26 +4,109 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"echoes/shared/protocol"
 	"echoes/shared/trsa"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/gorilla/websocket"
 )
 
 // Agent represents the client that will communicate with the server
 type Agent struct {
-	PrivateKey      []byte
-	PublicKey       []byte
-	Token           string
-	ServerPublicKey []byte
-	Id              int
-	Connection      *websocket.Conn
+	Keys       *trsa.Keypair
+	Token      string
+	ServerKeys *trsa.Keypair
+	Id         int
+	Connection *websocket.Conn
+
+	// EncryptionScheme and SignatureScheme are negotiated during the handshake
+	EncryptionScheme trsa.Scheme
+	SignatureScheme  trsa.Scheme
+
+	// Session holds the ephemeral session keys, if the server offered a session during the handshake
+	Session *trsa.Session
+
+	// ProtocolVersion is the protocol version negotiated during the handshake
+	ProtocolVersion int
+
+	// Capabilities holds the optional features the server enabled for the connection
+	Capabilities protocol.Capabilities
+
+	// InventoryInterval is how often the inventory is sent to the server, 0 disables the updates
+	InventoryInterval time.Duration
+
+	// StatsInterval is how often the resource usage of the containers selected by StatsSelector
+	// is sent to the server, 0 disables the stats
+	StatsInterval time.Duration
+	StatsSelector *containerSelector
+	// MetricsExporter receives the stats as OTLP metrics as well, nil disables the export
+	MetricsExporter *otlpExporter
+
+	// ContainerActions allows containerAction requests, no action is allowed by default
+	ContainerActions actionPolicy
+	// AuditLog records the actions the server requested
+	AuditLog *auditLog
+
+	// ExecEnabled offers the exec capability, exec sessions without input or output for
+	// ExecIdleTimeout are closed
+	ExecEnabled     bool
+	ExecIdleTimeout time.Duration
+
+	// DockerEvents spools the Docker events matching DockerEventFilters for the server,
+	// nil disables forwarding them
+	DockerEvents       *spool[protocol.DockerEvent]
+	DockerEventFilters filters.Args
+
+	// Runtime is the container engine the agent reads containers from
+	Runtime containerRuntime
+
+	// Sinks receive the logs of the containers selected by SinkSelector, nil disables them
+	Sinks        *sinkFanout
+	SinkSelector *containerSelector
+
+	// disconnected is closed when the current connection ends
+	disconnected chan struct{}
+	// tasksStarted is set once the periodic tasks of the current connection were started
+	tasksStarted bool
+	// metadata caches the container metadata published on the current connection
+	metadata *metadataCache
+	// logSubscriptions holds the server's log subscriptions of the current connection
+	logSubscriptions *logSubscriptions
+	// execSessions holds the server's exec sessions of the current connection
+	execSessions *execSessions
+	// writeMu serializes writes to the connection, which allows only one writer
+	writeMu sync.Mutex
+}
+
+// agentCapabilities lists the optional protocol features the agent supports
+var agentCapabilities = protocol.Capabilities{
+	protocol.CapabilityHybridEncryption,
+	protocol.CapabilityCompression,
+	protocol.CapabilityLogStreaming,
+	protocol.CapabilityStats,
+}
+
+// capabilities lists the optional protocol features the agent offers, exec and Docker events
+// are only offered when they are enabled
+func (a *Agent) capabilities() protocol.Capabilities {
+	capabilities := append(protocol.Capabilities{}, agentCapabilities...)
+	if a.ExecEnabled {
+		capabilities = append(capabilities, protocol.CapabilityExec)
+	}
+	if a.DockerEvents != nil {
+		capabilities = append(capabilities, protocol.CapabilityDockerEvents)
+	}
+	return capabilities
 }
 
 // agentDir is the directory where the agent stores its RSA keys and other files
@@ -36,15 +119,10 @@ func NewAgent() *Agent {
 
 // Initialize sets up the Agent by generating RSA keys
 func (a *Agent) Initialize(token string) {
-	// if on windows, store the RSA keys in %APPDATA%\Echoes\agent
-	if os.Getenv("OS") == "Windows_NT" {
-		agentDir = os.Getenv("APPDATA") + "\\Echoes\\agent"
-	} else {
-		agentDir = "/etc/echoes/agent"
-	}
+	agentDir = defaultAgentDir()
 
 	// Check if the files /etc/echoes/agent/private_key and /etc/echoes/agent/public_key exist
-	if _, err := os.Stat(agentDir + "/private_key"); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(agentDir, privateKeyFile)); os.IsNotExist(err) {
 		// Generate RSA Keys
 		publicKey, privateKey, err := trsa.GenerateKeys(2048)
 		if err != nil {
@@ -55,15 +133,7 @@ func (a *Agent) Initialize(token string) {
 		Logger.Info(Logger{}, "agent", "Generated RSA keys")
 
 		// Store the RSA keys in /etc/echoes/agent
-		err = os.MkdirAll(agentDir, os.ModePerm)
-		if err != nil {
-			panic(err) // Handle error
-		}
-		err = os.WriteFile(agentDir+"/private_key", privateKey, 0o644)
-		if err != nil {
-			panic(err) // Handle error
-		}
-		err = os.WriteFile(agentDir+"/public_key", publicKey, 0o644)
+		err = writeKeys(agentDir, publicKey, privateKey)
 		if err != nil {
 			panic(err) // Handle error
 		}
@@ -71,18 +141,17 @@ func (a *Agent) Initialize(token string) {
 		Logger.Info(Logger{}, "agent", "Stored RSA keys in "+agentDir)
 
 		// Set the agent's public and private keys
-		a.PrivateKey = privateKey
-		a.PublicKey = publicKey
+		a.Keys, err = trsa.NewKeypair(publicKey, privateKey)
+		if err != nil {
+			panic(err) // Handle error
+		}
 	} else {
-		// Read the private key from the file
-		privateKey, err := os.ReadFile(agentDir + "/private_key")
+		// Read the keys from disk
+		publicKey, privateKey, err := readKeys(agentDir)
 		if err != nil {
 			panic(err) // Handle error
 		}
-		a.PrivateKey = privateKey
-
-		// Read the public key from the file
-		a.PublicKey, err = os.ReadFile(agentDir + "/public_key")
+		a.Keys, err = trsa.NewKeypair(publicKey, privateKey)
 		if err != nil {
 			panic(err) // Handle error
 		}
@@ -94,6 +163,127 @@ func (a *Agent) Initialize(token string) {
 	a.Token = token
 }
 
+// send marshals the message and writes it to the server connection
+func (a *Agent) send(message protocol.Message) error {
+	return a.write(a.Connection, message)
+}
+
+// write marshals the message and writes it to the given connection
+func (a *Agent) write(conn *websocket.Conn, message protocol.Message) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	return writeMessage(conn, message)
+}
+
+// sendSealed encrypts the payload with the negotiated keys and writes it to the server
+// connection, see writeSealed
+func (a *Agent) sendSealed(event, messageId string, payload interface{}) error {
+	return a.writeSealed(a.Connection, a.codec(), event, messageId, payload)
+}
+
+// writeSealed encrypts the payload and writes it to the given connection under the write
+// lock. The session numbers every sealed frame and the server rejects frames arriving out of
+// order as replays, so sealing and writing must not interleave with other writers.
+func (a *Agent) writeSealed(conn *websocket.Conn, codec *protocol.Codec, event, messageId string, payload interface{}) error {
+	if conn == nil {
+		return errors.New("not connected to the server")
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	message, err := codec.NewMessage(event, payload)
+	if err != nil {
+		return err
+	}
+	message.MessageId = messageId
+
+	return writeMessage(conn, message)
+}
+
+// writeMessage marshals the message and writes it to the connection, the caller holds the
+// write lock
+func writeMessage(conn *websocket.Conn, message protocol.Message) error {
+	if conn == nil {
+		return errors.New("not connected to the server")
+	}
+
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("json.Marshal error: %w", err)
+	}
+
+	err = conn.WriteMessage(websocket.TextMessage, jsonData)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+// startConnectionTasks starts the periodic tasks of an authenticated connection
+func (a *Agent) startConnectionTasks(log Logger) {
+	if a.disconnected == nil || a.tasksStarted {
+		return
+	}
+	a.tasksStarted = true
+
+	a.startMetadataRefresh(log)
+	a.startLogSubscriptions(log)
+	a.startInventoryUpdates(log)
+	a.startStatsUpdates(log)
+	a.startExecSessions(log)
+	a.startDockerEventForwarding(log)
+}
+
+// sendPeriodically sends the payload returned by build as event every interval, until the
+// current connection ends. build may return a nil payload to skip sending for this interval.
+func (a *Agent) sendPeriodically(interval time.Duration, event string, log Logger, build func() (interface{}, error)) {
+	// Bind the task to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+	disconnected := a.disconnected
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-disconnected:
+				return
+			case <-ticker.C:
+			}
+
+			payload, err := build()
+			if err != nil {
+				log.Error("agent", err.Error())
+				continue
+			}
+			if payload == nil {
+				continue
+			}
+			if err := a.writeSealed(conn, codec, event, "", payload); err != nil {
+				log.Error("agent", "Error sending "+event+": "+err.Error())
+				return
+			}
+		}
+	}()
+}
+
+// codec returns the codec encrypting payloads for the server with the negotiated keys
+func (a *Agent) codec() *protocol.Codec {
+	return &protocol.Codec{
+		Keys:     a.Keys,
+		PeerKeys: a.ServerKeys,
+		Scheme:   a.EncryptionScheme,
+		Session:  a.Session,
+		Compress: a.Capabilities.Has(protocol.CapabilityCompression),
+		Hybrid:   a.Capabilities.Has(protocol.CapabilityHybridEncryption),
+	}
+}
+
 // PerformHandshake performs the E2E encryption handshake with the server
 func (a *Agent) PerformHandshake(url string) error {
 	Logger.Info(Logger{}, "agent", "Performing handshake with server...")
@@ -101,7 +291,7 @@ func (a *Agent) PerformHandshake(url string) error {
 	// Send agent token and public key to the server as JSON
 	jsonData := map[string]string{
 		"agent_token": string(a.Token),
-		"public_key":  string(a.PublicKey),
+		"public_key":  string(a.Keys.Public),
 	}
 	jsonValue, _ := json.Marshal(jsonData)
 
@@ -132,17 +322,18 @@ func (a *Agent) PerformHandshake(url string) error {
 
 // TODO: This would then be sent to the server, to display the possible containers that can be monitored (to help with regex pattern making)
 // Get a list of all the containers running on the host (used by the server to display the containers that can be monitored)
-func (a *Agent) GetContainers() []types.Container {
+func (a *Agent) GetContainers() ([]types.Container, error) {
 	// Create a new docker client
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	cli, err := a.runtimeClient()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer cli.Close()
 
 	// List containers
 	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Print the containers (for debugging)
@@ -151,30 +342,38 @@ func (a *Agent) GetContainers() []types.Container {
 	}
 
 	// return containers
-	return containers
+	return containers, nil
 }
 
 // GetContainerLog gets the logs of a container and returns them as a string
 func (a *Agent) GetContainerLog(containerId string) (string, error) {
+	// Use a buffer to store the logs
+	var buf bytes.Buffer
+	if err := a.WriteContainerLog(containerId, &buf); err != nil {
+		return "", err
+	}
+
+	// Return the logs as a string
+	return buf.String(), nil
+}
+
+// WriteContainerLog copies the logs of a container to w without holding them in memory
+func (a *Agent) WriteContainerLog(containerId string, w io.Writer) error {
 	// Create a new docker client
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	cli, err := a.runtimeClient()
 	if err != nil {
-		return "", err
+		return err
 	}
 
+	defer cli.Close()
+
 	// Get the container logs
 	out, err := cli.ContainerLogs(context.Background(), containerId, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer out.Close()
 
-	// Use a buffer to store the logs
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, out); err != nil {
-		return "", err
-	}
-
-	// Return the logs as a string
-	return buf.String(), nil
+	_, err = io.Copy(w, out)
+	return err
 }
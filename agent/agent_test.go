@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"echoes/shared/protocol"
+	"echoes/shared/trsa"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSessions returns the sessions of an agent and a server that completed the handshake
+func newTestSessions(t *testing.T) (*trsa.Session, *trsa.Session) {
+	t.Helper()
+
+	agentPublic, agentPrivate, err := trsa.GenerateKeys(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPublic, serverPrivate, err := trsa.GenerateKeys(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := trsa.NewSessionHandshake(agentPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := trsa.NewSessionHandshake(serverPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentSession, err := agent.Complete(server.Offer(), serverPublic, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSession, err := server.Complete(agent.Offer(), agentPublic, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agentSession, serverSession
+}
+
+func TestWriteSealedConcurrently(t *testing.T) {
+	const writers, messages = 8, 50
+	agentSession, serverSession := newTestSessions(t)
+
+	// The server opens every frame in the order it arrives, like the real server does
+	opened := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			opened <- err
+			return
+		}
+		defer conn.Close()
+
+		codec := &protocol.Codec{Session: serverSession}
+		for i := 0; i < writers*messages; i++ {
+			_, data, err := conn.ReadMessage()
+			if err == nil {
+				var msg protocol.Message
+				if msg, err = protocol.Parse(data); err == nil {
+					var payload string
+					err = codec.Unmarshal(msg, &payload)
+				}
+			}
+			if err != nil {
+				opened <- err
+				return
+			}
+		}
+		opened <- nil
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	a := &Agent{Session: agentSession}
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codec := a.codec()
+			for i := 0; i < messages; i++ {
+				if err := a.writeSealed(conn, codec, protocol.EventContainerMeta, "", strings.Repeat("x", i*2000)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := <-opened; err != nil {
+		t.Fatal("server failed to open a frame:", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditFile is the name of the default audit log in the agent directory
+const auditFile = "audit.log"
+
+// Results of audited operations
+const (
+	auditAllowed = "ok"
+	auditDenied  = "denied"
+	auditFailed  = "failed"
+)
+
+// auditEntry records an operation the server requested on the host
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Operation   string    `json:"operation"`
+	ContainerId string    `json:"containerId"`
+	Name        string    `json:"name,omitempty"`
+	// Details holds operation specific arguments, like the signal of a kill
+	Details map[string]string `json:"details,omitempty"`
+	Result  string            `json:"result"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to a local file, which only the agent's user can read
+type auditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+// Record appends an entry, a nil audit log records nothing
+func (l *auditLog) Record(entry auditEntry) error {
+	if l == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// collectorSource is the part of the Docker client the log collector uses
+type collectorSource interface {
+	logSource
+	eventSource
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+}
+
+// logCollector follows the logs of the selected containers, running or started later, and
+// publishes every line as a record for the sinks
+type logCollector struct {
+	selector *containerSelector
+	publish  func(record LogRecord)
+	log      Logger
+
+	mu        sync.Mutex
+	following map[string]bool
+	// restarted holds the start time of followed containers that restarted before their
+	// previous logs ended, they are followed again afterwards
+	restarted map[string]time.Time
+	// lastSeen holds the time of the last line of containers whose logs were interrupted,
+	// following them again resumes after it
+	lastSeen map[string]time.Time
+}
+
+func newLogCollector(selector *containerSelector, publish func(record LogRecord), log Logger) *logCollector {
+	return &logCollector{
+		selector:  selector,
+		publish:   publish,
+		log:       log,
+		following: map[string]bool{},
+		restarted: map[string]time.Time{},
+		lastSeen:  map[string]time.Time{},
+	}
+}
+
+// Run follows the containers until the context ends or the Docker events fail. Containers
+// already running are followed from now on, containers started later from their start.
+// Running the collector again resumes interrupted containers after their last line.
+func (c *logCollector) Run(ctx context.Context, source collectorSource) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// Subscribe before listing, so containers started meanwhile aren't missed
+	messages, errs := source.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", "container"),
+			filters.Arg("event", "start"),
+		),
+	})
+
+	containers, err := source.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if c.selector.Match(container.ID, container.Names) {
+			c.follow(ctx, source, &wg, container.ID, time.Time{})
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case event := <-messages:
+			if c.selector.Match(event.Actor.ID, []string{event.Actor.Attributes["name"]}) {
+				c.follow(ctx, source, &wg, event.Actor.ID, dockerEventRecord(event).Time)
+			}
+		}
+	}
+}
+
+// follow starts following the logs of a container from since, unless they are followed already
+func (c *logCollector) follow(ctx context.Context, source collectorSource, wg *sync.WaitGroup, containerId string, since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.following[containerId] {
+		if !since.IsZero() {
+			c.restarted[containerId] = since
+		}
+		return
+	}
+	c.following[containerId] = true
+	if last, ok := c.lastSeen[containerId]; ok {
+		since = last.Add(time.Nanosecond)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		last, err := c.followContainer(ctx, source, containerId, since)
+
+		c.mu.Lock()
+		delete(c.following, containerId)
+		delete(c.lastSeen, containerId)
+		if ctx.Err() != nil && !last.IsZero() {
+			c.lastSeen[containerId] = last
+		}
+		restartedAt, restarted := c.restarted[containerId]
+		delete(c.restarted, containerId)
+		c.mu.Unlock()
+
+		if err != nil && ctx.Err() == nil {
+			c.log.Debug("agent", "Stopped collecting logs of "+containerId+": "+err.Error())
+		}
+		if restarted && ctx.Err() == nil {
+			c.follow(ctx, source, wg, containerId, restartedAt)
+		}
+	}()
+}
+
+// followContainer publishes the lines of a container until it stops or the context ends, and
+// returns the time of the last line
+func (c *logCollector) followContainer(ctx context.Context, source logSource, containerId string, since time.Time) (time.Time, error) {
+	info, err := source.ContainerInspect(ctx, containerId)
+	if err != nil {
+		return since, err
+	}
+	meta := containerMetadata(info)
+	tty := info.Config != nil && info.Config.Tty
+
+	options := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+		Tail:       "0",
+	}
+	if !since.IsZero() {
+		options.Since = since.Format(time.RFC3339Nano)
+		options.Tail = "all"
+	}
+
+	out, err := source.ContainerLogs(ctx, containerId, options)
+	if err != nil {
+		return since, err
+	}
+	defer out.Close()
+
+	last := since
+	err = readLogEntries(out, tty, func(entry protocol.LogEntry) error {
+		c.publish(LogRecord{Time: entry.Timestamp, Container: meta, Stream: entry.Stream, Line: entry.Line})
+		last = entry.Timestamp
+		return nil
+	})
+	return last, err
+}
+
+// startLogCollector collects the logs of the containers selected by SinkSelector for the
+// sinks, for as long as the agent runs
+func (a *Agent) startLogCollector(log Logger) {
+	collector := newLogCollector(a.SinkSelector, a.Sinks.Publish, log)
+
+	go func() {
+		for {
+			cli, err := a.runtimeClient()
+			if err == nil {
+				err = collector.Run(context.Background(), cli)
+				cli.Close()
+			}
+			if err != nil {
+				log.Debug("agent", "Log collection interrupted: "+err.Error())
+			}
+
+			time.Sleep(eventsRetryDelay)
+		}
+	}()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+// fakeCollectorSource lists running containers and streams start events, the logs of every
+// container are served from memory
+type fakeCollectorSource struct {
+	fakeInspector
+	running []types.Container
+	logs    map[string][]byte
+	starts  chan events.Message
+	errs    chan error
+
+	mu      sync.Mutex
+	options map[string]types.ContainerLogsOptions
+}
+
+func newFakeCollectorSource() *fakeCollectorSource {
+	return &fakeCollectorSource{
+		fakeInspector: fakeInspector{containers: map[string]types.ContainerJSON{}},
+		logs:          map[string][]byte{},
+		starts:        make(chan events.Message),
+		errs:          make(chan error, 1),
+		options:       map[string]types.ContainerLogsOptions{},
+	}
+}
+
+// ContainerInspect serializes the inspections, containers are followed concurrently
+func (s *fakeCollectorSource) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fakeInspector.ContainerInspect(ctx, containerID)
+}
+
+func (s *fakeCollectorSource) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return s.running, nil
+}
+
+func (s *fakeCollectorSource) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return s.starts, s.errs
+}
+
+func (s *fakeCollectorSource) ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options[container] = options
+	return io.NopCloser(bytes.NewReader(s.logs[container])), nil
+}
+
+func (s *fakeCollectorSource) logsOptions(container string) types.ContainerLogsOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.options[container]
+}
+
+func TestLogCollector(t *testing.T) {
+	source := newFakeCollectorSource()
+	source.containers["web1"] = inspectedContainer("web1", "web", 0)
+	source.containers["db1"] = inspectedContainer("db1", "db", 0)
+	source.containers["web2"] = inspectedContainer("web2", "web-2", 0)
+	source.running = []types.Container{{ID: "web1", Names: []string{"/web"}}, {ID: "db1", Names: []string{"/db"}}}
+	source.logs["web1"] = logFrame(1, "2024-03-01T12:00:00Z running\n")
+	source.logs["db1"] = logFrame(1, "2024-03-01T12:00:00Z not selected\n")
+	source.logs["web2"] = logFrame(2, "2024-03-01T12:00:01Z started\n")
+
+	selector, _ := newContainerSelector([]string{"^web"})
+	records := make(chan LogRecord, 10)
+	collector := newLogCollector(selector, func(record LogRecord) { records <- record }, Logger{})
+
+	done := make(chan error)
+	go func() {
+		done <- collector.Run(context.Background(), source)
+	}()
+
+	// Running containers are followed from now on
+	record := <-records
+	if record.Container.ContainerId != "web1" || record.Container.Name != "web" || record.Line != "running" {
+		t.Fatal("collected", record)
+	}
+	if options := source.logsOptions("web1"); !options.Follow || options.Tail != "0" || options.Since != "" {
+		t.Fatal("followed running container with", options)
+	}
+
+	// Containers started later are followed from their start
+	started := time.Date(2024, 3, 1, 12, 0, 1, 0, time.UTC)
+	source.starts <- events.Message{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: "web2", Attributes: map[string]string{"name": "web-2"}}, TimeNano: started.UnixNano()}
+	record = <-records
+	if record.Container.ContainerId != "web2" || record.Stream != protocol.StreamStderr || record.Line != "started" {
+		t.Fatal("collected", record)
+	}
+	if options := source.logsOptions("web2"); options.Since != started.Format(time.RFC3339Nano) || options.Tail != "all" {
+		t.Fatal("followed started container with", options)
+	}
+
+	source.errs <- io.ErrUnexpectedEOF
+	if err := <-done; err != io.ErrUnexpectedEOF {
+		t.Fatal("collector ended with", err)
+	}
+	select {
+	case record := <-records:
+		t.Fatal("collected unselected container", record)
+	default:
+	}
+}
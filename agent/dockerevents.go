@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	// dockerEventSpoolSize is the number of Docker events kept while the server can't be reached
+	dockerEventSpoolSize = 10000
+	// dockerEventBatchSize is the largest number of events sent in one dockerEvent message
+	dockerEventBatchSize = 100
+)
+
+// dockerEventFilterKeys lists the filters of the Docker events API
+var dockerEventFilterKeys = []string{
+	"config", "container", "daemon", "event", "image", "label", "network",
+	"node", "plugin", "scope", "secret", "service", "type", "volume",
+}
+
+// defaultDockerEventTypes are forwarded if no filter is configured
+var defaultDockerEventTypes = []string{
+	events.ContainerEventType,
+	events.ImageEventType,
+	events.NetworkEventType,
+	events.VolumeEventType,
+}
+
+// eventSource is the part of the Docker client streaming daemon events
+type eventSource interface {
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// parseDockerEventFilters parses filters like "event=oom" or "type=network" into Docker event
+// filters. Filters with the same key match any of their values, different keys must all match.
+// Without filters the container, image, network and volume events are forwarded.
+func parseDockerEventFilters(rules []string) (filters.Args, error) {
+	args := filters.NewArgs()
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(rule, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !found || value == "" {
+			return args, fmt.Errorf("invalid Docker event filter %q, expected key=value", rule)
+		}
+		if !isDockerEventFilterKey(key) {
+			return args, fmt.Errorf("invalid Docker event filter %q, unknown key %q", rule, key)
+		}
+		args.Add(key, value)
+	}
+
+	if args.Len() == 0 {
+		for _, eventType := range defaultDockerEventTypes {
+			args.Add("type", eventType)
+		}
+	}
+	return args, nil
+}
+
+func isDockerEventFilterKey(key string) bool {
+	for _, k := range dockerEventFilterKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// dockerEventRecord converts a Docker event into its protocol record
+func dockerEventRecord(event events.Message) protocol.DockerEvent {
+	t := time.Unix(event.Time, 0)
+	if event.TimeNano != 0 {
+		t = time.Unix(0, event.TimeNano)
+	}
+
+	return protocol.DockerEvent{
+		Time:       t.UTC(),
+		Type:       event.Type,
+		Action:     event.Action,
+		ActorId:    event.Actor.ID,
+		Attributes: event.Actor.Attributes,
+		Scope:      event.Scope,
+	}
+}
+
+// followDockerEvents spools the Docker events matching the filters until the context ends or
+// the stream fails. Events up to since, in Unix nanoseconds, were already spooled and are
+// skipped. It returns the time of the last spooled event, to resume from.
+func followDockerEvents(ctx context.Context, source eventSource, args filters.Args, events *spool[protocol.DockerEvent], since int64) (int64, error) {
+	options := types.EventsOptions{Filters: args}
+	if since != 0 {
+		options.Since = fmt.Sprintf("%d.%09d", since/int64(time.Second), since%int64(time.Second))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages, errs := source.Events(ctx, options)
+	for {
+		select {
+		case <-ctx.Done():
+			return since, nil
+		case err := <-errs:
+			return since, err
+		case message := <-messages:
+			record := dockerEventRecord(message)
+			if t := record.Time.UnixNano(); t > since {
+				events.Push(record)
+				since = t
+			}
+		}
+	}
+}
+
+// startDockerEvents spools the Docker events for the server for as long as the agent runs,
+// regardless of the connection, so the timeline has no gaps while the server is unreachable
+func (a *Agent) startDockerEvents(log Logger) {
+	go func() {
+		var since int64
+		for {
+			cli, err := a.runtimeClient()
+			if err == nil {
+				since, err = followDockerEvents(context.Background(), cli, a.DockerEventFilters, a.DockerEvents, since)
+				cli.Close()
+			}
+			log.Debug("agent", "Docker events unavailable: "+err.Error())
+
+			time.Sleep(eventsRetryDelay)
+		}
+	}()
+}
+
+// startDockerEventForwarding sends the spooled Docker events in dockerEvent messages until the
+// current connection ends, if the server supports them. Events that could not be sent stay
+// spooled for the next connection.
+func (a *Agent) startDockerEventForwarding(log Logger) {
+	if a.DockerEvents == nil || !a.Capabilities.Has(protocol.CapabilityDockerEvents) {
+		return
+	}
+
+	// Bind the forwarding to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+	disconnected := a.disconnected
+	spooled := a.DockerEvents
+
+	go func() {
+		for {
+			select {
+			case <-disconnected:
+				return
+			case <-spooled.Ready():
+			}
+
+			for {
+				records, dropped := spooled.Take(dockerEventBatchSize)
+				if len(records) == 0 && dropped == 0 {
+					break
+				}
+
+				err := a.writeSealed(conn, codec, protocol.EventDockerEvent, "", protocol.DockerEventBatch{Events: records, Dropped: dropped})
+				if err != nil {
+					spooled.Requeue(records, dropped)
+					log.Error("agent", "Error sending dockerEvent: "+err.Error())
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// fakeEventSource streams the given events, then fails
+type fakeEventSource struct {
+	events  []events.Message
+	options types.EventsOptions
+}
+
+func (s *fakeEventSource) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	s.options = options
+
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+	go func() {
+		for _, event := range s.events {
+			select {
+			case messages <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		errs <- errors.New("stream ended")
+	}()
+	return messages, errs
+}
+
+func TestParseDockerEventFilters(t *testing.T) {
+	args, err := parseDockerEventFilters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, eventType := range []string{"container", "image", "network", "volume"} {
+		if !args.ExactMatch("type", eventType) {
+			t.Fatal("default filters without", eventType)
+		}
+	}
+	if len(args.Get("type")) != 4 {
+		t.Fatal("default filters", args.Get("type"))
+	}
+
+	args, err = parseDockerEventFilters([]string{"event=oom", " event = health_status ", "type=container", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Len() != 2 || !args.ExactMatch("type", "container") || !args.ExactMatch("event", "oom") || !args.ExactMatch("event", "health_status") {
+		t.Fatal("parsed filters", args)
+	}
+
+	for _, invalid := range []string{"event", "event=", "color=red"} {
+		if _, err := parseDockerEventFilters([]string{invalid}); err == nil {
+			t.Fatal("accepted invalid filter", invalid)
+		}
+	}
+}
+
+func TestFollowDockerEvents(t *testing.T) {
+	first := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	source := &fakeEventSource{events: []events.Message{
+		{
+			Type:     events.ContainerEventType,
+			Action:   "oom",
+			Actor:    events.Actor{ID: "abc", Attributes: map[string]string{"name": "web"}},
+			Scope:    "local",
+			TimeNano: first.UnixNano(),
+		},
+		// Events already spooled before a reconnect to Docker are skipped
+		{Type: events.ContainerEventType, Action: "die", TimeNano: first.UnixNano()},
+		{Type: events.NetworkEventType, Action: "create", Actor: events.Actor{ID: "net"}, Time: first.Unix() + 1},
+	}}
+	spooled := newSpool[protocol.DockerEvent](10)
+
+	args := filters.NewArgs(filters.Arg("type", "container"))
+	last, err := followDockerEvents(context.Background(), source, args, spooled, first.UnixNano()-1)
+	if err == nil {
+		t.Fatal("failed stream ended without error")
+	}
+	if source.options.Filters.Get("type")[0] != "container" || source.options.Since != "1709294400.000000499" {
+		t.Fatal("followed events with", source.options)
+	}
+
+	records, _ := spooled.Take(10)
+	expected := []protocol.DockerEvent{
+		{
+			Time:       first,
+			Type:       "container",
+			Action:     "oom",
+			ActorId:    "abc",
+			Attributes: map[string]string{"name": "web"},
+			Scope:      "local",
+		},
+		{Time: first.Truncate(time.Second).Add(time.Second), Type: "network", Action: "create", ActorId: "net"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatal("spooled", records)
+	}
+	if last != expected[1].Time.UnixNano() {
+		t.Fatal("resumes from", last)
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	// execStartTimeout bounds creating and attaching to an exec
+	execStartTimeout = 30 * time.Second
+	// maxExecSessions bounds the exec sessions of a connection
+	maxExecSessions = 16
+	// execInputQueue is the number of input messages buffered per session
+	execInputQueue = 64
+	// execOutputChunk is the largest output sent in one execOutput event
+	execOutputChunk = 32 * 1024
+	// execExpiryInterval is how often idle sessions are closed
+	execExpiryInterval = time.Second
+)
+
+// Reasons for ending an exec session
+const (
+	execExited   = "exited"
+	execClosed   = "closed"
+	execTimedOut = "timed out"
+)
+
+var (
+	// errUnknownSession is returned for events referring to a session that doesn't exist
+	errUnknownSession = errors.New("unknown exec session")
+	// errInputClosed is returned for input after the end of the input
+	errInputClosed = errors.New("exec input is closed")
+)
+
+// execBackend is the part of the Docker client running execs
+type execBackend interface {
+	ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error)
+	ContainerExecResize(ctx context.Context, execID string, options types.ResizeOptions) error
+	ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error)
+}
+
+// execSession is a command running in a container, attached over the agent connection
+type execSession struct {
+	id     string
+	execId string
+	tty    bool
+	conn   types.HijackedResponse
+	input  chan execInput
+	// done is closed once the command's output ended
+	done chan struct{}
+
+	// mu guards the fields below
+	mu          sync.Mutex
+	lastActive  time.Time
+	reason      string
+	inputClosed bool
+}
+
+// execInput is input queued for a command, eof closes the command's stdin after data
+type execInput struct {
+	data []byte
+	eof  bool
+}
+
+// touch marks the session as active
+func (s *execSession) touch() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+// stop ends the session for the given reason, unless it already ended
+func (s *execSession) stop(reason string) {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+
+	s.conn.Close()
+}
+
+// execSessions manages the exec sessions of a connection. Input and output of all sessions
+// are multiplexed over the connection by their session ID.
+type execSessions struct {
+	backend     execBackend
+	send        func(event string, payload interface{}) error
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*execSession
+	closed   bool
+}
+
+func newExecSessions(backend execBackend, idleTimeout time.Duration, send func(event string, payload interface{}) error) *execSessions {
+	return &execSessions{
+		backend:     backend,
+		send:        send,
+		idleTimeout: idleTimeout,
+		sessions:    map[string]*execSession{},
+	}
+}
+
+// Start creates an exec in the container and attaches to it
+func (m *execSessions) Start(ctx context.Context, req protocol.ExecStartRequest) (string, error) {
+	if req.SessionId == "" {
+		return "", errors.New("sessionId is required")
+	}
+	if req.ContainerId == "" {
+		return "", errors.New("containerId is required")
+	}
+	if len(req.Cmd) == 0 {
+		return "", errors.New("cmd is required")
+	}
+
+	// Reserve the session ID while Docker creates the exec
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return "", errors.New("connection closed")
+	}
+	if _, ok := m.sessions[req.SessionId]; ok {
+		m.mu.Unlock()
+		return "", fmt.Errorf("exec session %s already exists", req.SessionId)
+	}
+	if len(m.sessions) >= maxExecSessions {
+		m.mu.Unlock()
+		return "", errors.New("too many exec sessions")
+	}
+	m.sessions[req.SessionId] = nil
+	m.mu.Unlock()
+
+	session, err := m.attach(ctx, req)
+	m.mu.Lock()
+	closed := m.closed
+	if err != nil || closed {
+		delete(m.sessions, req.SessionId)
+	} else {
+		m.sessions[req.SessionId] = session
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if closed {
+		session.conn.Close()
+		return "", errors.New("connection closed")
+	}
+
+	go m.writeInput(session)
+	go m.readOutput(session)
+	return session.execId, nil
+}
+
+func (m *execSessions) attach(ctx context.Context, req protocol.ExecStartRequest) (*execSession, error) {
+	var consoleSize *[2]uint
+	if req.Tty && req.Cols > 0 && req.Rows > 0 {
+		consoleSize = &[2]uint{req.Rows, req.Cols}
+	}
+
+	created, err := m.backend.ContainerExecCreate(ctx, req.ContainerId, types.ExecConfig{
+		User:         req.User,
+		Tty:          req.Tty,
+		ConsoleSize:  consoleSize,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          req.Env,
+		WorkingDir:   req.WorkingDir,
+		Cmd:          req.Cmd,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := m.backend.ContainerExecAttach(ctx, created.ID, types.ExecStartCheck{Tty: req.Tty, ConsoleSize: consoleSize})
+	if err != nil {
+		return nil, err
+	}
+
+	return &execSession{
+		id:         req.SessionId,
+		execId:     created.ID,
+		tty:        req.Tty,
+		conn:       conn,
+		input:      make(chan execInput, execInputQueue),
+		done:       make(chan struct{}),
+		lastActive: time.Now(),
+	}, nil
+}
+
+// session returns a running session
+func (m *execSessions) session(sessionId string) (*execSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := m.sessions[sessionId]
+	if session == nil {
+		return nil, errUnknownSession
+	}
+	return session, nil
+}
+
+// Input queues input for the command, eof closes its stdin once the queued input was written.
+// Input is refused if the command doesn't keep up.
+func (m *execSessions) Input(sessionId string, data []byte, eof bool) error {
+	session, err := m.session(sessionId)
+	if err != nil {
+		return err
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.inputClosed {
+		return errInputClosed
+	}
+	session.lastActive = time.Now()
+
+	select {
+	case <-session.done:
+		return errUnknownSession
+	case session.input <- execInput{data: data, eof: eof}:
+		session.inputClosed = eof
+		return nil
+	default:
+		return errors.New("exec input buffer full")
+	}
+}
+
+// Resize changes the terminal size of a session
+func (m *execSessions) Resize(ctx context.Context, sessionId string, cols, rows uint) error {
+	session, err := m.session(sessionId)
+	if err != nil {
+		return err
+	}
+	if !session.tty {
+		return errors.New("exec session has no terminal")
+	}
+	session.touch()
+
+	return m.backend.ContainerExecResize(ctx, session.execId, types.ResizeOptions{Width: cols, Height: rows})
+}
+
+// Close ends a session, the end is reported with an execClose event
+func (m *execSessions) Close(sessionId string) error {
+	session, err := m.session(sessionId)
+	if err != nil {
+		return err
+	}
+
+	session.stop(execClosed)
+	return nil
+}
+
+// Expire ends the sessions without input or output for longer than the idle timeout,
+// a timeout of 0 keeps idle sessions open
+func (m *execSessions) Expire(now time.Time) {
+	if m.idleTimeout <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	var idle []*execSession
+	for _, session := range m.sessions {
+		if session == nil {
+			continue
+		}
+		session.mu.Lock()
+		if now.Sub(session.lastActive) > m.idleTimeout {
+			idle = append(idle, session)
+		}
+		session.mu.Unlock()
+	}
+	m.mu.Unlock()
+
+	for _, session := range idle {
+		session.stop(execTimedOut)
+	}
+}
+
+// CloseAll ends all sessions, for connections that ended
+func (m *execSessions) CloseAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	for _, session := range m.sessions {
+		if session != nil {
+			session.stop(execClosed)
+		}
+	}
+}
+
+// writeInput passes the queued input to the command until the session ends
+func (m *execSessions) writeInput(session *execSession) {
+	for {
+		select {
+		case <-session.done:
+			return
+		case input := <-session.input:
+			if len(input.data) > 0 {
+				if _, err := session.conn.Conn.Write(input.data); err != nil {
+					session.stop(err.Error())
+					return
+				}
+			}
+			if input.eof {
+				// The command keeps running and its output keeps being read
+				if err := session.conn.CloseWrite(); err != nil {
+					session.stop(err.Error())
+				}
+				return
+			}
+		}
+	}
+}
+
+// readOutput sends the command's output as execOutput events, and an execClose event once
+// the command exited or the session was closed
+func (m *execSessions) readOutput(session *execSession) {
+	err := readExecOutput(session.conn.Reader, session.tty, func(stream string, data []byte) error {
+		session.touch()
+		return m.send(protocol.EventExecOutput, protocol.ExecData{SessionId: session.id, Stream: stream, Data: data})
+	})
+
+	m.mu.Lock()
+	delete(m.sessions, session.id)
+	m.mu.Unlock()
+	close(session.done)
+	session.conn.Close()
+
+	session.mu.Lock()
+	reason := session.reason
+	session.mu.Unlock()
+	if reason == "" {
+		reason = execExited
+		if err != nil {
+			reason = err.Error()
+		}
+	}
+
+	ended := protocol.ExecClose{SessionId: session.id, Reason: reason}
+	ctx, cancel := context.WithTimeout(context.Background(), execStartTimeout)
+	defer cancel()
+	if inspect, err := m.backend.ContainerExecInspect(ctx, session.execId); err == nil && !inspect.Running {
+		ended.ExitCode = &inspect.ExitCode
+	}
+
+	_ = m.send(protocol.EventExecClose, ended)
+}
+
+// readExecOutput passes the output of an exec to emit in chunks of at most execOutputChunk.
+// Output of execs without a TTY is multiplexed like container logs.
+func readExecOutput(r io.Reader, tty bool, emit func(stream string, data []byte) error) error {
+	if tty {
+		return copyExecOutput(r, protocol.StreamStdout, emit)
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return ignoreClosed(err)
+		}
+
+		stream := protocol.StreamStdout
+		if header[0] == 2 {
+			stream = protocol.StreamStderr
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if err := copyExecOutput(io.LimitReader(r, int64(size)), stream, emit); err != nil {
+			return err
+		}
+	}
+}
+
+// copyExecOutput passes everything read from r to emit
+func copyExecOutput(r io.Reader, stream string, emit func(stream string, data []byte) error) error {
+	buf := make([]byte, execOutputChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := emit(stream, data); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return ignoreClosed(err)
+		}
+	}
+}
+
+// ignoreClosed treats the end of the stream and a closed connection as a regular end
+func ignoreClosed(err error) error {
+	if err == io.EOF || errors.Is(err, io.ErrClosedPipe) || strings.Contains(err.Error(), "use of closed network connection") {
+		return nil
+	}
+	return err
+}
+
+// startExecSessions creates the exec sessions of the current connection, if exec is enabled
+// and the server supports it. They end with the connection.
+func (a *Agent) startExecSessions(log Logger) {
+	if !a.ExecEnabled || !a.Capabilities.Has(protocol.CapabilityExec) {
+		return
+	}
+
+	cli, err := a.runtimeClient()
+	if err != nil {
+		log.Error("agent", "Exec unavailable: "+err.Error())
+		return
+	}
+
+	// Bind the sessions to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+	disconnected := a.disconnected
+
+	sessions := newExecSessions(cli, a.ExecIdleTimeout, func(event string, payload interface{}) error {
+		return a.writeSealed(conn, codec, event, "", payload)
+	})
+	a.execSessions = sessions
+
+	go func() {
+		defer cli.Close()
+		defer sessions.CloseAll()
+
+		ticker := time.NewTicker(execExpiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-disconnected:
+				return
+			case now := <-ticker.C:
+				sessions.Expire(now)
+			}
+		}
+	}()
+}
+
+// handleExec dispatches the exec events of the server
+func (a *Agent) handleExec(msg protocol.Message, log Logger) error {
+	fail := func(err error) error {
+		return a.send(protocol.NewError(msg.Event, msg.MessageId, err))
+	}
+
+	if err := a.Capabilities.Require(protocol.CapabilityExec); err != nil {
+		return fail(err)
+	}
+	if a.execSessions == nil {
+		return fail(errors.New("exec is disabled"))
+	}
+
+	switch msg.Event {
+	case protocol.EventExecStart:
+		var req protocol.ExecStartRequest
+		if err := a.codec().Unmarshal(msg, &req); err != nil {
+			return fail(err)
+		}
+		a.startExec(req, msg.MessageId, log)
+	case protocol.EventExecInput:
+		var input protocol.ExecData
+		if err := a.codec().Unmarshal(msg, &input); err != nil {
+			return fail(err)
+		}
+		if err := a.execSessions.Input(input.SessionId, input.Data, input.EOF); err != nil {
+			return fail(err)
+		}
+	case protocol.EventExecResize:
+		var resize protocol.ExecResize
+		if err := a.codec().Unmarshal(msg, &resize); err != nil {
+			return fail(err)
+		}
+		a.resizeExec(resize, msg.MessageId, log)
+	case protocol.EventExecClose:
+		var req protocol.ExecClose
+		if err := a.codec().Unmarshal(msg, &req); err != nil {
+			return fail(err)
+		}
+		if err := a.execSessions.Close(req.SessionId); err != nil {
+			return fail(err)
+		}
+	}
+
+	return nil
+}
+
+// resizeExec resizes the terminal of an exec session in the background, so a slow runtime
+// doesn't hold up the messages of the connection
+func (a *Agent) resizeExec(resize protocol.ExecResize, messageId string, log Logger) {
+	// Bind the reply to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	sessions := a.execSessions
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), execStartTimeout)
+		defer cancel()
+
+		err := sessions.Resize(ctx, resize.SessionId, resize.Cols, resize.Rows)
+		if err == nil {
+			return
+		}
+		if err := a.write(conn, protocol.NewError(protocol.EventExecResize, messageId, err)); err != nil {
+			log.Error("agent", "Error sending execResize: "+err.Error())
+		}
+	}()
+}
+
+// startExec starts an exec session in the background, answers with the exec's ID and
+// records the command in the audit log
+func (a *Agent) startExec(req protocol.ExecStartRequest, messageId string, log Logger) {
+	// Bind the reply to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+	sessions := a.execSessions
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), execStartTimeout)
+		defer cancel()
+
+		execId, err := sessions.Start(ctx, req)
+
+		entry := auditEntry{
+			Operation:   "container.exec",
+			ContainerId: req.ContainerId,
+			Details:     map[string]string{"cmd": strings.Join(req.Cmd, " "), "session": req.SessionId},
+			Result:      auditAllowed,
+		}
+		if req.User != "" {
+			entry.Details["user"] = req.User
+		}
+		if err != nil {
+			entry.Result = auditFailed
+			entry.Error = err.Error()
+		}
+		if err := a.AuditLog.Record(entry); err != nil {
+			log.Error("agent", "Error writing audit log: "+err.Error())
+		}
+
+		if err != nil {
+			log.Warn("agent", fmt.Sprintf("Exec in %s failed: %s", req.ContainerId, err))
+			err = a.write(conn, protocol.NewError(protocol.EventExecStart, messageId, err))
+		} else {
+			log.Info("agent", fmt.Sprintf("Started exec session %s in %s", req.SessionId, req.ContainerId))
+			err = a.writeSealed(conn, codec, protocol.EventExecStart, messageId, protocol.ExecStarted{SessionId: req.SessionId, ExecId: execId})
+		}
+		if err != nil {
+			log.Error("agent", "Error sending execStart: "+err.Error())
+		}
+	}()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+)
+
+// fakeExecBackend runs execs whose other end of the connection the test controls
+type fakeExecBackend struct {
+	mu       sync.Mutex
+	configs  []types.ExecConfig
+	commands map[string]net.Conn
+	// stdinClosed is closed once the agent closed an exec's input
+	stdinClosed map[string]chan struct{}
+	resizes     []types.ResizeOptions
+	exitCode    int
+}
+
+func newFakeExecBackend() *fakeExecBackend {
+	return &fakeExecBackend{commands: map[string]net.Conn{}, stdinClosed: map[string]chan struct{}{}}
+}
+
+// halfCloseConn is a connection whose write side can be closed on its own, like the Docker API's
+type halfCloseConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c halfCloseConn) CloseWrite() error {
+	close(c.closed)
+	return nil
+}
+
+func (b *fakeExecBackend) ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error) {
+	if container == "missing" {
+		return types.IDResponse{}, errors.New("No such container: missing")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.configs = append(b.configs, config)
+	return types.IDResponse{ID: "exec-" + config.Cmd[0]}, nil
+}
+
+func (b *fakeExecBackend) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	agentSide, commandSide := net.Pipe()
+	conn := halfCloseConn{Conn: agentSide, closed: make(chan struct{})}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commands[execID] = commandSide
+	b.stdinClosed[execID] = conn.closed
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(agentSide)}, nil
+}
+
+func (b *fakeExecBackend) ContainerExecResize(ctx context.Context, execID string, options types.ResizeOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resizes = append(b.resizes, options)
+	return nil
+}
+
+func (b *fakeExecBackend) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return types.ContainerExecInspect{ExecID: execID, ExitCode: b.exitCode}, nil
+}
+
+// command returns the command's end of an exec's connection
+func (b *fakeExecBackend) command(execId string) net.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.commands[execId]
+}
+
+func newTestExecSessions(idleTimeout time.Duration) (*execSessions, *fakeExecBackend, chan sentEvent) {
+	backend := newFakeExecBackend()
+	sent := make(chan sentEvent, 100)
+	sessions := newExecSessions(backend, idleTimeout, func(event string, payload interface{}) error {
+		sent <- sentEvent{event, payload}
+		return nil
+	})
+	return sessions, backend, sent
+}
+
+func TestExecSession(t *testing.T) {
+	sessions, backend, sent := newTestExecSessions(time.Minute)
+
+	execId, err := sessions.Start(context.Background(), protocol.ExecStartRequest{
+		SessionId:   "s1",
+		ContainerId: "web",
+		Cmd:         []string{"sh"},
+		Tty:         true,
+		Cols:        80,
+		Rows:        24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if execId != "exec-sh" {
+		t.Fatal("started exec", execId)
+	}
+	config := backend.configs[0]
+	if !config.AttachStdin || !config.Tty || config.ConsoleSize == nil || *config.ConsoleSize != [2]uint{24, 80} {
+		t.Fatal("created exec with", config)
+	}
+
+	// Input reaches the command, its output is sent with the session ID
+	if err := sessions.Input("s1", []byte("ls\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	command := backend.command(execId)
+	buf := make([]byte, 3)
+	if _, err := command.Read(buf); err != nil || string(buf) != "ls\n" {
+		t.Fatal("command read", string(buf), err)
+	}
+	if _, err := command.Write([]byte("bin\n")); err != nil {
+		t.Fatal(err)
+	}
+	output := expectEvent(t, sent, protocol.EventExecOutput).(protocol.ExecData)
+	if output.SessionId != "s1" || output.Stream != protocol.StreamStdout || string(output.Data) != "bin\n" {
+		t.Fatal("sent output", output)
+	}
+
+	if err := sessions.Resize(context.Background(), "s1", 120, 40); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(backend.resizes, []types.ResizeOptions{{Width: 120, Height: 40}}) {
+		t.Fatal("resized to", backend.resizes)
+	}
+
+	// The end of the input closes the command's stdin after the queued input, the output keeps flowing
+	if err := sessions.Input("s1", []byte("exit\n"), true); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, 5)
+	if _, err := command.Read(buf); err != nil || string(buf) != "exit\n" {
+		t.Fatal("command read", string(buf), err)
+	}
+	backend.mu.Lock()
+	stdinClosed := backend.stdinClosed[execId]
+	backend.mu.Unlock()
+	select {
+	case <-stdinClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stdin was not closed")
+	}
+	if err := sessions.Input("s1", []byte("x"), false); !errors.Is(err, errInputClosed) {
+		t.Fatal("input after the end of the input returned", err)
+	}
+	if _, err := command.Write([]byte("bye\n")); err != nil {
+		t.Fatal(err)
+	}
+	output = expectEvent(t, sent, protocol.EventExecOutput).(protocol.ExecData)
+	if string(output.Data) != "bye\n" {
+		t.Fatal("sent output", output)
+	}
+
+	// The command exiting ends the session with its exit code
+	backend.mu.Lock()
+	backend.exitCode = 3
+	backend.mu.Unlock()
+	command.Close()
+	ended := expectEvent(t, sent, protocol.EventExecClose).(protocol.ExecClose)
+	if ended.SessionId != "s1" || ended.Reason != execExited || ended.ExitCode == nil || *ended.ExitCode != 3 {
+		t.Fatal("ended session with", ended)
+	}
+	if err := sessions.Input("s1", []byte("x"), false); !errors.Is(err, errUnknownSession) {
+		t.Fatal("input after the end returned", err)
+	}
+}
+
+func TestExecSessionStreams(t *testing.T) {
+	sessions, backend, sent := newTestExecSessions(time.Minute)
+
+	execId, err := sessions.Start(context.Background(), protocol.ExecStartRequest{SessionId: "s1", ContainerId: "web", Cmd: []string{"env"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Resize(context.Background(), "s1", 80, 24); err == nil {
+		t.Fatal("resized a session without terminal")
+	}
+
+	// Without a terminal the output is multiplexed like container logs
+	command := backend.command(execId)
+	go func() {
+		command.Write(logFrame(1, "out\n"))
+		command.Write(logFrame(2, "err\n"))
+		command.Close()
+	}()
+
+	stdout := expectEvent(t, sent, protocol.EventExecOutput).(protocol.ExecData)
+	stderr := expectEvent(t, sent, protocol.EventExecOutput).(protocol.ExecData)
+	if stdout.Stream != protocol.StreamStdout || string(stdout.Data) != "out\n" {
+		t.Fatal("sent stdout", stdout)
+	}
+	if stderr.Stream != protocol.StreamStderr || string(stderr.Data) != "err\n" {
+		t.Fatal("sent stderr", stderr)
+	}
+	expectEvent(t, sent, protocol.EventExecClose)
+}
+
+func TestExecSessionStartErrors(t *testing.T) {
+	sessions, _, _ := newTestExecSessions(time.Minute)
+
+	invalid := []protocol.ExecStartRequest{
+		{ContainerId: "web", Cmd: []string{"sh"}},
+		{SessionId: "s1", Cmd: []string{"sh"}},
+		{SessionId: "s1", ContainerId: "web"},
+		{SessionId: "s1", ContainerId: "missing", Cmd: []string{"sh"}},
+	}
+	for _, req := range invalid {
+		if _, err := sessions.Start(context.Background(), req); err == nil {
+			t.Fatal("started invalid exec", req)
+		}
+	}
+
+	// Session IDs are unique and failed starts don't keep them reserved
+	req := protocol.ExecStartRequest{SessionId: "s1", ContainerId: "web", Cmd: []string{"sh"}}
+	if _, err := sessions.Start(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.Start(context.Background(), req); err == nil {
+		t.Fatal("started a duplicate session")
+	}
+	sessions.CloseAll()
+}
+
+func TestExecSessionClose(t *testing.T) {
+	sessions, _, sent := newTestExecSessions(time.Minute)
+
+	if err := sessions.Close("s1"); !errors.Is(err, errUnknownSession) {
+		t.Fatal("closed unknown session with", err)
+	}
+	if _, err := sessions.Start(context.Background(), protocol.ExecStartRequest{SessionId: "s1", ContainerId: "web", Cmd: []string{"sh"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Close("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if ended := expectEvent(t, sent, protocol.EventExecClose).(protocol.ExecClose); ended.Reason != execClosed {
+		t.Fatal("closed session with", ended)
+	}
+
+	// Sessions end with the connection
+	sessions.CloseAll()
+	if _, err := sessions.Start(context.Background(), protocol.ExecStartRequest{SessionId: "s2", ContainerId: "web", Cmd: []string{"sh"}}); err == nil {
+		t.Fatal("started a session after the connection ended")
+	}
+}
+
+func TestExecSessionExpire(t *testing.T) {
+	sessions, _, sent := newTestExecSessions(time.Minute)
+
+	if _, err := sessions.Start(context.Background(), protocol.ExecStartRequest{SessionId: "s1", ContainerId: "web", Cmd: []string{"sh"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Expire(time.Now())
+	select {
+	case e := <-sent:
+		t.Fatal("active session ended with", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	sessions.Expire(time.Now().Add(2 * time.Minute))
+	if ended := expectEvent(t, sent, protocol.EventExecClose).(protocol.ExecClose); ended.Reason != execTimedOut {
+		t.Fatal("expired session with", ended)
+	}
+}
+
+func TestExecCapability(t *testing.T) {
+	agent := &Agent{}
+	if agent.capabilities().Has(protocol.CapabilityExec) {
+		t.Fatal("agent offered exec without it being enabled")
+	}
+	agent.ExecEnabled = true
+	if !agent.capabilities().Has(protocol.CapabilityExec) {
+		t.Fatal("agent with exec enabled did not offer it")
+	}
+	if len(agentCapabilities) != 4 {
+		t.Fatal("offering exec changed the agent's default capabilities", agentCapabilities)
+	}
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
@@ -51,4 +52,85 @@ var flags = []cli.Flag{
 		Usage:   "healthcheck endpoint address",
 		Value:   ":5000",
 	},
+	&cli.DurationFlag{
+		EnvVars: []string{"ECHOES_INVENTORY_INTERVAL"},
+		Name:    "inventory-interval",
+		Usage:   "how often to send the host inventory to the server, 0 disables the updates",
+		Value:   5 * time.Minute,
+	},
+	&cli.DurationFlag{
+		EnvVars: []string{"ECHOES_STATS_INTERVAL"},
+		Name:    "stats-interval",
+		Usage:   "how often to send the resource usage of the selected containers, 0 disables the stats",
+		Value:   30 * time.Second,
+	},
+	&cli.StringSliceFlag{
+		EnvVars: []string{"ECHOES_STATS_CONTAINERS"},
+		Name:    "stats-containers",
+		Usage:   "regular expressions selecting the containers, by name or ID, to send resource usage stats for",
+	},
+	&cli.StringSliceFlag{
+		EnvVars: []string{"ECHOES_CONTAINER_ACTIONS"},
+		Name:    "container-actions",
+		Usage:   "container actions the server may run, as action=pattern rules like restart=^web- (start, stop, restart, pause, unpause, kill), none by default",
+	},
+	&cli.StringFlag{
+		EnvVars: []string{"ECHOES_AUDIT_LOG"},
+		Name:    "audit-log",
+		Usage:   "file recording the actions the server ran, audit.log in the agent directory by default",
+	},
+	&cli.StringFlag{
+		EnvVars: []string{"ECHOES_RUNTIME"},
+		Name:    "runtime",
+		Usage:   "container runtime to read containers from, docker, podman or containerd, detected by its socket by default",
+		Value:   "auto",
+	},
+	&cli.StringFlag{
+		EnvVars: []string{"ECHOES_RUNTIME_SOCKET"},
+		Name:    "runtime-socket",
+		Usage:   "address of the runtime, like unix:///run/podman/podman.sock, its default socket by default",
+	},
+	&cli.StringFlag{
+		EnvVars: []string{"ECHOES_CONTAINERD_NAMESPACE"},
+		Name:    "containerd-namespace",
+		Usage:   "containerd namespace to read containers from, k8s.io for Kubernetes",
+		Value:   defaultContainerdNamespace,
+	},
+	&cli.BoolFlag{
+		EnvVars: []string{"ECHOES_EXEC"},
+		Name:    "exec",
+		Usage:   "allow the server to run interactive commands in containers",
+	},
+	&cli.DurationFlag{
+		EnvVars: []string{"ECHOES_EXEC_IDLE_TIMEOUT"},
+		Name:    "exec-idle-timeout",
+		Usage:   "close exec sessions without input or output for this long",
+		Value:   10 * time.Minute,
+	},
+	&cli.BoolFlag{
+		EnvVars: []string{"ECHOES_DOCKER_EVENTS"},
+		Name:    "docker-events",
+		Usage:   "forward Docker daemon events to the server",
+	},
+	&cli.StringSliceFlag{
+		EnvVars: []string{"ECHOES_DOCKER_EVENTS_FILTER"},
+		Name:    "docker-events-filter",
+		Usage:   "Docker event filters as key=value, like type=container or event=oom, container, image, network and volume events by default",
+	},
+	&cli.StringSliceFlag{
+		EnvVars: []string{"ECHOES_SINKS"},
+		Name:    "sink",
+		Usage:   "outputs to ship container logs to, like stdout, file:///var/log/echoes.log, https://collector/logs, syslog+udp://host:514 or otlp+grpc://collector:4317",
+	},
+	&cli.StringSliceFlag{
+		EnvVars: []string{"ECHOES_SINK_CONTAINERS"},
+		Name:    "sink-containers",
+		Usage:   "regular expressions selecting the containers, by name or ID, whose logs are shipped to the sinks",
+		Value:   cli.NewStringSlice("."),
+	},
+	&cli.StringFlag{
+		EnvVars: []string{"ECHOES_OTLP_METRICS"},
+		Name:    "otlp-metrics",
+		Usage:   "OTLP endpoint to export the stats of the selected containers to every stats interval, like otlp+grpc://collector:4317 or otlp+http://collector:4318",
+	},
 }
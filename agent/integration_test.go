@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"echoes/agent/internal/fakeserver"
+	"echoes/shared/protocol"
+	"echoes/shared/trsa"
+	"echoes/version"
+)
+
+// startAgent connects a new agent to the fake server and handles its messages in the background.
+// The agent can be configured before it connects. The returned channel is closed once the agent
+// stopped handling messages.
+func startAgent(t *testing.T, srv *fakeserver.Server, configure ...func(*Agent)) (*Agent, <-chan struct{}) {
+	log.SetOutput(io.Discard)
+
+	keys, err := trsa.GenerateKeypair(2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	agent := &Agent{Keys: keys, Token: "secret-token"}
+	for _, c := range configure {
+		c(agent)
+	}
+
+	if !connectToServer(agent, Logger{}, srv.Addr()) {
+		t.Fatal("agent could not connect to the fake server")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleServerCommunication(agent, Logger{})
+	}()
+	return agent, done
+}
+
+func TestAgentHealthcheck(t *testing.T) {
+	srv := fakeserver.New(t)
+
+	if !checkServerHealth("http://" + srv.Addr() + "/general/healthcheck") {
+		t.Fatal("healthy server reported as unhealthy")
+	}
+	srv.SetHealthy(false)
+	if checkServerHealth("http://" + srv.Addr() + "/general/healthcheck") {
+		t.Fatal("unhealthy server reported as healthy")
+	}
+}
+
+func TestAgentProtocol(t *testing.T) {
+	schemes := append(append([]trsa.Scheme{}, trsa.EncryptionSchemes...), trsa.SignatureSchemes...)
+	tests := []struct {
+		name         string
+		opts         []fakeserver.Option
+		capabilities protocol.Capabilities
+	}{
+		{"legacy server", []fakeserver.Option{fakeserver.WithProtocolVersion(0)}, nil},
+		{"schemes", []fakeserver.Option{fakeserver.WithSchemes(schemes...)}, nil},
+		{"session", []fakeserver.Option{fakeserver.WithSchemes(schemes...), fakeserver.WithSession()}, nil},
+		{"no capabilities", []fakeserver.Option{fakeserver.WithCapabilities()}, protocol.Capabilities{}},
+		{
+			"capabilities",
+			[]fakeserver.Option{fakeserver.WithSession(), fakeserver.WithCapabilities(protocol.CapabilityCompression, "unknown")},
+			protocol.Capabilities{protocol.CapabilityCompression},
+		},
+		{
+			"hybrid encryption",
+			[]fakeserver.Option{fakeserver.WithCapabilities(protocol.CapabilityHybridEncryption)},
+			protocol.Capabilities{protocol.CapabilityHybridEncryption},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fakeserver.New(t, test.opts...)
+			agent, done := startAgent(t, srv)
+
+			conn := srv.Accept()
+			info, agentId := conn.Handshake()
+			if info["token"] != "secret-token" {
+				t.Fatal("agent sent token", info["token"])
+			}
+			if info["hostname"] != getHostName() {
+				t.Fatal("agent sent hostname", info["hostname"])
+			}
+			if conn.AgentVersion != version.String() {
+				t.Fatal("agent sent version", conn.AgentVersion)
+			}
+
+			// Payloads after the agentId message use the enabled capabilities
+			conn.Send(protocol.EventAgentInfo, true, true, "")
+			conn.Decrypt(conn.Expect(protocol.EventAgentInfo), &info)
+
+			// The agent answers with its containers, or an error if Docker is unavailable
+			reply := conn.Request("containerList", map[string]interface{}{})
+			switch reply.Status {
+			case "ok":
+				var containers []interface{}
+				conn.Decrypt(reply, &containers)
+			case "error":
+				var message string
+				if err := json.Unmarshal(reply.Data, &message); err != nil || message == "" {
+					t.Fatal("error reply without a message")
+				}
+			default:
+				t.Fatal("unexpected status", reply.Status)
+			}
+
+			// Invalid log requests are answered with an error
+			if reply := conn.Request("containerLogs", protocol.ContainerLogsRequest{Tail: 10}); reply.Status != "error" {
+				t.Fatal("invalid containerLogs request answered with", reply.Status)
+			}
+
+			// The log history needs the logStreaming capability as well
+			history := protocol.ContainerLogsRequest{ContainerId: "abc", Tail: 10}
+			reply = conn.Request("containerLogs", history)
+			var message string
+			if err := json.Unmarshal(reply.Data, &message); reply.Status != "error" || err != nil || !strings.Contains(message, "logStreaming") {
+				t.Fatal("containerLogs without logStreaming answered with", reply.Status, message)
+			}
+
+			// Subscriptions need the logStreaming capability
+			subscribe := protocol.SubscribeLogsRequest{SubscriptionId: "sub", ContainerId: "abc"}
+			if reply := conn.Request("subscribeLogs", subscribe); reply.Status != "error" {
+				t.Fatal("subscription without logStreaming answered with", reply.Status)
+			}
+
+			// Container actions are disabled by default
+			action := protocol.ContainerActionRequest{ContainerId: "abc", Action: protocol.ActionRestart}
+			if reply := conn.Request("containerAction", action); reply.Status != "error" {
+				t.Fatal("container action answered with", reply.Status)
+			}
+
+			// Exec needs the exec capability, which the agent only offers when enabled
+			exec := protocol.ExecStartRequest{SessionId: "s1", ContainerId: "abc", Cmd: []string{"sh"}}
+			if reply := conn.Request("execStart", exec); reply.Status != "error" {
+				t.Fatal("exec without the exec capability answered with", reply.Status)
+			}
+
+			conn.Close()
+			<-done
+			if agent.Id != agentId {
+				t.Fatal("agent stored id", agent.Id, "instead of", agentId)
+			}
+			if agent.ProtocolVersion != protocol.Version {
+				t.Fatal("agent negotiated protocol version", agent.ProtocolVersion)
+			}
+			if (agent.Session != nil) != (conn.Session != nil) {
+				t.Fatal("agent and server disagree on the session")
+			}
+			if !reflect.DeepEqual(agent.Capabilities, test.capabilities) {
+				t.Fatal("agent enabled capabilities", agent.Capabilities)
+			}
+		})
+	}
+}
+
+func TestAgentInventory(t *testing.T) {
+	srv := fakeserver.New(t, fakeserver.WithCapabilities(protocol.CapabilityCompression))
+	_, done := startAgent(t, srv, func(a *Agent) {
+		a.InventoryInterval = 10 * time.Millisecond
+	})
+
+	conn := srv.Accept()
+	info, _ := conn.Handshake()
+	inventory, ok := info["inventory"].(map[string]interface{})
+	if !ok {
+		t.Fatal("agentInfo without inventory")
+	}
+	if agent, _ := inventory["agent"].(map[string]interface{}); agent["version"] != version.String() {
+		t.Fatal("inventory without the agent version", inventory)
+	}
+
+	// Updates arrive periodically once the agent is authenticated
+	for i := 0; i < 2; i++ {
+		var update protocol.Inventory
+		conn.Decrypt(conn.Expect(protocol.EventAgentInfoUpdate), &update)
+		if update.Agent.Version != version.String() || update.Host.CPUs < 1 {
+			t.Fatal("incomplete inventory update", update)
+		}
+	}
+
+	conn.Close()
+	<-done
+}
+
+func TestAgentDockerEvents(t *testing.T) {
+	srv := fakeserver.New(t, fakeserver.WithCapabilities(protocol.CapabilityDockerEvents))
+
+	// Events spooled before the connection are sent once the server enabled them
+	spooled := newSpool[protocol.DockerEvent](1)
+	spooled.Push(protocol.DockerEvent{Type: "container", Action: "start", ActorId: "old"})
+	spooled.Push(protocol.DockerEvent{Type: "container", Action: "oom", ActorId: "abc"})
+	agent, done := startAgent(t, srv, func(a *Agent) {
+		a.DockerEvents = spooled
+	})
+
+	conn := srv.Accept()
+	conn.Handshake()
+
+	var batch protocol.DockerEventBatch
+	conn.Decrypt(conn.Expect(protocol.EventDockerEvent), &batch)
+	if len(batch.Events) != 1 || batch.Events[0].Action != "oom" || batch.Dropped != 1 {
+		t.Fatal("sent Docker events", batch)
+	}
+
+	conn.Close()
+	<-done
+	if !agent.Capabilities.Has(protocol.CapabilityDockerEvents) {
+		t.Fatal("agent enabled capabilities", agent.Capabilities)
+	}
+}
+
+func TestAgentIgnoresMalformedMessages(t *testing.T) {
+	srv := fakeserver.New(t)
+	_, done := startAgent(t, srv)
+
+	conn := srv.Accept()
+	conn.SendRaw([]byte("not json"))
+	conn.Send("unknownEvent", nil, false, "")
+	conn.Handshake()
+
+	conn.Close()
+	<-done
+}
+
+func TestAgentRejectsInvalidHandshake(t *testing.T) {
+	srv := fakeserver.New(t)
+	_, done := startAgent(t, srv)
+
+	conn := srv.Accept()
+	conn.Send(protocol.EventHandshake, protocol.Handshake{PublicKey: "not a key"}, false, "")
+
+	// The agent answers the server's valid handshake, then drops the connection
+	conn.Expect(protocol.EventHandshake)
+	<-done
+}
+
+func TestAgentRejectsIncompatibleServer(t *testing.T) {
+	// 0 stands for servers predating version negotiation, anything lower is invalid
+	srv := fakeserver.New(t, fakeserver.WithProtocolVersion(-1))
+	_, done := startAgent(t, srv)
+
+	// The agent drops the connection instead of answering the handshake
+	srv.Accept()
+	select {
+	case <-done:
+	case <-time.After(fakeserver.DefaultTimeout):
+		t.Fatal("agent accepted an incompatible server")
+	}
+}
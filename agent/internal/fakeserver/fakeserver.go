@@ -0,0 +1,395 @@
+// Package fakeserver implements the server side of the Echoes agent protocol
+// in-process, so the agent can be tested without the Node server and MySQL.
+//
+// A test starts a Server, points the agent at Addr, and scripts the
+// conversation through the Conn returned by Accept:
+//
+//	srv := fakeserver.New(t, fakeserver.WithSession())
+//	// start the agent against srv.Addr()
+//	conn := srv.Accept()
+//	info, agentId := conn.Handshake()
+//	reply := conn.Request("containerList", nil)
+package fakeserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+	"echoes/shared/trsa"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTimeout is how long Accept and Receive wait before failing the test
+const DefaultTimeout = 10 * time.Second
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithSchemes makes the server advertise the given trsa schemes in its handshake.
+// Without it the server behaves like servers predating scheme negotiation.
+func WithSchemes(schemes ...trsa.Scheme) Option {
+	return func(s *Server) {
+		s.schemes = schemes
+	}
+}
+
+// WithSession makes the server offer ephemeral session keys in its handshake
+func WithSession() Option {
+	return func(s *Server) {
+		s.session = true
+	}
+}
+
+// WithProtocolVersion makes the server advertise the given protocol version,
+// 0 behaves like servers predating version negotiation
+func WithProtocolVersion(version int) Option {
+	return func(s *Server) {
+		s.version = version
+	}
+}
+
+// WithCapabilities makes the server enable the given capabilities, as far as the agent
+// offered them. Without it the server behaves like servers predating capability negotiation.
+func WithCapabilities(capabilities ...protocol.Capability) Option {
+	return func(s *Server) {
+		s.capabilities = append(protocol.Capabilities{}, capabilities...)
+	}
+}
+
+// WithTimeout sets how long Accept and Receive wait, DefaultTimeout by default
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// Server is an in-process Echoes server
+type Server struct {
+	// Keys is the server's keypair, used to decrypt agent messages
+	Keys *trsa.Keypair
+
+	t            testing.TB
+	http         *httptest.Server
+	upgrader     websocket.Upgrader
+	conns        chan *Conn
+	healthy      atomic.Bool
+	nextId       atomic.Int64
+	mu           sync.Mutex
+	accepted     []*Conn
+	schemes      []trsa.Scheme
+	session      bool
+	version      int
+	capabilities protocol.Capabilities
+	timeout      time.Duration
+}
+
+// New starts a server listening on a random local port. The server is closed when the test ends.
+func New(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+
+	keys, err := trsa.GenerateKeypair(2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := &Server{
+		Keys:    keys,
+		t:       t,
+		conns:   make(chan *Conn, 16),
+		version: protocol.Version,
+		timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.healthy.Store(true)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/general/healthcheck", s.serveHealthcheck)
+	mux.HandleFunc("/ws", s.serveWebSocket)
+	s.http = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Addr returns the host:port the server listens on, as expected by the agent's --server flag
+func (s *Server) Addr() string {
+	return strings.TrimPrefix(s.http.URL, "http://")
+}
+
+// SetHealthy controls whether /general/healthcheck reports the server as healthy
+func (s *Server) SetHealthy(healthy bool) {
+	s.healthy.Store(healthy)
+}
+
+// Close closes all connections and stops the server
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, c := range s.accepted {
+		c.ws.Close()
+	}
+	s.mu.Unlock()
+	s.http.CloseClientConnections()
+	s.http.Close()
+}
+
+// Accept waits for the next agent to connect. The server has already sent its handshake message.
+func (s *Server) Accept() *Conn {
+	s.t.Helper()
+
+	select {
+	case c := <-s.conns:
+		return c
+	case <-time.After(s.timeout):
+		s.t.Fatal("fakeserver: no agent connected")
+		return nil
+	}
+}
+
+func (s *Server) serveHealthcheck(w http.ResponseWriter, r *http.Request) {
+	if !s.healthy.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &Conn{server: s, ws: ws}
+	c.EncryptionScheme, c.SignatureScheme = trsa.Strongest(s.schemes)
+
+	s.mu.Lock()
+	s.accepted = append(s.accepted, c)
+	s.mu.Unlock()
+
+	handshake := protocol.Handshake{
+		PublicKey:       string(s.Keys.Public),
+		ProtocolVersion: s.version,
+		Schemes:         s.schemes,
+	}
+	if s.session {
+		c.handshake, err = trsa.NewSessionHandshake(s.Keys.Private, trsa.WithScheme(c.SignatureScheme))
+		if err != nil {
+			ws.Close()
+			return
+		}
+		offer := c.handshake.Offer()
+		handshake.Session = &offer
+	}
+
+	// Like the real server, greet every connection with a handshake
+	msg, err := protocol.NewMessage(protocol.EventHandshake, handshake)
+	if err != nil || c.write(msg) != nil {
+		ws.Close()
+		return
+	}
+	s.conns <- c
+}
+
+// Conn is the server side of one agent connection
+type Conn struct {
+	// AgentKeys holds the agent's public key once the agent answered the handshake
+	AgentKeys *trsa.Keypair
+	// Session holds the session keys, if the server offered a session and the agent accepted it
+	Session *trsa.Session
+
+	// EncryptionScheme and SignatureScheme are the schemes the agent is expected to pick
+	EncryptionScheme trsa.Scheme
+	SignatureScheme  trsa.Scheme
+
+	// AgentVersion and AgentCapabilities hold what the agent announced in its handshake
+	AgentVersion      string
+	AgentCapabilities protocol.Capabilities
+	// Capabilities holds the capabilities enabled for the connection, nil if the server predates them
+	Capabilities protocol.Capabilities
+
+	server    *Server
+	ws        *websocket.Conn
+	mu        sync.Mutex
+	handshake *trsa.SessionHandshake
+}
+
+// Send sends an event to the agent. If encrypt is set, data is encrypted with the
+// session or the agent's public key and hex encoded, like the server's buildMessage does.
+func (c *Conn) Send(event string, data interface{}, encrypt bool, messageId string) {
+	c.server.t.Helper()
+
+	var msg protocol.Message
+	var err error
+	if encrypt {
+		if c.AgentKeys == nil {
+			c.server.t.Fatal("fakeserver: can't encrypt before the agent's handshake")
+		}
+		msg, err = c.codec().NewMessage(event, data)
+	} else {
+		msg, err = protocol.NewMessage(event, data)
+	}
+	if err != nil {
+		c.server.t.Fatal("fakeserver: " + err.Error())
+	}
+	msg.MessageId = messageId
+
+	if err := c.write(msg); err != nil {
+		c.server.t.Fatal("fakeserver: " + err.Error())
+	}
+}
+
+// SendRaw sends raw bytes to the agent, e.g. to script malformed messages
+func (c *Conn) SendRaw(raw []byte) {
+	c.server.t.Helper()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ws.WriteMessage(websocket.TextMessage, raw); err != nil {
+		c.server.t.Fatal("fakeserver: " + err.Error())
+	}
+}
+
+// Receive waits for the next message from the agent
+func (c *Conn) Receive() protocol.Message {
+	c.server.t.Helper()
+
+	c.ws.SetReadDeadline(time.Now().Add(c.server.timeout))
+	_, raw, err := c.ws.ReadMessage()
+	if err != nil {
+		c.server.t.Fatal("fakeserver: read: " + err.Error())
+	}
+
+	msg, err := protocol.Parse(raw)
+	if err != nil {
+		c.server.t.Fatal("fakeserver: agent sent an invalid message: " + err.Error())
+	}
+	return msg
+}
+
+// Expect waits for the next message and fails the test unless it is for event
+func (c *Conn) Expect(event string) protocol.Message {
+	c.server.t.Helper()
+
+	msg := c.Receive()
+	if msg.Event != event {
+		c.server.t.Fatalf("fakeserver: expected %q from the agent, got %q", event, msg.Event)
+	}
+	return msg
+}
+
+// Decrypt decrypts the hex encoded data of an agent message with the session or the server's key into v
+func (c *Conn) Decrypt(msg protocol.Message, v interface{}) {
+	c.server.t.Helper()
+
+	if err := c.codec().Unmarshal(msg, v); err != nil {
+		c.server.t.Fatal("fakeserver: " + err.Error())
+	}
+}
+
+// Handshake runs the server side of the connection setup: it waits for the agent's
+// handshake reply, requests agentInfo and assigns an agent id. It returns the
+// decrypted agent info and the assigned id. Afterwards the enabled capabilities are in Capabilities.
+func (c *Conn) Handshake() (map[string]interface{}, int) {
+	c.server.t.Helper()
+
+	var handshake protocol.Handshake
+	if err := c.Expect(protocol.EventHandshake).Unmarshal(&handshake); err != nil {
+		c.server.t.Fatal("fakeserver: " + err.Error())
+	}
+	if handshake.ProtocolVersion != protocol.Version {
+		c.server.t.Fatalf("fakeserver: agent speaks protocol version %d, expected %d", handshake.ProtocolVersion, protocol.Version)
+	}
+	agentKeys, err := trsa.NewKeypair([]byte(handshake.PublicKey), nil)
+	if err != nil {
+		c.server.t.Fatal("fakeserver: invalid agent public key: " + err.Error())
+	}
+	c.AgentKeys = agentKeys
+	c.AgentVersion = handshake.Version
+	c.AgentCapabilities = handshake.Capabilities
+
+	expected := []trsa.Scheme{c.EncryptionScheme, c.SignatureScheme}
+	if len(handshake.Schemes) != 2 || handshake.Schemes[0] != expected[0] || handshake.Schemes[1] != expected[1] {
+		c.server.t.Fatalf("fakeserver: agent picked schemes %v, expected %v", handshake.Schemes, expected)
+	}
+
+	if c.handshake != nil {
+		if handshake.Session == nil {
+			c.server.t.Fatal("fakeserver: agent did not accept the session offer")
+		}
+		c.Session, err = c.handshake.Complete(*handshake.Session, agentKeys.Public, false)
+		if err != nil {
+			c.server.t.Fatal("fakeserver: invalid session offer: " + err.Error())
+		}
+	}
+
+	c.Send(protocol.EventAgentInfo, true, false, "")
+	info := map[string]interface{}{}
+	c.Decrypt(c.Expect(protocol.EventAgentInfo), &info)
+
+	// Capabilities apply to the messages after the agentId message
+	agentId := int(c.server.nextId.Add(1))
+	var capabilities protocol.Capabilities
+	if c.server.capabilities != nil {
+		capabilities = handshake.Capabilities.Intersect(c.server.capabilities)
+	}
+	c.Send(protocol.EventAgentId, protocol.AgentId{AgentId: agentId, Capabilities: capabilities}, true, "")
+	c.Capabilities = capabilities
+
+	return info, agentId
+}
+
+// Request sends an encrypted event with a fresh messageId and waits for the reply
+// carrying the same messageId, like sendMessageAndWaitForResponse on the real server.
+// Unrelated messages received in the meantime are skipped.
+func (c *Conn) Request(event string, data interface{}) protocol.Message {
+	c.server.t.Helper()
+
+	messageId := "msg-" + strconv.FormatInt(c.server.nextId.Add(1), 10)
+	c.Send(event, data, true, messageId)
+
+	for {
+		msg := c.Receive()
+		if msg.MessageId == messageId {
+			return msg
+		}
+	}
+}
+
+// Close closes the connection to the agent
+func (c *Conn) Close() {
+	c.ws.Close()
+}
+
+func (c *Conn) write(msg protocol.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, raw)
+}
+
+// codec returns the codec encrypting payloads for the agent
+func (c *Conn) codec() *protocol.Codec {
+	return &protocol.Codec{
+		Keys:     c.server.Keys,
+		PeerKeys: c.AgentKeys,
+		Scheme:   c.EncryptionScheme,
+		Session:  c.Session,
+		Compress: c.Capabilities.Has(protocol.CapabilityCompression),
+		Hybrid:   c.Capabilities.Has(protocol.CapabilityHybridEncryption),
+	}
+}
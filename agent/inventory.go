@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"echoes/shared/protocol"
+	"echoes/version"
+
+	"github.com/docker/docker/api/types"
+)
+
+// inventoryTimeout bounds how long querying Docker for the inventory may take
+const inventoryTimeout = 10 * time.Second
+
+// agentStartedAt is when the agent process started, the agent's uptime is measured from it
+var agentStartedAt = time.Now()
+
+// procDir is where the proc filesystem is mounted
+var procDir = "/proc"
+
+// collectInventory gathers the agent, host and Docker details reported to the server.
+// Details that can't be determined are left empty, Docker is nil if the engine is unreachable.
+func collectInventory(log Logger, engine containerRuntime) protocol.Inventory {
+	inventory := protocol.Inventory{
+		Agent: protocol.AgentInventory{
+			Version:   version.String(),
+			Commit:    version.GitCommit(),
+			StartedAt: agentStartedAt,
+			Uptime:    int64(time.Since(agentStartedAt).Seconds()),
+		},
+		Host: protocol.HostInventory{
+			OS:           runtime.GOOS,
+			Kernel:       readKernelVersion(),
+			Architecture: runtime.GOARCH,
+			CPUs:         runtime.NumCPU(),
+			Memory:       readTotalMemory(),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), inventoryTimeout)
+	defer cancel()
+
+	docker, info, err := collectDockerInventory(ctx, engine)
+	if err != nil {
+		log.Debug("agent", "Docker inventory unavailable: "+err.Error())
+		return inventory
+	}
+	inventory.Docker = docker
+
+	// Docker reports the host's distribution, and knows the kernel and memory where /proc is missing
+	inventory.Host.Distribution = info.OperatingSystem
+	if inventory.Host.Kernel == "" {
+		inventory.Host.Kernel = info.KernelVersion
+	}
+	if inventory.Host.Memory == 0 && info.MemTotal > 0 {
+		inventory.Host.Memory = uint64(info.MemTotal)
+	}
+
+	return inventory
+}
+
+// collectDockerInventory queries the Info, Version and container list APIs of the engine
+func collectDockerInventory(ctx context.Context, engine containerRuntime) (*protocol.DockerInventory, types.Info, error) {
+	cli, err := engine.NewClient()
+	if err != nil {
+		return nil, types.Info{}, err
+	}
+	defer cli.Close()
+
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, types.Info{}, err
+	}
+	serverVersion, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return nil, types.Info{}, err
+	}
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, types.Info{}, err
+	}
+
+	return &protocol.DockerInventory{
+		Runtime:       engine.Name,
+		Version:       serverVersion.Version,
+		APIVersion:    serverVersion.APIVersion,
+		StorageDriver: info.Driver,
+		Rootless:      isRootless(info.SecurityOptions),
+		Containers:    countContainerStates(containers),
+	}, info, nil
+}
+
+// isRootless reports whether the engine's security options mark it as running rootless
+func isRootless(securityOptions []string) bool {
+	for _, option := range securityOptions {
+		for _, field := range strings.Split(option, ",") {
+			if field == "name=rootless" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countContainerStates counts the containers by their state
+func countContainerStates(containers []types.Container) map[string]int {
+	counts := map[string]int{}
+	for _, container := range containers {
+		counts[container.State]++
+	}
+	return counts
+}
+
+// readKernelVersion returns the kernel release from /proc, or an empty string
+func readKernelVersion() string {
+	release, err := os.ReadFile(filepath.Join(procDir, "sys", "kernel", "osrelease"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(release))
+}
+
+// readTotalMemory returns the total memory in bytes from /proc/meminfo, or 0
+func readTotalMemory() uint64 {
+	meminfo, err := os.ReadFile(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return 0
+	}
+	return parseMemTotal(meminfo)
+}
+
+// parseMemTotal parses the MemTotal line of /proc/meminfo, which is given in kB
+func parseMemTotal(meminfo []byte) uint64 {
+	scanner := bufio.NewScanner(bytes.NewReader(meminfo))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		total, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			total *= 1024
+		}
+		return total
+	}
+	return 0
+}
+
+// startInventoryUpdates sends the inventory as agentInfoUpdate event every InventoryInterval
+func (a *Agent) startInventoryUpdates(log Logger) {
+	if a.InventoryInterval <= 0 {
+		return
+	}
+
+	a.sendPeriodically(a.InventoryInterval, protocol.EventAgentInfoUpdate, log, func() (interface{}, error) {
+		return collectInventory(log, a.Runtime), nil
+	})
+}
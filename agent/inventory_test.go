@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestParseMemTotal(t *testing.T) {
+	tests := []struct {
+		meminfo string
+		total   uint64
+	}{
+		{"MemTotal:       16303036 kB\nMemFree:         1022044 kB\n", 16303036 * 1024},
+		{"MemFree:         1022044 kB\nMemTotal:       2048 kB\n", 2048 * 1024},
+		{"MemTotal: 1000\n", 1000},
+		{"MemTotal: lots kB\n", 0},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		if total := parseMemTotal([]byte(test.meminfo)); total != test.total {
+			t.Errorf("%q parsed as %d, expected %d", test.meminfo, total, test.total)
+		}
+	}
+}
+
+func TestIsRootless(t *testing.T) {
+	if !isRootless([]string{"name=seccomp,profile=builtin", "name=rootless", "name=cgroupns"}) {
+		t.Fatal("rootless engine not detected")
+	}
+	if isRootless([]string{"name=seccomp,profile=builtin", "name=cgroupns"}) {
+		t.Fatal("rootful engine detected as rootless")
+	}
+}
+
+func TestCountContainerStates(t *testing.T) {
+	counts := countContainerStates([]types.Container{
+		{State: "running"}, {State: "exited"}, {State: "running"}, {State: "paused"},
+	})
+	if counts["running"] != 2 || counts["exited"] != 1 || counts["paused"] != 1 || len(counts) != 3 {
+		t.Fatal("unexpected counts", counts)
+	}
+}
+
+func TestCollectInventory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sys", "kernel"), 0o755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sys", "kernel", "osrelease"), []byte("6.1.0-test\n"), 0o644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "meminfo"), []byte("MemTotal: 1024 kB\n"), 0o644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = dir
+
+	inventory := collectInventory(Logger{}, containerRuntime{})
+	if inventory.Agent.Version == "" || inventory.Agent.Commit == "" || inventory.Agent.Uptime < 0 {
+		t.Fatal("incomplete agent inventory", inventory.Agent)
+	}
+	if inventory.Host.Kernel != "6.1.0-test" {
+		t.Fatal("kernel", inventory.Host.Kernel)
+	}
+	if inventory.Docker == nil && inventory.Host.Memory != 1024*1024 {
+		t.Fatal("memory", inventory.Host.Memory)
+	}
+	if inventory.Host.OS != runtime.GOOS || inventory.Host.Architecture != runtime.GOARCH || inventory.Host.CPUs < 1 {
+		t.Fatal("unexpected host inventory", inventory.Host)
+	}
+}
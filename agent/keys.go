@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"echoes/shared/protocol"
+	"echoes/shared/trsa"
+
+	"github.com/gorilla/websocket"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	privateKeyFile = "private_key"
+	publicKeyFile  = "public_key"
+
+	// keyRotateTimeout is how long the rotate command waits for the server to acknowledge the new key
+	keyRotateTimeout = 30 * time.Second
+)
+
+var keysCommand = &cli.Command{
+	Name:  "keys",
+	Usage: "manage the agent's RSA keys",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "show",
+			Usage:  "print the agent's public key and its fingerprint",
+			Action: showKeys,
+		},
+		{
+			Name:   "generate",
+			Usage:  "generate a keypair without connecting to the server",
+			Action: generateKeys,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "bits",
+					Usage: "size of the RSA key in bits",
+					Value: 2048,
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "overwrite existing keys",
+				},
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "import a PEM encoded RSA private key in PKCS#1 or PKCS#8 format",
+			ArgsUsage: "<private key file>",
+			Action:    importKeys,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "overwrite existing keys",
+				},
+			},
+		},
+		{
+			Name:   "rotate",
+			Usage:  "generate a new keypair and register it with the server",
+			Action: rotateKeys,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "bits",
+					Usage: "size of the new RSA key in bits",
+					Value: 2048,
+				},
+			},
+		},
+	},
+}
+
+// defaultAgentDir returns the directory where the agent stores its RSA keys and other files
+func defaultAgentDir() string {
+	// if on windows, store the RSA keys in %APPDATA%\Echoes\agent
+	if os.Getenv("OS") == "Windows_NT" {
+		return os.Getenv("APPDATA") + "\\Echoes\\agent"
+	}
+
+	return "/etc/echoes/agent"
+}
+
+// readKeys reads the public and private key stored in dir
+func readKeys(dir string) ([]byte, []byte, error) {
+	publicKey, err := os.ReadFile(filepath.Join(dir, publicKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey, err := os.ReadFile(filepath.Join(dir, privateKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return publicKey, privateKey, nil
+}
+
+// writeKeys stores the public and private key in dir. Both keys are first written
+// to temporary files and then renamed into place, so a crash never leaves a
+// truncated key behind.
+func writeKeys(dir string, publicKey, privateKey []byte) error {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{privateKeyFile, privateKey, 0o600},
+		{publicKeyFile, publicKey, 0o644},
+	}
+
+	// Stage both keys before touching the current ones
+	for _, f := range files {
+		err := os.WriteFile(filepath.Join(dir, f.name+".new"), f.data, f.perm)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Switch over to the staged keys
+	for _, f := range files {
+		err := os.Rename(filepath.Join(dir, f.name+".new"), filepath.Join(dir, f.name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// showKeys prints the agent's public key and its SHA-256 fingerprint
+func showKeys(context *cli.Context) error {
+	publicKey, _, err := readKeys(defaultAgentDir())
+	if err != nil {
+		return fmt.Errorf("could not read keys: %w", err)
+	}
+
+	fingerprint, err := trsa.Fingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(string(publicKey))
+	fmt.Println("SHA256 fingerprint: " + fingerprint)
+	return nil
+}
+
+// generateKeys pre-provisions a keypair, e.g. when baking the agent into an image
+func generateKeys(context *cli.Context) error {
+	publicKey, privateKey, err := trsa.GenerateKeys(context.Int("bits"))
+	if err != nil {
+		return err
+	}
+
+	return storeNewKeys(publicKey, privateKey, context.Bool("force"))
+}
+
+// importKeys stores an existing private key and its public key as the agent's keys
+func importKeys(context *cli.Context) error {
+	if context.NArg() != 1 {
+		return errors.New("expected exactly one private key file")
+	}
+
+	privateKeyPem, err := os.ReadFile(context.Args().First())
+	if err != nil {
+		return err
+	}
+
+	publicKey, privateKey, err := trsa.ImportPrivateKey(privateKeyPem)
+	if err != nil {
+		return fmt.Errorf("could not import private key: %w", err)
+	}
+
+	return storeNewKeys(publicKey, privateKey, context.Bool("force"))
+}
+
+// storeNewKeys writes the keys to the agent directory, refusing to replace existing keys unless forced
+func storeNewKeys(publicKey, privateKey []byte, force bool) error {
+	dir := defaultAgentDir()
+
+	if _, err := os.Stat(filepath.Join(dir, privateKeyFile)); err == nil && !force {
+		return errors.New("keys already exist in " + dir + ", use --force to overwrite them")
+	}
+
+	err := writeKeys(dir, publicKey, privateKey)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := trsa.Fingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Stored keys in " + dir)
+	fmt.Println("SHA256 fingerprint: " + fingerprint)
+	return nil
+}
+
+// rotateKeys generates a new keypair, proves possession of the old and the new
+// private key to the server and stores the new keys once the server acknowledged them
+func rotateKeys(context *cli.Context) error {
+	log := Logger{}
+
+	dir := defaultAgentDir()
+	oldPublicKey, oldPrivateKey, err := readKeys(dir)
+	if err != nil {
+		return fmt.Errorf("could not read current keys: %w", err)
+	}
+	oldKeys, err := trsa.NewKeypair(oldPublicKey, oldPrivateKey)
+	if err != nil {
+		return fmt.Errorf("could not parse current keys: %w", err)
+	}
+
+	newKeys, err := trsa.GenerateKeypair(context.Int("bits"))
+	if err != nil {
+		return err
+	}
+	log.Info("agent", "Generated new RSA keys")
+
+	agent := &Agent{
+		Keys:  oldKeys,
+		Token: context.String("secret"),
+	}
+
+	u := url.URL{Scheme: "ws", Host: context.String("server"), Path: "/ws"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer c.Close()
+
+	agent.Connection = c
+	err = c.SetReadDeadline(time.Now().Add(keyRotateTimeout))
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+
+		msg, err := protocol.Parse(message)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Event {
+		case protocol.EventHandshake:
+			err = agent.replyHandshake(msg)
+		case protocol.EventAgentInfo:
+			err = agent.replyAgentInfo(log)
+		case protocol.EventAgentId:
+			err = agent.handleAgentId(msg)
+			if err != nil {
+				return err
+			}
+
+			log.Info("agent", "Requesting key rotation for agent "+strconv.Itoa(agent.Id))
+			err = agent.requestKeyRotation(newKeys)
+		case protocol.EventKeyRotate:
+			if msg.Status != protocol.StatusOK {
+				return errors.New("server rejected the key rotation")
+			}
+
+			// The acknowledgement is encrypted with the new public key, so
+			// being able to read it proves the server switched over
+			var ack protocol.KeyRotateAck
+			codec := protocol.Codec{Keys: newKeys, Scheme: agent.EncryptionScheme}
+			if err := codec.Unmarshal(msg, &ack); err != nil {
+				return err
+			}
+			if ack.PublicKey != string(newKeys.Public) {
+				return errors.New("server acknowledged a different public key")
+			}
+
+			err = writeKeys(dir, newKeys.Public, newKeys.Private)
+			if err != nil {
+				return fmt.Errorf("server accepted the new key, but storing it failed: %w", err)
+			}
+
+			log.Info("agent", "Stored rotated RSA keys in "+dir)
+			return nil
+		default:
+			log.Warn("agent", "Unknown message event: "+msg.Event)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// requestKeyRotation sends a signed keyRotate event to the server. The proofs are signed with
+// PKCS#1 v1.5 regardless of the negotiated scheme, the server verifies them with it.
+func (a *Agent) requestKeyRotation(newKeys *trsa.Keypair) error {
+	proof, err := json.Marshal(protocol.KeyRotateProof{
+		AgentId:   a.Id,
+		Token:     a.Token,
+		PublicKey: string(newKeys.Public),
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	oldSignature, err := a.Keys.Sign(proof, trsa.WithScheme(trsa.SchemePKCS1v15))
+	if err != nil {
+		return err
+	}
+	newSignature, err := newKeys.Sign(proof, trsa.WithScheme(trsa.SchemePKCS1v15))
+	if err != nil {
+		return err
+	}
+
+	return a.sendSealed(protocol.EventKeyRotate, "", protocol.KeyRotateRequest{
+		Payload:      string(proof),
+		OldSignature: string(oldSignature),
+		NewSignature: string(newSignature),
+	})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// logsTimeout bounds how long answering a containerLogs request may take
+	logsTimeout = 2 * time.Minute
+	// logChunkSize is the size of the lines after which a containerLogs reply is sent
+	logChunkSize = 256 * 1024
+	// defaultLogsMaxBytes and maxLogsMaxBytes are the default and largest size of a containerLogs result
+	defaultLogsMaxBytes = 16 * 1024 * 1024
+	maxLogsMaxBytes     = 256 * 1024 * 1024
+	// rsaLogChunkSize and rsaLogsMaxBytes replace the sizes above for replies encrypted block by
+	// block with RSA. The server decrypts those on its event loop, every 256 KiB take more than
+	// a thousand private key operations.
+	rsaLogChunkSize = 16 * 1024
+	rsaLogsMaxBytes = 512 * 1024
+	// maxLogFrameSize bounds a frame of the multiplexed log stream, Docker splits lines into 16 KiB
+	maxLogFrameSize = 1024 * 1024
+	// maxLogLineSize bounds a log line, the logs of containers with a TTY are not split into
+	// frames. Longer lines are truncated.
+	maxLogLineSize = maxLogFrameSize
+)
+
+// errLogFrameTooLarge is returned for multiplexed log frames above maxLogFrameSize
+var errLogFrameTooLarge = errors.New("log frame too large")
+
+// logSource is the part of the Docker client reading container logs
+type logSource interface {
+	containerInspector
+	ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+}
+
+// validateLogsRequest checks a containerLogs request and applies the defaults
+func validateLogsRequest(req *protocol.ContainerLogsRequest) error {
+	if req.ContainerId == "" {
+		return errors.New("containerId is required")
+	}
+	if req.Tail < 0 {
+		return errors.New("tail must not be negative")
+	}
+	if !req.Since.IsZero() && !req.Until.IsZero() && req.Until.Before(req.Since) {
+		return errors.New("until is before since")
+	}
+	for _, stream := range req.Streams {
+		if stream != protocol.StreamStdout && stream != protocol.StreamStderr {
+			return fmt.Errorf("unknown stream %q", stream)
+		}
+	}
+
+	if req.MaxBytes <= 0 {
+		req.MaxBytes = defaultLogsMaxBytes
+	}
+	if req.MaxBytes > maxLogsMaxBytes {
+		req.MaxBytes = maxLogsMaxBytes
+	}
+	return nil
+}
+
+// limitLogsRequest returns the chunk size of the replies to req and caps its MaxBytes. Large
+// results need session keys or hybrid encryption, see rsaLogsMaxBytes.
+func limitLogsRequest(req *protocol.ContainerLogsRequest, codec *protocol.Codec) int64 {
+	if codec.Session != nil || codec.Hybrid {
+		return logChunkSize
+	}
+	if req.MaxBytes > rsaLogsMaxBytes {
+		req.MaxBytes = rsaLogsMaxBytes
+	}
+	return rsaLogChunkSize
+}
+
+// logsOptions translates a containerLogs request to the options of the Docker logs API
+func logsOptions(req protocol.ContainerLogsRequest) types.ContainerLogsOptions {
+	options := types.ContainerLogsOptions{
+		ShowStdout: len(req.Streams) == 0,
+		ShowStderr: len(req.Streams) == 0,
+		Timestamps: true,
+		Tail:       "all",
+	}
+	for _, stream := range req.Streams {
+		switch stream {
+		case protocol.StreamStdout:
+			options.ShowStdout = true
+		case protocol.StreamStderr:
+			options.ShowStderr = true
+		}
+	}
+	if !req.Since.IsZero() {
+		options.Since = req.Since.Format(time.RFC3339Nano)
+	}
+	if !req.Until.IsZero() {
+		options.Until = req.Until.Format(time.RFC3339Nano)
+	}
+	if req.Tail > 0 {
+		options.Tail = strconv.Itoa(req.Tail)
+	}
+	return options
+}
+
+// readLogEntries decodes a log stream requested with timestamps, calling emit for every line.
+// Streams of containers without a TTY are multiplexed, every frame starts with a header
+// holding the stream and the frame size.
+func readLogEntries(r io.Reader, tty bool, emit func(entry protocol.LogEntry) error) error {
+	if tty {
+		return readLogLines(r, protocol.StreamStdout, emit)
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		stream := protocol.StreamStdout
+		if header[0] == 2 {
+			stream = protocol.StreamStderr
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if size > maxLogFrameSize {
+			return errLogFrameTooLarge
+		}
+
+		if err := readLogLines(io.LimitReader(r, int64(size)), stream, emit); err != nil {
+			return err
+		}
+	}
+}
+
+// readLogLines calls emit for every line of r, truncating lines to maxLogLineSize
+func readLogLines(r io.Reader, stream string, emit func(entry protocol.LogEntry) error) error {
+	reader := bufio.NewReader(r)
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if room := maxLogLineSize - len(line); room > 0 {
+			line = append(line, fragment[:min(len(fragment), room)]...)
+		}
+		if err == bufio.ErrBufferFull {
+			// Skip the rest of a line above the limit without keeping it
+			continue
+		}
+
+		if len(line) > 0 {
+			if err := emit(parseLogLine(stream, strings.TrimSuffix(string(line), "\n"))); err != nil {
+				return err
+			}
+			line = line[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseLogLine splits the timestamp Docker prefixes to each line from the line
+func parseLogLine(stream, line string) protocol.LogEntry {
+	entry := protocol.LogEntry{Stream: stream, Line: line}
+
+	timestamp, rest, found := strings.Cut(line, " ")
+	if !found {
+		rest = ""
+	}
+	if parsed, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		entry.Timestamp = parsed
+		entry.Line = rest
+	}
+	return entry
+}
+
+// fetchContainerLogs reads the logs selected by req, passing them to send in chunks of about
+// chunkSize bytes. The last chunk is marked final, and truncated if MaxBytes was reached.
+func fetchContainerLogs(ctx context.Context, source logSource, metadata *metadataCache, req protocol.ContainerLogsRequest, chunkSize int64, send func(chunk protocol.ContainerLogsChunk) error) error {
+	info, err := source.ContainerInspect(ctx, req.ContainerId)
+	if err != nil {
+		return err
+	}
+	tty := info.Config != nil && info.Config.Tty
+
+	batch, err := metadata.NewLogBatch(ctx, source, req.ContainerId, []protocol.LogEntry{})
+	if err != nil {
+		return err
+	}
+
+	out, err := source.ContainerLogs(ctx, req.ContainerId, logsOptions(req))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	chunk := protocol.ContainerLogsChunk{LogBatch: batch}
+	var size, total int64
+	errCapReached := errors.New("cap reached")
+
+	err = readLogEntries(out, tty, func(entry protocol.LogEntry) error {
+		lineSize := int64(len(entry.Line))
+		if total+lineSize > req.MaxBytes {
+			return errCapReached
+		}
+		total += lineSize
+
+		chunk.Entries = append(chunk.Entries, entry)
+		size += lineSize
+		if size < chunkSize {
+			return nil
+		}
+
+		if err := send(chunk); err != nil {
+			return err
+		}
+		chunk.Seq++
+		chunk.Entries = []protocol.LogEntry{}
+		size = 0
+		return nil
+	})
+	if err == errCapReached {
+		chunk.Truncated = true
+	} else if err != nil {
+		return err
+	}
+
+	chunk.Final = true
+	return send(chunk)
+}
+
+// replyContainerLogs answers a containerLogs request with the requested logs. The logs are
+// read in the background, so the connection keeps being served meanwhile.
+func (a *Agent) replyContainerLogs(msg protocol.Message, log Logger) error {
+	if err := a.Capabilities.Require(protocol.CapabilityLogStreaming); err != nil {
+		return a.send(protocol.NewError(protocol.EventContainerLogs, msg.MessageId, err))
+	}
+
+	var req protocol.ContainerLogsRequest
+	if err := a.codec().Unmarshal(msg, &req); err != nil {
+		return a.send(protocol.NewError(protocol.EventContainerLogs, msg.MessageId, err))
+	}
+	if err := validateLogsRequest(&req); err != nil {
+		return a.send(protocol.NewError(protocol.EventContainerLogs, msg.MessageId, err))
+	}
+	if a.metadata == nil {
+		return a.send(protocol.NewError(protocol.EventContainerLogs, msg.MessageId, errors.New("agent is not authenticated")))
+	}
+
+	// Bind the reply to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+	metadata := a.metadata
+	chunkSize := limitLogsRequest(&req, codec)
+
+	go func() {
+		err := a.sendContainerLogs(conn, codec, metadata, req, chunkSize, msg.MessageId)
+		if err == nil {
+			return
+		}
+
+		log.Error("agent", "Error fetching container logs: "+err.Error())
+		if err := a.write(conn, protocol.NewError(protocol.EventContainerLogs, msg.MessageId, err)); err != nil {
+			log.Error("agent", "Error sending containerLogs: "+err.Error())
+		}
+	}()
+	return nil
+}
+
+// sendContainerLogs sends the logs selected by req as containerLogs replies of chunkSize to conn
+func (a *Agent) sendContainerLogs(conn *websocket.Conn, codec *protocol.Codec, metadata *metadataCache, req protocol.ContainerLogsRequest, chunkSize int64, messageId string) error {
+	cli, err := a.runtimeClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), logsTimeout)
+	defer cancel()
+
+	return fetchContainerLogs(ctx, cli, metadata, req, chunkSize, func(chunk protocol.ContainerLogsChunk) error {
+		return a.writeSealed(conn, codec, protocol.EventContainerLogs, messageId, chunk)
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+	"echoes/shared/trsa"
+
+	"github.com/docker/docker/api/types"
+)
+
+// fakeLogSource serves the log stream of a single container from memory
+type fakeLogSource struct {
+	fakeInspector
+	logs    []byte
+	options types.ContainerLogsOptions
+}
+
+func (s *fakeLogSource) ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	s.options = options
+	return io.NopCloser(bytes.NewReader(s.logs)), nil
+}
+
+// logFrame encodes a frame of a multiplexed log stream
+func logFrame(stream byte, payload string) []byte {
+	frame := make([]byte, 8, 8+len(payload))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func collectLogEntries(t *testing.T, r io.Reader, tty bool) []protocol.LogEntry {
+	t.Helper()
+
+	var entries []protocol.LogEntry
+	err := readLogEntries(r, tty, func(entry protocol.LogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestParseLogLine(t *testing.T) {
+	entry := parseLogLine("stderr", "2024-01-02T03:04:05.123456789Z hello world")
+	if !entry.Timestamp.Equal(time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)) || entry.Line != "hello world" || entry.Stream != "stderr" {
+		t.Fatal("unexpected entry", entry)
+	}
+
+	if entry := parseLogLine("stdout", "2024-01-02T03:04:05Z"); entry.Line != "" || entry.Timestamp.IsZero() {
+		t.Fatal("unexpected entry of empty line", entry)
+	}
+	if entry := parseLogLine("stdout", "no timestamp"); entry.Line != "no timestamp" || !entry.Timestamp.IsZero() {
+		t.Fatal("unexpected entry without timestamp", entry)
+	}
+}
+
+func TestReadLogEntries(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(logFrame(1, "2024-01-02T03:04:05Z first\n"))
+	stream.Write(logFrame(2, "2024-01-02T03:04:06Z second\n2024-01-02T03:04:07Z third\n"))
+	stream.Write(logFrame(1, "2024-01-02T03:04:08Z unterminated"))
+
+	entries := collectLogEntries(t, &stream, false)
+	expected := []protocol.LogEntry{
+		{Stream: "stdout", Line: "first"},
+		{Stream: "stderr", Line: "second"},
+		{Stream: "stderr", Line: "third"},
+		{Stream: "stdout", Line: "unterminated"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatal("unexpected entries", entries)
+	}
+	for i := range expected {
+		if entries[i].Stream != expected[i].Stream || entries[i].Line != expected[i].Line || entries[i].Timestamp.IsZero() {
+			t.Error("unexpected entry", i, entries[i])
+		}
+	}
+
+	// Containers with a TTY write a raw stream
+	entries = collectLogEntries(t, strings.NewReader("2024-01-02T03:04:05Z a\n2024-01-02T03:04:06Z b\n"), true)
+	if len(entries) != 2 || entries[1].Line != "b" || entries[1].Stream != "stdout" {
+		t.Fatal("unexpected tty entries", entries)
+	}
+
+	// Lines above the limit are truncated instead of buffered whole
+	long := strings.Repeat("x", 3*maxLogLineSize)
+	entries = collectLogEntries(t, strings.NewReader(long+"\n2024-01-02T03:04:06Z b\n"), true)
+	if len(entries) != 2 || entries[0].Line != long[:maxLogLineSize] || entries[1].Line != "b" {
+		t.Fatal("unexpected entries after a long line", len(entries))
+	}
+
+	if err := readLogEntries(bytes.NewReader(logFrame(1, "x")[:8]), false, func(protocol.LogEntry) error { return nil }); err != nil {
+		t.Fatal("empty frame payload rejected", err)
+	}
+	huge := make([]byte, 8)
+	binary.BigEndian.PutUint32(huge[4:], maxLogFrameSize+1)
+	if err := readLogEntries(bytes.NewReader(huge), false, func(protocol.LogEntry) error { return nil }); err != errLogFrameTooLarge {
+		t.Fatal("oversized frame accepted", err)
+	}
+	if err := readLogEntries(bytes.NewReader([]byte{1, 0, 0}), false, func(protocol.LogEntry) error { return nil }); err == nil {
+		t.Fatal("truncated header accepted")
+	}
+}
+
+func TestValidateLogsRequest(t *testing.T) {
+	now := time.Now()
+	invalid := []protocol.ContainerLogsRequest{
+		{},
+		{ContainerId: "abc", Tail: -1},
+		{ContainerId: "abc", Since: now, Until: now.Add(-time.Second)},
+		{ContainerId: "abc", Streams: []string{"stdin"}},
+	}
+	for _, req := range invalid {
+		if err := validateLogsRequest(&req); err == nil {
+			t.Error("invalid request accepted", req)
+		}
+	}
+
+	req := protocol.ContainerLogsRequest{ContainerId: "abc"}
+	if err := validateLogsRequest(&req); err != nil || req.MaxBytes != defaultLogsMaxBytes {
+		t.Fatal("default cap not applied", err, req.MaxBytes)
+	}
+	req.MaxBytes = maxLogsMaxBytes * 2
+	if err := validateLogsRequest(&req); err != nil || req.MaxBytes != maxLogsMaxBytes {
+		t.Fatal("cap not limited", err, req.MaxBytes)
+	}
+}
+
+func TestLimitLogsRequest(t *testing.T) {
+	req := protocol.ContainerLogsRequest{ContainerId: "abc", MaxBytes: defaultLogsMaxBytes}
+	if chunkSize := limitLogsRequest(&req, &protocol.Codec{}); chunkSize != rsaLogChunkSize || req.MaxBytes != rsaLogsMaxBytes {
+		t.Fatal("RSA encrypted result limited to", chunkSize, req.MaxBytes)
+	}
+
+	for _, codec := range []*protocol.Codec{{Hybrid: true}, {Session: &trsa.Session{}}} {
+		req := protocol.ContainerLogsRequest{ContainerId: "abc", MaxBytes: defaultLogsMaxBytes}
+		if chunkSize := limitLogsRequest(&req, codec); chunkSize != logChunkSize || req.MaxBytes != defaultLogsMaxBytes {
+			t.Fatal("result limited to", chunkSize, req.MaxBytes)
+		}
+	}
+}
+
+func TestLogsOptions(t *testing.T) {
+	options := logsOptions(protocol.ContainerLogsRequest{ContainerId: "abc"})
+	if !options.ShowStdout || !options.ShowStderr || !options.Timestamps || options.Tail != "all" || options.Since != "" || options.Until != "" {
+		t.Fatal("unexpected default options", options)
+	}
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	options = logsOptions(protocol.ContainerLogsRequest{
+		ContainerId: "abc",
+		Since:       since,
+		Until:       since.Add(time.Hour),
+		Tail:        10,
+		Streams:     []string{"stderr"},
+	})
+	if options.ShowStdout || !options.ShowStderr || options.Tail != "10" || options.Since != "2024-01-02T03:04:05Z" || options.Until != "2024-01-02T04:04:05Z" {
+		t.Fatal("unexpected options", options)
+	}
+}
+
+func TestFetchContainerLogs(t *testing.T) {
+	line := strings.Repeat("x", 1000)
+	var stream bytes.Buffer
+	for i := 0; i < 600; i++ {
+		stream.Write(logFrame(1, "2024-01-02T03:04:05Z "+line+"\n"))
+	}
+	source := &fakeLogSource{
+		fakeInspector: fakeInspector{containers: map[string]types.ContainerJSON{"abc": inspectedContainer("abc", "web", 0)}},
+		logs:          stream.Bytes(),
+	}
+
+	var published []protocol.ContainerMeta
+	metadata := newMetadataCache(func(meta protocol.ContainerMeta) error {
+		published = append(published, meta)
+		return nil
+	})
+
+	fetch := func(maxBytes int64) []protocol.ContainerLogsChunk {
+		var chunks []protocol.ContainerLogsChunk
+		req := protocol.ContainerLogsRequest{ContainerId: "abc", MaxBytes: maxBytes}
+		err := fetchContainerLogs(context.Background(), source, metadata, req, logChunkSize, func(chunk protocol.ContainerLogsChunk) error {
+			chunks = append(chunks, chunk)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chunks
+	}
+
+	chunks := fetch(defaultLogsMaxBytes)
+	if len(chunks) != 3 || len(published) != 1 {
+		t.Fatal("unexpected chunks", len(chunks), "and metadata", len(published))
+	}
+	lines := 0
+	for i, chunk := range chunks {
+		if chunk.Seq != i || chunk.Final != (i == len(chunks)-1) || chunk.Truncated || chunk.ContainerId != "abc" || chunk.MetaRef != published[0].Ref {
+			t.Fatal("unexpected chunk", i, chunk.Seq, chunk.Final, chunk.Truncated, chunk.MetaRef)
+		}
+		lines += len(chunk.Entries)
+	}
+	if lines != 600 {
+		t.Fatal("lines lost", lines)
+	}
+
+	// The cap ends the result early
+	chunks = fetch(10_500)
+	if len(chunks) != 1 || len(chunks[0].Entries) != 10 || !chunks[0].Final || !chunks[0].Truncated {
+		t.Fatal("cap not applied", len(chunks))
+	}
+}
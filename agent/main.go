@@ -1,17 +1,18 @@
 package main
 
 import (
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
+	"echoes/shared/protocol"
 	"echoes/shared/trsa"
 	"echoes/version"
 
@@ -22,19 +23,6 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
-type response struct {
-	Status    string      `json:"status"`
-	Event     string      `json:"event"`
-	Data      interface{} `json:"data"`
-	MessageId string      `json:"messageId"`
-}
-
-// Create a custom struct for PublicKey and Token
-type AgentInfo struct {
-	Token    string `json:"token"`
-	Hostname string `json:"hostname"`
-}
-
 const (
 	retryDuration = 60 * time.Second // Total duration to keep retrying
 )
@@ -64,6 +52,7 @@ func main() {
 			Usage:  "check the health of the server",
 			Action: healthchecker,
 		},
+		keysCommand,
 	}
 	app.Flags = flags
 
@@ -98,10 +87,101 @@ func runAgent(context *cli.Context) error {
 		return nil
 	}
 
-	agent := Agent{}
+	statsSelector, err := newContainerSelector(context.StringSlice("stats-containers"))
+	if err != nil {
+		return err
+	}
+
+	containerActions, err := parseActionPolicy(context.StringSlice("container-actions"))
+	if err != nil {
+		return err
+	}
+
+	dockerEventFilters, err := parseDockerEventFilters(context.StringSlice("docker-events-filter"))
+	if err != nil {
+		return err
+	}
+
+	sinkSelector, err := newContainerSelector(context.StringSlice("sink-containers"))
+	if err != nil {
+		return err
+	}
+
+	engine, err := newContainerRuntime(context.String("runtime"), context.String("runtime-socket"), context.String("containerd-namespace"))
+	if err != nil {
+		return err
+	}
+	log.Info("agent", "Using container runtime "+engine.String())
+
+	sinks, err := parseSinks(context.StringSlice("sink"), engine.Name, log)
+	if err != nil {
+		return err
+	}
+	defer sinks.Close()
+
+	var metricsExporter *otlpExporter
+	if endpoint := context.String("otlp-metrics"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err == nil {
+			metricsExporter, err = newOTLPExporter(u)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid OTLP metrics endpoint %q: %w", endpoint, err)
+		}
+		defer metricsExporter.Close()
+	}
+
+	agent := Agent{
+		InventoryInterval:  context.Duration("inventory-interval"),
+		StatsInterval:      context.Duration("stats-interval"),
+		StatsSelector:      statsSelector,
+		MetricsExporter:    metricsExporter,
+		ContainerActions:   containerActions,
+		ExecEnabled:        context.Bool("exec"),
+		ExecIdleTimeout:    context.Duration("exec-idle-timeout"),
+		DockerEventFilters: dockerEventFilters,
+		SinkSelector:       sinkSelector,
+		Runtime:            engine,
+	}
+	if agent.ExecEnabled && !engine.SupportsExec() {
+		log.Warn("agent", "The "+engine.Name+" runtime doesn't support exec, not allowing exec sessions")
+		agent.ExecEnabled = false
+	}
+	if agent.StatsInterval > 0 && !engine.SupportsStats() {
+		log.Warn("agent", "The "+engine.Name+" runtime doesn't report stats, not collecting stats")
+		agent.StatsInterval = 0
+	}
 	// Initialize the agent
 	agent.Initialize(context.String("secret"))
 
+	// The audit log is kept next to the keys unless configured otherwise
+	auditPath := context.String("audit-log")
+	if auditPath == "" {
+		auditPath = filepath.Join(agentDir, auditFile)
+	}
+	agent.AuditLog = newAuditLog(auditPath)
+
+	// Logs are shipped to the sinks regardless of the connection to the server
+	if len(sinks.sinks) > 0 {
+		agent.Sinks = sinks
+		agent.startLogCollector(log)
+	}
+
+	// Stats are exported regardless of the connection to the server as well
+	if agent.MetricsExporter != nil {
+		if agent.StatsInterval > 0 && !agent.StatsSelector.Empty() {
+			agent.startStatsExport(log)
+		} else {
+			log.Warn("agent", "OTLP metrics need a stats interval and selected containers, not exporting stats")
+		}
+	}
+
+	// Docker events are spooled for the whole run, so they survive reconnects
+	if context.Bool("docker-events") {
+		agent.DockerEvents = newSpool[protocol.DockerEvent](dockerEventSpoolSize)
+		agent.startDockerEvents(log)
+	}
+
 	// Infinite loop replaced with loop that runs for retryDuration
 	for {
 		if time.Since(startTime) > retryDuration {
@@ -109,7 +189,7 @@ func runAgent(context *cli.Context) error {
 			break
 		}
 
-		if connectToServer(&agent, log, context) {
+		if connectToServer(&agent, log, context.String("server")) {
 			handleServerCommunication(&agent, log)
 		}
 
@@ -120,9 +200,9 @@ func runAgent(context *cli.Context) error {
 	return nil
 }
 
-// Connect to the server
-func connectToServer(agent *Agent, log Logger, context *cli.Context) bool {
-	u := url.URL{Scheme: "ws", Host: context.String("server"), Path: "/ws"}
+// Connect to the server at the given host:port
+func connectToServer(agent *Agent, log Logger, server string) bool {
+	u := url.URL{Scheme: "ws", Host: server, Path: "/ws"}
 
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
@@ -131,6 +211,11 @@ func connectToServer(agent *Agent, log Logger, context *cli.Context) bool {
 	}
 
 	agent.Connection = c // Assuming you store the connection in the Agent struct
+	agent.disconnected = make(chan struct{})
+	agent.tasksStarted = false
+	agent.metadata = nil
+	agent.logSubscriptions = nil
+	agent.execSessions = nil
 	log.Info("agent", "WebSocket connected")
 	return true
 }
@@ -140,6 +225,7 @@ func handleServerCommunication(agent *Agent, log Logger) {
 	c := agent.Connection // Assuming you store the connection in the Agent struct
 
 	defer c.Close()
+	defer close(agent.disconnected)
 
 	// Create a channel to listen for termination signals
 	sigCh := make(chan os.Signal, 1)
@@ -157,6 +243,13 @@ func handleServerCommunication(agent *Agent, log Logger) {
 			log.Info("agent", "WebSocket connection closed")
 		}
 
+		// Ship the buffered logs before exiting
+		if agent.Sinks != nil {
+			if err := agent.Sinks.Close(); err != nil {
+				log.Error("agent", "Error closing sinks: "+err.Error())
+			}
+		}
+
 		// Exit the program
 		os.Exit(0)
 	}()
@@ -170,175 +263,183 @@ func handleServerCommunication(agent *Agent, log Logger) {
 			return
 		}
 
-		var resp response
-
 		// Parse message
-		err = json.Unmarshal(message, &resp)
+		msg, err := protocol.Parse(message)
 		if err != nil {
-			log.Error("agent", "Error unmarshaling JSON: "+err.Error())
+			log.Error("agent", err.Error())
+			continue
 		}
 
 		// Handle message
-		switch resp.Event {
-		case "handshake":
-			log.Info("agent", "Server performing handshake")
-
-			// Check if resp.Data is a map and contains "publicKey" key
-			data, ok := resp.Data.(map[string]interface{})
-			if !ok {
-				log.Error("agent", "Invalid handshake message format")
-				// Handle the error appropriately, e.g., return or log
-				return
-			}
+		err = agent.handleMessage(msg, log)
+		if err != nil {
+			log.Error("agent", err.Error())
+			return
+		}
+	}
+}
 
-			publicKeyValue, ok := data["publicKey"].(string)
-			if !ok {
-				log.Error("agent", "Invalid publicKey format")
-				// Handle the error appropriately, e.g., return or log
-				return
-			}
+// handleMessage dispatches a message from the server to the handler of its event.
+// An error means the connection can not be used any further.
+func (a *Agent) handleMessage(msg protocol.Message, log Logger) error {
+	switch msg.Event {
+	case protocol.EventHandshake:
+		log.Info("agent", "Server performing handshake")
 
-			// Convert the publicKeyValue string to []byte
-			publicKeyBytes := []byte(publicKeyValue)
+		return a.replyHandshake(msg)
+	case protocol.EventAgentInfo:
+		log.Info("agent", "Server interrogating for agent info")
 
-			// Now you can use publicKeyBytes as []byte
-			agent.ServerPublicKey = publicKeyBytes
+		return a.replyAgentInfo(log)
+	case protocol.EventContainerList:
+		log.Info("agent", "Server interrogating for container list")
 
-			// Build handshake message
-			handshakeData := response{
-				Event: "handshake",
-				Data: struct {
-					PublicKey string `json:"publicKey"`
-				}{
-					PublicKey: string(agent.PublicKey),
-				},
-			}
+		list, err := a.GetContainers()
+		if err != nil {
+			// Answer the request, so the server is not left waiting for a reply
+			log.Error("agent", "Error listing containers: "+err.Error())
+			return a.send(protocol.NewError(protocol.EventContainerList, msg.MessageId, err))
+		}
 
-			// Convert the handshakeData struct to a JSON string
-			jsonData, err := json.Marshal(handshakeData)
-			if err != nil {
-				log.Error("agent", "json.Marshal error:"+err.Error())
-				return
-			}
+		// Encrypt the list with the session keys or the server's public key, answering the
+		// request's message ID if present
+		return a.sendSealed(protocol.EventContainerList, msg.MessageId, list)
+	case protocol.EventContainerLogs:
+		log.Info("agent", "Server requesting container logs")
 
-			// Send the JSON string as a byte slice
-			err = c.WriteMessage(websocket.TextMessage, jsonData)
-			if err != nil {
-				log.Error("agent", "write:"+err.Error())
-			}
-		case "agentInfo":
-			log.Info("agent", "Server interrogating for agent info")
+		return a.replyContainerLogs(msg, log)
+	case protocol.EventSubscribeLogs:
+		log.Info("agent", "Server subscribing to container logs")
 
-			agentData := AgentInfo{
-				Token:    agent.Token,
-				Hostname: getHostName(),
-			}
+		return a.handleSubscribeLogs(msg)
+	case protocol.EventUnsubscribeLogs:
+		log.Info("agent", "Server unsubscribing from container logs")
 
-			// Convert to JSON so that it can be encrypted
-			agentDataJSON, err := json.Marshal(agentData)
-			if err != nil {
-				log.Error("agent", "json.Marshal error:"+err.Error())
-				return
-			}
+		return a.handleUnsubscribeLogs(msg)
+	case protocol.EventContainerAction:
+		log.Info("agent", "Server requesting a container action")
 
-			// Encrypt the agentData using trsa.Encrypt with the server's public key
-			encryptedData, err := trsa.Encrypt([]byte(agentDataJSON), agent.ServerPublicKey)
-			if err != nil {
-				log.Error("agent", "Encryption error: "+err.Error())
-				return
-			}
+		return a.handleContainerAction(msg, log)
+	case protocol.EventExecStart:
+		log.Info("agent", "Server starting an exec session")
 
-			// Build agent info message
-			agentInfo := response{
-				Event: "agentInfo",
-				Data:  hex.EncodeToString(encryptedData),
-			}
+		return a.handleExec(msg, log)
+	case protocol.EventExecInput, protocol.EventExecResize, protocol.EventExecClose:
+		return a.handleExec(msg, log)
+	case protocol.EventAgentId:
+		log.Info("agent", "Server sending agent id")
 
-			// Convert the agentInfo struct to a JSON string
-			jsonData, err := json.Marshal(agentInfo)
-			if err != nil {
-				log.Error("agent", "json.Marshal error:"+err.Error())
-				return
-			}
+		err := a.handleAgentId(msg)
+		if err != nil {
+			return err
+		}
 
-			// Send the JSON string as a byte slice
-			err = c.WriteMessage(websocket.TextMessage, jsonData)
-			if err != nil {
-				log.Error("agent", "write:"+err.Error())
-			}
-		case "containerList":
-			log.Info("agent", "Server interrogating for container list")
+		if a.Capabilities == nil {
+			log.Warn("agent", "Server predates capability negotiation, optional features are disabled")
+		} else {
+			log.Info("agent", fmt.Sprintf("Server enabled capabilities %v", a.Capabilities))
+		}
 
-			list := agent.GetContainers()
+		// The agent is authenticated, keep the server's view of the host up to date
+		a.startConnectionTasks(log)
+		return nil
+	default:
+		log.Warn("agent", "Unknown message event: "+msg.Event)
+	}
 
-			// Convert to JSON so that it can be encrypted
-			listJSON, err := json.Marshal(list)
-			if err != nil {
-				log.Error("agent", "json.Marshal error:"+err.Error())
-				return
-			}
+	return nil
+}
 
-			// Encrypt the list using trsa.Encrypt with the server's public key
-			encryptedData, err := trsa.Encrypt([]byte(listJSON), agent.ServerPublicKey)
-			if err != nil {
-				log.Error("agent", "Encryption error: "+err.Error())
-				return
-			}
+// replyHandshake stores the server's public key and answers with the agent's public key
+func (a *Agent) replyHandshake(msg protocol.Message) error {
+	var handshake protocol.Handshake
+	if err := msg.Unmarshal(&handshake); err != nil {
+		return err
+	}
 
-			// Build container list message
-			containerList := response{
-				Status: "ok",
-				Event:  "containerList",
-				Data:   hex.EncodeToString(encryptedData),
-			}
+	serverKeys, err := trsa.NewKeypair([]byte(handshake.PublicKey), nil)
+	if err != nil {
+		return fmt.Errorf("Invalid publicKey: %w", err)
+	}
+	a.ServerKeys = serverKeys
 
-			// If a message ID is present, add it to the response
-			if resp.MessageId != "" {
-				containerList.MessageId = resp.MessageId
-			}
+	// Refuse servers speaking a protocol version the agent no longer understands
+	a.ProtocolVersion, err = protocol.Negotiate(handshake.ProtocolVersion)
+	if err != nil {
+		return fmt.Errorf("Incompatible server: %w", err)
+	}
 
-			// Convert the containerList struct to a JSON string
-			jsonData, err := json.Marshal(containerList)
-			if err != nil {
-				log.Error("agent", "json.Marshal error:"+err.Error())
-				return
-			}
+	// Optional features stay disabled until the server enabled them in its agentId message
+	a.Capabilities = nil
 
-			// Send the JSON string as a byte slice
-			err = c.WriteMessage(websocket.TextMessage, jsonData)
-			if err != nil {
-				log.Error("agent", "write:"+err.Error())
-			}
-		case "agentId":
-			log.Info("agent", "Server sending agent id")
+	// Pick the strongest schemes the server advertises, servers without
+	// a scheme list only understand the trsa defaults
+	a.EncryptionScheme, a.SignatureScheme = trsa.Strongest(handshake.Schemes)
 
-			decryptedJSON, err := decryptAndUnmarshal([]byte(resp.Data.(string)), agent.PrivateKey)
-			if err != nil {
-				log.Error("agent", "Error decrypting message: "+err.Error())
-				return
-			}
+	// Agree on ephemeral session keys if the server offers a signed X25519 key
+	a.Session = nil
+	var sessionOffer *trsa.SessionOffer
+	if handshake.Session != nil {
+		sessionHandshake, err := trsa.NewSessionHandshake(a.Keys.Private, trsa.WithScheme(a.SignatureScheme))
+		if err != nil {
+			return err
+		}
+		a.Session, err = sessionHandshake.Complete(*handshake.Session, a.ServerKeys.Public, true)
+		if err != nil {
+			return fmt.Errorf("Invalid session offer: %w", err)
+		}
 
-			// Access and process the agentId
-			agentIdValue, ok := decryptedJSON["agentId"]
-			if !ok {
-				log.Error("agent", "Invalid agentId message format")
-				return
-			}
+		offer := sessionHandshake.Offer()
+		sessionOffer = &offer
+	}
 
-			// Convert the agentIdValue to int
-			agentIdFloat, ok := agentIdValue.(float64) // JSON numbers are float64 by default
-			if !ok {
-				log.Error("agent", "Invalid agentId format")
-				return
-			}
+	// Build handshake message
+	reply, err := protocol.NewMessage(protocol.EventHandshake, protocol.Handshake{
+		PublicKey:       string(a.Keys.Public),
+		ProtocolVersion: protocol.Version,
+		Schemes:         []trsa.Scheme{a.EncryptionScheme, a.SignatureScheme},
+		Session:         sessionOffer,
+		Version:         version.String(),
+		Capabilities:    a.capabilities(),
+	})
+	if err != nil {
+		return err
+	}
 
-			agentId := int(agentIdFloat)
-			agent.Id = agentId
-		default:
-			log.Warn("agent", "Unknown message event: "+resp.Event)
-		}
+	return a.send(reply)
+}
+
+// replyAgentInfo sends the encrypted agent token, hostname and inventory to the server
+func (a *Agent) replyAgentInfo(log Logger) error {
+	inventory := collectInventory(log, a.Runtime)
+	return a.sendSealed(protocol.EventAgentInfo, "", protocol.AgentInfo{
+		Token:     a.Token,
+		Hostname:  getHostName(),
+		Inventory: &inventory,
+	})
+}
+
+// handleAgentId decrypts the id the server assigned to the agent and the capabilities it enabled
+func (a *Agent) handleAgentId(msg protocol.Message) error {
+	var agentId protocol.AgentId
+	if err := a.codec().Unmarshal(msg, &agentId); err != nil {
+		return err
+	}
+
+	if agentId.AgentId <= 0 {
+		return errors.New("Invalid agentId format")
+	}
 
+	// The server may only enable what the agent offered
+	for _, capability := range agentId.Capabilities {
+		if !a.capabilities().Has(capability) {
+			return fmt.Errorf("Incompatible server: it enabled the %s capability the agent does not support", capability)
+		}
 	}
+
+	a.Id = agentId.AgentId
+	a.Capabilities = agentId.Capabilities
+	return nil
 }
 
 // Check if the server is healthy
@@ -378,30 +479,3 @@ func healthchecker(context *cli.Context) error {
 
 	return nil
 }
-
-// decryptAndUnmarshal takes a hex-encoded encrypted string and a private key,
-// decrypts the string, and unmarshals the JSON content into a map.
-// It returns the unmarshaled map and any error encountered.
-func decryptAndUnmarshal(message, privateKey []byte) (map[string]interface{}, error) {
-	// Decode the hex string to a byte slice
-	dataBytes, err := hex.DecodeString(string(message))
-	if err != nil {
-		return nil, fmt.Errorf("Error decoding hex string: %v\n", err)
-	}
-
-	// Decrypt the data using trsa.Decrypt
-	decryptedData, err := trsa.Decrypt(dataBytes, privateKey)
-	if err != nil {
-		return nil, fmt.Errorf("Decryption error: %v\n", err)
-	}
-
-	// Unmarshal the JSON from the decrypted data
-	var decryptedJSON map[string]interface{}
-	err = json.Unmarshal(decryptedData, &decryptedJSON)
-	if err != nil {
-		return nil, fmt.Errorf("Error unmarshaling JSON: %v\n", err)
-	}
-
-	// Return the decrypted json
-	return decryptedJSON, nil
-}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"testing"
+
+	"echoes/shared/protocol"
+	"echoes/shared/trsa"
+)
+
+// newFuzzAgent returns an agent with fresh keys that is not connected to a server
+func newFuzzAgent(f *testing.F) *Agent {
+	log.SetOutput(io.Discard)
+
+	keys, err := trsa.GenerateKeypair(2048)
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	return &Agent{Keys: keys, ServerKeys: keys}
+}
+
+func FuzzHandleMessage(f *testing.F) {
+	agent := newFuzzAgent(f)
+
+	agentId, err := agent.codec().NewMessage(protocol.EventAgentId, protocol.AgentId{AgentId: 1})
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	handshake, err := protocol.NewMessage(protocol.EventHandshake, protocol.Handshake{
+		PublicKey:       string(agent.Keys.Public),
+		ProtocolVersion: protocol.Version,
+		Schemes:         trsa.EncryptionSchemes,
+	})
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	for _, msg := range []protocol.Message{handshake, agentId} {
+		seed, err := json.Marshal(msg)
+		if err != nil {
+			f.Fatal(err.Error())
+		}
+		f.Add(seed)
+	}
+	f.Add([]byte(`{"status":"ok","event":"handshake","data":{"publicKey":1,"schemes":[1,"rsa-pss-sha256"],"session":{"publicKey":"00"}}}`))
+	f.Add([]byte(`{"status":"ok","event":"handshake","data":{"publicKey":"","protocolVersion":-1}}`))
+	f.Add([]byte(`{"status":"ok","event":"agentId","data":{"agentId":1}}`))
+	f.Add([]byte(`{"event":"agentInfo","data":true,"messageId":"1234"}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		msg, err := protocol.Parse(message)
+		if err != nil {
+			return
+		}
+		// Handlers must fail gracefully, no matter what the server sends
+		if msg.Event == protocol.EventContainerList {
+			return
+		}
+		a := &Agent{Keys: agent.Keys, ServerKeys: agent.ServerKeys}
+		a.handleMessage(msg, Logger{})
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// eventsRetryDelay is how long to wait before subscribing to Docker events again after an error
+const eventsRetryDelay = 10 * time.Second
+
+// Labels set by Docker Compose
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// containerInspector is the part of the Docker client the metadata cache uses
+type containerInspector interface {
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+}
+
+// metadataCache holds the metadata of the containers whose logs were shipped on the current
+// connection. A container is inspected once and its metadata published before the first log
+// batch referencing it, rename and restart events refresh it.
+type metadataCache struct {
+	publish func(meta protocol.ContainerMeta) error
+
+	mu      sync.Mutex
+	entries map[string]protocol.ContainerMeta
+}
+
+func newMetadataCache(publish func(meta protocol.ContainerMeta) error) *metadataCache {
+	return &metadataCache{
+		publish: publish,
+		entries: map[string]protocol.ContainerMeta{},
+	}
+}
+
+// Ref returns the reference to the current metadata of a container
+func (c *metadataCache) Ref(ctx context.Context, source containerInspector, containerId string) (string, error) {
+	c.mu.Lock()
+	meta, ok := c.entries[containerId]
+	c.mu.Unlock()
+	if ok {
+		return meta.Ref, nil
+	}
+
+	return c.refresh(ctx, source, containerId)
+}
+
+// Refresh inspects a referenced container again and publishes its metadata if it changed.
+// Containers that were never referenced are ignored.
+func (c *metadataCache) Refresh(ctx context.Context, source containerInspector, containerId string) error {
+	c.mu.Lock()
+	_, ok := c.entries[containerId]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	_, err := c.refresh(ctx, source, containerId)
+	return err
+}
+
+// Forget drops a container, the server keeps its published metadata
+func (c *metadataCache) Forget(containerId string) {
+	c.mu.Lock()
+	delete(c.entries, containerId)
+	c.mu.Unlock()
+}
+
+// HandleEvent updates the cache on a Docker container event
+func (c *metadataCache) HandleEvent(ctx context.Context, source containerInspector, event events.Message) error {
+	if event.Action == "destroy" {
+		c.Forget(event.Actor.ID)
+		return nil
+	}
+
+	return c.Refresh(ctx, source, event.Actor.ID)
+}
+
+func (c *metadataCache) refresh(ctx context.Context, source containerInspector, containerId string) (string, error) {
+	info, err := source.ContainerInspect(ctx, containerId)
+	if err != nil {
+		return "", err
+	}
+	meta := containerMetadata(info)
+
+	c.mu.Lock()
+	previous, ok := c.entries[containerId]
+	c.entries[containerId] = meta
+	c.mu.Unlock()
+
+	if ok && previous.Ref == meta.Ref {
+		return meta.Ref, nil
+	}
+	if err := c.publish(meta); err != nil {
+		// The server never got this version, publish it again on the next reference
+		c.Forget(containerId)
+		return "", err
+	}
+
+	return meta.Ref, nil
+}
+
+// containerMetadata extracts the metadata of an inspected container
+func containerMetadata(info types.ContainerJSON) protocol.ContainerMeta {
+	meta := protocol.ContainerMeta{}
+	if info.ContainerJSONBase != nil {
+		meta.ContainerId = info.ID
+		meta.Name = strings.TrimPrefix(info.Name, "/")
+		meta.ImageId = info.Image
+		meta.RestartCount = info.RestartCount
+		meta.CreatedAt, _ = time.Parse(time.RFC3339Nano, info.Created)
+		if info.State != nil {
+			meta.StartedAt, _ = time.Parse(time.RFC3339Nano, info.State.StartedAt)
+		}
+	}
+	if info.Config != nil {
+		meta.Image, meta.Tag = splitImage(info.Config.Image)
+		if len(info.Config.Labels) > 0 {
+			meta.Labels = info.Config.Labels
+		}
+		meta.ComposeProject = info.Config.Labels[composeProjectLabel]
+		meta.ComposeService = info.Config.Labels[composeServiceLabel]
+	}
+
+	meta.Ref = metadataRef(meta)
+	return meta
+}
+
+// metadataRef derives the reference of metadata from its content
+func metadataRef(meta protocol.ContainerMeta) string {
+	meta.Ref = ""
+	content, _ := json.Marshal(meta)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
+
+// splitImage splits an image reference into the image name and its tag.
+// Images referenced by digest have no tag, untagged images are "latest".
+func splitImage(reference string) (string, string) {
+	if reference == "" || strings.Contains(reference, "@") {
+		return reference, ""
+	}
+
+	// A colon before the last slash separates a registry port, not a tag
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		return reference[:i], reference[i+1:]
+	}
+	return reference, "latest"
+}
+
+// NewLogBatch builds a log batch of a container referencing its current metadata
+func (c *metadataCache) NewLogBatch(ctx context.Context, source containerInspector, containerId string, entries []protocol.LogEntry) (protocol.LogBatch, error) {
+	ref, err := c.Ref(ctx, source, containerId)
+	if err != nil {
+		return protocol.LogBatch{}, err
+	}
+
+	return protocol.LogBatch{
+		ContainerId: containerId,
+		MetaRef:     ref,
+		Entries:     entries,
+	}, nil
+}
+
+// startMetadataRefresh creates the metadata cache of the current connection, which publishes
+// metadata as containerMeta event, and keeps it up to date with the Docker events
+func (a *Agent) startMetadataRefresh(log Logger) {
+	// Bind the cache to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+	disconnected := a.disconnected
+
+	cache := newMetadataCache(func(meta protocol.ContainerMeta) error {
+		return a.writeSealed(conn, codec, protocol.EventContainerMeta, "", meta)
+	})
+	a.metadata = cache
+
+	go func() {
+		for {
+			err := followContainerEvents(cache, a.Runtime, disconnected)
+			if err == nil {
+				return
+			}
+			log.Debug("agent", "Docker events unavailable: "+err.Error())
+
+			select {
+			case <-disconnected:
+				return
+			case <-time.After(eventsRetryDelay):
+			}
+		}
+	}()
+}
+
+// followContainerEvents passes the runtime's events changing container metadata to the cache
+// until the connection ends
+func followContainerEvents(cache *metadataCache, runtime containerRuntime, disconnected <-chan struct{}) error {
+	cli, err := runtime.NewClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, errs := cli.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", "container"),
+			filters.Arg("event", "rename"),
+			filters.Arg("event", "restart"),
+			filters.Arg("event", "start"),
+			filters.Arg("event", "destroy"),
+		),
+	})
+
+	for {
+		select {
+		case <-disconnected:
+			return nil
+		case err := <-errs:
+			return err
+		case event := <-messages:
+			// A container may be gone by now, it is inspected again when referenced
+			_ = cache.HandleEvent(ctx, cli, event)
+		}
+	}
+}
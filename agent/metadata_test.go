@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+)
+
+// fakeInspector serves inspected containers from memory and counts the inspections
+type fakeInspector struct {
+	containers  map[string]types.ContainerJSON
+	inspections int
+}
+
+func (i *fakeInspector) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	i.inspections++
+	info, ok := i.containers[containerID]
+	if !ok {
+		return types.ContainerJSON{}, errors.New("no such container")
+	}
+	return info, nil
+}
+
+func inspectedContainer(id, name string, restartCount int) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:           id,
+			Name:         "/" + name,
+			Image:        "sha256:1234",
+			Created:      "2024-01-02T03:04:05.123456789Z",
+			RestartCount: restartCount,
+			State:        &types.ContainerState{StartedAt: "2024-01-02T03:04:06Z"},
+		},
+		Config: &container.Config{
+			Image: "registry:5000/shop/web:1.2",
+			Labels: map[string]string{
+				composeProjectLabel: "shop",
+				composeServiceLabel: "web",
+			},
+		},
+	}
+}
+
+func TestSplitImage(t *testing.T) {
+	tests := []struct {
+		reference, image, tag string
+	}{
+		{"nginx:1.25", "nginx", "1.25"},
+		{"nginx", "nginx", "latest"},
+		{"registry:5000/shop/web", "registry:5000/shop/web", "latest"},
+		{"registry:5000/shop/web:1.2", "registry:5000/shop/web", "1.2"},
+		{"nginx@sha256:abcd", "nginx@sha256:abcd", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		if image, tag := splitImage(test.reference); image != test.image || tag != test.tag {
+			t.Errorf("%q split into %q and %q", test.reference, image, tag)
+		}
+	}
+}
+
+func TestContainerMetadata(t *testing.T) {
+	meta := containerMetadata(inspectedContainer("abc", "shop-web-1", 2))
+
+	if meta.ContainerId != "abc" || meta.Name != "shop-web-1" || meta.ImageId != "sha256:1234" {
+		t.Fatal("unexpected identity", meta)
+	}
+	if meta.Image != "registry:5000/shop/web" || meta.Tag != "1.2" {
+		t.Fatal("unexpected image", meta.Image, meta.Tag)
+	}
+	if meta.ComposeProject != "shop" || meta.ComposeService != "web" || len(meta.Labels) != 2 {
+		t.Fatal("unexpected compose details", meta)
+	}
+	if meta.RestartCount != 2 {
+		t.Fatal("unexpected restart count", meta.RestartCount)
+	}
+	if !meta.CreatedAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)) || !meta.StartedAt.Equal(time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC)) {
+		t.Fatal("unexpected times", meta.CreatedAt, meta.StartedAt)
+	}
+	if meta.Ref == "" || meta.Ref != containerMetadata(inspectedContainer("abc", "shop-web-1", 2)).Ref {
+		t.Fatal("reference is not derived from the metadata", meta.Ref)
+	}
+	if meta.Ref == containerMetadata(inspectedContainer("abc", "shop-web-1", 3)).Ref {
+		t.Fatal("restart did not change the reference")
+	}
+
+	// Inspections of removed containers may lack details
+	if meta := containerMetadata(types.ContainerJSON{}); meta.Ref == "" {
+		t.Fatal("empty metadata has no reference")
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	source := &fakeInspector{containers: map[string]types.ContainerJSON{
+		"abc": inspectedContainer("abc", "web", 0),
+	}}
+	var published []protocol.ContainerMeta
+	var publishErr error
+	cache := newMetadataCache(func(meta protocol.ContainerMeta) error {
+		if publishErr != nil {
+			return publishErr
+		}
+		published = append(published, meta)
+		return nil
+	})
+	ctx := context.Background()
+
+	ref, err := cache.Ref(ctx, source, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cache.Ref(ctx, source, "abc"); again != ref || source.inspections != 1 || len(published) != 1 || published[0].Ref != ref {
+		t.Fatal("container not inspected and published once", source.inspections, published)
+	}
+	if _, err := cache.Ref(ctx, source, "gone"); err == nil {
+		t.Fatal("missing container referenced")
+	}
+
+	// Events about unchanged or unreferenced containers publish nothing
+	if err := cache.HandleEvent(ctx, source, events.Message{Action: "start", Actor: events.Actor{ID: "abc"}}); err != nil || len(published) != 1 {
+		t.Fatal("unchanged metadata published again", err, published)
+	}
+	source.containers["other"] = inspectedContainer("other", "db", 0)
+	if err := cache.HandleEvent(ctx, source, events.Message{Action: "rename", Actor: events.Actor{ID: "other"}}); err != nil || len(published) != 1 {
+		t.Fatal("unreferenced container published", err, published)
+	}
+
+	source.containers["abc"] = inspectedContainer("abc", "web-renamed", 0)
+	if err := cache.HandleEvent(ctx, source, events.Message{Action: "rename", Actor: events.Actor{ID: "abc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 2 || published[1].Name != "web-renamed" {
+		t.Fatal("renamed container not published", published)
+	}
+	if renamed, _ := cache.Ref(ctx, source, "abc"); renamed == ref || renamed != published[1].Ref {
+		t.Fatal("reference not updated", renamed)
+	}
+
+	// Destroyed containers are dropped, unpublished metadata is retried
+	cache.HandleEvent(ctx, source, events.Message{Action: "destroy", Actor: events.Actor{ID: "abc"}})
+	publishErr = errors.New("connection closed")
+	if _, err := cache.Ref(ctx, source, "abc"); err == nil {
+		t.Fatal("publish error ignored")
+	}
+	publishErr = nil
+	if _, err := cache.Ref(ctx, source, "abc"); err != nil || len(published) != 3 {
+		t.Fatal("metadata not published again", err, published)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+	"echoes/shared/trsa"
+
+	"github.com/gorilla/websocket"
+)
+
+// nodeServerResult is what testdata/nodeserver.js reports once it got an answer from the agent
+type nodeServerResult struct {
+	AgentId          int                   `json:"agentId"`
+	Session          bool                  `json:"session"`
+	EncryptionScheme trsa.Scheme           `json:"encryptionScheme"`
+	SignatureScheme  trsa.Scheme           `json:"signatureScheme"`
+	Capabilities     protocol.Capabilities `json:"capabilities"`
+	Status           string                `json:"status"`
+	Containers       bool                  `json:"containers"`
+}
+
+// startNodeServer serves the WebSocket handling of the Node server, run by testdata/nodeserver.js
+// with the given arguments, on a local port. The results channel is closed if the server stops without a result.
+// The test is skipped if node is not installed.
+func startNodeServer(t *testing.T, args ...string) (string, <-chan nodeServerResult) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+
+	results := make(chan nodeServerResult, 1)
+	handled := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		defer close(results)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		var stderr bytes.Buffer
+		cmd := exec.Command(node, append([]string{"testdata/nodeserver.js"}, args...)...)
+		cmd.Stderr = &stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() {
+			stdin.Close()
+			if err := cmd.Wait(); err != nil {
+				t.Errorf("node server failed: %v\n%s", err, stderr.String())
+			}
+		}()
+
+		// Relay the agent's frames to the server, one per line
+		go func() {
+			for {
+				_, frame, err := conn.ReadMessage()
+				if err != nil {
+					stdin.Close()
+					return
+				}
+				if _, err := stdin.Write(append(frame, '\n')); err != nil {
+					return
+				}
+			}
+		}()
+
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			var line struct {
+				Send   string            `json:"send"`
+				Close  bool              `json:"close"`
+				Result *nodeServerResult `json:"result"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Errorf("invalid line from the node server: %v", err)
+				return
+			}
+
+			switch {
+			case line.Result != nil:
+				results <- *line.Result
+				return
+			case line.Close:
+				t.Errorf("node server closed the connection\n%s", stderr.String())
+				return
+			default:
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(line.Send)); err != nil {
+					return
+				}
+			}
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	// The connection is hijacked, so closing the server does not wait for it
+	t.Cleanup(func() {
+		select {
+		case <-handled:
+		case <-time.After(10 * time.Second):
+			t.Error("node server connection is still open")
+		}
+	})
+	return strings.TrimPrefix(srv.URL, "http://"), results
+}
+
+// startFakeDocker serves an empty container list in place of the Docker API
+func startFakeDocker(t *testing.T) containerRuntime {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/containers/json") {
+			w.Write([]byte("[]"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "not implemented"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return containerRuntime{Name: runtimeDocker, Host: "tcp://" + strings.TrimPrefix(srv.URL, "http://")}
+}
+
+func TestAgentNodeServerHandshake(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts the node server")
+	}
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name    string
+		args    []string
+		session bool
+	}{
+		{"session", nil, true},
+		// Without session keys the payloads after agentId are compressed trsa streams
+		{"hybrid encryption", []string{"--no-session"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, results := startNodeServer(t, test.args...)
+
+			keys, err := trsa.GenerateKeypair(2048)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			agent := &Agent{Keys: keys, Token: "secret-token", Runtime: startFakeDocker(t)}
+			if !connectToServer(agent, Logger{}, addr) {
+				t.Fatal("agent could not connect to the node server")
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handleServerCommunication(agent, Logger{})
+			}()
+
+			var result nodeServerResult
+			select {
+			case r, ok := <-results:
+				if !ok {
+					t.Fatal("node server stopped without an answer from the agent")
+				}
+				result = r
+			case <-time.After(30 * time.Second):
+				t.Fatal("node server did not get an answer from the agent")
+			}
+
+			if result.AgentId != 1 {
+				t.Fatal("server authenticated agent", result.AgentId)
+			}
+			if result.Session != test.session {
+				t.Fatal("server set up session keys", result.Session)
+			}
+			if result.EncryptionScheme != trsa.SchemeOAEPSHA256 || result.SignatureScheme != trsa.SchemePSS {
+				t.Fatal("server uses schemes", result.EncryptionScheme, result.SignatureScheme)
+			}
+			if result.Status != "ok" || !result.Containers {
+				t.Fatal("server could not read the containerList reply", result.Status)
+			}
+
+			// The server closes the connection once it got its answer
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("agent did not stop after the server closed the connection")
+			}
+
+			if agent.Id != 1 {
+				t.Fatal("agent got id", agent.Id)
+			}
+			if (agent.Session != nil) != test.session {
+				t.Fatal("agent set up session keys", agent.Session != nil)
+			}
+			if agent.EncryptionScheme != trsa.SchemeOAEPSHA256 || agent.SignatureScheme != trsa.SchemePSS {
+				t.Fatal("agent picked schemes", agent.EncryptionScheme, agent.SignatureScheme)
+			}
+			for _, capability := range []protocol.Capability{
+				protocol.CapabilityHybridEncryption,
+				protocol.CapabilityCompression,
+				protocol.CapabilityLogStreaming,
+				protocol.CapabilityStats,
+			} {
+				if !agent.Capabilities.Has(capability) {
+					t.Fatal("server enabled capabilities", agent.Capabilities)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"echoes/shared/protocol"
+	"echoes/version"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpScope is the instrumentation scope of the logs and metrics the agent exports
+var otlpScope = &commonpb.InstrumentationScope{Name: "echoes-agent", Version: version.String()}
+
+// otlpExporter sends OTLP export requests over HTTP/protobuf or gRPC
+type otlpExporter struct {
+	headers map[string]string
+
+	// HTTP transport
+	baseURL string
+	client  *http.Client
+
+	// gRPC transport
+	conn    *grpc.ClientConn
+	logs    collogspb.LogsServiceClient
+	metrics colmetricspb.MetricsServiceClient
+}
+
+// newOTLPExporter creates an exporter from a spec like otlp+http://collector:4318 or
+// otlp+grpc://collector:4317. otlp+https and otlp+grpcs use TLS, trusting the PEM file in the
+// ca query parameter if there is one. The headers parameter, like headers=api-key=secret,x=y,
+// and credentials in the URL are sent with every request.
+func newOTLPExporter(u *url.URL) (*otlpExporter, error) {
+	if u.Host == "" {
+		return nil, errors.New("OTLP endpoint host is required")
+	}
+
+	query := u.Query()
+	e := &otlpExporter{headers: map[string]string{}}
+	for _, header := range strings.Split(query.Get("headers"), ",") {
+		if header == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(header, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, use name=value", header)
+		}
+		e.headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		e.headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+
+	var tlsConfig *tls.Config
+	switch u.Scheme {
+	case "otlp+https", "otlp+grpcs":
+		tlsConfig = &tls.Config{}
+		if ca := query.Get("ca"); ca != "" {
+			pem, err := os.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate in %s", ca)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	switch u.Scheme {
+	case "otlp+http", "otlp+https":
+		base := url.URL{Scheme: strings.TrimPrefix(u.Scheme, "otlp+"), Host: u.Host, Path: strings.TrimSuffix(u.Path, "/")}
+		e.baseURL = base.String()
+		e.client = &http.Client{Timeout: sinkWriteTimeout}
+		if tlsConfig != nil {
+			e.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		}
+	case "otlp+grpc", "otlp+grpcs":
+		creds := insecure.NewCredentials()
+		if tlsConfig != nil {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		e.conn = conn
+		e.logs = collogspb.NewLogsServiceClient(conn)
+		e.metrics = colmetricspb.NewMetricsServiceClient(conn)
+	default:
+		return nil, fmt.Errorf("unknown OTLP scheme %q", u.Scheme)
+	}
+	return e, nil
+}
+
+// ExportLogs sends a logs export request
+func (e *otlpExporter) ExportLogs(ctx context.Context, request *collogspb.ExportLogsServiceRequest) error {
+	if e.conn != nil {
+		_, err := e.logs.Export(e.outgoing(ctx), request)
+		return otlpGRPCError(err)
+	}
+	return e.post(ctx, "/v1/logs", request)
+}
+
+// ExportMetrics sends a metrics export request
+func (e *otlpExporter) ExportMetrics(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+	if e.conn != nil {
+		_, err := e.metrics.Export(e.outgoing(ctx), request)
+		return otlpGRPCError(err)
+	}
+	return e.post(ctx, "/v1/metrics", request)
+}
+
+// outgoing adds the headers to the metadata of a gRPC call
+func (e *otlpExporter) outgoing(ctx context.Context) context.Context {
+	for name, value := range e.headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(name), value)
+	}
+	return ctx
+}
+
+// post sends an export request with HTTP/protobuf
+func (e *otlpExporter) post(ctx context.Context, path string, request proto.Message) error {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkSinkResponse(resp)
+}
+
+// otlpGRPCError classifies a failed export as OTLP does: transient codes are retried, after
+// the delay the server asked for if it did, other codes mean the request was rejected
+func otlpGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	s := status.Convert(err)
+	switch s.Code() {
+	case codes.Canceled, codes.DeadlineExceeded, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return err
+	case codes.ResourceExhausted:
+		for _, detail := range s.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+				return &retryAfterError{after: info.RetryDelay.AsDuration(), err: err}
+			}
+		}
+		return err
+	default:
+		return permanent(err)
+	}
+}
+
+// Close releases the exporter's connections
+func (e *otlpExporter) Close() error {
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// otlpResource maps the metadata of a container of the runtime to resource attributes,
+// following the OpenTelemetry semantic conventions
+func otlpResource(meta protocol.ContainerMeta, hostname, runtime string) *resourcepb.Resource {
+	service := meta.ComposeService
+	if service == "" {
+		service = meta.Name
+	}
+
+	attributes := []*commonpb.KeyValue{
+		otlpString("container.id", meta.ContainerId),
+		otlpString("container.name", meta.Name),
+		otlpString("container.image.name", meta.Image),
+		otlpString("container.runtime", runtime),
+		otlpString("host.name", hostname),
+		otlpString("service.name", service),
+	}
+	if meta.Tag != "" {
+		tags := &commonpb.ArrayValue{Values: []*commonpb.AnyValue{{Value: &commonpb.AnyValue_StringValue{StringValue: meta.Tag}}}}
+		attributes = append(attributes, &commonpb.KeyValue{Key: "container.image.tags", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: tags}}})
+	}
+	if meta.ComposeProject != "" {
+		attributes = append(attributes, otlpString("service.namespace", meta.ComposeProject))
+	}
+	labels := make([]string, 0, len(meta.Labels))
+	for key := range meta.Labels {
+		labels = append(labels, key)
+	}
+	sort.Strings(labels)
+	for _, key := range labels {
+		attributes = append(attributes, otlpString("container.label."+key, meta.Labels[key]))
+	}
+	return &resourcepb.Resource{Attributes: attributes}
+}
+
+func otlpString(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// otlpStub is an OTLP collector stub serving HTTP/protobuf and gRPC, it records the export
+// requests and the header api-key they were sent with
+type otlpStub struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	mu      sync.Mutex
+	paths   []string
+	apiKeys []string
+	logs    []*collogspb.ExportLogsServiceRequest
+	metrics []*colmetricspb.ExportMetricsServiceRequest
+}
+
+func (s *otlpStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("Content-Type") != "application/x-protobuf" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, r.URL.Path)
+	s.apiKeys = append(s.apiKeys, r.Header.Get("api-key"))
+	switch r.URL.Path {
+	case "/otlp/v1/logs":
+		request := &collogspb.ExportLogsServiceRequest{}
+		proto.Unmarshal(body, request)
+		s.logs = append(s.logs, request)
+	case "/otlp/v1/metrics":
+		request := &colmetricspb.ExportMetricsServiceRequest{}
+		proto.Unmarshal(body, request)
+		s.metrics = append(s.metrics, request)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *otlpStub) Export(ctx context.Context, request *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys = append(s.apiKeys, strings.Join(md.Get("api-key"), ","))
+	s.logs = append(s.logs, request)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+// serveGRPC serves the stub's logs service on a local port
+func (s *otlpStub) serveGRPC(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(server, s)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().String()
+}
+
+// otlpAttributes returns the string attributes, array values joined with commas
+func otlpAttributes(attributes []*commonpb.KeyValue) map[string]string {
+	values := map[string]string{}
+	for _, attribute := range attributes {
+		if array := attribute.Value.GetArrayValue(); array != nil {
+			var items []string
+			for _, item := range array.Values {
+				items = append(items, item.GetStringValue())
+			}
+			values[attribute.Key] = strings.Join(items, ",")
+			continue
+		}
+		values[attribute.Key] = attribute.Value.GetStringValue()
+	}
+	return values
+}
+
+// checkOTLPLogs verifies the export request of otlpTestRecords
+func checkOTLPLogs(t *testing.T, request *collogspb.ExportLogsServiceRequest) {
+	t.Helper()
+
+	if len(request.ResourceLogs) != 2 {
+		t.Fatal("exported resources", request.ResourceLogs)
+	}
+	resource := otlpAttributes(request.ResourceLogs[0].Resource.Attributes)
+	expected := map[string]string{
+		"container.id":         "abc123",
+		"container.name":       "web",
+		"container.image.name": "nginx",
+		"container.image.tags": "1.25",
+		"container.runtime":    "docker",
+		"container.label.team": "shop",
+		"host.name":            "node1",
+		"service.name":         "frontend",
+		"service.namespace":    "shop",
+	}
+	for key, value := range expected {
+		if resource[key] != value {
+			t.Fatal("exported resource", resource)
+		}
+	}
+	if service := otlpAttributes(request.ResourceLogs[1].Resource.Attributes)["service.name"]; service != "db" {
+		t.Fatal("exported container without Compose service as", service)
+	}
+
+	scope := request.ResourceLogs[0].ScopeLogs[0]
+	if scope.Scope.Name != "echoes-agent" || len(scope.LogRecords) != 2 {
+		t.Fatal("exported scope", scope)
+	}
+	record := scope.LogRecords[1]
+	if record.Body.GetStringValue() != "b" || record.TimeUnixNano != uint64(testRecord("").Time.UnixNano()) || record.ObservedTimeUnixNano == 0 {
+		t.Fatal("exported record", record)
+	}
+	if stream := otlpAttributes(record.Attributes)["log.iostream"]; stream != "stderr" {
+		t.Fatal("exported record of stream", stream)
+	}
+	if record.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_ERROR || record.SeverityText != "ERROR" {
+		t.Fatal("exported stderr record with severity", record.SeverityNumber, record.SeverityText)
+	}
+	if stdout := scope.LogRecords[0]; stdout.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED || stdout.SeverityText != "" {
+		t.Fatal("exported stdout record with severity", stdout.SeverityNumber, stdout.SeverityText)
+	}
+}
+
+// otlpTestRecords are two records of a Compose container and one of another container
+func otlpTestRecords() []LogRecord {
+	web := testRecord("a")
+	web.Container.Tag = "1.25"
+	web.Container.ComposeProject = "shop"
+	web.Container.Labels = map[string]string{"team": "shop"}
+	stderr := web
+	stderr.Line = "b"
+	stderr.Stream = protocol.StreamStderr
+	db := testRecord("c")
+	db.Container.ContainerId = "def456"
+	db.Container.Name = "db"
+	db.Container.ComposeService = ""
+	return []LogRecord{web, db, stderr}
+}
+
+func TestOTLPSinkHTTP(t *testing.T) {
+	stub := &otlpStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	u, _ := url.Parse(strings.Replace(server.URL, "http://", "otlp+http://", 1) + "/otlp/?headers=api-key=secret")
+	sink, err := newOTLPSink(u, runtimeDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.hostname = "node1"
+
+	if err := sink.Write(context.Background(), otlpTestRecords()); err != nil {
+		t.Fatal(err)
+	}
+	if stub.paths[0] != "/otlp/v1/logs" || stub.apiKeys[0] != "secret" {
+		t.Fatal("exported to", stub.paths, "with", stub.apiKeys)
+	}
+	checkOTLPLogs(t, stub.logs[0])
+}
+
+func TestOTLPSinkGRPC(t *testing.T) {
+	stub := &otlpStub{}
+	address := stub.serveGRPC(t)
+
+	u, _ := url.Parse("otlp+grpc://" + address + "?headers=api-key=secret")
+	sink, err := newOTLPSink(u, runtimeDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.hostname = "node1"
+
+	if err := sink.Write(context.Background(), otlpTestRecords()); err != nil {
+		t.Fatal(err)
+	}
+	if stub.apiKeys[0] != "secret" {
+		t.Fatal("exported with", stub.apiKeys)
+	}
+	checkOTLPLogs(t, stub.logs[0])
+}
+
+func TestOTLPGRPCErrors(t *testing.T) {
+	if err := otlpGRPCError(status.Error(codes.Unavailable, "down")); err == nil || isPermanent(err) {
+		t.Fatal("unavailable collector returned", err)
+	}
+	if err := otlpGRPCError(status.Error(codes.InvalidArgument, "bad")); !isPermanent(err) {
+		t.Fatal("rejected export returned", err)
+	}
+
+	throttled, _ := status.New(codes.ResourceExhausted, "slow down").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(5 * time.Second)})
+	var retryAfter *retryAfterError
+	if err := otlpGRPCError(throttled.Err()); !errors.As(err, &retryAfter) || retryAfter.after != 5*time.Second {
+		t.Fatal("throttled export returned", err)
+	}
+}
+
+func TestOTLPExporterSpec(t *testing.T) {
+	for _, spec := range []string{"otlp+http://", "otlp+ftp://collector", "otlp+http://collector?headers=novalue"} {
+		u, _ := url.Parse(spec)
+		if _, err := newOTLPExporter(u); err == nil {
+			t.Fatal("accepted", spec)
+		}
+	}
+}
+
+// fakeStatsExportSource serves stats samples and inspections from memory
+type fakeStatsExportSource struct {
+	fakeStatsSource
+	fakeInspector
+}
+
+func TestStatsExporter(t *testing.T) {
+	stats := cpuSample(1_000, 10_000)
+	stats.Read = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	stats.MemoryStats.Usage = 1024
+	stats.BlkioStats.IoServiceBytesRecursive = []types.BlkioStatEntry{{Op: "Read", Value: 10}, {Op: "Write", Value: 20}}
+
+	source := &fakeStatsExportSource{
+		fakeStatsSource: fakeStatsSource{
+			containers: []types.Container{{ID: "web1", Names: []string{"/web"}}},
+			stats:      map[string]types.StatsJSON{"web1": stats},
+		},
+		fakeInspector: fakeInspector{containers: map[string]types.ContainerJSON{"web1": inspectedContainer("web1", "web", 0)}},
+	}
+
+	stub := &otlpStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	u, _ := url.Parse(strings.Replace(server.URL, "http://", "otlp+http://", 1) + "/otlp")
+	otlp, err := newOTLPExporter(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otlp.Close()
+
+	selector, _ := newContainerSelector([]string{"."})
+	exporter := newStatsExporter(selector, otlp, runtimePodman)
+	if err := exporter.Export(context.Background(), source); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := stub.metrics[0].ResourceMetrics[0]
+	if attributes := otlpAttributes(resource.Resource.Attributes); attributes["container.id"] != "web1" || attributes["service.name"] != "web" || attributes["service.namespace"] != "shop" || attributes["container.runtime"] != "podman" {
+		t.Fatal("exported resource", attributes)
+	}
+
+	metrics := map[string]int{}
+	for i, metric := range resource.ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = i
+	}
+	all := resource.ScopeMetrics[0].Metrics
+	memory := all[metrics["container.memory.usage.total"]].GetSum().DataPoints[0]
+	if memory.GetAsInt() != 1024 || memory.TimeUnixNano != uint64(stats.Read.UnixNano()) {
+		t.Fatal("exported memory usage", memory)
+	}
+	started := time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC)
+	blockio := all[metrics["container.blockio.io_service_bytes_recursive"]].GetSum()
+	if !blockio.IsMonotonic || len(blockio.DataPoints) != 2 || blockio.DataPoints[1].GetAsInt() != 20 || blockio.DataPoints[1].StartTimeUnixNano != uint64(started.UnixNano()) {
+		t.Fatal("exported block IO", blockio)
+	}
+	if operation := otlpAttributes(blockio.DataPoints[1].Attributes)["operation"]; operation != "write" {
+		t.Fatal("exported block IO of", operation)
+	}
+	if _, ok := metrics["container.cpu.utilization"]; !ok || len(all) != 8 {
+		t.Fatal("exported metrics", metrics)
+	}
+
+	// The metadata is kept while the container runs
+	source.fakeInspector.containers["web1"] = inspectedContainer("web1", "web", 5)
+	if err := exporter.Export(context.Background(), source); err != nil {
+		t.Fatal(err)
+	}
+	if exporter.metadata["web1"].RestartCount != 0 || source.inspections != 2 {
+		t.Fatal("running container got metadata", exporter.metadata["web1"], source.inspections)
+	}
+
+	// A restart is told by the new start time, even if the counters grew past the previous sample's
+	restarted := inspectedContainer("web1", "web", 1)
+	restarted.State.StartedAt = "2024-03-01T11:59:00Z"
+	source.fakeInspector.containers["web1"] = restarted
+	stats.BlkioStats.IoServiceBytesRecursive = []types.BlkioStatEntry{{Op: "Read", Value: 100}, {Op: "Write", Value: 200}}
+	source.fakeStatsSource.stats["web1"] = stats
+	if err := exporter.Export(context.Background(), source); err != nil {
+		t.Fatal(err)
+	}
+	if exporter.metadata["web1"].RestartCount != 1 || source.inspections != 3 {
+		t.Fatal("restarted container got metadata", exporter.metadata["web1"], source.inspections)
+	}
+	restartedAt := time.Date(2024, 3, 1, 11, 59, 0, 0, time.UTC)
+	for _, metric := range stub.metrics[2].ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if sum := metric.GetSum(); sum != nil && sum.DataPoints[0].StartTimeUnixNano != uint64(restartedAt.UnixNano()) {
+			t.Fatal("exported", metric.Name, "since", sum.DataPoints[0].StartTimeUnixNano)
+		}
+	}
+
+	// Containers are forgotten once they stop
+	source.fakeStatsSource.containers = nil
+	if err := exporter.Export(context.Background(), source); err != nil || len(exporter.metadata) != 0 || len(stub.metrics) != 3 {
+		t.Fatal("stopped container not forgotten", exporter.metadata, err)
+	}
+}
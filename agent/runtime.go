@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+)
+
+// Container runtimes the agent supports
+const (
+	runtimeDocker     = "docker"
+	runtimePodman     = "podman"
+	runtimeContainerd = "containerd"
+)
+
+const (
+	// defaultDockerSocket is where the Docker daemon listens unless DOCKER_HOST says otherwise
+	defaultDockerSocket = "/var/run/docker.sock"
+	// rootfulPodmanSocket is where the Podman service of root listens
+	rootfulPodmanSocket = "/run/podman/podman.sock"
+	// defaultContainerdSocket is where containerd listens
+	defaultContainerdSocket = "/run/containerd/containerd.sock"
+	// defaultContainerdNamespace is the namespace of the containers nerdctl and ctr run
+	defaultContainerdNamespace = "default"
+)
+
+// runtimeClient is the part of the Docker API the agent uses. Every runtime provides it, Podman
+// through its Docker compatible API and containerd through an adapter.
+type runtimeClient interface {
+	collectorSource
+	statsSource
+	containerController
+	execBackend
+	Info(ctx context.Context) (types.Info, error)
+	ServerVersion(ctx context.Context) (types.Version, error)
+	Close() error
+}
+
+// containerRuntime is the container engine the agent reads containers from. The zero value is
+// Docker as configured by the DOCKER_HOST environment variables.
+type containerRuntime struct {
+	// Name is docker, podman or containerd
+	Name string
+	// Host is the engine's address, like unix:///run/podman/podman.sock. Empty uses the
+	// runtime's default.
+	Host string
+	// Namespace is the containerd namespace the containers are read from
+	Namespace string
+}
+
+// newContainerRuntime selects a runtime by name, detecting it if the name is empty or auto
+func newContainerRuntime(name, host, namespace string) (containerRuntime, error) {
+	if namespace == "" {
+		namespace = defaultContainerdNamespace
+	}
+
+	switch name {
+	case "", "auto":
+		runtime := detectRuntime(os.Getenv, fileExists)
+		if host != "" {
+			runtime.Host = host
+		}
+		runtime.Namespace = namespace
+		return runtime, nil
+	case runtimeDocker, runtimePodman, runtimeContainerd:
+		runtime := containerRuntime{Name: name, Host: host, Namespace: namespace}
+		if runtime.Host == "" && name == runtimePodman {
+			runtime.Host = podmanHost(os.Getenv, fileExists)
+		}
+		return runtime, nil
+	default:
+		return containerRuntime{}, fmt.Errorf("unknown runtime %q, use docker, podman or containerd", name)
+	}
+}
+
+// detectRuntime picks the runtime whose socket exists. Docker is preferred, as configured by
+// DOCKER_HOST or at its default socket, then Podman, rootless before rootful, then containerd.
+// Without any socket it falls back to Docker.
+func detectRuntime(getenv func(string) string, exists func(string) bool) containerRuntime {
+	if getenv("DOCKER_HOST") != "" || exists(defaultDockerSocket) {
+		return containerRuntime{Name: runtimeDocker}
+	}
+	if host := podmanHost(getenv, exists); host != "" {
+		return containerRuntime{Name: runtimePodman, Host: host}
+	}
+	if exists(defaultContainerdSocket) {
+		return containerRuntime{Name: runtimeContainerd, Host: defaultContainerdSocket}
+	}
+	return containerRuntime{Name: runtimeDocker}
+}
+
+// podmanHost returns the address of the Podman socket, the rootless one in $XDG_RUNTIME_DIR
+// before the one of root. It is empty if neither exists.
+func podmanHost(getenv func(string) string, exists func(string) bool) string {
+	var sockets []string
+	if dir := getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	sockets = append(sockets, rootfulPodmanSocket)
+
+	for _, socket := range sockets {
+		if exists(socket) {
+			return "unix://" + socket
+		}
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// String describes the runtime in the agent's log
+func (r containerRuntime) String() string {
+	name := r.Name
+	if name == "" {
+		name = runtimeDocker
+	}
+	switch {
+	case name == runtimeContainerd:
+		return fmt.Sprintf("%s at %s, namespace %s", name, r.containerdSocket(), r.Namespace)
+	case r.Host != "":
+		return fmt.Sprintf("%s at %s", name, r.Host)
+	default:
+		return name
+	}
+}
+
+// SupportsExec reports whether exec sessions can be run in the runtime's containers
+func (r containerRuntime) SupportsExec() bool {
+	return r.Name != runtimeContainerd
+}
+
+// SupportsStats reports whether the runtime reports the resource usage of containers
+func (r containerRuntime) SupportsStats() bool {
+	return r.Name != runtimeContainerd
+}
+
+// NewClient connects to the runtime
+func (r containerRuntime) NewClient() (runtimeClient, error) {
+	switch r.Name {
+	case runtimePodman:
+		cli, err := client.NewClientWithOpts(client.WithHost(r.Host), client.WithAPIVersionNegotiation())
+		if err != nil {
+			return nil, err
+		}
+		return &podmanClient{Client: cli}, nil
+	case runtimeContainerd:
+		cli, err := newContainerdClient(r.containerdSocket(), r.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	default:
+		if r.Host != "" {
+			return client.NewClientWithOpts(client.FromEnv, client.WithHost(r.Host))
+		}
+		return client.NewClientWithOpts(client.FromEnv)
+	}
+}
+
+func (r containerRuntime) containerdSocket() string {
+	if r.Host == "" {
+		return defaultContainerdSocket
+	}
+	return r.Host
+}
+
+// podmanClient smooths over where Podman's Docker compatible API differs from Docker's
+type podmanClient struct {
+	*client.Client
+}
+
+// Events passes the events on as Docker reports them
+func (c *podmanClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	messages, errs := c.Client.Events(ctx, options)
+
+	normalized := make(chan events.Message)
+	go func() {
+		for {
+			select {
+			case message := <-messages:
+				select {
+				case normalized <- normalizePodmanEvent(message):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return normalized, errs
+}
+
+// normalizePodmanEvent fixes the differences of Podman's events: older versions report died
+// instead of die and leave the nanosecond time and type empty
+func normalizePodmanEvent(message events.Message) events.Message {
+	if message.Action == "died" {
+		message.Action = "die"
+		message.Status = "die"
+	}
+	if message.Type == "" {
+		message.Type = events.ContainerEventType
+	}
+	if message.TimeNano == 0 {
+		message.TimeNano = message.Time * 1e9
+	}
+	return message
+}
+
+// runtimeClient connects to the agent's container runtime
+func (a *Agent) runtimeClient() (runtimeClient, error) {
+	return a.Runtime.NewClient()
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	eventtypes "github.com/containerd/containerd/api/events"
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	// containerdStopInterval is how often a stopping task is checked for having exited
+	containerdStopInterval = 100 * time.Millisecond
+	// defaultContainerdStopTimeout is how long a task may take to exit after SIGTERM
+	defaultContainerdStopTimeout = 10
+)
+
+// Labels naming containerd containers, set by nerdctl and the Kubernetes CRI plugin
+const (
+	nerdctlNameLabel      = "nerdctl/name"
+	nerdctlStateDirLabel  = "nerdctl/state-dir"
+	kubernetesPodLabel    = "io.kubernetes.pod.name"
+	kubernetesNSLabel     = "io.kubernetes.pod.namespace"
+	kubernetesUIDLabel    = "io.kubernetes.pod.uid"
+	kubernetesNameLabel   = "io.kubernetes.container.name"
+	kubernetesPodLogsPath = "/var/log/pods"
+)
+
+// errRuntimeUnsupported is returned for operations the runtime can't perform
+var errRuntimeUnsupported = errors.New("not supported by the containerd runtime")
+
+// linuxSignals maps signal names to their Linux numbers, containerd runs Linux tasks
+var linuxSignals = map[string]uint32{
+	"HUP": 1, "INT": 2, "QUIT": 3, "KILL": 9, "USR1": 10, "USR2": 12, "TERM": 15, "CONT": 18, "STOP": 19, "WINCH": 28,
+}
+
+// containerdClient serves the part of the Docker API the agent uses from containerd.
+// Containers are read from a single namespace, their logs from the files their tasks write
+// to, see containerdLogFile. containerd doesn't keep resource usage or run exec sessions for
+// clients that don't manage the task's IO, so those aren't supported.
+type containerdClient struct {
+	conn       *grpc.ClientConn
+	namespace  string
+	containers containersapi.ContainersClient
+	tasks      tasksapi.TasksClient
+	events     eventsapi.EventsClient
+	version    versionapi.VersionClient
+	// podLogs is where the Kubernetes CRI plugin writes the logs of pods
+	podLogs string
+}
+
+func newContainerdClient(socket, namespace string) (*containerdClient, error) {
+	conn, err := grpc.Dial("unix://"+strings.TrimPrefix(socket, "unix://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &containerdClient{
+		conn:       conn,
+		namespace:  namespace,
+		containers: containersapi.NewContainersClient(conn),
+		tasks:      tasksapi.NewTasksClient(conn),
+		events:     eventsapi.NewEventsClient(conn),
+		version:    versionapi.NewVersionClient(conn),
+		podLogs:    kubernetesPodLogsPath,
+	}, nil
+}
+
+// withNamespace scopes a call to the client's namespace
+func (c *containerdClient) withNamespace(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "containerd-namespace", c.namespace)
+}
+
+// containerdName names a container like Docker would: by its nerdctl name, pod and container
+// name in Kubernetes, or its ID
+func containerdName(c *containersapi.Container) string {
+	if name := c.Labels[nerdctlNameLabel]; name != "" {
+		return name
+	}
+	if pod, name := c.Labels[kubernetesPodLabel], c.Labels[kubernetesNameLabel]; pod != "" && name != "" {
+		return pod + "/" + name
+	}
+	return c.ID
+}
+
+// containerdState maps a task status to a Docker container state. Containers without a task
+// were created but never started, or their task was deleted when it exited.
+func containerdState(process *task.Process) string {
+	if process == nil {
+		return "created"
+	}
+	switch process.Status {
+	case task.Status_RUNNING:
+		return "running"
+	case task.Status_PAUSED, task.Status_PAUSING:
+		return "paused"
+	case task.Status_STOPPED:
+		return "exited"
+	default:
+		return "created"
+	}
+}
+
+// processStartTime returns when a process started, from the proc filesystem. containerd
+// reports PIDs of the host's PID namespace, so the agent needs to share it (like --pid=host)
+// to find the process, otherwise no start time is known.
+func processStartTime(pid uint32) time.Time {
+	stat, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(int(pid)), "stat"))
+	if err != nil {
+		return time.Time{}
+	}
+	// The command in parentheses may contain spaces, the start time is the 22nd field
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 20 {
+		return time.Time{}
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	boot := readBootTime()
+	if boot.IsZero() {
+		return time.Time{}
+	}
+	// The kernel reports times in USER_HZ, 100 on all Linux platforms containerd supports
+	return boot.Add(time.Duration(ticks) * time.Second / 100)
+}
+
+// readBootTime returns when the host booted, from the proc filesystem
+func readBootTime() time.Time {
+	stat, err := os.ReadFile(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err == nil {
+				return time.Unix(seconds, 0)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// processes returns the tasks of the namespace by container
+func (c *containerdClient) processes(ctx context.Context) (map[string]*task.Process, error) {
+	resp, err := c.tasks.List(c.withNamespace(ctx), &tasksapi.ListTasksRequest{})
+	if err != nil {
+		return nil, err
+	}
+	processes := map[string]*task.Process{}
+	for _, process := range resp.Tasks {
+		processes[process.ContainerID] = process
+	}
+	return processes, nil
+}
+
+// process returns the task of a container, nil if it has none
+func (c *containerdClient) process(ctx context.Context, containerId string) (*task.Process, error) {
+	resp, err := c.tasks.Get(c.withNamespace(ctx), &tasksapi.GetRequest{ContainerID: containerId})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Process, nil
+}
+
+func (c *containerdClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	resp, err := c.containers.List(c.withNamespace(ctx), &containersapi.ListContainersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	processes, err := c.processes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []types.Container{}
+	for _, info := range resp.Containers {
+		state := containerdState(processes[info.ID])
+		if state != "running" && !options.All {
+			continue
+		}
+		listed := types.Container{
+			ID:      info.ID,
+			Names:   []string{"/" + containerdName(info)},
+			Image:   info.Image,
+			ImageID: info.Image,
+			Labels:  info.Labels,
+			State:   state,
+			Status:  state,
+		}
+		if info.CreatedAt != nil {
+			listed.Created = info.CreatedAt.AsTime().Unix()
+		}
+		containers = append(containers, listed)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Created > containers[j].Created })
+	return containers, nil
+}
+
+func (c *containerdClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	resp, err := c.containers.Get(c.withNamespace(ctx), &containersapi.GetContainerRequest{ID: containerID})
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	process, err := c.process(ctx, containerID)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	return containerdInspect(resp.Container, process), nil
+}
+
+// containerdInspect describes a container and its task like Docker's inspect does
+func containerdInspect(info *containersapi.Container, process *task.Process) types.ContainerJSON {
+	state := &types.ContainerState{Status: containerdState(process)}
+	if process != nil {
+		state.Running = process.Status == task.Status_RUNNING
+		state.Paused = process.Status == task.Status_PAUSED
+		state.Pid = int(process.Pid)
+		state.ExitCode = int(process.ExitStatus)
+		if started := processStartTime(process.Pid); process.Pid > 0 && !started.IsZero() {
+			state.StartedAt = started.UTC().Format(time.RFC3339Nano)
+		}
+		if process.ExitedAt != nil && process.Status == task.Status_STOPPED {
+			state.FinishedAt = process.ExitedAt.AsTime().Format(time.RFC3339Nano)
+		}
+	}
+
+	inspected := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    info.ID,
+			Name:  "/" + containerdName(info),
+			Image: info.Image,
+			State: state,
+		},
+		Config: &container.Config{Image: info.Image, Labels: info.Labels},
+	}
+	if info.CreatedAt != nil {
+		inspected.Created = info.CreatedAt.AsTime().Format(time.RFC3339Nano)
+	}
+	return inspected
+}
+
+func (c *containerdClient) ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	resp, err := c.containers.Get(c.withNamespace(ctx), &containersapi.GetContainerRequest{ID: containerID})
+	if err != nil {
+		return nil, err
+	}
+	process, err := c.process(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	path, format, err := containerdLogFile(resp.Container, process, c.podLogs)
+	if err != nil {
+		return nil, err
+	}
+	running := func() bool {
+		process, err := c.process(ctx, containerID)
+		return err == nil && process != nil && process.Status != task.Status_STOPPED
+	}
+	return readLogFile(ctx, path, format, options, running)
+}
+
+// Events maps the task and container events of containerd to Docker container events.
+// containerd doesn't keep past events, so Since and Until are ignored.
+func (c *containerdClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+
+	go func() {
+		stream, err := c.events.Subscribe(ctx, &eventsapi.SubscribeRequest{
+			Filters: []string{`namespace==` + c.namespace + `,topic~="^/tasks/"`, `namespace==` + c.namespace + `,topic~="^/containers/"`},
+		})
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for {
+			envelope, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			message, ok := containerdEvent(envelope)
+			if !ok {
+				continue
+			}
+			c.describeActor(ctx, &message)
+			if !containerdEventMatches(options.Filters, message) {
+				continue
+			}
+
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return messages, errs
+}
+
+// describeActor adds the name, image and labels of the event's container to its attributes,
+// if the container still exists
+func (c *containerdClient) describeActor(ctx context.Context, message *events.Message) {
+	resp, err := c.containers.Get(c.withNamespace(ctx), &containersapi.GetContainerRequest{ID: message.Actor.ID})
+	if err != nil {
+		return
+	}
+	for key, value := range resp.Container.Labels {
+		message.Actor.Attributes[key] = value
+	}
+	message.Actor.Attributes["name"] = containerdName(resp.Container)
+	message.Actor.Attributes["image"] = resp.Container.Image
+	message.From = resp.Container.Image
+}
+
+// containerdEvent maps an event of containerd to a Docker container event. Events about exec
+// processes and other objects are skipped.
+func containerdEvent(envelope *eventsapi.Envelope) (events.Message, bool) {
+	if envelope.Event == nil {
+		return events.Message{}, false
+	}
+
+	var action, containerId string
+	attributes := map[string]string{}
+	decode := func(event proto.Message) bool {
+		return proto.Unmarshal(envelope.Event.Value, event) == nil
+	}
+
+	switch envelope.Topic {
+	case "/tasks/start":
+		event := &eventtypes.TaskStart{}
+		if !decode(event) {
+			return events.Message{}, false
+		}
+		action, containerId = "start", event.ContainerID
+	case "/tasks/exit":
+		event := &eventtypes.TaskExit{}
+		if !decode(event) || (event.ID != "" && event.ID != event.ContainerID) {
+			return events.Message{}, false
+		}
+		action, containerId = "die", event.ContainerID
+		attributes["exitCode"] = strconv.Itoa(int(event.ExitStatus))
+	case "/tasks/oom":
+		event := &eventtypes.TaskOOM{}
+		if !decode(event) {
+			return events.Message{}, false
+		}
+		action, containerId = "oom", event.ContainerID
+	case "/tasks/paused":
+		event := &eventtypes.TaskPaused{}
+		if !decode(event) {
+			return events.Message{}, false
+		}
+		action, containerId = "pause", event.ContainerID
+	case "/tasks/resumed":
+		event := &eventtypes.TaskResumed{}
+		if !decode(event) {
+			return events.Message{}, false
+		}
+		action, containerId = "unpause", event.ContainerID
+	case "/containers/create":
+		event := &eventtypes.ContainerCreate{}
+		if !decode(event) {
+			return events.Message{}, false
+		}
+		action, containerId = "create", event.ID
+		attributes["image"] = event.Image
+	case "/containers/update":
+		event := &eventtypes.ContainerUpdate{}
+		if !decode(event) {
+			return events.Message{}, false
+		}
+		action, containerId = "update", event.ID
+	case "/containers/delete":
+		event := &eventtypes.ContainerDelete{}
+		if !decode(event) {
+			return events.Message{}, false
+		}
+		action, containerId = "destroy", event.ID
+	default:
+		return events.Message{}, false
+	}
+
+	at := time.Now()
+	if envelope.Timestamp != nil {
+		at = envelope.Timestamp.AsTime()
+	}
+	return events.Message{
+		Status:   action,
+		ID:       containerId,
+		Type:     events.ContainerEventType,
+		Action:   action,
+		Actor:    events.Actor{ID: containerId, Attributes: attributes},
+		Scope:    "local",
+		Time:     at.Unix(),
+		TimeNano: at.UnixNano(),
+	}, true
+}
+
+// containerdEventMatches applies Docker event filters to a container event. Filters on other
+// objects, like networks or volumes, never match.
+func containerdEventMatches(args filters.Args, message events.Message) bool {
+	for _, key := range args.Keys() {
+		var match bool
+		switch key {
+		case "type":
+			match = args.ExactMatch(key, string(message.Type))
+		case "event":
+			match = args.ExactMatch(key, string(message.Action))
+		case "container":
+			match = args.ExactMatch(key, message.Actor.ID) || args.ExactMatch(key, message.Actor.Attributes["name"])
+		case "image":
+			match = args.ExactMatch(key, message.Actor.Attributes["image"])
+		case "label":
+			match = args.MatchKVList(key, message.Actor.Attributes)
+		case "scope":
+			match = args.ExactMatch(key, message.Scope)
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLinuxSignal parses a signal like SIGTERM, TERM or 15
+func parseLinuxSignal(signal string) (uint32, error) {
+	if n, err := strconv.ParseUint(signal, 10, 32); err == nil && n > 0 && n < 65 {
+		return uint32(n), nil
+	}
+	if n, ok := linuxSignals[strings.TrimPrefix(strings.ToUpper(signal), "SIG")]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", signal)
+}
+
+// kill signals the task's init process like Docker does, the other processes of the container
+// end with it
+func (c *containerdClient) kill(ctx context.Context, containerID string, signal uint32) error {
+	_, err := c.tasks.Kill(c.withNamespace(ctx), &tasksapi.KillRequest{ContainerID: containerID, Signal: signal})
+	return err
+}
+
+func (c *containerdClient) ContainerKill(ctx context.Context, containerID, signal string) error {
+	if signal == "" {
+		signal = "KILL"
+	}
+	n, err := parseLinuxSignal(signal)
+	if err != nil {
+		return err
+	}
+	return c.kill(ctx, containerID, n)
+}
+
+// ContainerStop signals the task like Docker does: SIGTERM, or the requested signal, then
+// SIGKILL if it didn't exit within the timeout
+func (c *containerdClient) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	signal := uint32(linuxSignals["TERM"])
+	if options.Signal != "" {
+		n, err := parseLinuxSignal(options.Signal)
+		if err != nil {
+			return err
+		}
+		signal = n
+	}
+	timeout := defaultContainerdStopTimeout
+	if options.Timeout != nil {
+		timeout = *options.Timeout
+	}
+
+	if err := c.kill(ctx, containerID, signal); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for time.Now().Before(deadline) {
+		process, err := c.process(ctx, containerID)
+		if err != nil {
+			return err
+		}
+		if process == nil || process.Status == task.Status_STOPPED {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(containerdStopInterval):
+		}
+	}
+	return c.kill(ctx, containerID, linuxSignals["KILL"])
+}
+
+func (c *containerdClient) ContainerPause(ctx context.Context, containerID string) error {
+	_, err := c.tasks.Pause(c.withNamespace(ctx), &tasksapi.PauseTaskRequest{ContainerID: containerID})
+	return err
+}
+
+func (c *containerdClient) ContainerUnpause(ctx context.Context, containerID string) error {
+	_, err := c.tasks.Resume(c.withNamespace(ctx), &tasksapi.ResumeTaskRequest{ContainerID: containerID})
+	return err
+}
+
+// ContainerStart isn't supported, the task's IO is set up by whoever created the container
+func (c *containerdClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return fmt.Errorf("start %w", errRuntimeUnsupported)
+}
+
+// ContainerRestart isn't supported, see ContainerStart
+func (c *containerdClient) ContainerRestart(ctx context.Context, containerID string, options container.StopOptions) error {
+	return fmt.Errorf("restart %w", errRuntimeUnsupported)
+}
+
+func (c *containerdClient) ContainerStatsOneShot(ctx context.Context, containerID string) (types.ContainerStats, error) {
+	return types.ContainerStats{}, fmt.Errorf("stats %w", errRuntimeUnsupported)
+}
+
+func (c *containerdClient) ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error) {
+	return types.IDResponse{}, fmt.Errorf("exec %w", errRuntimeUnsupported)
+}
+
+func (c *containerdClient) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	return types.HijackedResponse{}, fmt.Errorf("exec %w", errRuntimeUnsupported)
+}
+
+func (c *containerdClient) ContainerExecResize(ctx context.Context, execID string, options types.ResizeOptions) error {
+	return fmt.Errorf("exec %w", errRuntimeUnsupported)
+}
+
+func (c *containerdClient) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	return types.ContainerExecInspect{}, fmt.Errorf("exec %w", errRuntimeUnsupported)
+}
+
+// Info reports the containers of the namespace, containerd has no details of the host
+func (c *containerdClient) Info(ctx context.Context) (types.Info, error) {
+	containers, err := c.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return types.Info{}, err
+	}
+	info := types.Info{Containers: len(containers)}
+	for _, listed := range containers {
+		switch listed.State {
+		case "running":
+			info.ContainersRunning++
+		case "paused":
+			info.ContainersPaused++
+		default:
+			info.ContainersStopped++
+		}
+	}
+	return info, nil
+}
+
+func (c *containerdClient) ServerVersion(ctx context.Context) (types.Version, error) {
+	resp, err := c.version.Version(ctx, &emptypb.Empty{})
+	if err != nil {
+		return types.Version{}, err
+	}
+	return types.Version{Version: resp.Version, GitCommit: resp.Revision}, nil
+}
+
+func (c *containerdClient) Close() error {
+	return c.conn.Close()
+}
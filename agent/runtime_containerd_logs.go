@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"echoes/shared/protocol"
+
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Formats of the log files containerd tasks write to
+const (
+	// logFormatJSON is the json-file format of Docker, used by nerdctl
+	logFormatJSON = "json"
+	// logFormatCRI is the format the Kubernetes CRI plugin writes pod logs in
+	logFormatCRI = "cri"
+	// logFormatRaw is the output of the task as is, without streams or times, see containerdLogFile
+	logFormatRaw = "raw"
+)
+
+// containerdLogPollInterval is how often a followed log file is checked for new lines
+var containerdLogPollInterval = 250 * time.Millisecond
+
+var (
+	// errNoLogFile is returned for containers whose output isn't written to a file
+	errNoLogFile = errors.New("container output isn't written to a log file")
+	// errRawStderr is returned when only stderr is requested from a raw file, which doesn't tell the streams apart
+	errRawStderr = errors.New("container output is written to a file without streams, stderr can't be read on its own")
+)
+
+// containerdLogFile finds the file the output of a container is written to, and its format.
+// nerdctl writes json-file logs in its state directory, the Kubernetes CRI plugin writes
+// a file per container restart below podLogs, and ctr can write the output to a file. Raw
+// files are read from the task's stdout, their lines are all reported as stdout: ctr writes
+// both streams to the same file, and a separate stderr file isn't read.
+func containerdLogFile(info *containersapi.Container, process *task.Process, podLogs string) (string, string, error) {
+	if dir := info.Labels[nerdctlStateDirLabel]; dir != "" {
+		return filepath.Join(dir, info.ID+"-json.log"), logFormatJSON, nil
+	}
+
+	namespace, pod, uid, name := info.Labels[kubernetesNSLabel], info.Labels[kubernetesPodLabel], info.Labels[kubernetesUIDLabel], info.Labels[kubernetesNameLabel]
+	if namespace != "" && pod != "" && uid != "" && name != "" {
+		files, _ := filepath.Glob(filepath.Join(podLogs, namespace+"_"+pod+"_"+uid, name, "*.log"))
+		if len(files) == 0 {
+			return "", "", errNoLogFile
+		}
+		// Files are named by restart count, the last one belongs to the current task
+		sort.Slice(files, func(i, j int) bool { return restartCount(files[i]) < restartCount(files[j]) })
+		return files[len(files)-1], logFormatCRI, nil
+	}
+
+	if process != nil {
+		if path, ok := strings.CutPrefix(process.Stdout, "file://"); ok {
+			return path, logFormatRaw, nil
+		}
+	}
+	return "", "", errNoLogFile
+}
+
+// restartCount returns the restart count a CRI log file is named by
+func restartCount(path string) int {
+	count, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".log"))
+	return count
+}
+
+// logFileLine is a line of a log file. Raw lines have no stream or time.
+type logFileLine struct {
+	stream string
+	time   time.Time
+	line   string
+}
+
+// logFileParser parses the lines of a log file, it returns false for lines that are incomplete
+// or invalid
+type logFileParser func(line string) (logFileLine, bool)
+
+// newLogFileParser returns a parser for a log format
+func newLogFileParser(format string) logFileParser {
+	switch format {
+	case logFormatJSON:
+		return parseJSONLogLine
+	case logFormatCRI:
+		// Long lines are split in partial lines, they're joined until the full one
+		var partial strings.Builder
+		return func(line string) (logFileLine, bool) {
+			parsed, full, ok := parseCRILogLine(line)
+			if !ok {
+				return logFileLine{}, false
+			}
+			partial.WriteString(parsed.line)
+			if !full {
+				return logFileLine{}, false
+			}
+			parsed.line = partial.String()
+			partial.Reset()
+			return parsed, true
+		}
+	default:
+		return func(line string) (logFileLine, bool) {
+			return logFileLine{stream: protocol.StreamStdout, line: line}, true
+		}
+	}
+}
+
+// parseJSONLogLine parses a line like {"log":"hello\n","stream":"stdout","time":"..."}
+func parseJSONLogLine(line string) (logFileLine, bool) {
+	var entry struct {
+		Log    string    `json:"log"`
+		Stream string    `json:"stream"`
+		Time   time.Time `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return logFileLine{}, false
+	}
+	return logFileLine{stream: entry.Stream, time: entry.Time, line: strings.TrimSuffix(entry.Log, "\n")}, true
+}
+
+// parseCRILogLine parses a line like 2024-03-01T12:00:00.123456789Z stdout F hello, where P
+// instead of F marks a partial line
+func parseCRILogLine(line string) (logFileLine, bool, bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return logFileLine{}, false, false
+	}
+	at, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return logFileLine{}, false, false
+	}
+	parsed := logFileLine{stream: fields[1], time: at}
+	if len(fields) == 4 {
+		parsed.line = fields[3]
+	}
+	return parsed, fields[2] != "P", true
+}
+
+// parseLogsTime parses the Since and Until options of the Docker logs API, RFC 3339 times or
+// Unix timestamps
+func parseLogsTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if at, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return at, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Unix(0, int64(seconds*1e9)), nil
+}
+
+// logFileReader reads a log file like the Docker logs API returns logs, multiplexed in
+// frames per stream
+type logFileReader struct {
+	path    string
+	options types.ContainerLogsOptions
+	since   time.Time
+	until   time.Time
+	tail    int
+	parse   logFileParser
+	// running reports whether the container still runs, following ends once it doesn't
+	running func() bool
+}
+
+// readLogFile streams a log file with the options of the Docker logs API. Lines without a
+// time, of raw files, are stamped with the time they're read and never skipped by Since.
+// Raw files have no streams, so requests for stderr alone are refused.
+func readLogFile(ctx context.Context, path, format string, options types.ContainerLogsOptions, running func() bool) (io.ReadCloser, error) {
+	since, err := parseLogsTime(options.Since)
+	if err != nil {
+		return nil, err
+	}
+	until, err := parseLogsTime(options.Until)
+	if err != nil {
+		return nil, err
+	}
+	tail := -1
+	if options.Tail != "" && options.Tail != "all" {
+		if tail, err = strconv.Atoi(options.Tail); err != nil || tail < 0 {
+			return nil, fmt.Errorf("invalid tail %q", options.Tail)
+		}
+	}
+
+	if format == logFormatRaw && !options.ShowStdout && options.ShowStderr {
+		return nil, errRawStderr
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &logFileReader{path: path, options: options, since: since, until: until, tail: tail, parse: newLogFileParser(format), running: running}
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		pw.CloseWithError(reader.copy(ctx, file, pw))
+	}()
+	return &cancelReadCloser{ReadCloser: pr, cancel: cancel}, nil
+}
+
+// copy writes the selected lines of the file to w, then follows it if requested. It closes the
+// file, and the files it reopens when the log is rotated.
+func (r *logFileReader) copy(ctx context.Context, file *os.File, w io.Writer) error {
+	defer func() { file.Close() }()
+
+	stdout := stdcopy.NewStdWriter(w, stdcopy.Stdout)
+	stderr := stdcopy.NewStdWriter(w, stdcopy.Stderr)
+	write := func(line logFileLine) error {
+		if (line.stream == protocol.StreamStderr && !r.options.ShowStderr) || (line.stream != protocol.StreamStderr && !r.options.ShowStdout) {
+			return nil
+		}
+		out := stdout
+		if line.stream == protocol.StreamStderr {
+			out = stderr
+		}
+		text := line.line + "\n"
+		if r.options.Timestamps {
+			at := line.time
+			if at.IsZero() {
+				at = time.Now()
+			}
+			text = at.UTC().Format(time.RFC3339Nano) + " " + text
+		}
+		_, err := io.WriteString(out, text)
+		return err
+	}
+
+	// The lines written so far, only the last ones are written with Tail
+	var tailed []logFileLine
+	add := func(text string) error {
+		line, ok := r.selected(text)
+		if !ok {
+			return nil
+		}
+		if r.tail < 0 {
+			return write(line)
+		}
+		tailed = append(tailed, line)
+		if len(tailed) > r.tail {
+			tailed = tailed[1:]
+		}
+		return nil
+	}
+	reader := bufio.NewReader(file)
+	var pending string
+	for {
+		chunk, err := reader.ReadString('\n')
+		pending += chunk
+		if err == io.EOF {
+			// The last line may lack its newline, only a running container followed may still finish it
+			if pending != "" && (!r.options.Follow || !r.running()) {
+				if err := add(pending); err != nil {
+					return err
+				}
+				pending = ""
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := add(strings.TrimSuffix(pending, "\n")); err != nil {
+			return err
+		}
+		pending = ""
+	}
+	for _, line := range tailed {
+		if err := write(line); err != nil {
+			return err
+		}
+	}
+	if !r.options.Follow {
+		return nil
+	}
+
+	// New lines are written as they're appended, a partial line is kept until it's complete
+	for {
+		chunk, err := reader.ReadString('\n')
+		pending += chunk
+		if err == nil {
+			line, ok := r.selected(strings.TrimSuffix(pending, "\n"))
+			pending = ""
+			if ok {
+				if err := write(line); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+
+		// A rotated or truncated log continues at the start of the file at path
+		if r.rotated(file) {
+			if reopened, err := os.Open(r.path); err == nil {
+				file.Close()
+				file = reopened
+				reader.Reset(file)
+				pending = ""
+				continue
+			}
+		}
+
+		if !r.running() {
+			// The container stopped, its last line stays without newline
+			if pending == "" {
+				return nil
+			}
+			if line, ok := r.selected(pending); ok {
+				return write(line)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(containerdLogPollInterval):
+		}
+	}
+}
+
+// rotated reports whether the file at the reader's path was replaced by another one, or
+// truncated below the part of file that was read
+func (r *logFileReader) rotated(file *os.File) bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	current, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	if !os.SameFile(info, current) {
+		return true
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	return err == nil && info.Size() < offset
+}
+
+// selected parses a line and reports whether it's within Since and Until
+func (r *logFileReader) selected(text string) (logFileLine, bool) {
+	line, ok := r.parse(text)
+	if !ok {
+		return line, false
+	}
+	if !line.time.IsZero() {
+		if !r.since.IsZero() && line.time.Before(r.since) {
+			return line, false
+		}
+		if !r.until.IsZero() && line.time.After(r.until) {
+			return line, false
+		}
+	}
+	return line, true
+}
+
+// cancelReadCloser cancels a context when it's closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	c.cancel()
+	return c.ReadCloser.Close()
+}
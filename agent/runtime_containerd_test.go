@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+
+	eventtypes "github.com/containerd/containerd/api/events"
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// containerdStub serves the containerd services the agent uses from memory, the tasks
+// service through tasksService. Killed tasks stop, events are streamed from the events channel.
+type containerdStub struct {
+	containersapi.UnimplementedContainersServer
+	eventsapi.UnimplementedEventsServer
+	versionapi.UnimplementedVersionServer
+
+	mu         sync.Mutex
+	containers []*containersapi.Container
+	tasks      map[string]*task.Process
+	namespaces []string
+	signals    []uint32
+	killedAll  bool
+	events     chan *eventsapi.Envelope
+}
+
+func (s *containerdStub) namespace(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.namespaces = append(s.namespaces, strings.Join(md.Get("containerd-namespace"), ","))
+}
+
+func (s *containerdStub) Get(ctx context.Context, req *containersapi.GetContainerRequest) (*containersapi.GetContainerResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.namespace(ctx)
+	for _, c := range s.containers {
+		if c.ID == req.ID {
+			return &containersapi.GetContainerResponse{Container: c}, nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "container not found")
+}
+
+func (s *containerdStub) List(ctx context.Context, req *containersapi.ListContainersRequest) (*containersapi.ListContainersResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.namespace(ctx)
+	return &containersapi.ListContainersResponse{Containers: s.containers}, nil
+}
+
+func (s *containerdStub) ListTasks(ctx context.Context, req *tasksapi.ListTasksRequest) (*tasksapi.ListTasksResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &tasksapi.ListTasksResponse{}
+	for _, process := range s.tasks {
+		resp.Tasks = append(resp.Tasks, process)
+	}
+	return resp, nil
+}
+
+func (s *containerdStub) GetTask(ctx context.Context, req *tasksapi.GetRequest) (*tasksapi.GetResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if process, ok := s.tasks[req.ContainerID]; ok {
+		return &tasksapi.GetResponse{Process: process}, nil
+	}
+	return nil, status.Error(codes.NotFound, "no running task found")
+}
+
+func (s *containerdStub) Kill(ctx context.Context, req *tasksapi.KillRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signals = append(s.signals, req.Signal)
+	s.killedAll = s.killedAll || req.All
+	s.tasks[req.ContainerID].Status = task.Status_STOPPED
+	return &emptypb.Empty{}, nil
+}
+
+func (s *containerdStub) Pause(ctx context.Context, req *tasksapi.PauseTaskRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[req.ContainerID].Status = task.Status_PAUSED
+	return &emptypb.Empty{}, nil
+}
+
+func (s *containerdStub) Subscribe(req *eventsapi.SubscribeRequest, stream eventsapi.Events_SubscribeServer) error {
+	for envelope := range s.events {
+		if err := stream.Send(envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *containerdStub) Version(ctx context.Context, req *emptypb.Empty) (*versionapi.VersionResponse, error) {
+	return &versionapi.VersionResponse{Version: "v1.7.19", Revision: "abc"}, nil
+}
+
+// tasksService serves the task methods of the stub, whose names clash with those of containers
+type tasksService struct {
+	tasksapi.UnimplementedTasksServer
+	stub *containerdStub
+}
+
+func (s tasksService) List(ctx context.Context, req *tasksapi.ListTasksRequest) (*tasksapi.ListTasksResponse, error) {
+	return s.stub.ListTasks(ctx, req)
+}
+
+func (s tasksService) Get(ctx context.Context, req *tasksapi.GetRequest) (*tasksapi.GetResponse, error) {
+	return s.stub.GetTask(ctx, req)
+}
+
+func (s tasksService) Kill(ctx context.Context, req *tasksapi.KillRequest) (*emptypb.Empty, error) {
+	return s.stub.Kill(ctx, req)
+}
+
+func (s tasksService) Pause(ctx context.Context, req *tasksapi.PauseTaskRequest) (*emptypb.Empty, error) {
+	return s.stub.Pause(ctx, req)
+}
+
+func newContainerdStub() *containerdStub {
+	created := timestamppb.New(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	return &containerdStub{
+		containers: []*containersapi.Container{
+			{ID: "web1", Image: "docker.io/library/nginx:1.25", Labels: map[string]string{nerdctlNameLabel: "web", "team": "shop"}, CreatedAt: created},
+			{ID: "pod1", Image: "registry.k8s.io/pause:3.9", Labels: map[string]string{kubernetesPodLabel: "api-7d9", kubernetesNameLabel: "api"}, CreatedAt: created},
+			{ID: "job1", Image: "docker.io/library/busybox:latest"},
+		},
+		tasks: map[string]*task.Process{
+			"web1": {ContainerID: "web1", Status: task.Status_RUNNING},
+			"pod1": {ContainerID: "pod1", Status: task.Status_STOPPED, ExitStatus: 137, ExitedAt: created},
+		},
+		events: make(chan *eventsapi.Envelope, 10),
+	}
+}
+
+func newTestContainerdClient(t *testing.T, stub *containerdStub) *containerdClient {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "containerd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	containersapi.RegisterContainersServer(server, stub)
+	tasksapi.RegisterTasksServer(server, tasksService{stub: stub})
+	eventsapi.RegisterEventsServer(server, stub)
+	versionapi.RegisterVersionServer(server, stub)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	cli, err := newContainerdClient(socket, "k8s.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func TestContainerdClientContainers(t *testing.T) {
+	stub := newContainerdStub()
+	cli := newTestContainerdClient(t, stub)
+	ctx := context.Background()
+
+	running, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(running) != 1 || running[0].Names[0] != "/web" || running[0].State != "running" || running[0].Labels["team"] != "shop" {
+		t.Fatal("running containers", running)
+	}
+
+	all, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]string{}
+	for _, listed := range all {
+		states[listed.Names[0]] = listed.State
+	}
+	if len(all) != 3 || states["/api-7d9/api"] != "exited" || states["/job1"] != "created" {
+		t.Fatal("all containers", states)
+	}
+
+	info, err := cli.ContainerInspect(ctx, "pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "/api-7d9/api" || info.State.Running || info.State.ExitCode != 137 || info.State.FinishedAt != "2024-03-01T12:00:00Z" || info.Config.Image != "registry.k8s.io/pause:3.9" {
+		t.Fatal("inspected", info.ContainerJSONBase, info.State)
+	}
+	if meta := containerMetadata(info); meta.Name != "api-7d9/api" || meta.Image != "registry.k8s.io/pause" || meta.Tag != "3.9" {
+		t.Fatal("metadata", meta)
+	}
+	for _, namespace := range stub.namespaces {
+		if namespace != "k8s.io" {
+			t.Fatal("called in namespace", stub.namespaces)
+		}
+	}
+
+	if _, err := cli.ContainerInspect(ctx, "missing"); status.Code(err) != codes.NotFound {
+		t.Fatal("inspected missing container", err)
+	}
+
+	version, err := cli.ServerVersion(ctx)
+	if err != nil || version.Version != "v1.7.19" {
+		t.Fatal("version", version, err)
+	}
+	engine, err := cli.Info(ctx)
+	if err != nil || engine.Containers != 3 || engine.ContainersRunning != 1 || engine.ContainersStopped != 2 {
+		t.Fatal("info", engine, err)
+	}
+}
+
+func TestContainerdClientActions(t *testing.T) {
+	stub := newContainerdStub()
+	cli := newTestContainerdClient(t, stub)
+	ctx := context.Background()
+
+	if err := cli.ContainerPause(ctx, "web1"); err != nil || stub.tasks["web1"].Status != task.Status_PAUSED {
+		t.Fatal("paused", stub.tasks["web1"], err)
+	}
+
+	timeout := 1
+	if err := cli.ContainerStop(ctx, "web1", container.StopOptions{Timeout: &timeout, Signal: "SIGINT"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.signals) != 1 || stub.signals[0] != 2 {
+		t.Fatal("stopped with", stub.signals)
+	}
+
+	if err := cli.ContainerKill(ctx, "web1", ""); err != nil || stub.signals[1] != 9 || stub.killedAll {
+		t.Fatal("killed with", stub.signals, stub.killedAll, err)
+	}
+	if err := cli.ContainerKill(ctx, "web1", "SIGNOPE"); err == nil {
+		t.Fatal("killed with unknown signal")
+	}
+
+	if err := cli.ContainerRestart(ctx, "web1", container.StopOptions{}); !errors.Is(err, errRuntimeUnsupported) {
+		t.Fatal("restart returned", err)
+	}
+	if _, err := cli.ContainerExecCreate(ctx, "web1", types.ExecConfig{}); !errors.Is(err, errRuntimeUnsupported) {
+		t.Fatal("exec returned", err)
+	}
+	if _, err := cli.ContainerStatsOneShot(ctx, "web1"); !errors.Is(err, errRuntimeUnsupported) {
+		t.Fatal("stats returned", err)
+	}
+}
+
+func TestParseLinuxSignal(t *testing.T) {
+	for signal, expected := range map[string]uint32{"SIGTERM": 15, "term": 15, "HUP": 1, "9": 9} {
+		if n, err := parseLinuxSignal(signal); err != nil || n != expected {
+			t.Fatal("parsed", signal, "as", n, err)
+		}
+	}
+	for _, signal := range []string{"", "SIGFOO", "0", "99"} {
+		if _, err := parseLinuxSignal(signal); err == nil {
+			t.Fatal("parsed", signal)
+		}
+	}
+}
+
+func TestContainerdClientEvents(t *testing.T) {
+	stub := newContainerdStub()
+	cli := newTestContainerdClient(t, stub)
+
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	envelope := func(topic string, event interface{}) *eventsapi.Envelope {
+		var wrapped *anypb.Any
+		var err error
+		switch event := event.(type) {
+		case *eventtypes.TaskExit:
+			wrapped, err = anypb.New(event)
+		case *eventtypes.TaskStart:
+			wrapped, err = anypb.New(event)
+		case *eventtypes.ContainerDelete:
+			wrapped, err = anypb.New(event)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &eventsapi.Envelope{Timestamp: timestamppb.New(at), Namespace: "k8s.io", Topic: topic, Event: wrapped}
+	}
+	// The exit of an exec process and the start of another container are filtered out
+	stub.events <- envelope("/tasks/exit", &eventtypes.TaskExit{ContainerID: "web1", ID: "exec1", ExitStatus: 1})
+	stub.events <- envelope("/tasks/start", &eventtypes.TaskStart{ContainerID: "job1"})
+	stub.events <- envelope("/tasks/exit", &eventtypes.TaskExit{ContainerID: "web1", ID: "web1", ExitStatus: 137})
+	stub.events <- envelope("/containers/delete", &eventtypes.ContainerDelete{ID: "web1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, errs := cli.Events(ctx, types.EventsOptions{Filters: filters.NewArgs(filters.Arg("type", "container"), filters.Arg("label", "team=shop"))})
+
+	select {
+	case message := <-messages:
+		if message.Action != "die" || message.Actor.ID != "web1" || message.Actor.Attributes["exitCode"] != "137" || message.Actor.Attributes["name"] != "web" || message.TimeNano != at.UnixNano() {
+			t.Fatal("event", message)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestContainerdEventMatches(t *testing.T) {
+	message, ok := containerdEvent(&eventsapi.Envelope{Topic: "/tasks/paused", Event: mustAny(t, &eventtypes.TaskPaused{ContainerID: "web1"})})
+	if !ok || message.Action != "pause" {
+		t.Fatal("mapped", message)
+	}
+	message.Actor.Attributes["name"] = "web"
+
+	if !containerdEventMatches(filters.NewArgs(filters.Arg("container", "web"), filters.Arg("event", "pause")), message) {
+		t.Fatal("filtered out", message)
+	}
+	if containerdEventMatches(filters.NewArgs(filters.Arg("type", "network")), message) {
+		t.Fatal("matched network filter")
+	}
+	if _, ok := containerdEvent(&eventsapi.Envelope{Topic: "/images/create", Event: mustAny(t, &eventtypes.TaskPaused{})}); ok {
+		t.Fatal("mapped image event")
+	}
+}
+
+func mustAny(t *testing.T, event *eventtypes.TaskPaused) *anypb.Any {
+	t.Helper()
+	wrapped, err := anypb.New(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapped
+}
+
+func TestContainerdLogFile(t *testing.T) {
+	podLogs := t.TempDir()
+	dir := filepath.Join(podLogs, "default_api-7d9_1234", "api")
+	os.MkdirAll(dir, 0o755)
+	for _, name := range []string{"0.log", "2.log", "10.log"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+	}
+
+	tests := []struct {
+		labels map[string]string
+		stdout string
+		path   string
+		format string
+	}{
+		{labels: map[string]string{nerdctlStateDirLabel: "/var/lib/nerdctl/1935db59/containers/default/web1"}, path: "/var/lib/nerdctl/1935db59/containers/default/web1/web1-json.log", format: logFormatJSON},
+		{labels: map[string]string{kubernetesNSLabel: "default", kubernetesPodLabel: "api-7d9", kubernetesUIDLabel: "1234", kubernetesNameLabel: "api"}, path: filepath.Join(dir, "10.log"), format: logFormatCRI},
+		{stdout: "file:///var/log/job.log", path: "/var/log/job.log", format: logFormatRaw},
+	}
+	for _, test := range tests {
+		path, format, err := containerdLogFile(&containersapi.Container{ID: "web1", Labels: test.labels}, &task.Process{Stdout: test.stdout}, podLogs)
+		if err != nil || path != test.path || format != test.format {
+			t.Fatal("log file", path, format, err)
+		}
+	}
+
+	if _, _, err := containerdLogFile(&containersapi.Container{ID: "job1"}, &task.Process{Stdout: "binary:///usr/bin/logger"}, podLogs); err != errNoLogFile {
+		t.Fatal("log file of binary logger", err)
+	}
+}
+
+func TestReadLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web1-json.log")
+	os.WriteFile(path, []byte(`{"log":"one\n","stream":"stdout","time":"2024-03-01T12:00:01Z"}
+{"log":"two\n","stream":"stderr","time":"2024-03-01T12:00:02Z"}
+{"log":"three\n","stream":"stdout","time":"2024-03-01T12:00:03Z"}
+{"log":"four\n","stream":"stdout","time":"2024-03-01T12:00:04Z"}
+`), 0o644)
+
+	out, err := readLogFile(context.Background(), path, logFormatJSON, types.ContainerLogsOptions{
+		ShowStdout: true,
+		Timestamps: true,
+		Since:      "2024-03-01T12:00:02Z",
+		Tail:       "1",
+	}, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := collectLogEntries(t, out, false)
+	out.Close()
+	if len(entries) != 1 || entries[0].Line != "four" || entries[0].Stream != protocol.StreamStdout || !entries[0].Timestamp.Equal(time.Date(2024, 3, 1, 12, 0, 4, 0, time.UTC)) {
+		t.Fatal("read", entries)
+	}
+
+	out, _ = readLogFile(context.Background(), path, logFormatJSON, types.ContainerLogsOptions{ShowStderr: true, Until: "1709294402"}, func() bool { return false })
+	entries = collectLogEntries(t, out, false)
+	if len(entries) != 1 || entries[0].Line != "two" || entries[0].Stream != protocol.StreamStderr {
+		t.Fatal("read stderr", entries)
+	}
+
+	if _, err := readLogFile(context.Background(), path, logFormatJSON, types.ContainerLogsOptions{Tail: "last"}, nil); err == nil {
+		t.Fatal("accepted invalid tail")
+	}
+}
+
+func TestReadLogFileRaw(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "job.log")
+	os.WriteFile(path, []byte("first\nlast"), 0o644)
+
+	// The last line is read without its newline
+	out, err := readLogFile(context.Background(), path, logFormatRaw, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := collectLogEntries(t, out, false)
+	if len(entries) != 2 || entries[1].Line != "last" || entries[1].Stream != protocol.StreamStdout {
+		t.Fatal("read", entries)
+	}
+
+	if _, err := readLogFile(context.Background(), path, logFormatRaw, types.ContainerLogsOptions{ShowStderr: true}, nil); err != errRawStderr {
+		t.Fatal("reading stderr of a raw file returned", err)
+	}
+}
+
+func TestReadLogFileCRI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.log")
+	os.WriteFile(path, []byte("2024-03-01T12:00:01.5Z stdout P hello \n2024-03-01T12:00:01.6Z stdout F world\n2024-03-01T12:00:02Z stderr F\ngarbage\n"), 0o644)
+
+	out, err := readLogFile(context.Background(), path, logFormatCRI, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Timestamps: true}, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := collectLogEntries(t, out, false)
+	if len(entries) != 2 || entries[0].Line != "hello world" || !entries[0].Timestamp.Equal(time.Date(2024, 3, 1, 12, 0, 1, 6e8, time.UTC)) {
+		t.Fatal("read", entries)
+	}
+	if entries[1].Line != "" || entries[1].Stream != protocol.StreamStderr {
+		t.Fatal("read empty line", entries[1])
+	}
+}
+
+func TestReadLogFileFollow(t *testing.T) {
+	defer func(interval time.Duration) { containerdLogPollInterval = interval }(containerdLogPollInterval)
+	containerdLogPollInterval = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "job.log")
+	os.WriteFile(path, []byte("old\n"), 0o644)
+
+	var mu sync.Mutex
+	running := true
+	out, err := readLogFile(context.Background(), path, logFormatRaw, types.ContainerLogsOptions{ShowStdout: true, Follow: true, Tail: "0"}, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	file.WriteString("new ")
+	time.Sleep(5 * containerdLogPollInterval)
+	file.WriteString("line\nlast")
+	file.Close()
+
+	entries := make(chan []protocol.LogEntry)
+	go func() { entries <- collectLogEntries(t, out, false) }()
+
+	time.Sleep(5 * containerdLogPollInterval)
+	mu.Lock()
+	running = false
+	mu.Unlock()
+
+	select {
+	case read := <-entries:
+		// The last line is written without its newline once the container stopped
+		if len(read) != 2 || read[0].Line != "new line" || read[1].Line != "last" {
+			t.Fatal("followed", read)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("following didn't end with the container")
+	}
+}
+
+func TestReadLogFileFollowRotation(t *testing.T) {
+	defer func(interval time.Duration) { containerdLogPollInterval = interval }(containerdLogPollInterval)
+	containerdLogPollInterval = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "job.log")
+	os.WriteFile(path, []byte("old\n"), 0o644)
+
+	var mu sync.Mutex
+	running := true
+	out, err := readLogFile(context.Background(), path, logFormatRaw, types.ContainerLogsOptions{ShowStdout: true, Follow: true}, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	entries := make(chan []protocol.LogEntry)
+	go func() { entries <- collectLogEntries(t, out, false) }()
+
+	// The file is rotated, then the new one is truncated
+	time.Sleep(5 * containerdLogPollInterval)
+	os.Rename(path, path+".1")
+	os.WriteFile(path, []byte("rotated\nlines\n"), 0o644)
+	time.Sleep(5 * containerdLogPollInterval)
+	os.WriteFile(path, []byte("cut\n"), 0o644)
+	time.Sleep(5 * containerdLogPollInterval)
+	mu.Lock()
+	running = false
+	mu.Unlock()
+
+	select {
+	case read := <-entries:
+		var lines []string
+		for _, entry := range read {
+			lines = append(lines, entry.Line)
+		}
+		if strings.Join(lines, ",") != "old,rotated,lines,cut" {
+			t.Fatal("followed", lines)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("following didn't end with the container")
+	}
+}
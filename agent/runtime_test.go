@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestDetectRuntime(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		sockets []string
+		runtime containerRuntime
+	}{
+		{sockets: []string{defaultDockerSocket, rootfulPodmanSocket}, runtime: containerRuntime{Name: runtimeDocker}},
+		{env: map[string]string{"DOCKER_HOST": "tcp://docker:2375"}, sockets: []string{rootfulPodmanSocket}, runtime: containerRuntime{Name: runtimeDocker}},
+		{env: map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000"}, sockets: []string{"/run/user/1000/podman/podman.sock", rootfulPodmanSocket}, runtime: containerRuntime{Name: runtimePodman, Host: "unix:///run/user/1000/podman/podman.sock"}},
+		{env: map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000"}, sockets: []string{rootfulPodmanSocket, defaultContainerdSocket}, runtime: containerRuntime{Name: runtimePodman, Host: "unix://" + rootfulPodmanSocket}},
+		{sockets: []string{defaultContainerdSocket}, runtime: containerRuntime{Name: runtimeContainerd, Host: defaultContainerdSocket}},
+		{runtime: containerRuntime{Name: runtimeDocker}},
+	}
+	for _, test := range tests {
+		getenv := func(key string) string { return test.env[key] }
+		exists := func(path string) bool {
+			for _, socket := range test.sockets {
+				if socket == path {
+					return true
+				}
+			}
+			return false
+		}
+		if runtime := detectRuntime(getenv, exists); runtime != test.runtime {
+			t.Fatal("detected", runtime, "with", test.env, test.sockets)
+		}
+	}
+}
+
+func TestNewContainerRuntime(t *testing.T) {
+	runtime, err := newContainerRuntime(runtimeContainerd, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.Namespace != defaultContainerdNamespace || runtime.String() != "containerd at /run/containerd/containerd.sock, namespace default" {
+		t.Fatal("containerd runtime", runtime)
+	}
+	if runtime.SupportsExec() || runtime.SupportsStats() {
+		t.Fatal("containerd runtime supports exec or stats")
+	}
+
+	runtime, err = newContainerRuntime(runtimePodman, "tcp://podman:8080", "")
+	if err != nil || runtime.Host != "tcp://podman:8080" || !runtime.SupportsExec() {
+		t.Fatal("podman runtime", runtime, err)
+	}
+
+	if _, err := newContainerRuntime("rkt", "", ""); err == nil {
+		t.Fatal("accepted unknown runtime")
+	}
+	if (containerRuntime{}).String() != runtimeDocker {
+		t.Fatal("zero runtime is", containerRuntime{})
+	}
+}
+
+func TestNormalizePodmanEvent(t *testing.T) {
+	message := normalizePodmanEvent(events.Message{Action: "died", Status: "died", Time: 1700000000})
+	if message.Action != "die" || message.Status != "die" || message.Type != events.ContainerEventType || message.TimeNano != 1700000000*1e9 {
+		t.Fatal("normalized", message)
+	}
+
+	message = normalizePodmanEvent(events.Message{Type: events.ImageEventType, Action: "pull", Time: 1, TimeNano: 1500000000})
+	if message.Type != events.ImageEventType || message.Action != "pull" || message.TimeNano != 1500000000 {
+		t.Fatal("normalized", message)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// containerSelector selects containers whose name or ID matches one of its regular expressions
+type containerSelector struct {
+	patterns []*regexp.Regexp
+	// sources are the patterns as they were given, for comparing them to IDs
+	sources []string
+}
+
+// newContainerSelector compiles the patterns, a selector without patterns selects nothing
+func newContainerSelector(patterns []string) (*containerSelector, error) {
+	s := &containerSelector{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid container pattern %q: %w", pattern, err)
+		}
+		s.patterns = append(s.patterns, re)
+		s.sources = append(s.sources, pattern)
+	}
+	return s, nil
+}
+
+// Empty reports whether the selector selects nothing
+func (s *containerSelector) Empty() bool {
+	return s == nil || len(s.patterns) == 0
+}
+
+// Match reports whether the container with the given ID and names is selected.
+// Docker prefixes names with a slash, it is ignored.
+func (s *containerSelector) Match(id string, names []string) bool {
+	if s == nil {
+		return false
+	}
+
+	for _, re := range s.patterns {
+		if re.MatchString(id) {
+			return true
+		}
+		for _, name := range names {
+			if re.MatchString(strings.TrimPrefix(name, "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchStrict reports whether one of the container's names matches, or a pattern is its full ID.
+// Unlike Match it doesn't match parts of the ID, a hex ID contains almost any short pattern.
+func (s *containerSelector) MatchStrict(id string, names []string) bool {
+	if s == nil {
+		return false
+	}
+
+	for i, re := range s.patterns {
+		if s.sources[i] == id {
+			return true
+		}
+		for _, name := range names {
+			if re.MatchString(strings.TrimPrefix(name, "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
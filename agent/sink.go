@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"echoes/shared/protocol"
+)
+
+const (
+	// defaultSinkBuffer is the number of records a sink buffers before dropping the oldest
+	defaultSinkBuffer = 10000
+	// defaultSinkBatch is the largest number of records written to a sink at once
+	defaultSinkBatch = 500
+	// defaultSinkFlush is how long records may wait for a batch to fill
+	defaultSinkFlush = time.Second
+	// sinkWriteTimeout bounds a single write to a sink
+	sinkWriteTimeout = 30 * time.Second
+	// minSinkBackoff and maxSinkBackoff bound the wait between retries of a failed write
+	minSinkBackoff = time.Second
+	maxSinkBackoff = time.Minute
+)
+
+// LogRecord is a log line of a container, with the metadata of the container when it was read
+type LogRecord struct {
+	Time      time.Time              `json:"time"`
+	Container protocol.ContainerMeta `json:"container"`
+	Stream    string                 `json:"stream"`
+	Line      string                 `json:"line"`
+}
+
+// Sink is an output the agent ships log records to, next to the Echoes server
+type Sink interface {
+	// Write delivers the records in order. After an error the records are written again,
+	// unless the error is permanent, or only those of a partialError.
+	Write(ctx context.Context, records []LogRecord) error
+	// Close releases the sink's resources
+	Close() error
+}
+
+// permanentError marks errors retrying the write can't fix, like a rejected request
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks err as permanent, the records of the failed write are dropped
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// partialError reports a write that failed for some records only, like a bulk request
+// with rejected items. Only the records it holds are written again.
+type partialError struct {
+	records []LogRecord
+	err     error
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partialError) Unwrap() error {
+	return e.err
+}
+
+// retryAfterError reports a sink asking to wait before the next write, like a HTTP 429
+// response with a Retry-After header
+type retryAfterError struct {
+	after time.Duration
+	err   error
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// sinkOptions configures the buffering of a sink
+type sinkOptions struct {
+	buffer int
+	batch  int
+	flush  time.Duration
+}
+
+// bufferedSink buffers the records of a sink and writes them in batches, retrying failed
+// writes with exponential backoff. While the sink is failing the buffer fills up, and the
+// oldest records are dropped.
+type bufferedSink struct {
+	name    string
+	sink    Sink
+	options sinkOptions
+	records *spool[LogRecord]
+	log     Logger
+
+	// minBackoff and maxBackoff bound the wait between retries
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBufferedSink(name string, sink Sink, options sinkOptions, log Logger) *bufferedSink {
+	return &bufferedSink{
+		name:       name,
+		sink:       sink,
+		options:    options,
+		records:    newSpool[LogRecord](options.buffer),
+		log:        log,
+		minBackoff: minSinkBackoff,
+		maxBackoff: maxSinkBackoff,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// run writes the buffered records until the sink is closed, then flushes what is left once
+func (b *bufferedSink) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.options.flush)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			b.flush(false)
+			return
+		case <-ticker.C:
+			b.flush(true)
+		case <-b.records.Ready():
+			// Wait for a full batch, or the next tick
+			if b.records.Len() >= b.options.batch {
+				b.flush(true)
+			}
+		}
+	}
+}
+
+// flush writes the buffered records in batches. With retry, failed writes are retried until
+// they succeed or the sink is closed.
+func (b *bufferedSink) flush(retry bool) {
+	backoff := b.minBackoff
+	for {
+		records, dropped := b.records.Take(b.options.batch)
+		if dropped > 0 {
+			b.log.Warn("agent", fmt.Sprintf("Sink %s dropped %d records, its buffer was full", b.name, dropped))
+		}
+		if len(records) == 0 {
+			return
+		}
+
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), sinkWriteTimeout)
+			err := b.sink.Write(ctx, records)
+			cancel()
+			if err == nil {
+				backoff = b.minBackoff
+				break
+			}
+			if isPermanent(err) {
+				b.log.Error("agent", fmt.Sprintf("Sink %s rejected %d records: %s", b.name, len(records), err))
+				break
+			}
+			var partial *partialError
+			if errors.As(err, &partial) {
+				records = partial.records
+			}
+			if !retry {
+				b.log.Error("agent", fmt.Sprintf("Sink %s lost %d records: %s", b.name, len(records), err))
+				return
+			}
+
+			wait := backoff
+			var retryAfter *retryAfterError
+			if errors.As(err, &retryAfter) && retryAfter.after > wait {
+				wait = min(retryAfter.after, b.maxBackoff)
+			}
+			b.log.Warn("agent", fmt.Sprintf("Sink %s failed, retrying in %s: %s", b.name, wait, err))
+			select {
+			case <-b.stop:
+				// Keep the records for the final flush
+				b.records.Requeue(records, 0)
+				return
+			case <-time.After(wait):
+			}
+			backoff *= 2
+			if backoff > b.maxBackoff {
+				backoff = b.maxBackoff
+			}
+		}
+	}
+}
+
+// Close flushes the buffered records and closes the sink
+func (b *bufferedSink) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.sink.Close()
+}
+
+// sinkFanout passes every record to all sinks, each buffering and retrying on its own so a
+// failing sink doesn't hold up the others
+type sinkFanout struct {
+	sinks []*bufferedSink
+
+	closeOnce sync.Once
+}
+
+func newSinkFanout(sinks ...*bufferedSink) *sinkFanout {
+	for _, sink := range sinks {
+		go sink.run()
+	}
+	return &sinkFanout{sinks: sinks}
+}
+
+// Publish queues a record for all sinks
+func (f *sinkFanout) Publish(record LogRecord) {
+	for _, sink := range f.sinks {
+		sink.records.Push(record)
+	}
+}
+
+// Close flushes and closes all sinks
+func (f *sinkFanout) Close() error {
+	var errs []error
+	f.closeOnce.Do(func() {
+		for _, sink := range f.sinks {
+			if err := sink.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %w", sink.name, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// parseSinks creates the sinks of the given specs, see parseSink
+func parseSinks(specs []string, runtime string, log Logger) (*sinkFanout, error) {
+	var sinks []*bufferedSink
+	for _, spec := range specs {
+		if spec == "" {
+			continue
+		}
+
+		sink, err := parseSink(spec, runtime, log)
+		if err != nil {
+			for _, s := range sinks {
+				s.sink.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return newSinkFanout(sinks...), nil
+}
+
+// parseSink creates a sink from a URL like spec:
+//
+//	stdout                                   JSON lines on stdout
+//	file:///var/log/echoes.log?maxSize=100MB  JSON lines in a rotating file
+//	http://collector:8080/logs               NDJSON POST requests, https as well
+//	syslog+udp://host:514                    RFC 5424 syslog messages, syslog+tcp as well
+//	elasticsearch+https://es:9200?index=logs Elasticsearch bulk API, elasticsearch+http as well
+//	loki+http://loki:3100?labels=team        Loki push API, loki+https as well
+//	otlp+grpc://collector:4317               OTLP logs, otlp+grpcs, otlp+http and otlp+https as well
+//
+// The buffer, batch and flush query parameters configure the buffering of every sink. OTLP
+// sinks describe the containers as those of the given runtime.
+func parseSink(spec, runtime string, log Logger) (*bufferedSink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink %q: %w", spec, err)
+	}
+
+	query := u.Query()
+	options, err := parseSinkOptions(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink %q: %w", spec, err)
+	}
+	for _, key := range []string{"buffer", "batch", "flush"} {
+		query.Del(key)
+	}
+	u.RawQuery = query.Encode()
+
+	var sink Sink
+	switch u.Scheme {
+	case "":
+		if u.Path != "stdout" {
+			return nil, fmt.Errorf("invalid sink %q, unknown output", spec)
+		}
+		sink = newStreamSink(os.Stdout)
+	case "file":
+		sink, err = newFileSink(u)
+	case "http", "https":
+		sink, err = newHTTPSink(u)
+	case "syslog+udp", "syslog+tcp":
+		sink, err = newSyslogSink(u)
+	case "elasticsearch+http", "elasticsearch+https":
+		sink, err = newElasticsearchSink(u)
+	case "loki+http", "loki+https":
+		sink, err = newLokiSink(u)
+	case "otlp+grpc", "otlp+grpcs", "otlp+http", "otlp+https":
+		sink, err = newOTLPSink(u, runtime)
+	default:
+		return nil, fmt.Errorf("invalid sink %q, unknown scheme %q", spec, u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink %q: %w", spec, err)
+	}
+
+	return newBufferedSink(sinkName(u), sink, options, log), nil
+}
+
+// sinkName describes a sink in the agent's log, without its credentials
+func sinkName(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	for key := range query {
+		if isSecretParameter(key) {
+			query.Set(key, "xxxxx")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.Redacted()
+}
+
+// isSecretParameter reports whether a sink's query parameter holds credentials
+func isSecretParameter(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range []string{"key", "token", "password", "secret", "header"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSinkOptions reads the buffering options of a sink from its query
+func parseSinkOptions(query url.Values) (sinkOptions, error) {
+	options := sinkOptions{buffer: defaultSinkBuffer, batch: defaultSinkBatch, flush: defaultSinkFlush}
+
+	for key, target := range map[string]*int{"buffer": &options.buffer, "batch": &options.batch} {
+		if value := query.Get(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return options, fmt.Errorf("%s must be a positive number", key)
+			}
+			*target = n
+		}
+	}
+	if value := query.Get("flush"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return options, errors.New("flush must be a positive duration")
+		}
+		options.flush = d
+	}
+	return options, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultElasticsearchIndex is the index the server searches, see ELASTICSEARCH_INDEX
+const defaultElasticsearchIndex = "search-container-echoes"
+
+// elasticsearchDatePattern matches the date placeholders of index templates, like {yyyy.MM.dd}
+var elasticsearchDatePattern = regexp.MustCompile(`\{([^}]*)\}`)
+
+// elasticsearchSink indexes records with the Elasticsearch bulk API. Items Elasticsearch
+// rejects for overload are retried, other rejected items are dropped.
+type elasticsearchSink struct {
+	url      string
+	index    string
+	apiKey   string
+	username string
+	password string
+	hostname string
+	client   *http.Client
+}
+
+// newElasticsearchSink creates an Elasticsearch sink from a spec like
+// elasticsearch+https://es:9200?index=logs-{yyyy.MM.dd}&apiKey=...
+// Credentials in the URL are sent with basic auth, other query parameters are passed to the
+// bulk API, like pipeline.
+func newElasticsearchSink(u *url.URL) (*elasticsearchSink, error) {
+	if u.Host == "" {
+		return nil, errors.New("Elasticsearch host is required")
+	}
+
+	target := *u
+	target.Scheme = strings.TrimPrefix(u.Scheme, "elasticsearch+")
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/_bulk"
+
+	s := &elasticsearchSink{
+		index:    defaultElasticsearchIndex,
+		hostname: getHostName(),
+		client:   &http.Client{Timeout: sinkWriteTimeout},
+	}
+	if target.User != nil {
+		s.username = target.User.Username()
+		s.password, _ = target.User.Password()
+		target.User = nil
+	}
+
+	query := target.Query()
+	if index := query.Get("index"); index != "" {
+		s.index = index
+	}
+	s.apiKey = query.Get("apiKey")
+	if ca := query.Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", ca)
+		}
+		s.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	for _, key := range []string{"index", "apiKey", "ca"} {
+		query.Del(key)
+	}
+	target.RawQuery = query.Encode()
+	s.url = target.String()
+
+	return s, nil
+}
+
+// elasticsearchIndex expands the date placeholders of an index template with the record's
+// time. {yyyy.MM.dd} becomes 2024.03.01, the supported fields are yyyy, yy, MM, dd and HH.
+func elasticsearchIndex(template string, t time.Time) string {
+	return elasticsearchDatePattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		format := elasticsearchDatePattern.FindStringSubmatch(placeholder)[1]
+		layout := strings.NewReplacer("yyyy", "2006", "yy", "06", "MM", "01", "dd", "02", "HH", "15").Replace(format)
+		return t.UTC().Format(layout)
+	})
+}
+
+// elasticsearchDocument maps a record to ECS fields
+func elasticsearchDocument(record LogRecord, hostname string) map[string]interface{} {
+	container := map[string]interface{}{
+		"id":   record.Container.ContainerId,
+		"name": record.Container.Name,
+		"image": map[string]interface{}{
+			"name": record.Container.Image,
+			"tag":  record.Container.Tag,
+		},
+	}
+	if len(record.Container.Labels) > 0 {
+		container["labels"] = record.Container.Labels
+	}
+
+	document := map[string]interface{}{
+		"@timestamp": record.Time.UTC().Format(time.RFC3339Nano),
+		"message":    record.Line,
+		"stream":     record.Stream,
+		"container":  container,
+		"host":       map[string]interface{}{"name": hostname},
+	}
+	if record.Container.ComposeProject != "" {
+		document["compose"] = map[string]interface{}{
+			"project": record.Container.ComposeProject,
+			"service": record.Container.ComposeService,
+		}
+	}
+	return document
+}
+
+// elasticsearchBulkResponse is the part of a bulk response reporting rejected items
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (s *elasticsearchSink) Write(ctx context.Context, records []LogRecord) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, record := range records {
+		action := map[string]interface{}{
+			"create": map[string]string{"_index": elasticsearchIndex(s.index, record.Time)},
+		}
+		if err := encoder.Encode(action); err != nil {
+			return permanent(err)
+		}
+		if err := encoder.Encode(elasticsearchDocument(record, s.hostname)); err != nil {
+			return permanent(err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case s.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	case s.username != "" || s.password != "":
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return checkSinkResponse(resp)
+	}
+
+	var result elasticsearchBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	return bulkItemsError(records, result)
+}
+
+// bulkItemsError reports the items of a bulk request that failed. Items rejected for
+// overload or server errors are retried, the others are dropped.
+func bulkItemsError(records []LogRecord, result elasticsearchBulkResponse) error {
+	var retry []LogRecord
+	rejected := 0
+	reason := ""
+	for i, item := range result.Items {
+		if i >= len(records) {
+			break
+		}
+		for _, status := range item {
+			if status.Status < 300 {
+				continue
+			}
+			if status.Error != nil && reason == "" {
+				reason = status.Error.Type + ": " + status.Error.Reason
+			}
+			if status.Status == http.StatusTooManyRequests || status.Status >= 500 {
+				retry = append(retry, records[i])
+			} else {
+				rejected++
+			}
+		}
+	}
+
+	err := fmt.Errorf("%d of %d items rejected, %d to retry: %s", rejected+len(retry), len(records), len(retry), reason)
+	if len(retry) == 0 {
+		if rejected == 0 {
+			return nil
+		}
+		return permanent(err)
+	}
+	return &partialError{records: retry, err: err}
+}
+
+func (s *elasticsearchSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
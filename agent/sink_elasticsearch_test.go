@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkStub is an Elasticsearch stub answering bulk requests with the given item statuses
+type bulkStub struct {
+	mu       sync.Mutex
+	statuses [][]int
+	requests []*http.Request
+	actions  []map[string]map[string]string
+	docs     []map[string]interface{}
+}
+
+func (s *bulkStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+
+	var statuses []int
+	if len(s.statuses) > 0 {
+		statuses, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+
+	var items []map[string]interface{}
+	hasErrors := false
+	scanner := bufio.NewScanner(r.Body)
+	for i := 0; scanner.Scan(); i++ {
+		var action map[string]map[string]string
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var doc map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &doc)
+		s.actions = append(s.actions, action)
+		s.docs = append(s.docs, doc)
+
+		status := http.StatusCreated
+		if i < len(statuses) {
+			status = statuses[i]
+		}
+		item := map[string]interface{}{"status": status}
+		if status >= 300 {
+			hasErrors = true
+			item["error"] = map[string]string{"type": "rejected", "reason": "test"}
+		}
+		items = append(items, map[string]interface{}{"create": item})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": hasErrors, "items": items})
+}
+
+func newTestElasticsearchSink(t *testing.T, stub http.Handler, query string) *elasticsearchSink {
+	t.Helper()
+
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(strings.Replace(server.URL, "http://", "elasticsearch+http://", 1) + query)
+	sink, err := newElasticsearchSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestElasticsearchIndex(t *testing.T) {
+	at := time.Date(2024, 3, 1, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*3600))
+	indices := map[string]string{
+		"logs":                   "logs",
+		"logs-{yyyy.MM.dd}":      "logs-2024.03.02",
+		"logs-{yy}-{MM}-{HH}":    "logs-24-03-01",
+		"{yyyy}.{MM}/containers": "2024.03/containers",
+	}
+	for template, expected := range indices {
+		if index := elasticsearchIndex(template, at); index != expected {
+			t.Fatal(template, "expanded to", index)
+		}
+	}
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	stub := &bulkStub{}
+	sink := newTestElasticsearchSink(t, stub, "/?index=logs-{yyyy.MM.dd}&apiKey=secret&pipeline=containers")
+
+	record := testRecord("hello")
+	record.Container.ComposeProject = "shop"
+	if err := sink.Write(context.Background(), []LogRecord{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := stub.requests[0]
+	if req.URL.Path != "/_bulk" || req.URL.Query().Get("pipeline") != "containers" || req.URL.Query().Get("apiKey") != "" {
+		t.Fatal("requested", req.URL)
+	}
+	if req.Header.Get("Authorization") != "ApiKey secret" || req.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("requested with headers", req.Header)
+	}
+	if stub.actions[0]["create"]["_index"] != "logs-2024.03.01" {
+		t.Fatal("indexed with", stub.actions[0])
+	}
+
+	doc := stub.docs[0]
+	container := doc["container"].(map[string]interface{})
+	compose := doc["compose"].(map[string]interface{})
+	if doc["@timestamp"] != "2024-03-01T12:00:00.123456789Z" || doc["message"] != "hello" || doc["stream"] != "stdout" {
+		t.Fatal("indexed document", doc)
+	}
+	if container["id"] != "abc123" || container["name"] != "web" || compose["service"] != "frontend" {
+		t.Fatal("indexed document", doc)
+	}
+}
+
+func TestElasticsearchSinkBasicAuth(t *testing.T) {
+	stub := &bulkStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	u, _ := url.Parse(strings.Replace(server.URL, "http://", "elasticsearch+http://elastic:changeme@", 1))
+	sink, err := newElasticsearchSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), []LogRecord{testRecord("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if user, password, _ := stub.requests[0].BasicAuth(); user != "elastic" || password != "changeme" {
+		t.Fatal("authenticated as", user, password)
+	}
+	if stub.actions[0]["create"]["_index"] != defaultElasticsearchIndex {
+		t.Fatal("indexed with", stub.actions[0])
+	}
+}
+
+func TestElasticsearchSinkPartialFailure(t *testing.T) {
+	// The first item is indexed, the second rejected for overload and the third for its mapping
+	stub := &bulkStub{statuses: [][]int{{http.StatusCreated, http.StatusTooManyRequests, http.StatusBadRequest}}}
+	sink := newTestElasticsearchSink(t, stub, "")
+
+	err := sink.Write(context.Background(), []LogRecord{testRecord("a"), testRecord("b"), testRecord("c")})
+	var partial *partialError
+	if !errors.As(err, &partial) || len(partial.records) != 1 || partial.records[0].Line != "b" {
+		t.Fatal("partial failure returned", err)
+	}
+
+	// Only rejected items are dropped
+	stub.statuses = [][]int{{http.StatusBadRequest}}
+	if err := sink.Write(context.Background(), []LogRecord{testRecord("d")}); !isPermanent(err) {
+		t.Fatal("rejected item returned", err)
+	}
+}
+
+func TestElasticsearchSinkRetriesOnlyFailedItems(t *testing.T) {
+	stub := &bulkStub{statuses: [][]int{{http.StatusCreated, http.StatusServiceUnavailable}}}
+	sink := newTestElasticsearchSink(t, stub, "")
+	buffered := newTestBufferedSink(sink, sinkOptions{buffer: 10, batch: 10, flush: time.Hour})
+	fanout := newSinkFanout(buffered)
+
+	fanout.Publish(testRecord("a"))
+	fanout.Publish(testRecord("b"))
+	fanout.Close()
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if len(stub.docs) != 2 {
+		t.Fatal("indexed", len(stub.docs), "documents")
+	}
+	if stub.docs[0]["message"] != "a" || stub.docs[1]["message"] != "b" {
+		t.Fatal("indexed", stub.docs)
+	}
+}
+
+func TestSinkName(t *testing.T) {
+	u, _ := url.Parse("elasticsearch+https://elastic:changeme@es:9200?apiKey=secret&index=logs")
+	if name := sinkName(u); strings.Contains(name, "secret") || strings.Contains(name, "changeme") || !strings.Contains(name, "index=logs") {
+		t.Fatal("sink named", name)
+	}
+}
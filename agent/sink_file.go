@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultMaxFileSize is the size at which file sinks rotate
+	defaultMaxFileSize = 100 * 1024 * 1024
+	// defaultMaxFiles is the number of rotated files kept next to the current one
+	defaultMaxFiles = 5
+)
+
+// streamSink writes records as JSON lines to a stream, like stdout
+type streamSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newStreamSink(w io.Writer) *streamSink {
+	return &streamSink{w: w}
+}
+
+func (s *streamSink) Write(ctx context.Context, records []LogRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeJSONLines(s.w, records)
+}
+
+func (s *streamSink) Close() error {
+	return nil
+}
+
+// writeJSONLines writes every record as a JSON line
+func writeJSONLines(w io.Writer, records []LogRecord) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return permanent(err)
+		}
+	}
+	return buffered.Flush()
+}
+
+// fileSink writes records as JSON lines to a file. Once the file reaches maxSize it is renamed
+// to path.1, previous files are shifted to path.2 and so on, and the oldest beyond maxFiles
+// is removed.
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// newFileSink creates a file sink from a spec like file:///var/log/echoes.log?maxSize=100MB&maxFiles=5
+func newFileSink(u *url.URL) (*fileSink, error) {
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, errors.New("file path is required")
+	}
+
+	s := &fileSink{path: path, maxSize: defaultMaxFileSize, maxFiles: defaultMaxFiles}
+	query := u.Query()
+	if value := query.Get("maxSize"); value != "" {
+		size, err := parseByteSize(value)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid maxSize %q", value)
+		}
+		s.maxSize = size
+	}
+	if value := query.Get("maxFiles"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid maxFiles %q", value)
+		}
+		s.maxFiles = n
+	}
+	return s, nil
+}
+
+func (s *fileSink) Write(ctx context.Context, records []LogRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return permanent(err)
+		}
+		line = append(line, '\n')
+
+		if s.file != nil && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		if s.file == nil {
+			if err := s.open(); err != nil {
+				return err
+			}
+		}
+
+		n, err := s.file.Write(line)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open opens the current file, appending to what a previous run wrote
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate closes the current file and shifts the rotated files
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	if s.maxFiles == 0 {
+		return os.Remove(s.path)
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// parseByteSize parses sizes like 512, 64KB or 100MB, units are powers of 1024
+func parseByteSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * factor, nil
+}
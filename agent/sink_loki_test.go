@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pushedStream is a stream of a push request received by lokiStub
+type pushedStream struct {
+	labels string
+	times  []time.Time
+	lines  []string
+}
+
+// lokiStub is a Loki stub decoding push requests, it answers with the given statuses
+type lokiStub struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	streams  []pushedStream
+}
+
+func (s *lokiStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("Content-Type") == "application/json" {
+		s.streams = append(s.streams, decodeLokiJSON(body)...)
+	} else {
+		body, _ = snappy.Decode(nil, body)
+		s.streams = append(s.streams, decodeLokiProtobuf(body)...)
+	}
+
+	if len(s.statuses) > 0 {
+		var status int
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeLokiJSON(body []byte) []pushedStream {
+	var request struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	json.Unmarshal(body, &request)
+
+	var streams []pushedStream
+	for _, s := range request.Streams {
+		stream := pushedStream{labels: lokiLabelsKey(s.Stream)}
+		for _, value := range s.Values {
+			var nanos int64
+			json.Unmarshal([]byte(value[0]), &nanos)
+			stream.times = append(stream.times, time.Unix(0, nanos).UTC())
+			stream.lines = append(stream.lines, value[1])
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// decodeLokiProtobuf decodes a PushRequest, see encodeLokiProtobuf
+func decodeLokiProtobuf(body []byte) []pushedStream {
+	var streams []pushedStream
+	for _, message := range protobufFields(body)[1] {
+		fields := protobufFields(message)
+		stream := pushedStream{labels: string(fields[1][0])}
+		for _, entry := range fields[2] {
+			entryFields := protobufFields(entry)
+			timestamp := protobufFields(entryFields[1][0])
+			var seconds, nanos uint64
+			if len(timestamp[1]) > 0 {
+				seconds, _ = protowire.ConsumeVarint(timestamp[1][0])
+			}
+			if len(timestamp[2]) > 0 {
+				nanos, _ = protowire.ConsumeVarint(timestamp[2][0])
+			}
+			stream.times = append(stream.times, time.Unix(int64(seconds), int64(nanos)).UTC())
+			stream.lines = append(stream.lines, string(entryFields[2][0]))
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// protobufFields returns the raw values of a message's fields by number, varints encoded
+func protobufFields(message []byte) map[protowire.Number][][]byte {
+	fields := map[protowire.Number][][]byte{}
+	for len(message) > 0 {
+		number, typ, n := protowire.ConsumeTag(message)
+		message = message[n:]
+		switch typ {
+		case protowire.BytesType:
+			value, n := protowire.ConsumeBytes(message)
+			fields[number] = append(fields[number], value)
+			message = message[n:]
+		default:
+			value, n := protowire.ConsumeVarint(message)
+			fields[number] = append(fields[number], protowire.AppendVarint(nil, value))
+			message = message[n:]
+		}
+	}
+	return fields
+}
+
+func newTestLokiSink(t *testing.T, stub http.Handler, query string) *lokiSink {
+	t.Helper()
+
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(strings.Replace(server.URL, "http://", "loki+http://", 1) + query)
+	sink, err := newLokiSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.hostname = "node1"
+	return sink
+}
+
+func TestLokiLabels(t *testing.T) {
+	if name := lokiLabelName("com.example.team-name"); name != "com_example_team_name" {
+		t.Fatal("label named", name)
+	}
+	if name := lokiLabelName("1st"); name != "_1st" {
+		t.Fatal("label named", name)
+	}
+	if key := lokiLabelsKey(map[string]string{"stream": "stdout", "container": `we"b`}); key != `{container="we\"b", stream="stdout"}` {
+		t.Fatal("labels formatted as", key)
+	}
+}
+
+func TestLokiSink(t *testing.T) {
+	for _, format := range []string{"protobuf", "json"} {
+		t.Run(format, func(t *testing.T) {
+			stub := &lokiStub{}
+			sink := newTestLokiSink(t, stub, "?format="+format+"&labels=com.example.team&tenant=ops")
+
+			web := testRecord("hello")
+			web.Container.Labels = map[string]string{"com.example.team": "shop", "unselected": "x"}
+			db := testRecord("ready")
+			db.Container.Name = "db"
+			db.Container.ComposeService = ""
+			late := testRecord("late")
+			late.Time = web.Time.Add(-time.Second)
+			late.Container.Labels = web.Container.Labels
+
+			if err := sink.Write(context.Background(), []LogRecord{web, db, late}); err != nil {
+				t.Fatal(err)
+			}
+
+			req := stub.requests[0]
+			if req.URL.Path != lokiPushPath || req.URL.RawQuery != "" || req.Header.Get("X-Scope-OrgID") != "ops" {
+				t.Fatal("requested", req.URL, req.Header)
+			}
+
+			expected := []pushedStream{
+				{
+					labels: `{com_example_team="shop", compose_service="frontend", container="web", host="node1", stream="stdout"}`,
+					times:  []time.Time{web.Time, web.Time},
+					lines:  []string{"hello", "late"},
+				},
+				{
+					labels: `{container="db", host="node1", stream="stdout"}`,
+					times:  []time.Time{db.Time},
+					lines:  []string{"ready"},
+				},
+			}
+			if !reflect.DeepEqual(stub.streams, expected) {
+				t.Fatal("pushed", stub.streams)
+			}
+		})
+	}
+}
+
+func TestLokiSinkOrdersAcrossPushes(t *testing.T) {
+	stub := &lokiStub{}
+	sink := newTestLokiSink(t, stub, "")
+
+	first := testRecord("first")
+	if err := sink.Write(context.Background(), []LogRecord{first}); err != nil {
+		t.Fatal(err)
+	}
+	earlier := testRecord("earlier")
+	earlier.Time = first.Time.Add(-time.Minute)
+	if err := sink.Write(context.Background(), []LogRecord{earlier}); err != nil {
+		t.Fatal(err)
+	}
+
+	if pushed := stub.streams[1]; !pushed.times[0].Equal(first.Time) {
+		t.Fatal("pushed entry older than its stream at", pushed.times[0])
+	}
+}
+
+func TestLokiSinkCardinalityLimits(t *testing.T) {
+	stub := &lokiStub{}
+	sink := newTestLokiSink(t, stub, "?labels=request&maxLabelValues=2&maxStreams=3")
+
+	var records []LogRecord
+	for _, request := range []string{"a", "b", "c", "d"} {
+		record := testRecord(request)
+		record.Container.Labels = map[string]string{"request": request}
+		records = append(records, record)
+	}
+	// A new container once the stream limit is reached
+	other := testRecord("other")
+	other.Container.Name = "worker"
+	records = append(records, other)
+
+	if err := sink.Write(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	var labels []string
+	for _, stream := range stub.streams {
+		labels = append(labels, stream.labels)
+	}
+	expected := []string{
+		`{compose_service="frontend", container="web", host="node1", request="a", stream="stdout"}`,
+		`{compose_service="frontend", container="web", host="node1", request="b", stream="stdout"}`,
+		`{compose_service="frontend", container="web", host="node1", request="__overflow__", stream="stdout"}`,
+		`{echoes_overflow="true", host="node1"}`,
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatal("pushed streams", labels)
+	}
+	if lines := stub.streams[2].lines; !reflect.DeepEqual(lines, []string{"c", "d"}) {
+		t.Fatal("pushed to overflowing label", lines)
+	}
+}
+
+func TestLokiSinkExpiresIdleStreams(t *testing.T) {
+	sink := newTestLokiSink(t, &lokiStub{}, "?labels=request&maxLabelValues=1&maxStreams=1&idleTimeout=30m")
+	request := func(name, value string) LogRecord {
+		record := testRecord(value)
+		record.Container.Name = name
+		record.Container.Labels = map[string]string{"request": value}
+		return record
+	}
+
+	now := time.Now()
+	sink.group([]LogRecord{request("web", "a")}, now)
+	if streams := sink.group([]LogRecord{request("web", "b"), request("worker", "a")}, now.Add(20*time.Minute)); len(streams) != 1 || streams[0].labels["echoes_overflow"] != "true" {
+		t.Fatal("grouped beyond the limits into", streams[0].labels)
+	}
+
+	// Once idle, the stream and the label value no longer count towards the limits
+	streams := sink.group([]LogRecord{request("worker", "b")}, now.Add(time.Hour))
+	if len(streams) != 1 || streams[0].labels["container"] != "worker" || streams[0].labels["request"] != "b" {
+		t.Fatal("grouped after expiry into", streams[0].labels)
+	}
+	if len(sink.streams) != 1 || len(sink.labelValues["request"]) != 1 {
+		t.Fatal("kept", sink.streams, sink.labelValues)
+	}
+}
+
+func TestLokiSinkBackpressure(t *testing.T) {
+	stub := &lokiStub{statuses: []int{http.StatusTooManyRequests}}
+	sink := newTestLokiSink(t, stub, "")
+
+	err := sink.Write(context.Background(), []LogRecord{testRecord("a")})
+	if _, ok := err.(*retryAfterError); !ok || isPermanent(err) {
+		t.Fatal("throttled push returned", err)
+	}
+
+	fanout := newSinkFanout(newTestBufferedSink(sink, sinkOptions{buffer: 10, batch: 10, flush: time.Millisecond}))
+	stub.mu.Lock()
+	stub.statuses = []int{http.StatusTooManyRequests}
+	stub.mu.Unlock()
+	fanout.Publish(testRecord("b"))
+	defer fanout.Close()
+
+	// The throttled push is retried after Retry-After
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		stub.mu.Lock()
+		pushed := len(stub.requests)
+		stub.mu.Unlock()
+		if pushed == 3 {
+			break
+		}
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if len(stub.requests) != 3 || stub.streams[2].lines[0] != "b" {
+		t.Fatal("retried throttled push", len(stub.requests), "times")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if after, ok := parseRetryAfter("120"); !ok || after != 2*time.Minute {
+		t.Fatal("parsed", after, ok)
+	}
+	if after, ok := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); !ok || after < 59*time.Minute {
+		t.Fatal("parsed", after, ok)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Fatal("parsed invalid Retry-After")
+	}
+}
+
+func TestLokiSinkSpec(t *testing.T) {
+	u, _ := url.Parse("loki+https://loki:3100?format=yaml")
+	if _, err := newLokiSink(u); err == nil {
+		t.Fatal("accepted unknown format")
+	}
+	u, _ = url.Parse("loki+https://loki:3100?maxStreams=0")
+	if _, err := newLokiSink(u); err == nil {
+		t.Fatal("accepted stream limit 0")
+	}
+	u, _ = url.Parse("loki+https://loki:3100?idleTimeout=soon")
+	if _, err := newLokiSink(u); err == nil {
+		t.Fatal("accepted invalid idle timeout")
+	}
+	u, _ = url.Parse("loki+https://loki:3100/custom/push")
+	if sink, err := newLokiSink(u); err != nil || sink.url != "https://loki:3100/custom/push" {
+		t.Fatal("created", sink, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"echoes/shared/protocol"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+// otlpSink exports records as OTLP logs. Every container is a resource described by its
+// metadata, see otlpResource.
+type otlpSink struct {
+	exporter *otlpExporter
+	hostname string
+	// runtime is the container runtime the records were read from
+	runtime string
+}
+
+// newOTLPSink creates an OTLP sink from a spec like otlp+grpc://collector:4317, see
+// newOTLPExporter
+func newOTLPSink(u *url.URL, runtime string) (*otlpSink, error) {
+	exporter, err := newOTLPExporter(u)
+	if err != nil {
+		return nil, err
+	}
+	return &otlpSink{exporter: exporter, hostname: getHostName(), runtime: runtime}, nil
+}
+
+// otlpLogsRequest groups the records by container in an export request
+func otlpLogsRequest(records []LogRecord, hostname, runtime string, observed time.Time) *collogspb.ExportLogsServiceRequest {
+	request := &collogspb.ExportLogsServiceRequest{}
+	byContainer := map[string]*logspb.ScopeLogs{}
+
+	for _, record := range records {
+		scope := byContainer[record.Container.ContainerId]
+		if scope == nil {
+			scope = &logspb.ScopeLogs{Scope: otlpScope}
+			byContainer[record.Container.ContainerId] = scope
+			request.ResourceLogs = append(request.ResourceLogs, &logspb.ResourceLogs{
+				Resource:  otlpResource(record.Container, hostname, runtime),
+				ScopeLogs: []*logspb.ScopeLogs{scope},
+			})
+		}
+
+		logRecord := &logspb.LogRecord{
+			TimeUnixNano:         uint64(record.Time.UnixNano()),
+			ObservedTimeUnixNano: uint64(observed.UnixNano()),
+			Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: record.Line}},
+			Attributes:           []*commonpb.KeyValue{otlpString("log.iostream", record.Stream)},
+		}
+		// The stream is all there is to tell the severity by, stdout lines are left unspecified
+		if record.Stream == protocol.StreamStderr {
+			logRecord.SeverityNumber = logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+			logRecord.SeverityText = "ERROR"
+		}
+		scope.LogRecords = append(scope.LogRecords, logRecord)
+	}
+	return request
+}
+
+func (s *otlpSink) Write(ctx context.Context, records []LogRecord) error {
+	return s.exporter.ExportLogs(ctx, otlpLogsRequest(records, s.hostname, s.runtime, time.Now()))
+}
+
+func (s *otlpSink) Close() error {
+	return s.exporter.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+)
+
+// spool buffers records for the server, including while the agent is disconnected. Once the
+// limit is reached the oldest records are dropped, and counted so the loss is reported.
+type spool[T any] struct {
+	limit int
+
+	mu      sync.Mutex
+	records []T
+	dropped int
+	// ready holds a signal while records are waiting
+	ready chan struct{}
+}
+
+func newSpool[T any](limit int) *spool[T] {
+	return &spool[T]{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// Push appends a record, dropping the oldest one if the spool is full
+func (s *spool[T]) Push(record T) {
+	s.mu.Lock()
+	if len(s.records) >= s.limit {
+		s.records = s.records[1:]
+		s.dropped++
+	}
+	s.records = append(s.records, record)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// Ready receives a value when records may be waiting
+func (s *spool[T]) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Take removes up to n of the oldest records, and returns them with the number of records
+// dropped since the last Take
+func (s *spool[T]) Take(n int) ([]T, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.records) {
+		n = len(s.records)
+	}
+	records := make([]T, n)
+	copy(records, s.records)
+	s.records = s.records[n:]
+
+	dropped := s.dropped
+	s.dropped = 0
+	return records, dropped
+}
+
+// Requeue puts records that could not be sent back in front of the spool. Records that no
+// longer fit are dropped, oldest first.
+func (s *spool[T]) Requeue(records []T, dropped int) {
+	s.mu.Lock()
+	all := append(append(make([]T, 0, len(records)+len(s.records)), records...), s.records...)
+	s.dropped += dropped
+	if excess := len(all) - s.limit; excess > 0 {
+		all = all[excess:]
+		s.dropped += excess
+	}
+	s.records = all
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// Len returns the number of waiting records
+func (s *spool[T]) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+func (s *spool[T]) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	s := newSpool[int](3)
+
+	select {
+	case <-s.Ready():
+		t.Fatal("empty spool is ready")
+	default:
+	}
+
+	for i := 1; i <= 5; i++ {
+		s.Push(i)
+	}
+	<-s.Ready()
+
+	// The oldest records are dropped once the spool is full
+	records, dropped := s.Take(2)
+	if !reflect.DeepEqual(records, []int{3, 4}) || dropped != 2 {
+		t.Fatal("took", records, "with", dropped, "dropped")
+	}
+
+	// Records that could not be sent go back in front, in order
+	s.Push(6)
+	s.Requeue(records, dropped)
+	<-s.Ready()
+	if s.Len() != 3 {
+		t.Fatal("spool holds", s.Len(), "records")
+	}
+	records, dropped = s.Take(10)
+	if !reflect.DeepEqual(records, []int{4, 5, 6}) || dropped != 3 {
+		t.Fatal("took", records, "with", dropped, "dropped after requeueing")
+	}
+
+	if records, dropped := s.Take(10); len(records) != 0 || dropped != 0 {
+		t.Fatal("drained spool returned", records, dropped)
+	}
+}
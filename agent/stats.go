@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+)
+
+// statsSource is the part of the Docker client the stats collector uses
+type statsSource interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerStatsOneShot(ctx context.Context, containerID string) (types.ContainerStats, error)
+}
+
+// statsCollector samples the resource usage of the selected running containers.
+// One-shot stats don't include the previous CPU usage, so the collector keeps
+// the CPU usage of the last sample of every container to compute the percentage.
+type statsCollector struct {
+	selector *containerSelector
+	previous map[string]types.CPUStats
+}
+
+func newStatsCollector(selector *containerSelector) *statsCollector {
+	return &statsCollector{
+		selector: selector,
+		previous: map[string]types.CPUStats{},
+	}
+}
+
+// Collect samples every selected running container. Containers that stop while
+// being sampled are skipped.
+func (c *statsCollector) Collect(ctx context.Context, source statsSource) ([]protocol.ContainerStats, error) {
+	containers, err := source.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	samples := []protocol.ContainerStats{}
+	seen := map[string]bool{}
+	for _, container := range containers {
+		if !c.selector.Match(container.ID, container.Names) {
+			continue
+		}
+
+		stats, err := sampleStats(ctx, source, container.ID)
+		if err != nil {
+			continue
+		}
+		seen[container.ID] = true
+
+		name := ""
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		var previous *types.CPUStats
+		if cpu, ok := c.previous[container.ID]; ok {
+			previous = &cpu
+		}
+		samples = append(samples, computeStats(container.ID, name, stats, previous))
+		c.previous[container.ID] = stats.CPUStats
+	}
+
+	// Forget containers that are gone, a restarted container starts over
+	for id := range c.previous {
+		if !seen[id] {
+			delete(c.previous, id)
+		}
+	}
+
+	return samples, nil
+}
+
+// sampleStats reads one stats sample of a container
+func sampleStats(ctx context.Context, source statsSource, containerId string) (types.StatsJSON, error) {
+	resp, err := source.ContainerStatsOneShot(ctx, containerId)
+	if err != nil {
+		return types.StatsJSON{}, err
+	}
+	defer resp.Body.Close()
+
+	var stats types.StatsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return types.StatsJSON{}, err
+	}
+	return stats, nil
+}
+
+// computeStats turns a Docker stats sample into a ContainerStats, using the CPU usage of
+// the previous sample for the CPU percentage. Without a previous sample it is 0.
+func computeStats(id, name string, stats types.StatsJSON, previous *types.CPUStats) protocol.ContainerStats {
+	sample := protocol.ContainerStats{
+		ContainerId: id,
+		Name:        name,
+		Timestamp:   stats.Read,
+		MemoryUsage: memoryUsage(stats.MemoryStats),
+		MemoryLimit: stats.MemoryStats.Limit,
+		Pids:        stats.PidsStats.Current,
+	}
+	if sample.Timestamp.IsZero() {
+		sample.Timestamp = time.Now()
+	}
+
+	if previous != nil {
+		sample.CPUPercent = cpuPercent(*previous, stats.CPUStats)
+	}
+	if sample.MemoryLimit > 0 {
+		sample.MemoryPercent = float64(sample.MemoryUsage) / float64(sample.MemoryLimit) * 100
+	}
+
+	for _, network := range stats.Networks {
+		sample.NetworkRx += network.RxBytes
+		sample.NetworkTx += network.TxBytes
+	}
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			sample.BlockRead += entry.Value
+		case "write":
+			sample.BlockWrite += entry.Value
+		}
+	}
+
+	return sample
+}
+
+// cpuPercent computes the CPU usage between two samples the way docker stats does
+func cpuPercent(previous, current types.CPUStats) float64 {
+	// Counters go backwards when a container restarts
+	if current.CPUUsage.TotalUsage <= previous.CPUUsage.TotalUsage || current.SystemUsage <= previous.SystemUsage {
+		return 0
+	}
+
+	cpuDelta := float64(current.CPUUsage.TotalUsage - previous.CPUUsage.TotalUsage)
+	systemDelta := float64(current.SystemUsage - previous.SystemUsage)
+
+	onlineCPUs := float64(current.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(current.CPUUsage.PercpuUsage))
+	}
+
+	return cpuDelta / systemDelta * onlineCPUs * 100
+}
+
+// memoryUsage returns the memory used without the page cache, like docker stats does
+func memoryUsage(memory types.MemoryStats) uint64 {
+	// cgroup v1 reports total_inactive_file, cgroup v2 inactive_file
+	for _, key := range []string{"total_inactive_file", "inactive_file"} {
+		if inactive, ok := memory.Stats[key]; ok && inactive < memory.Usage {
+			return memory.Usage - inactive
+		}
+	}
+	return memory.Usage
+}
+
+// startStatsUpdates sends samples of the selected containers as containerStats event every
+// StatsInterval, if the server enabled the stats capability
+func (a *Agent) startStatsUpdates(log Logger) {
+	if a.StatsInterval <= 0 || a.StatsSelector.Empty() || !a.Capabilities.Has(protocol.CapabilityStats) {
+		return
+	}
+
+	collector := newStatsCollector(a.StatsSelector)
+	a.sendPeriodically(a.StatsInterval, protocol.EventContainerStats, log, func() (interface{}, error) {
+		cli, err := a.runtimeClient()
+		if err != nil {
+			return nil, err
+		}
+		defer cli.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), a.StatsInterval)
+		defer cancel()
+
+		samples, err := collector.Collect(ctx, cli)
+		if err != nil || len(samples) == 0 {
+			return nil, err
+		}
+
+		return protocol.ContainerStatsBatch{Samples: samples}, nil
+	})
+}
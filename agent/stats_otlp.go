@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"echoes/shared/protocol"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// statsExportSource is the part of the Docker client the stats exporter uses
+type statsExportSource interface {
+	statsSource
+	containerInspector
+}
+
+// statsExporter exports the stats samples of the selected containers as OTLP metrics,
+// named like those of the OpenTelemetry Collector's Docker stats receiver. Every container
+// is a resource described by its metadata, extracted again when the container restarted.
+type statsExporter struct {
+	collector *statsCollector
+	exporter  *otlpExporter
+	hostname  string
+	runtime   string
+	metadata  map[string]protocol.ContainerMeta
+}
+
+func newStatsExporter(selector *containerSelector, exporter *otlpExporter, runtime string) *statsExporter {
+	return &statsExporter{
+		collector: newStatsCollector(selector),
+		exporter:  exporter,
+		hostname:  getHostName(),
+		runtime:   runtime,
+		metadata:  map[string]protocol.ContainerMeta{},
+	}
+}
+
+// Export samples the selected containers and exports the samples
+func (e *statsExporter) Export(ctx context.Context, source statsExportSource) error {
+	samples, err := e.collector.Collect(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	metas := make([]protocol.ContainerMeta, 0, len(samples))
+	for _, sample := range samples {
+		// Containers are inspected with every sample, a restarted container has a new start
+		// time and the sums start over
+		meta, ok := e.metadata[sample.ContainerId]
+		if info, err := source.ContainerInspect(ctx, sample.ContainerId); err == nil {
+			if inspected := containerMetadata(info); !ok || !inspected.StartedAt.Equal(meta.StartedAt) {
+				meta = inspected
+				e.metadata[sample.ContainerId] = meta
+			}
+		} else if !ok {
+			meta = protocol.ContainerMeta{ContainerId: sample.ContainerId, Name: sample.Name}
+		}
+		seen[sample.ContainerId] = true
+		metas = append(metas, meta)
+	}
+	// Stopped containers are forgotten
+	for id := range e.metadata {
+		if !seen[id] {
+			delete(e.metadata, id)
+		}
+	}
+
+	if len(samples) == 0 {
+		return nil
+	}
+	return e.exporter.ExportMetrics(ctx, otlpMetricsRequest(samples, metas, e.hostname, e.runtime))
+}
+
+// otlpMetricsRequest maps the samples, with the metadata of their containers, to an export
+// request. Byte and process counts are sums starting when the container started.
+func otlpMetricsRequest(samples []protocol.ContainerStats, metas []protocol.ContainerMeta, hostname, runtime string) *colmetricspb.ExportMetricsServiceRequest {
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	for i, sample := range samples {
+		meta := metas[i]
+		at := uint64(sample.Timestamp.UnixNano())
+		var start uint64
+		if !meta.StartedAt.IsZero() {
+			start = uint64(meta.StartedAt.UnixNano())
+		}
+
+		gauge := func(name, unit string, value float64) *metricspb.Metric {
+			point := &metricspb.NumberDataPoint{TimeUnixNano: at, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: value}}
+			return &metricspb.Metric{Name: name, Unit: unit, Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{point}}}}
+		}
+		point := func(value uint64, attributes ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+			return &metricspb.NumberDataPoint{StartTimeUnixNano: start, TimeUnixNano: at, Attributes: attributes, Value: &metricspb.NumberDataPoint_AsInt{AsInt: int64(value)}}
+		}
+		sum := func(name, unit string, monotonic bool, points ...*metricspb.NumberDataPoint) *metricspb.Metric {
+			return &metricspb.Metric{Name: name, Unit: unit, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             points,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            monotonic,
+			}}}
+		}
+
+		metrics := []*metricspb.Metric{
+			gauge("container.cpu.utilization", "1", sample.CPUPercent),
+			sum("container.memory.usage.total", "By", false, point(sample.MemoryUsage)),
+			sum("container.memory.usage.limit", "By", false, point(sample.MemoryLimit)),
+			gauge("container.memory.percent", "1", sample.MemoryPercent),
+			sum("container.network.io.usage.rx_bytes", "By", true, point(sample.NetworkRx)),
+			sum("container.network.io.usage.tx_bytes", "By", true, point(sample.NetworkTx)),
+			sum("container.blockio.io_service_bytes_recursive", "By", true,
+				point(sample.BlockRead, otlpString("operation", "read")),
+				point(sample.BlockWrite, otlpString("operation", "write"))),
+			sum("container.pids.count", "{pids}", false, point(sample.Pids)),
+		}
+
+		request.ResourceMetrics = append(request.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource:     otlpResource(meta, hostname, runtime),
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: otlpScope, Metrics: metrics}},
+		})
+	}
+	return request
+}
+
+// startStatsExport exports samples of the containers selected by StatsSelector as OTLP
+// metrics every StatsInterval, regardless of the connection to the server. Failed exports
+// are dropped, the next sample follows soon.
+func (a *Agent) startStatsExport(log Logger) {
+	exporter := newStatsExporter(a.StatsSelector, a.MetricsExporter, a.Runtime.Name)
+
+	go func() {
+		ticker := time.NewTicker(a.StatsInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			cli, err := a.runtimeClient()
+			if err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), a.StatsInterval)
+				err = exporter.Export(ctx, cli)
+				cancel()
+				cli.Close()
+			}
+			if err != nil {
+				log.Warn("agent", fmt.Sprintf("Failed to export stats: %s", err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// fakeStatsSource serves stats samples for containers from memory
+type fakeStatsSource struct {
+	containers []types.Container
+	stats      map[string]types.StatsJSON
+}
+
+func (s *fakeStatsSource) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return s.containers, nil
+}
+
+func (s *fakeStatsSource) ContainerStatsOneShot(ctx context.Context, containerID string) (types.ContainerStats, error) {
+	stats, ok := s.stats[containerID]
+	if !ok {
+		return types.ContainerStats{}, errors.New("no such container")
+	}
+	body, _ := json.Marshal(stats)
+	return types.ContainerStats{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func cpuSample(total, system uint64) types.StatsJSON {
+	var stats types.StatsJSON
+	stats.CPUStats.CPUUsage.TotalUsage = total
+	stats.CPUStats.SystemUsage = system
+	stats.CPUStats.OnlineCPUs = 2
+	return stats
+}
+
+func TestContainerSelector(t *testing.T) {
+	selector, err := newContainerSelector([]string{"^web-", " ", "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id    string
+		names []string
+		match bool
+	}{
+		{"ffff", []string{"/web-1"}, true},
+		{"ffff", []string{"/db", "/web-2"}, true},
+		{"abc123def", []string{"/db"}, true},
+		{"ffff", []string{"/db-web-1"}, false},
+		{"ffff", nil, false},
+	}
+	for _, test := range tests {
+		if match := selector.Match(test.id, test.names); match != test.match {
+			t.Errorf("%s %v matched %t, expected %t", test.id, test.names, match, test.match)
+		}
+	}
+
+	if empty, _ := newContainerSelector([]string{""}); !empty.Empty() || empty.Match("ffff", []string{"/web-1"}) {
+		t.Fatal("selector without patterns selects containers")
+	}
+	if _, err := newContainerSelector([]string{"web-("}); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	stats := cpuSample(3_000, 20_000)
+	stats.Read = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	stats.MemoryStats = types.MemoryStats{
+		Usage: 600,
+		Limit: 1_000,
+		Stats: map[string]uint64{"inactive_file": 100},
+	}
+	stats.PidsStats.Current = 7
+	stats.Networks = map[string]types.NetworkStats{
+		"eth0": {RxBytes: 10, TxBytes: 20},
+		"eth1": {RxBytes: 1, TxBytes: 2},
+	}
+	stats.BlkioStats.IoServiceBytesRecursive = []types.BlkioStatEntry{
+		{Op: "Read", Value: 5},
+		{Op: "write", Value: 6},
+		{Op: "read", Value: 1},
+		{Op: "Total", Value: 12},
+	}
+
+	previous := cpuSample(1_000, 10_000).CPUStats
+	sample := computeStats("abc", "web", stats, &previous)
+
+	if sample.ContainerId != "abc" || sample.Name != "web" || !sample.Timestamp.Equal(stats.Read) {
+		t.Fatal("unexpected sample identity", sample)
+	}
+	// 2000 of 10000 system ticks on 2 CPUs
+	if sample.CPUPercent != 40 {
+		t.Error("cpu percent", sample.CPUPercent)
+	}
+	if sample.MemoryUsage != 500 || sample.MemoryLimit != 1_000 || sample.MemoryPercent != 50 {
+		t.Error("memory", sample.MemoryUsage, sample.MemoryLimit, sample.MemoryPercent)
+	}
+	if sample.NetworkRx != 11 || sample.NetworkTx != 22 {
+		t.Error("network", sample.NetworkRx, sample.NetworkTx)
+	}
+	if sample.BlockRead != 6 || sample.BlockWrite != 6 {
+		t.Error("block io", sample.BlockRead, sample.BlockWrite)
+	}
+	if sample.Pids != 7 {
+		t.Error("pids", sample.Pids)
+	}
+
+	if sample := computeStats("abc", "web", stats, nil); sample.CPUPercent != 0 {
+		t.Error("cpu percent without previous sample", sample.CPUPercent)
+	}
+	// The counters restart with the container
+	restarted := cpuSample(5_000, 30_000).CPUStats
+	if sample := computeStats("abc", "web", stats, &restarted); sample.CPUPercent != 0 {
+		t.Error("cpu percent after counter reset", sample.CPUPercent)
+	}
+}
+
+func TestStatsCollector(t *testing.T) {
+	source := &fakeStatsSource{
+		containers: []types.Container{
+			{ID: "a", Names: []string{"/web-1"}},
+			{ID: "b", Names: []string{"/db"}},
+			{ID: "c", Names: []string{"/web-gone"}},
+		},
+		stats: map[string]types.StatsJSON{
+			"a": cpuSample(1_000, 10_000),
+			"b": cpuSample(1_000, 10_000),
+		},
+	}
+	selector, _ := newContainerSelector([]string{"^web-"})
+	collector := newStatsCollector(selector)
+
+	samples, err := collector.Collect(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].ContainerId != "a" || samples[0].Name != "web-1" || samples[0].CPUPercent != 0 {
+		t.Fatal("unexpected first samples", samples)
+	}
+
+	source.stats["a"] = cpuSample(2_000, 20_000)
+	samples, err = collector.Collect(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].CPUPercent != 20 {
+		t.Fatal("unexpected second samples", samples)
+	}
+
+	source.containers = nil
+	if samples, _ := collector.Collect(context.Background(), source); len(samples) != 0 || len(collector.previous) != 0 {
+		t.Fatal("stopped containers not forgotten", samples, collector.previous)
+	}
+}
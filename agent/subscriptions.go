@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	// defaultSubscriptionTTL and maxSubscriptionTTL are the default and longest time
+	// a log subscription lives without being renewed
+	defaultSubscriptionTTL = time.Minute
+	maxSubscriptionTTL     = 10 * time.Minute
+	// maxLogSubscriptions bounds the subscriptions of a connection
+	maxLogSubscriptions = 64
+	// logFlushInterval is how long lines of a followed container are collected before they are sent
+	logFlushInterval = 250 * time.Millisecond
+	// maxPendingLogEntries is the number of collected lines that are sent right away
+	maxPendingLogEntries = 1000
+	// subscriptionExpiryInterval is how often expired subscriptions are ended
+	subscriptionExpiryInterval = time.Second
+)
+
+// Reasons for ending a subscription
+const (
+	subscriptionExpired  = "expired"
+	subscriptionFinished = "container stopped"
+)
+
+// logSubscription is a subscription of the server to the live logs of a container
+type logSubscription struct {
+	id        string
+	filter    *regexp.Regexp
+	stdout    bool
+	stderr    bool
+	expiresAt time.Time
+	stream    *logStream
+}
+
+// Match reports whether a line passes the subscription's stream selection and filter
+func (s logSubscription) Match(entry protocol.LogEntry) bool {
+	if entry.Stream == protocol.StreamStderr && !s.stderr || entry.Stream != protocol.StreamStderr && !s.stdout {
+		return false
+	}
+	return s.filter == nil || s.filter.MatchString(entry.Line)
+}
+
+// logStream follows the logs of a container for all of its subscriptions
+type logStream struct {
+	containerId   string
+	cancel        context.CancelFunc
+	subscriptions map[string]*logSubscription
+}
+
+// logSubscriptions manages the log subscriptions of a connection. Subscriptions to the same
+// container share one Docker log stream, which stops with the container's last subscription.
+type logSubscriptions struct {
+	source        logSource
+	metadata      *metadataCache
+	send          func(event string, payload interface{}) error
+	flushInterval time.Duration
+
+	mu            sync.Mutex
+	subscriptions map[string]*logSubscription
+	streams       map[string]*logStream
+}
+
+func newLogSubscriptions(source logSource, metadata *metadataCache, send func(event string, payload interface{}) error) *logSubscriptions {
+	return &logSubscriptions{
+		source:        source,
+		metadata:      metadata,
+		send:          send,
+		flushInterval: logFlushInterval,
+		subscriptions: map[string]*logSubscription{},
+		streams:       map[string]*logStream{},
+	}
+}
+
+// Subscribe starts or renews a subscription and returns when it expires
+func (m *logSubscriptions) Subscribe(req protocol.SubscribeLogsRequest, now time.Time) (time.Time, error) {
+	if req.SubscriptionId == "" {
+		return time.Time{}, errors.New("subscriptionId is required")
+	}
+	if req.ContainerId == "" {
+		return time.Time{}, errors.New("containerId is required")
+	}
+	if req.TTL < 0 {
+		return time.Time{}, errors.New("ttl must not be negative")
+	}
+
+	var filter *regexp.Regexp
+	if req.Filter != "" {
+		var err error
+		filter, err = regexp.Compile(req.Filter)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+
+	stdout, stderr := len(req.Streams) == 0, len(req.Streams) == 0
+	for _, stream := range req.Streams {
+		switch stream {
+		case protocol.StreamStdout:
+			stdout = true
+		case protocol.StreamStderr:
+			stderr = true
+		default:
+			return time.Time{}, fmt.Errorf("unknown stream %q", stream)
+		}
+	}
+
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl == 0 {
+		ttl = defaultSubscriptionTTL
+	}
+	if ttl > maxSubscriptionTTL {
+		ttl = maxSubscriptionTTL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subscriptions[req.SubscriptionId]
+	if ok && sub.stream.containerId != req.ContainerId {
+		return time.Time{}, fmt.Errorf("subscription %s follows another container", req.SubscriptionId)
+	}
+	if !ok {
+		if len(m.subscriptions) >= maxLogSubscriptions {
+			return time.Time{}, errors.New("too many log subscriptions")
+		}
+
+		stream, ok := m.streams[req.ContainerId]
+		if !ok {
+			stream = m.startStream(req.ContainerId)
+		}
+		sub = &logSubscription{id: req.SubscriptionId, stream: stream}
+		stream.subscriptions[sub.id] = sub
+		m.subscriptions[sub.id] = sub
+	}
+
+	sub.filter = filter
+	sub.stdout = stdout
+	sub.stderr = stderr
+	sub.expiresAt = now.Add(ttl)
+	return sub.expiresAt, nil
+}
+
+// Unsubscribe ends a subscription, it reports false for unknown subscriptions
+func (m *logSubscriptions) Unsubscribe(subscriptionId string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subscriptions[subscriptionId]
+	if ok {
+		m.remove(sub)
+	}
+	return ok
+}
+
+// Expire ends the subscriptions that were not renewed in time and tells the server
+func (m *logSubscriptions) Expire(now time.Time) error {
+	m.mu.Lock()
+	var expired []string
+	for _, sub := range m.subscriptions {
+		if !now.Before(sub.expiresAt) {
+			m.remove(sub)
+			expired = append(expired, sub.id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range expired {
+		if err := m.send(protocol.EventLogSubscriptionEnded, protocol.LogSubscriptionEnded{SubscriptionId: id, Reason: subscriptionExpired}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops all streams without telling the server, for connections that ended
+func (m *logSubscriptions) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sub := range m.subscriptions {
+		m.remove(sub)
+	}
+}
+
+// remove drops a subscription and stops its stream if it was the last subscription.
+// The caller holds mu.
+func (m *logSubscriptions) remove(sub *logSubscription) {
+	delete(m.subscriptions, sub.id)
+	delete(sub.stream.subscriptions, sub.id)
+
+	if len(sub.stream.subscriptions) == 0 {
+		sub.stream.cancel()
+		delete(m.streams, sub.stream.containerId)
+	}
+}
+
+// startStream starts following the logs of a container. The caller holds mu.
+func (m *logSubscriptions) startStream(containerId string) *logStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &logStream{
+		containerId:   containerId,
+		cancel:        cancel,
+		subscriptions: map[string]*logSubscription{},
+	}
+	m.streams[containerId] = stream
+
+	go m.follow(ctx, stream)
+	return stream
+}
+
+// follow passes the lines of a stream to its subscriptions until the stream is stopped,
+// or the container stops which ends the subscriptions
+func (m *logSubscriptions) follow(ctx context.Context, stream *logStream) {
+	err := m.followStream(ctx, stream)
+	if ctx.Err() != nil {
+		// The last subscription was removed
+		return
+	}
+
+	reason := subscriptionFinished
+	if err != nil {
+		reason = err.Error()
+	}
+
+	m.mu.Lock()
+	var ended []string
+	for _, sub := range stream.subscriptions {
+		m.remove(sub)
+		ended = append(ended, sub.id)
+	}
+	m.mu.Unlock()
+
+	for _, id := range ended {
+		if err := m.send(protocol.EventLogSubscriptionEnded, protocol.LogSubscriptionEnded{SubscriptionId: id, Reason: reason}); err != nil {
+			return
+		}
+	}
+}
+
+func (m *logSubscriptions) followStream(ctx context.Context, stream *logStream) error {
+	info, err := m.source.ContainerInspect(ctx, stream.containerId)
+	if err != nil {
+		return err
+	}
+	tty := info.Config != nil && info.Config.Tty
+
+	// Only new lines are followed, the server fetches the history with containerLogs
+	out, err := m.source.ContainerLogs(ctx, stream.containerId, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+		Tail:       "0",
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	entries := make(chan protocol.LogEntry, maxPendingLogEntries)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readLogEntries(out, tty, func(entry protocol.LogEntry) error {
+			select {
+			case entries <- entry:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(m.flushInterval)
+	defer ticker.Stop()
+
+	var pending []protocol.LogEntry
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case entry := <-entries:
+			pending = append(pending, entry)
+			if len(pending) < maxPendingLogEntries {
+				continue
+			}
+		case <-ticker.C:
+		case err := <-readErr:
+			// Send what was read before the stream ended
+			for len(entries) > 0 {
+				pending = append(pending, <-entries)
+			}
+			if flushErr := m.flush(ctx, stream, pending); flushErr != nil {
+				return flushErr
+			}
+			return err
+		}
+
+		if err := m.flush(ctx, stream, pending); err != nil {
+			return err
+		}
+		pending = nil
+	}
+}
+
+// flush sends the lines matching each subscription of the stream as logBatch event
+func (m *logSubscriptions) flush(ctx context.Context, stream *logStream, entries []protocol.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Subscriptions may be renewed with another filter meanwhile
+	m.mu.Lock()
+	subscriptions := make([]logSubscription, 0, len(stream.subscriptions))
+	for _, sub := range stream.subscriptions {
+		subscriptions = append(subscriptions, *sub)
+	}
+	m.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		matched := []protocol.LogEntry{}
+		for _, entry := range entries {
+			if sub.Match(entry) {
+				matched = append(matched, entry)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		batch, err := m.metadata.NewLogBatch(ctx, m.source, stream.containerId, matched)
+		if err != nil {
+			return err
+		}
+		if err := m.send(protocol.EventLogBatch, protocol.SubscriptionLogBatch{SubscriptionId: sub.id, LogBatch: batch}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startLogSubscriptions creates the log subscriptions of the current connection, if the server
+// enabled log streaming. They end with the connection.
+func (a *Agent) startLogSubscriptions(log Logger) {
+	if !a.Capabilities.Has(protocol.CapabilityLogStreaming) {
+		return
+	}
+
+	cli, err := a.runtimeClient()
+	if err != nil {
+		log.Error("agent", "Log streaming unavailable: "+err.Error())
+		return
+	}
+
+	// Bind the subscriptions to this connection, a reconnect replaces the agent's connection
+	conn := a.Connection
+	codec := a.codec()
+	disconnected := a.disconnected
+
+	subscriptions := newLogSubscriptions(cli, a.metadata, func(event string, payload interface{}) error {
+		return a.writeSealed(conn, codec, event, "", payload)
+	})
+	a.logSubscriptions = subscriptions
+
+	go func() {
+		defer cli.Close()
+		defer subscriptions.Close()
+
+		ticker := time.NewTicker(subscriptionExpiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-disconnected:
+				return
+			case now := <-ticker.C:
+				if err := subscriptions.Expire(now); err != nil {
+					log.Error("agent", "Error ending log subscriptions: "+err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// handleSubscribeLogs starts or renews a log subscription and answers with its expiry
+func (a *Agent) handleSubscribeLogs(msg protocol.Message) error {
+	if err := a.Capabilities.Require(protocol.CapabilityLogStreaming); err != nil {
+		return a.send(protocol.NewError(protocol.EventSubscribeLogs, msg.MessageId, err))
+	}
+	if a.logSubscriptions == nil {
+		return a.send(protocol.NewError(protocol.EventSubscribeLogs, msg.MessageId, errors.New("log streaming is unavailable")))
+	}
+
+	var req protocol.SubscribeLogsRequest
+	if err := a.codec().Unmarshal(msg, &req); err != nil {
+		return a.send(protocol.NewError(protocol.EventSubscribeLogs, msg.MessageId, err))
+	}
+
+	expiresAt, err := a.logSubscriptions.Subscribe(req, time.Now())
+	if err != nil {
+		return a.send(protocol.NewError(protocol.EventSubscribeLogs, msg.MessageId, err))
+	}
+
+	return a.sendSealed(protocol.EventSubscribeLogs, msg.MessageId, protocol.SubscribeLogsReply{
+		SubscriptionId: req.SubscriptionId,
+		ExpiresAt:      expiresAt,
+	})
+}
+
+// handleUnsubscribeLogs ends a log subscription
+func (a *Agent) handleUnsubscribeLogs(msg protocol.Message) error {
+	var req protocol.UnsubscribeLogsRequest
+	if err := a.codec().Unmarshal(msg, &req); err != nil {
+		return a.send(protocol.NewError(protocol.EventUnsubscribeLogs, msg.MessageId, err))
+	}
+
+	if a.logSubscriptions == nil || !a.logSubscriptions.Unsubscribe(req.SubscriptionId) {
+		return a.send(protocol.NewError(protocol.EventUnsubscribeLogs, msg.MessageId, fmt.Errorf("unknown subscription %q", req.SubscriptionId)))
+	}
+
+	return a.sendSealed(protocol.EventUnsubscribeLogs, msg.MessageId, req)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"echoes/shared/protocol"
+
+	"github.com/docker/docker/api/types"
+)
+
+// pipeLogSource follows the logs of containers through pipes the test writes to
+type pipeLogSource struct {
+	mu      sync.Mutex
+	streams map[string]*io.PipeWriter
+	opened  int
+}
+
+func (s *pipeLogSource) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return inspectedContainer(containerID, "web", 0), nil
+}
+
+func (s *pipeLogSource) ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	r, w := io.Pipe()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[container] = w
+	s.opened++
+	return r, nil
+}
+
+// writer waits until the logs of a container are followed
+func (s *pipeLogSource) writer(t *testing.T, containerId string) *io.PipeWriter {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		w := s.streams[containerId]
+		s.mu.Unlock()
+		if w != nil {
+			return w
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("logs of", containerId, "not followed")
+	return nil
+}
+
+type sentEvent struct {
+	event   string
+	payload interface{}
+}
+
+func newTestSubscriptions() (*logSubscriptions, *pipeLogSource, chan sentEvent) {
+	source := &pipeLogSource{streams: map[string]*io.PipeWriter{}}
+	sent := make(chan sentEvent, 100)
+	send := func(event string, payload interface{}) error {
+		sent <- sentEvent{event, payload}
+		return nil
+	}
+
+	subscriptions := newLogSubscriptions(source, newMetadataCache(func(meta protocol.ContainerMeta) error {
+		return send(protocol.EventContainerMeta, meta)
+	}), send)
+	subscriptions.flushInterval = 5 * time.Millisecond
+	return subscriptions, source, sent
+}
+
+func expectEvent(t *testing.T, sent chan sentEvent, event string) interface{} {
+	t.Helper()
+
+	select {
+	case e := <-sent:
+		if e.event != event {
+			t.Fatal("sent", e.event, "instead of", event)
+		}
+		return e.payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for", event)
+	}
+	return nil
+}
+
+func TestLogSubscriptions(t *testing.T) {
+	subscriptions, source, sent := newTestSubscriptions()
+	defer subscriptions.Close()
+	now := time.Now()
+
+	if _, err := subscriptions.Subscribe(protocol.SubscribeLogsRequest{SubscriptionId: "all", ContainerId: "abc"}, now); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err := subscriptions.Subscribe(protocol.SubscribeLogsRequest{SubscriptionId: "errors", ContainerId: "abc", Filter: "^ERROR", Streams: []string{"stderr"}, TTL: 5}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.Equal(now.Add(5 * time.Second)) {
+		t.Fatal("unexpected expiry", expiresAt)
+	}
+
+	w := source.writer(t, "abc")
+	w.Write(logFrame(1, "2024-01-02T03:04:05Z ERROR on stdout\n"))
+	w.Write(logFrame(2, "2024-01-02T03:04:06Z ERROR on stderr\n"))
+	w.Write(logFrame(2, "2024-01-02T03:04:07Z warning on stderr\n"))
+
+	meta := expectEvent(t, sent, protocol.EventContainerMeta).(protocol.ContainerMeta)
+	batches := map[string]protocol.SubscriptionLogBatch{}
+	for len(batches) < 2 {
+		batch := expectEvent(t, sent, protocol.EventLogBatch).(protocol.SubscriptionLogBatch)
+		if batch.ContainerId != "abc" || batch.MetaRef != meta.Ref {
+			t.Fatal("batch without metadata reference", batch)
+		}
+		batches[batch.SubscriptionId] = batch
+	}
+	if len(batches["all"].Entries) != 3 {
+		t.Fatal("unfiltered subscription got", batches["all"].Entries)
+	}
+	if entries := batches["errors"].Entries; len(entries) != 1 || entries[0].Line != "ERROR on stderr" {
+		t.Fatal("filtered subscription got", entries)
+	}
+
+	// Both subscriptions share one stream, which stops with the last one
+	source.mu.Lock()
+	opened := source.opened
+	source.mu.Unlock()
+	if opened != 1 {
+		t.Fatal("container followed", opened, "times")
+	}
+	if !subscriptions.Unsubscribe("all") || subscriptions.Unsubscribe("all") {
+		t.Fatal("unsubscribing failed")
+	}
+	if _, err := subscriptions.Subscribe(protocol.SubscribeLogsRequest{SubscriptionId: "errors", ContainerId: "other"}, now); err == nil {
+		t.Fatal("subscription moved to another container")
+	}
+
+	// Renewed subscriptions live on, the others expire
+	if _, err := subscriptions.Subscribe(protocol.SubscribeLogsRequest{SubscriptionId: "errors", ContainerId: "abc", TTL: 60}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subscriptions.Subscribe(protocol.SubscribeLogsRequest{SubscriptionId: "other", ContainerId: "def", TTL: 5}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriptions.Expire(now.Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	ended := expectEvent(t, sent, protocol.EventLogSubscriptionEnded).(protocol.LogSubscriptionEnded)
+	if ended.SubscriptionId != "other" || ended.Reason != subscriptionExpired {
+		t.Fatal("unexpected end", ended)
+	}
+
+	// Subscriptions end with their container
+	w.Close()
+	ended = expectEvent(t, sent, protocol.EventLogSubscriptionEnded).(protocol.LogSubscriptionEnded)
+	if ended.SubscriptionId != "errors" || ended.Reason != subscriptionFinished {
+		t.Fatal("unexpected end", ended)
+	}
+	if subscriptions.Unsubscribe("errors") {
+		t.Fatal("ended subscription still active")
+	}
+}
+
+func TestLogSubscriptionsInvalid(t *testing.T) {
+	subscriptions, _, _ := newTestSubscriptions()
+	defer subscriptions.Close()
+
+	invalid := []protocol.SubscribeLogsRequest{
+		{ContainerId: "abc"},
+		{SubscriptionId: "a"},
+		{SubscriptionId: "a", ContainerId: "abc", TTL: -1},
+		{SubscriptionId: "a", ContainerId: "abc", Filter: "("},
+		{SubscriptionId: "a", ContainerId: "abc", Streams: []string{"stdin"}},
+	}
+	for _, req := range invalid {
+		if _, err := subscriptions.Subscribe(req, time.Now()); err == nil {
+			t.Error("invalid subscription accepted", req)
+		}
+	}
+
+	now := time.Now()
+	if expiresAt, _ := subscriptions.Subscribe(protocol.SubscribeLogsRequest{SubscriptionId: "a", ContainerId: "abc", TTL: 3600}, now); !expiresAt.Equal(now.Add(maxSubscriptionTTL)) {
+		t.Fatal("ttl not limited", expiresAt)
+	}
+}
@@ -0,0 +1,127 @@
+// Runs the WebSocket handling of the Node server for one agent connection, so
+// nodeserver_test.go can test the agent against the real server handshake.
+//
+// Frames are exchanged with the test as JSON lines. stdin carries the frames
+// the agent sent, stdout the frames for the agent ({"send": frame}), the end
+// of the connection ({"close": true}) and the result ({"result": {...}}).
+// The database, the configuration and the logger are replaced by stubs.
+// With --no-session the server behaves like servers predating session keys.
+const Module = require("module");
+const crypto = require("crypto");
+const readline = require("readline");
+const { EventEmitter } = require("events");
+
+const token = "secret-token";
+const agentRow = { agentId: 1, token: token, publickey: "" };
+
+// knex("table").where(...).first() finds the agent by its token or id, other
+// queries resolve to nothing
+function knex(table) {
+	const conditions = {};
+	const query = new Proxy(
+		{},
+		{
+			get(target, property) {
+				switch (property) {
+					case "where":
+						return (where) => {
+							Object.assign(conditions, where);
+							return query;
+						};
+					case "first":
+						return async () =>
+							table === "agent" &&
+							(conditions.token === token ||
+								conditions.agentId === agentRow.agentId)
+								? agentRow
+								: undefined;
+					case "then":
+						return (resolve) => resolve(undefined);
+					default:
+						return () => query;
+				}
+			},
+		}
+	);
+	return query;
+}
+
+const logger = {};
+for (const level of ["debug", "info", "warn", "error"]) {
+	logger[level] = (...args) => console.error(level, ...args);
+}
+
+const stubs = {
+	"@vmgware/js-logger": { getInstance: () => logger },
+	"@container-echoes/core/database": knex,
+	"@container-echoes/core/config": {
+		getInstance: () => ({ app: { autoAddAgents: false } }),
+	},
+	ws: { OPEN: 1 },
+};
+const load = Module._load;
+Module._load = function (request, ...args) {
+	if (request in stubs) {
+		return stubs[request];
+	}
+	return load.call(this, request, ...args);
+};
+
+const WebSocketManager = require("../../server/webSocket/manager");
+const encryption = require("../../server/webSocket/encryption");
+
+if (process.argv.includes("--no-session")) {
+	// A handshake without an offer, which leaves the session field out
+	encryption.SessionHandshake = class {};
+}
+
+function write(line) {
+	process.stdout.write(JSON.stringify(line) + "\n");
+}
+
+const { publicKey, privateKey } = crypto.generateKeyPairSync("rsa", {
+	modulusLength: 2048,
+	publicKeyEncoding: { type: "spki", format: "pem" },
+	privateKeyEncoding: { type: "pkcs8", format: "pem" },
+});
+
+const wss = new EventEmitter();
+const manager = new WebSocketManager(wss, publicKey, privateKey);
+
+const ws = new EventEmitter();
+ws.readyState = 1;
+ws.send = (frame) => write({ send: frame });
+ws.close = () => write({ close: true });
+
+readline.createInterface({ input: process.stdin }).on("line", (line) => {
+	ws.emit("message", line);
+});
+process.stdin.on("end", () => process.exit(0));
+
+wss.emit("connection", ws);
+
+// Once the agent is authenticated, send it a request and report how the
+// connection was set up
+const authenticated = setInterval(async () => {
+	if (!manager.agents[agentRow.agentId]) {
+		return;
+	}
+	clearInterval(authenticated);
+
+	const reply = await manager.sendMessageAndWaitForResponse(
+		agentRow.agentId,
+		manager.events.CONTAINER_LIST,
+		{}
+	);
+	write({
+		result: {
+			agentId: ws.id,
+			session: Boolean(ws.session),
+			encryptionScheme: ws.encryptionScheme,
+			signatureScheme: ws.signatureScheme,
+			capabilities: ws.capabilities,
+			status: reply.status,
+			containers: Array.isArray(reply.data),
+		},
+	});
+}, 10);
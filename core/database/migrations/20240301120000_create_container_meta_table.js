@@ -0,0 +1,32 @@
+/**
+ * @param { import("knex").Knex } knex
+ * @returns { Promise<void> }
+ */
+exports.up = function (knex) {
+  return knex.schema.createTable("container_meta", function (table) {
+    table.increments("id").primary();
+    table.integer("agentId").unsigned().references("agentId").inTable("agent");
+    table.string("containerId", 64);
+    table.string("ref", 32);
+    table.string("name", 255);
+    table.string("image", 255);
+    table.string("tag", 128);
+    table.string("imageId", 255);
+    table.string("composeProject", 255);
+    table.string("composeService", 255);
+    table.text("labels");
+    table.integer("restartCount");
+    table.timestamp("containerCreatedAt");
+    table.timestamp("containerStartedAt");
+    table.timestamp("createdAt").defaultTo(knex.fn.now());
+    table.unique(["agentId", "containerId", "ref"]);
+  });
+};
+
+/**
+ * @param { import("knex").Knex } knex
+ * @returns { Promise<void> }
+ */
+exports.down = function (knex) {
+  return knex.schema.dropTable("container_meta");
+};
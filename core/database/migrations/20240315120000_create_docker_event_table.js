@@ -0,0 +1,26 @@
+/**
+ * @param { import("knex").Knex } knex
+ * @returns { Promise<void> }
+ */
+exports.up = function (knex) {
+  return knex.schema.createTable("docker_event", function (table) {
+    table.increments("id").primary();
+    table.integer("agentId").unsigned().references("agentId").inTable("agent");
+    table.timestamp("time", { precision: 6 });
+    table.string("type", 32);
+    table.string("action", 255);
+    table.string("actorId", 255);
+    table.text("attributes");
+    table.string("scope", 16);
+    table.timestamp("createdAt").defaultTo(knex.fn.now());
+    table.index(["agentId", "time"]);
+  });
+};
+
+/**
+ * @param { import("knex").Knex } knex
+ * @returns { Promise<void> }
+ */
+exports.down = function (knex) {
+  return knex.schema.dropTable("docker_event");
+};
@@ -13,7 +13,7 @@ const {
 	genericInternalServerError,
 	standardResponse,
 } = require("../utils/responses");
-// const AuditLog = require("@container-echoes/core/helpers/auditLog");
+const AuditLog = require("@container-echoes/core/helpers/auditLog");
 // const config = require("@container-echoes/core/config").getInstance();
 const WebSocketManager = require("../webSocket/manager").getInstance();
 
@@ -274,6 +274,11 @@ async function getContainers(req, res) {
 			{}
 		);
 
+		// The agent answers with an error status if it can't list its containers
+		if (containers.status === "error") {
+			throw new Error(containers.data);
+		}
+
 		return standardResponse(
 			res,
 			"Successfully retrieved containers for agent",
@@ -285,8 +290,893 @@ async function getContainers(req, res) {
 	}
 }
 
+/**
+ * @swagger
+ * /agents/{agentId}/containers/{containerId}/logs:
+ *   get:
+ *     tags:
+ *       - Agents
+ *     summary: Get the logs of a container
+ *     description: Fetch the log history of a container from its agent
+ *     produces:
+ *       - application/json
+ *     parameters:
+ *       - name: agentId
+ *         description: The id of the agent
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - name: containerId
+ *         description: The id or name of the container
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: string
+ *       - name: since
+ *         description: Only return lines written at or after this time (ISO 8601)
+ *         in: query
+ *         schema:
+ *           type: string
+ *       - name: until
+ *         description: Only return lines written before this time (ISO 8601)
+ *         in: query
+ *         schema:
+ *           type: string
+ *       - name: tail
+ *         description: Only return this many of the last lines
+ *         in: query
+ *         schema:
+ *           type: number
+ *       - name: streams
+ *         description: Comma separated streams to return, stdout and/or stderr
+ *         in: query
+ *         schema:
+ *           type: string
+ *       - name: maxBytes
+ *         description: The maximum size of the returned lines
+ *         in: query
+ *         schema:
+ *           type: number
+ *     responses:
+ *       200:
+ *         description: Successfully retrieved container logs
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: success
+ *                 code:
+ *                   type: number
+ *                   example: 200
+ *                 message:
+ *                   type: string
+ *                   example: Successfully retrieved container logs
+ *                 data:
+ *                   type: object
+ *                   properties:
+ *                     containerId:
+ *                       type: string
+ *                     metaRef:
+ *                       type: string
+ *                     truncated:
+ *                       type: boolean
+ *                     entries:
+ *                       type: array
+ *                       items:
+ *                         type: object
+ *       500:
+ *         description: Something went wrong. But it's probably not your fault.
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 500
+ *                 message:
+ *                   type: string
+ *                   example: Something went wrong. But it's probably not your fault.
+ *                 data:
+ *                   type: null
+ *                   example: null
+ */
+/**
+ * Get the logs of a container, the agent answers in several chunks
+ * @param {Object} req The request object.
+ * @param {Object} res The response object.
+ * @returns {Object} A response object.
+ */
+async function getContainerLogs(req, res) {
+	try {
+		const chunks = await WebSocketManager.sendMessageAndCollectResponses(
+			req.params.agentId,
+			WebSocketManager.events.CONTAINER_LOGS,
+			{
+				containerId: req.params.containerId,
+				since: req.query.since ? new Date(req.query.since) : undefined,
+				until: req.query.until ? new Date(req.query.until) : undefined,
+				tail: parseInt(req.query.tail) || 0,
+				streams: req.query.streams ? req.query.streams.split(",") : [],
+				maxBytes: parseInt(req.query.maxBytes) || 0,
+			}
+		);
+
+		// The agent answers with an error status if it can't read the logs
+		const failed = chunks.find((chunk) => chunk.status === "error");
+		if (failed) {
+			throw new Error(failed.data);
+		}
+
+		const last = chunks[chunks.length - 1].data;
+		return standardResponse(res, "Successfully retrieved container logs", {
+			containerId: last.containerId,
+			metaRef: last.metaRef,
+			truncated: Boolean(last.truncated),
+			entries: chunks.flatMap((chunk) => chunk.data.entries),
+		});
+	} catch (err) {
+		log.error("agents", "Error getting container logs: " + err);
+		genericInternalServerError(res, err, "agents");
+	}
+}
+
+/**
+ * @swagger
+ * /agents/{agentId}/containers/{containerId}/logs/live:
+ *   get:
+ *     tags:
+ *       - Agents
+ *     summary: Follow the logs of a container
+ *     description: Stream new log lines of a container as server-sent events. Every "logs" event holds a batch of entries, an "end" event with the reason is sent if the agent ends the subscription.
+ *     produces:
+ *       - text/event-stream
+ *     parameters:
+ *       - name: agentId
+ *         description: The id of the agent
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - name: containerId
+ *         description: The id or name of the container
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: string
+ *       - name: filter
+ *         description: A regular expression the lines have to match
+ *         in: query
+ *         schema:
+ *           type: string
+ *       - name: streams
+ *         description: Comma separated streams to follow, stdout and/or stderr
+ *         in: query
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The log stream
+ *         content:
+ *           text/event-stream:
+ *             schema:
+ *               type: string
+ *       500:
+ *         description: Something went wrong. But it's probably not your fault.
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 500
+ *                 message:
+ *                   type: string
+ *                   example: Something went wrong. But it's probably not your fault.
+ *                 data:
+ *                   type: null
+ *                   example: null
+ */
+/**
+ * Follow the logs of a container, the subscription ends when the client disconnects
+ * @param {Object} req The request object.
+ * @param {Object} res The response object.
+ * @returns {Object} A response object.
+ */
+async function followContainerLogs(req, res) {
+	let subscriptionId;
+	try {
+		subscriptionId = await WebSocketManager.subscribeLogs(
+			req.params.agentId,
+			{
+				containerId: req.params.containerId,
+				filter: req.query.filter,
+				streams: req.query.streams ? req.query.streams.split(",") : [],
+			},
+			(batch) => {
+				res.write(`event: logs\ndata: ${JSON.stringify(batch)}\n\n`);
+			},
+			(reason) => {
+				res.write(`event: end\ndata: ${JSON.stringify(reason)}\n\n`);
+				res.end();
+			}
+		);
+	} catch (err) {
+		log.error("agents", "Error following container logs: " + err);
+		return genericInternalServerError(res, err, "agents");
+	}
+
+	res.writeHead(200, {
+		"Content-Type": "text/event-stream",
+		"Cache-Control": "no-cache",
+		Connection: "keep-alive",
+	});
+	req.on("close", () => WebSocketManager.unsubscribeLogs(subscriptionId));
+}
+
+/**
+ * @swagger
+ * /agents/{agentId}/containers/{containerId}/actions:
+ *   post:
+ *     tags:
+ *       - Agents
+ *     summary: Run a container action
+ *     description: Start, stop, restart, pause, unpause or kill a container. The agent only runs the actions its configuration allows for the container.
+ *     produces:
+ *       - application/json
+ *     parameters:
+ *       - name: agentId
+ *         description: The id of the agent
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - name: containerId
+ *         description: The id or name of the container
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               action:
+ *                 type: string
+ *                 enum: [start, stop, restart, pause, unpause, kill]
+ *               signal:
+ *                 type: string
+ *                 example: SIGTERM
+ *               timeout:
+ *                 type: number
+ *                 example: 10
+ *     responses:
+ *       200:
+ *         description: Successfully ran container action
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: success
+ *                 code:
+ *                   type: number
+ *                   example: 200
+ *                 message:
+ *                   type: string
+ *                   example: Successfully ran container action
+ *                 data:
+ *                   type: object
+ *                   properties:
+ *                     containerId:
+ *                       type: string
+ *                     name:
+ *                       type: string
+ *                     action:
+ *                       type: string
+ *                     state:
+ *                       type: string
+ *                     completedAt:
+ *                       type: string
+ *       500:
+ *         description: Something went wrong. But it's probably not your fault.
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 500
+ *                 message:
+ *                   type: string
+ *                   example: Something went wrong. But it's probably not your fault.
+ *                 data:
+ *                   type: null
+ *                   example: null
+ */
+/**
+ * Run a lifecycle action on a container
+ * @param {Object} req The request object.
+ * @param {Object} res The response object.
+ * @returns {Object} A response object.
+ */
+async function runContainerAction(req, res) {
+	const action = {
+		containerId: req.params.containerId,
+		action: req.body.action,
+		signal: req.body.signal,
+		timeout: req.body.timeout,
+	};
+
+	try {
+		const result = await WebSocketManager.sendMessageAndWaitForResponse(
+			req.params.agentId,
+			WebSocketManager.events.CONTAINER_ACTION,
+			action
+		);
+
+		AuditLog.log(
+			"container." + action.action,
+			"agent",
+			req.params.agentId,
+			result.status === "error" ? result.data : "Container action",
+			action,
+			"user",
+			req.user
+		);
+
+		// The agent answers with an error status if the action is not allowed or failed
+		if (result.status === "error") {
+			throw new Error(result.data);
+		}
+
+		return standardResponse(
+			res,
+			"Successfully ran container action",
+			result.data
+		);
+	} catch (err) {
+		log.error("agents", "Error running container action: " + err);
+		genericInternalServerError(res, err, "agents");
+	}
+}
+
+/**
+ * @swagger
+ * /agents/{agentId}/containers/{containerId}/exec:
+ *   post:
+ *     tags:
+ *       - Agents
+ *     summary: Run a command in a container
+ *     description: Start an interactive command in a container, if the agent enabled exec, and stream it as server-sent events. A "started" event holds the sessionId used to send input, "output" events hold the stream and the base64 data, and an "exit" event with the exitCode and the reason ends the stream. The session is closed when the client disconnects.
+ *     produces:
+ *       - text/event-stream
+ *     parameters:
+ *       - name: agentId
+ *         description: The id of the agent
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - name: containerId
+ *         description: The id or name of the container
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               cmd:
+ *                 type: array
+ *                 items:
+ *                   type: string
+ *                 example: ["sh"]
+ *               tty:
+ *                 type: boolean
+ *               user:
+ *                 type: string
+ *               workingDir:
+ *                 type: string
+ *               env:
+ *                 type: array
+ *                 items:
+ *                   type: string
+ *               cols:
+ *                 type: number
+ *                 example: 80
+ *               rows:
+ *                 type: number
+ *                 example: 24
+ *     responses:
+ *       200:
+ *         description: The exec session
+ *         content:
+ *           text/event-stream:
+ *             schema:
+ *               type: string
+ *       500:
+ *         description: Something went wrong. But it's probably not your fault.
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 500
+ *                 message:
+ *                   type: string
+ *                   example: Something went wrong. But it's probably not your fault.
+ *                 data:
+ *                   type: null
+ *                   example: null
+ */
+/**
+ * Run an interactive command in a container, the session is closed when the client disconnects
+ * @param {Object} req The request object.
+ * @param {Object} res The response object.
+ * @returns {Object} A response object.
+ */
+async function startExec(req, res) {
+	const options = {
+		containerId: req.params.containerId,
+		cmd: req.body.cmd,
+		tty: req.body.tty,
+		user: req.body.user,
+		workingDir: req.body.workingDir,
+		env: req.body.env,
+		cols: req.body.cols,
+		rows: req.body.rows,
+	};
+
+	// Output may arrive before the session started, it's held back until the stream is set up
+	let pending = [];
+	const send = (event, data) => {
+		if (pending) {
+			pending.push({ event, data });
+			return;
+		}
+		res.write(`event: ${event}\ndata: ${JSON.stringify(data)}\n\n`);
+		if (event === "exit") {
+			res.end();
+		}
+	};
+
+	let sessionId;
+	try {
+		sessionId = await WebSocketManager.startExec(
+			req.params.agentId,
+			options,
+			(stream, data) =>
+				send("output", { stream: stream, data: data.toString("base64") }),
+			(exitCode, reason) => send("exit", { exitCode, reason }),
+			req.user
+		);
+	} catch (err) {
+		AuditLog.log(
+			"container.exec",
+			"agent",
+			req.params.agentId,
+			err.message,
+			options,
+			"user",
+			req.user
+		);
+		log.error("agents", "Error starting exec session: " + err);
+		return genericInternalServerError(res, err, "agents");
+	}
+
+	AuditLog.log(
+		"container.exec",
+		"agent",
+		req.params.agentId,
+		"Exec session",
+		{ ...options, sessionId },
+		"user",
+		req.user
+	);
+
+	res.writeHead(200, {
+		"Content-Type": "text/event-stream",
+		"Cache-Control": "no-cache",
+		Connection: "keep-alive",
+	});
+	const held = [{ event: "started", data: { sessionId } }, ...pending];
+	pending = null;
+	held.forEach(({ event, data }) => send(event, data));
+	req.on("close", () => WebSocketManager.closeExec(sessionId));
+}
+
+/**
+ * Checks that an exec session exists on the agent of the request and was started by the requesting user
+ * @param {Object} req The request object.
+ * @returns {boolean} Whether the user may use the session
+ */
+function ownsExecSession(req) {
+	const session = WebSocketManager.execSessions.get(req.params.sessionId);
+	return Boolean(
+		session &&
+			session.agentId === String(req.params.agentId) &&
+			session.owner === req.user
+	);
+}
+
+/**
+ * @swagger
+ * /agents/{agentId}/exec/{sessionId}/input:
+ *   post:
+ *     tags:
+ *       - Agents
+ *     summary: Send input to an exec session
+ *     description: Send input to the command of an exec session. With eof the command's stdin is closed after the input, its output keeps streaming until it exits.
+ *     produces:
+ *       - application/json
+ *     parameters:
+ *       - name: agentId
+ *         description: The id of the agent
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - name: sessionId
+ *         description: The id of the exec session
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               data:
+ *                 type: string
+ *                 description: The base64 encoded input
+ *               eof:
+ *                 type: boolean
+ *     responses:
+ *       200:
+ *         description: Successfully sent exec input
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: success
+ *                 code:
+ *                   type: number
+ *                   example: 200
+ *                 message:
+ *                   type: string
+ *                   example: Successfully sent exec input
+ *                 data:
+ *                   type: null
+ *                   example: null
+ *       404:
+ *         description: The exec session does not exist or belongs to another user
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 404
+ *                 message:
+ *                   type: string
+ *                   example: Exec session not found
+ *                 data:
+ *                   type: null
+ *                   example: null
+ *       500:
+ *         description: Something went wrong. But it's probably not your fault.
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 500
+ *                 message:
+ *                   type: string
+ *                   example: Something went wrong. But it's probably not your fault.
+ *                 data:
+ *                   type: null
+ *                   example: null
+ */
+/**
+ * Send input to an exec session
+ * @param {Object} req The request object.
+ * @param {Object} res The response object.
+ * @returns {Object} A response object.
+ */
+async function sendExecInput(req, res) {
+	try {
+		if (!ownsExecSession(req)) {
+			return standardResponse(res, "Exec session not found", null, 404);
+		}
+
+		WebSocketManager.sendExecInput(
+			req.params.sessionId,
+			Buffer.from(req.body.data || "", "base64"),
+			req.body.eof
+		);
+		return standardResponse(res, "Successfully sent exec input", null);
+	} catch (err) {
+		log.error("agents", "Error sending exec input: " + err);
+		genericInternalServerError(res, err, "agents");
+	}
+}
+
+/**
+ * @swagger
+ * /agents/{agentId}/exec/{sessionId}/resize:
+ *   post:
+ *     tags:
+ *       - Agents
+ *     summary: Resize the terminal of an exec session
+ *     description: Resize the terminal of an exec session started with tty
+ *     produces:
+ *       - application/json
+ *     parameters:
+ *       - name: agentId
+ *         description: The id of the agent
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - name: sessionId
+ *         description: The id of the exec session
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               cols:
+ *                 type: number
+ *                 example: 80
+ *               rows:
+ *                 type: number
+ *                 example: 24
+ *     responses:
+ *       200:
+ *         description: Successfully resized exec session
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: success
+ *                 code:
+ *                   type: number
+ *                   example: 200
+ *                 message:
+ *                   type: string
+ *                   example: Successfully resized exec session
+ *                 data:
+ *                   type: null
+ *                   example: null
+ *       404:
+ *         description: The exec session does not exist or belongs to another user
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 404
+ *                 message:
+ *                   type: string
+ *                   example: Exec session not found
+ *                 data:
+ *                   type: null
+ *                   example: null
+ *       500:
+ *         description: Something went wrong. But it's probably not your fault.
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 500
+ *                 message:
+ *                   type: string
+ *                   example: Something went wrong. But it's probably not your fault.
+ *                 data:
+ *                   type: null
+ *                   example: null
+ */
+/**
+ * Resize the terminal of an exec session
+ * @param {Object} req The request object.
+ * @param {Object} res The response object.
+ * @returns {Object} A response object.
+ */
+async function resizeExec(req, res) {
+	try {
+		if (!ownsExecSession(req)) {
+			return standardResponse(res, "Exec session not found", null, 404);
+		}
+
+		WebSocketManager.resizeExec(
+			req.params.sessionId,
+			req.body.cols,
+			req.body.rows
+		);
+		return standardResponse(res, "Successfully resized exec session", null);
+	} catch (err) {
+		log.error("agents", "Error resizing exec session: " + err);
+		genericInternalServerError(res, err, "agents");
+	}
+}
+
+/**
+ * @swagger
+ * /agents/{agentId}/exec/{sessionId}:
+ *   delete:
+ *     tags:
+ *       - Agents
+ *     summary: Close an exec session
+ *     description: Close an exec session, its event stream ends with the exit event
+ *     produces:
+ *       - application/json
+ *     parameters:
+ *       - name: agentId
+ *         description: The id of the agent
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - name: sessionId
+ *         description: The id of the exec session
+ *         in: path
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Successfully closed exec session
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: success
+ *                 code:
+ *                   type: number
+ *                   example: 200
+ *                 message:
+ *                   type: string
+ *                   example: Successfully closed exec session
+ *                 data:
+ *                   type: null
+ *                   example: null
+ *       404:
+ *         description: The exec session does not exist or belongs to another user
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 404
+ *                 message:
+ *                   type: string
+ *                   example: Exec session not found
+ *                 data:
+ *                   type: null
+ *                   example: null
+ *       500:
+ *         description: Something went wrong. But it's probably not your fault.
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 status:
+ *                   type: string
+ *                   example: error
+ *                 code:
+ *                   type: number
+ *                   example: 500
+ *                 message:
+ *                   type: string
+ *                   example: Something went wrong. But it's probably not your fault.
+ *                 data:
+ *                   type: null
+ *                   example: null
+ */
+/**
+ * Close an exec session
+ * @param {Object} req The request object.
+ * @param {Object} res The response object.
+ * @returns {Object} A response object.
+ */
+async function closeExec(req, res) {
+	try {
+		if (!ownsExecSession(req)) {
+			return standardResponse(res, "Exec session not found", null, 404);
+		}
+
+		WebSocketManager.closeExec(req.params.sessionId);
+		return standardResponse(res, "Successfully closed exec session", null);
+	} catch (err) {
+		log.error("agents", "Error closing exec session: " + err);
+		genericInternalServerError(res, err, "agents");
+	}
+}
+
 module.exports = {
 	getAll,
 	getOne,
 	getContainers,
+	getContainerLogs,
+	followContainerLogs,
+	runContainerAction,
+	startExec,
+	sendExecInput,
+	resizeExec,
+	closeExec,
 };
@@ -5,9 +5,47 @@ const router = express.Router();
 // Controller
 const AgentsController = require("../controllers/agents");
 
+// Middleware
+const { auth } = require("../middleware/auth");
+
 // Routes
 router.get("/agents", AgentsController.getAll);
 router.get("/agents/:agentId", AgentsController.getOne);
 router.get("/agents/:agentId/containers", AgentsController.getContainers);
+router.get(
+	"/agents/:agentId/containers/:containerId/logs",
+	auth,
+	AgentsController.getContainerLogs
+);
+router.get(
+	"/agents/:agentId/containers/:containerId/logs/live",
+	auth,
+	AgentsController.followContainerLogs
+);
+router.post(
+	"/agents/:agentId/containers/:containerId/actions",
+	auth,
+	AgentsController.runContainerAction
+);
+router.post(
+	"/agents/:agentId/containers/:containerId/exec",
+	auth,
+	AgentsController.startExec
+);
+router.post(
+	"/agents/:agentId/exec/:sessionId/input",
+	auth,
+	AgentsController.sendExecInput
+);
+router.post(
+	"/agents/:agentId/exec/:sessionId/resize",
+	auth,
+	AgentsController.resizeExec
+);
+router.delete(
+	"/agents/:agentId/exec/:sessionId",
+	auth,
+	AgentsController.closeExec
+);
 
 module.exports = router;
@@ -0,0 +1,205 @@
+const chai = require("chai");
+const assert = chai.assert;
+const crypto = require("crypto");
+
+const encryption = require("../../webSocket/encryption");
+const Codec = require("../../webSocket/codec");
+
+describe("WebSocket Encryption Tests", function () {
+	const { publicKey, privateKey } = crypto.generateKeyPairSync("rsa", {
+		modulusLength: 2048,
+		publicKeyEncoding: { type: "spki", format: "pem" },
+		privateKeyEncoding: { type: "pkcs8", format: "pem" },
+	});
+
+	describe("Scheme Negotiation", function () {
+		it("should pick the strongest advertised scheme", function () {
+			assert.strictEqual(
+				encryption.strongest(encryption.ENCRYPTION_SCHEMES, [
+					encryption.SCHEMES.OAEP_SHA1,
+					encryption.SCHEMES.OAEP_SHA256,
+				]),
+				encryption.SCHEMES.OAEP_SHA256
+			);
+		});
+
+		it("should fall back to the defaults without advertised schemes", function () {
+			assert.strictEqual(
+				encryption.strongest(encryption.ENCRYPTION_SCHEMES, []),
+				encryption.SCHEMES.OAEP_SHA1
+			);
+			assert.strictEqual(
+				encryption.strongest(encryption.SIGNATURE_SCHEMES, ["unknown"]),
+				encryption.SCHEMES.PKCS1V15
+			);
+		});
+	});
+
+	describe("Encryption & Decryption", function () {
+		for (const scheme of encryption.ENCRYPTION_SCHEMES) {
+			it(`should encrypt and decrypt several blocks with ${scheme}`, function () {
+				const data = Buffer.from("x".repeat(1000));
+				const encrypted = encryption.encrypt(data, publicKey, scheme);
+				assert.strictEqual(encrypted.length % 256, 0);
+				assert.deepEqual(
+					encryption.decrypt(encrypted, privateKey, scheme),
+					data
+				);
+			});
+		}
+
+		it("should not decrypt with another scheme", function () {
+			const encrypted = encryption.encrypt(
+				Buffer.from("Hello World!"),
+				publicKey,
+				encryption.SCHEMES.OAEP_SHA256
+			);
+			assert.throws(() =>
+				encryption.decrypt(encrypted, privateKey, encryption.SCHEMES.OAEP_SHA1)
+			);
+		});
+	});
+
+	describe("Signatures", function () {
+		for (const scheme of encryption.SIGNATURE_SCHEMES) {
+			it(`should sign and verify with ${scheme}`, function () {
+				const signature = encryption.sign("Hello World!", privateKey, scheme);
+				assert.ok(
+					encryption.verify("Hello World!", signature, publicKey, scheme)
+				);
+				assert.ok(
+					!encryption.verify("Hello World?", signature, publicKey, scheme)
+				);
+			});
+		}
+
+		it("should reject signatures that are not hex encoded", function () {
+			assert.ok(!encryption.verify("Hello World!", "zz", publicKey));
+			assert.ok(!encryption.verify("Hello World!", undefined, publicKey));
+		});
+	});
+
+	describe("Streams", function () {
+		for (const length of [0, 100, 64 * 1024, 200 * 1024]) {
+			it(`should open a stream of ${length} bytes`, function () {
+				const data = crypto.randomBytes(length);
+				const stream = encryption.sealStream(data, publicKey);
+				assert.deepEqual(encryption.openStream(stream, privateKey), data);
+			});
+		}
+
+		it("should reject truncated streams and trailing data", function () {
+			const stream = encryption.sealStream(
+				crypto.randomBytes(100 * 1024),
+				publicKey
+			);
+			assert.throws(() =>
+				encryption.openStream(stream.subarray(0, stream.length - 1), privateKey)
+			);
+			assert.throws(() =>
+				encryption.openStream(
+					Buffer.concat([stream, Buffer.from([0])]),
+					privateKey
+				)
+			);
+		});
+
+		it("should reject streams without their final chunk", function () {
+			const data = crypto.randomBytes(100 * 1024 + 100);
+			const stream = encryption.sealStream(data, publicKey, undefined, 1024);
+			// Drop the final chunk of 100 bytes plus its tag and length
+			const truncated = stream.subarray(0, stream.length - (100 + 16 + 4));
+			assert.throws(() => encryption.openStream(truncated, privateKey));
+		});
+	});
+
+	describe("Session Keys", function () {
+		function sessionPair(options) {
+			const agent = new encryption.SessionHandshake(
+				privateKey,
+				encryption.SCHEMES.PSS,
+				options
+			);
+			const server = new encryption.SessionHandshake(
+				privateKey,
+				encryption.SCHEMES.PSS,
+				options
+			);
+			return [
+				agent.complete(server.offer, publicKey, true),
+				server.complete(agent.offer, publicKey, false),
+			];
+		}
+
+		it("should open what the peer sealed in both directions", function () {
+			const [agent, server] = sessionPair();
+			const data = Buffer.from("Hello World!");
+			assert.deepEqual(server.open(agent.seal(data)), data);
+			assert.deepEqual(agent.open(server.seal(data)), data);
+		});
+
+		it("should reject replayed and modified messages", function () {
+			const [agent, server] = sessionPair();
+			const sealed = agent.seal(Buffer.from("Hello World!"));
+			server.open(sealed);
+			assert.throws(() => server.open(sealed));
+
+			const modified = agent.seal(Buffer.from("Hello World!"));
+			modified[modified.length - 1] ^= 1;
+			assert.throws(() => server.open(modified));
+		});
+
+		it("should follow the peer's re-keys", function () {
+			const [agent, server] = sessionPair({ rekeyBytes: 16 });
+			for (let i = 0; i < 3; i++) {
+				const data = Buffer.from(`message ${i} longer than the limit`);
+				assert.deepEqual(server.open(agent.seal(data)), data);
+			}
+			assert.strictEqual(agent.send.epoch, 2);
+			assert.strictEqual(server.recv.epoch, 2);
+		});
+
+		it("should reject offers with an invalid signature", function () {
+			const agent = new encryption.SessionHandshake(
+				privateKey,
+				encryption.SCHEMES.PSS
+			);
+			const server = new encryption.SessionHandshake(
+				privateKey,
+				encryption.SCHEMES.PSS
+			);
+			const offer = { ...agent.offer, publicKey: server.offer.publicKey };
+			assert.throws(() => server.complete(offer, publicKey, false));
+		});
+	});
+
+	describe("Codec", function () {
+		it("should open what it sealed with the negotiated scheme", function () {
+			const codec = new Codec({
+				privateKey,
+				peerPublicKey: publicKey,
+				scheme: encryption.SCHEMES.OAEP_SHA256,
+			});
+			const payload = { hello: "world", list: [1, 2, 3] };
+			assert.deepEqual(codec.open(codec.seal(payload)), payload);
+		});
+
+		it("should open compressed streams", function () {
+			const codec = new Codec({
+				privateKey,
+				peerPublicKey: publicKey,
+				compress: true,
+				hybrid: true,
+			});
+			const payload = { logs: "line\n".repeat(100000) };
+			const sealed = codec.seal(payload);
+			assert.ok(sealed.length < 100000);
+			assert.deepEqual(codec.open(sealed), payload);
+		});
+
+		it("should reject payloads that are not hex encoded", function () {
+			const codec = new Codec({ privateKey, peerPublicKey: publicKey });
+			assert.throws(() => codec.open("not hex"));
+		});
+	});
+});
@@ -0,0 +1,97 @@
+const zlib = require("zlib");
+const encryption = require("./encryption");
+
+/**
+ * Limits how large a compressed payload may get when decompressing it
+ */
+const MAX_DECOMPRESSED_SIZE = 64 * 1024 * 1024;
+
+/**
+ * Encrypts and decrypts the message payloads exchanged with one agent, like
+ * shared/protocol/codec.go in the agent. Payloads are JSON encoded, compressed
+ * if the compression capability is enabled, encrypted with the session keys if
+ * there are any and with the agent's public key otherwise, and hex encoded.
+ */
+class Codec {
+	/**
+	 * New Codec
+	 * @param {Object} options - The codec options
+	 * @param {string} options.privateKey - The server's private key, to decrypt payloads from the agent
+	 * @param {string} options.peerPublicKey - The agent's public key, to encrypt payloads for the agent
+	 * @param {string} options.scheme - The negotiated encryption scheme, the trsa default if empty
+	 * @param {encryption.Session} options.session - The session keys, if the handshake established a session
+	 * @param {boolean} options.compress - Whether payloads are gzip compressed before encrypting them
+	 * @param {boolean} options.hybrid - Whether payloads are encrypted as a stream instead of block by block, the session keys take precedence
+	 */
+	constructor({ privateKey, peerPublicKey, scheme, session, compress, hybrid }) {
+		this.privateKey = privateKey;
+		this.peerPublicKey = peerPublicKey;
+		this.scheme = scheme || encryption.SCHEMES.OAEP_SHA1;
+		this.session = session;
+		this.compress = Boolean(compress);
+		this.hybrid = Boolean(hybrid);
+	}
+
+	/**
+	 * Encodes, encrypts and hex encodes a payload
+	 * @param {*} payload - The payload
+	 * @returns {string} The sealed payload
+	 */
+	seal(payload) {
+		let data = Buffer.from(JSON.stringify(payload));
+		if (this.compress) {
+			data = zlib.gzipSync(data);
+		}
+
+		if (this.session) {
+			return this.session.seal(data).toString("hex");
+		}
+		if (!this.peerPublicKey) {
+			throw new Error("Peer public key is unknown, the handshake is missing");
+		}
+		if (this.hybrid) {
+			return encryption
+				.sealStream(data, this.peerPublicKey, this.scheme)
+				.toString("hex");
+		}
+		return encryption
+			.encrypt(data, this.peerPublicKey, this.scheme)
+			.toString("hex");
+	}
+
+	/**
+	 * Decodes and decrypts a payload sealed by the agent
+	 * @param {string} data - The sealed payload
+	 * @returns {*} The payload
+	 */
+	open(data) {
+		if (typeof data !== "string" || !/^([0-9a-fA-F]{2})*$/.test(data)) {
+			throw new Error("Sealed payload is not hex encoded");
+		}
+
+		const encrypted = Buffer.from(data, "hex");
+		let decrypted;
+		if (this.session) {
+			decrypted = this.session.open(encrypted);
+		} else if (this.privateKey && this.hybrid) {
+			decrypted = encryption.openStream(
+				encrypted,
+				this.privateKey,
+				this.scheme
+			);
+		} else if (this.privateKey) {
+			decrypted = encryption.decrypt(encrypted, this.privateKey, this.scheme);
+		} else {
+			throw new Error("Private key is unknown");
+		}
+
+		if (this.compress) {
+			decrypted = zlib.gunzipSync(decrypted, {
+				maxOutputLength: MAX_DECOMPRESSED_SIZE,
+			});
+		}
+		return JSON.parse(decrypted.toString());
+	}
+}
+
+module.exports = Codec;
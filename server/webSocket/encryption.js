@@ -0,0 +1,656 @@
+const crypto = require("crypto");
+
+/**
+ * The trsa schemes, they have to match shared/trsa/scheme.go in the agent
+ */
+const SCHEMES = {
+	OAEP_SHA1: "rsa-oaep-sha1",
+	OAEP_SHA256: "rsa-oaep-sha256",
+	PKCS1V15: "rsa-pkcs1v15-sha256",
+	PSS: "rsa-pss-sha256",
+};
+
+/**
+ * The supported encryption schemes, strongest first. The last one is the
+ * default of peers predating scheme negotiation.
+ */
+const ENCRYPTION_SCHEMES = [SCHEMES.OAEP_SHA256, SCHEMES.OAEP_SHA1];
+
+/**
+ * The supported signature schemes, strongest first. The last one is the
+ * default of peers predating scheme negotiation.
+ */
+const SIGNATURE_SCHEMES = [SCHEMES.PSS, SCHEMES.PKCS1V15];
+
+/**
+ * Picks the strongest supported scheme out of the advertised ones
+ * @param {string[]} supported - The supported schemes, strongest first
+ * @param {string[]} advertised - The schemes a peer advertised
+ * @returns {string} The strongest common scheme, or the default if there is none
+ */
+function strongest(supported, advertised = []) {
+	return (
+		supported.find((scheme) => advertised.includes(scheme)) ||
+		supported[supported.length - 1]
+	);
+}
+
+/**
+ * Returns the hash OAEP uses with an encryption scheme
+ * @param {string} scheme - The encryption scheme
+ * @returns {string} The hash name
+ */
+function oaepHash(scheme) {
+	return scheme === SCHEMES.OAEP_SHA256 ? "sha256" : "sha1";
+}
+
+/**
+ * Returns how many plaintext bytes fit into one RSA block, like the agent
+ * splits them
+ * @param {crypto.KeyObject} key - The RSA key
+ * @param {string} scheme - The encryption scheme
+ * @returns {number} The chunk size in bytes
+ */
+function oaepChunkSize(key, scheme) {
+	const blockSize = key.asymmetricKeyDetails.modulusLength / 8;
+	if (scheme === SCHEMES.OAEP_SHA256) {
+		// Two hashes and two bytes of OAEP padding
+		return blockSize - 2 * 32 - 2;
+	}
+	return blockSize - 11 - 32;
+}
+
+/**
+ * Encrypts data block by block with RSA-OAEP
+ * @param {Buffer} data - The plaintext
+ * @param {string|crypto.KeyObject} publicKey - The PEM encoded public key of the recipient
+ * @param {string} scheme - The encryption scheme
+ * @returns {Buffer} The concatenated encrypted blocks
+ */
+function encrypt(data, publicKey, scheme = SCHEMES.OAEP_SHA1) {
+	const key = crypto.createPublicKey(publicKey);
+	const chunkSize = oaepChunkSize(key, scheme);
+
+	const blocks = [];
+	for (let i = 0; i < data.length; i += chunkSize) {
+		blocks.push(
+			crypto.publicEncrypt(
+				{
+					key,
+					padding: crypto.constants.RSA_PKCS1_OAEP_PADDING,
+					oaepHash: oaepHash(scheme),
+				},
+				data.subarray(i, i + chunkSize)
+			)
+		);
+	}
+	return Buffer.concat(blocks);
+}
+
+/**
+ * Decrypts data encrypted block by block with RSA-OAEP
+ * @param {Buffer} encrypted - The concatenated encrypted blocks
+ * @param {string|crypto.KeyObject} privateKey - The PEM encoded private key
+ * @param {string} scheme - The encryption scheme
+ * @returns {Buffer} The plaintext
+ */
+function decrypt(encrypted, privateKey, scheme = SCHEMES.OAEP_SHA1) {
+	const key = crypto.createPrivateKey(privateKey);
+	const blockSize = key.asymmetricKeyDetails.modulusLength / 8;
+	if (encrypted.length % blockSize !== 0) {
+		throw new Error("Encrypted data is not a multiple of the key size");
+	}
+
+	const chunks = [];
+	for (let i = 0; i < encrypted.length; i += blockSize) {
+		chunks.push(
+			crypto.privateDecrypt(
+				{
+					key,
+					padding: crypto.constants.RSA_PKCS1_OAEP_PADDING,
+					oaepHash: oaepHash(scheme),
+				},
+				encrypted.subarray(i, i + blockSize)
+			)
+		);
+	}
+	return Buffer.concat(chunks);
+}
+
+/**
+ * Returns the options signing and verifying with a key take
+ * @param {crypto.KeyObject} key - The private or public key
+ * @param {string} scheme - The signature scheme, only used for RSA keys
+ * @returns {Array} The algorithm and the key options
+ */
+function signatureOptions(key, scheme) {
+	switch (key.asymmetricKeyType) {
+		case "rsa":
+			if (scheme === SCHEMES.PSS) {
+				// The salt is as long as the hash
+				return [
+					"sha256",
+					{ key, padding: crypto.constants.RSA_PKCS1_PSS_PADDING, saltLength: 32 },
+				];
+			}
+			return ["sha256", { key, padding: crypto.constants.RSA_PKCS1_PADDING }];
+		case "ec":
+			return ["sha256", { key, dsaEncoding: "der" }];
+		case "ed25519":
+			return [null, { key }];
+		default:
+			throw new Error(`Unsupported key type ${key.asymmetricKeyType}`);
+	}
+}
+
+/**
+ * Signs data with an RSA, ECDSA P-256 or Ed25519 private key, like the agent does
+ * @param {Buffer|string} data - The data to sign
+ * @param {string|crypto.KeyObject} privateKey - The PEM encoded private key
+ * @param {string} scheme - The signature scheme of RSA keys
+ * @returns {string} The hex encoded signature
+ */
+function sign(data, privateKey, scheme = SCHEMES.PKCS1V15) {
+	const [algorithm, options] = signatureOptions(
+		crypto.createPrivateKey(privateKey),
+		scheme
+	);
+	return crypto.sign(algorithm, Buffer.from(data), options).toString("hex");
+}
+
+/**
+ * Verifies a signature made by sign or the agent
+ * @param {Buffer|string} data - The signed data
+ * @param {string} signature - The hex encoded signature
+ * @param {string|crypto.KeyObject} publicKey - The PEM encoded public key
+ * @param {string} scheme - The signature scheme of RSA keys
+ * @returns {boolean} Whether the signature is valid
+ */
+function verify(data, signature, publicKey, scheme = SCHEMES.PKCS1V15) {
+	if (typeof signature !== "string" || !/^([0-9a-fA-F]{2})*$/.test(signature)) {
+		return false;
+	}
+
+	try {
+		const [algorithm, options] = signatureOptions(
+			crypto.createPublicKey(publicKey),
+			scheme
+		);
+		return crypto.verify(
+			algorithm,
+			Buffer.from(data),
+			options,
+			Buffer.from(signature, "hex")
+		);
+	} catch (err) {
+		return false;
+	}
+}
+
+/**
+ * A stream starts with a header holding the magic, the length of the RSA
+ * encrypted data key and the data key itself. It is followed by chunks, each
+ * prefixed with the length of its ciphertext, like the trsa streams of the agent.
+ */
+const STREAM_MAGIC = "TRS1";
+const STREAM_KEY_LENGTH = 32;
+const STREAM_CHUNK_SIZE = 64 * 1024;
+const STREAM_TAG_LENGTH = 16;
+const MAX_STREAM_CHUNK_LENGTH = 16 * 1024 * 1024;
+
+/**
+ * Builds the nonce of a stream chunk from its counter and the final flag
+ * @param {number} counter - The position of the chunk
+ * @param {boolean} final - Whether it is the final chunk
+ * @returns {Buffer} The nonce
+ */
+function streamNonce(counter, final) {
+	const nonce = Buffer.alloc(12);
+	nonce.writeBigUInt64BE(BigInt(counter), 0);
+	if (final) {
+		nonce[11] = 1;
+	}
+	return nonce;
+}
+
+/**
+ * Encrypts data as a stream, which takes a single RSA operation for the data key
+ * @param {Buffer} data - The plaintext
+ * @param {string} publicKey - The PEM encoded public key of the recipient
+ * @param {string} scheme - The encryption scheme of the data key
+ * @param {number} chunkSize - How many plaintext bytes are sealed per chunk
+ * @returns {Buffer} The stream
+ */
+function sealStream(
+	data,
+	publicKey,
+	scheme = SCHEMES.OAEP_SHA1,
+	chunkSize = STREAM_CHUNK_SIZE
+) {
+	const key = crypto.randomBytes(STREAM_KEY_LENGTH);
+	const encryptedKey = crypto.publicEncrypt(
+		{
+			key: publicKey,
+			padding: crypto.constants.RSA_PKCS1_OAEP_PADDING,
+			oaepHash: oaepHash(scheme),
+		},
+		key
+	);
+
+	const keyLength = Buffer.alloc(4);
+	keyLength.writeUInt32BE(encryptedKey.length);
+	const parts = [Buffer.from(STREAM_MAGIC), keyLength, encryptedKey];
+
+	// There always is a final chunk, empty for empty data
+	let counter = 0;
+	let offset = 0;
+	for (;;) {
+		const final = data.length - offset <= chunkSize;
+		const cipher = crypto.createCipheriv(
+			"aes-256-gcm",
+			key,
+			streamNonce(counter++, final)
+		);
+		const sealed = Buffer.concat([
+			cipher.update(data.subarray(offset, offset + chunkSize)),
+			cipher.final(),
+			cipher.getAuthTag(),
+		]);
+		const length = Buffer.alloc(4);
+		length.writeUInt32BE(sealed.length);
+		parts.push(length, sealed);
+
+		offset += chunkSize;
+		if (final) {
+			return Buffer.concat(parts);
+		}
+	}
+}
+
+/**
+ * Decrypts a stream made by sealStream or the agent, verifying every chunk.
+ * The stream has to end with its final chunk.
+ * @param {Buffer} stream - The stream
+ * @param {string} privateKey - The PEM encoded private key
+ * @param {string} scheme - The encryption scheme of the data key
+ * @returns {Buffer} The plaintext
+ */
+function openStream(stream, privateKey, scheme = SCHEMES.OAEP_SHA1) {
+	const rsaKey = crypto.createPrivateKey(privateKey);
+	const headerLength = STREAM_MAGIC.length + 4;
+	if (
+		stream.length < headerLength ||
+		stream.subarray(0, STREAM_MAGIC.length).toString() !== STREAM_MAGIC
+	) {
+		throw new Error("Encrypted stream is corrupt");
+	}
+	const keyLength = stream.readUInt32BE(STREAM_MAGIC.length);
+	if (keyLength !== rsaKey.asymmetricKeyDetails.modulusLength / 8) {
+		throw new Error("Encrypted stream is corrupt");
+	}
+	if (stream.length < headerLength + keyLength) {
+		throw new Error("Encrypted stream is truncated");
+	}
+
+	let key;
+	try {
+		key = crypto.privateDecrypt(
+			{
+				key: rsaKey,
+				padding: crypto.constants.RSA_PKCS1_OAEP_PADDING,
+				oaepHash: oaepHash(scheme),
+			},
+			stream.subarray(headerLength, headerLength + keyLength)
+		);
+	} catch (err) {
+		throw new Error("Encrypted stream is corrupt");
+	}
+	if (key.length !== STREAM_KEY_LENGTH) {
+		throw new Error("Encrypted stream is corrupt");
+	}
+
+	const chunks = [];
+	let offset = headerLength + keyLength;
+	for (let counter = 0; ; counter++) {
+		if (stream.length < offset + 4) {
+			throw new Error("Encrypted stream is truncated");
+		}
+		const length = stream.readUInt32BE(offset);
+		offset += 4;
+		if (
+			length < STREAM_TAG_LENGTH ||
+			length > MAX_STREAM_CHUNK_LENGTH + STREAM_TAG_LENGTH
+		) {
+			throw new Error("Encrypted stream is corrupt");
+		}
+		if (stream.length < offset + length) {
+			throw new Error("Encrypted stream is truncated");
+		}
+		const sealed = stream.subarray(offset, offset + length);
+		offset += length;
+
+		// Try the chunk as a regular chunk first, then as the final one
+		for (const final of [false, true]) {
+			const chunk = openStreamChunk(key, streamNonce(counter, final), sealed);
+			if (chunk) {
+				chunks.push(chunk);
+				if (final) {
+					// Nothing may follow the final chunk of a payload
+					if (offset !== stream.length) {
+						throw new Error("Encrypted stream is corrupt");
+					}
+					return Buffer.concat(chunks);
+				}
+				break;
+			}
+			if (final) {
+				throw new Error("Encrypted stream is corrupt");
+			}
+		}
+	}
+}
+
+/**
+ * Authenticates and decrypts one stream chunk
+ * @param {Buffer} key - The data key
+ * @param {Buffer} nonce - The nonce of the chunk
+ * @param {Buffer} sealed - The ciphertext and the authentication tag
+ * @returns {Buffer|null} The plaintext, or null if authentication failed
+ */
+function openStreamChunk(key, nonce, sealed) {
+	try {
+		const decipher = crypto.createDecipheriv("aes-256-gcm", key, nonce);
+		decipher.setAuthTag(sealed.subarray(sealed.length - STREAM_TAG_LENGTH));
+		return Buffer.concat([
+			decipher.update(sealed.subarray(0, sealed.length - STREAM_TAG_LENGTH)),
+			decipher.final(),
+		]);
+	} catch (err) {
+		return null;
+	}
+}
+
+/**
+ * The label signed together with an ephemeral session key
+ */
+const SESSION_SIGNATURE_LABEL = "echoes session offer v1\n";
+
+/**
+ * The HKDF info of the session keys and of their re-keys
+ */
+const SESSION_KEY_INFO = "echoes session keys v1";
+const SESSION_REKEY_INFO = "echoes session rekey v1";
+
+/**
+ * The length of the epoch and counter prefixed to every sealed message
+ */
+const SESSION_HEADER_LENGTH = 12;
+
+/**
+ * The length of the AES-GCM authentication tag
+ */
+const SESSION_TAG_LENGTH = 16;
+
+/**
+ * How many re-keys a single received message can trigger at most
+ */
+const MAX_EPOCH_SKIP = 64;
+
+/**
+ * The amount of plaintext sealed under one key and the maximum lifetime of
+ * one key before re-keying
+ */
+const DEFAULT_REKEY_BYTES = 2 ** 30;
+const DEFAULT_REKEY_INTERVAL = 60 * 60 * 1000;
+
+/**
+ * The highest message counter, the key is re-keyed before it wraps around
+ */
+const MAX_COUNTER = 2n ** 64n - 1n;
+
+/**
+ * Derives key material with HKDF-SHA256
+ * @param {Buffer} secret - The input key material
+ * @param {Buffer|null} salt - The salt, a hash long string of zeros if null
+ * @param {string} info - The context of the derived keys
+ * @param {number} length - The number of bytes to derive
+ * @returns {Buffer} The derived bytes
+ */
+function hkdf(secret, salt, info, length) {
+	return Buffer.from(
+		crypto.hkdfSync("sha256", secret, salt || Buffer.alloc(32), info, length)
+	);
+}
+
+/**
+ * Holds the ephemeral X25519 key of the server until the agent's offer arrives,
+ * like the SessionHandshake of the agent
+ */
+class SessionHandshake {
+	/**
+	 * Creates an ephemeral X25519 key and signs it with the long-term private key
+	 * @param {string} longTermPrivateKey - The PEM encoded private key of the server
+	 * @param {string} scheme - The signature scheme of the offers
+	 * @param {Object} options - The re-keying limits, rekeyBytes and rekeyInterval in milliseconds
+	 */
+	constructor(longTermPrivateKey, scheme, options = {}) {
+		const { publicKey, privateKey } = crypto.generateKeyPairSync("x25519");
+		this.privateKey = privateKey;
+		this.publicKey = Buffer.from(
+			publicKey.export({ format: "jwk" }).x,
+			"base64url"
+		);
+		this.scheme = scheme;
+		this.options = options;
+
+		const hexPublicKey = this.publicKey.toString("hex");
+		this.offer = {
+			publicKey: hexPublicKey,
+			signature: sign(
+				SESSION_SIGNATURE_LABEL + hexPublicKey,
+				longTermPrivateKey,
+				scheme
+			),
+		};
+	}
+
+	/**
+	 * Verifies the peer's offer against its long-term public key and derives the session keys
+	 * @param {Object} peer - The peer's offer, its hex encoded publicKey and signature
+	 * @param {string} peerLongTermPublicKey - The PEM encoded public key of the peer
+	 * @param {boolean} initiator - Whether this side initiates, exactly one side of a connection does
+	 * @returns {Session} The session
+	 */
+	complete(peer, peerLongTermPublicKey, initiator) {
+		if (
+			!peer ||
+			typeof peer.publicKey !== "string" ||
+			!/^[0-9a-fA-F]{64}$/.test(peer.publicKey)
+		) {
+			throw new Error("Invalid session offer");
+		}
+		if (
+			!verify(
+				SESSION_SIGNATURE_LABEL + peer.publicKey,
+				peer.signature,
+				peerLongTermPublicKey,
+				this.scheme
+			)
+		) {
+			throw new Error("Invalid session offer signature");
+		}
+
+		const peerKey = Buffer.from(peer.publicKey, "hex");
+		const secret = crypto.diffieHellman({
+			privateKey: this.privateKey,
+			publicKey: crypto.createPublicKey({
+				key: { kty: "OKP", crv: "X25519", x: peerKey.toString("base64url") },
+				format: "jwk",
+			}),
+		});
+		// A low order peer key yields an all zero secret
+		if (secret.every((byte) => byte === 0)) {
+			throw new Error("Invalid session offer key");
+		}
+
+		// Bind the keys to both ephemeral public keys, in initiator-responder order
+		const salt = initiator
+			? Buffer.concat([this.publicKey, peerKey])
+			: Buffer.concat([peerKey, this.publicKey]);
+		const keys = hkdf(secret, salt, SESSION_KEY_INFO, 64);
+
+		let initiatorKey = keys.subarray(0, 32);
+		let responderKey = keys.subarray(32);
+		if (!initiator) {
+			[initiatorKey, responderKey] = [responderKey, initiatorKey];
+		}
+
+		return new Session(initiatorKey, responderKey, this.options);
+	}
+}
+
+/**
+ * Encrypts messages with AES-256-GCM under the keys of a session handshake.
+ * Each direction re-keys independently by ratcheting its key forward once
+ * the byte or time limit is reached, the epoch in every message tells the
+ * receiver to follow.
+ */
+class Session {
+	/**
+	 * New Session
+	 * @param {Buffer} sendKey - The key of messages to the peer
+	 * @param {Buffer} recvKey - The key of messages from the peer
+	 * @param {Object} options - The re-keying limits, rekeyBytes and rekeyInterval in milliseconds
+	 */
+	constructor(sendKey, recvKey, options = {}) {
+		this.send = Session.direction(sendKey, 0);
+		this.recv = Session.direction(recvKey, 0);
+		this.rekeyBytes = options.rekeyBytes || DEFAULT_REKEY_BYTES;
+		this.rekeyInterval = options.rekeyInterval || DEFAULT_REKEY_INTERVAL;
+	}
+
+	/**
+	 * Creates the state of one direction
+	 * @param {Buffer} key - The key of the epoch
+	 * @param {number} epoch - The epoch
+	 * @returns {Object} The state
+	 */
+	static direction(key, epoch) {
+		return { key, epoch, counter: 0n, bytes: 0, since: Date.now() };
+	}
+
+	/**
+	 * Ratchets the key of a direction forward, the previous key can not be
+	 * recovered from the new one
+	 * @param {Object} direction - The state of the direction
+	 * @returns {Object} The state of the next epoch
+	 */
+	static rekey(direction) {
+		return Session.direction(
+			hkdf(direction.key, null, SESSION_REKEY_INFO, 32),
+			direction.epoch + 1
+		);
+	}
+
+	/**
+	 * Encrypts and authenticates data for the peer
+	 * @param {Buffer} data - The plaintext
+	 * @returns {Buffer} The header, the ciphertext and the authentication tag
+	 */
+	seal(data) {
+		const limitReached =
+			this.send.bytes + data.length > this.rekeyBytes ||
+			Date.now() - this.send.since > this.rekeyInterval;
+		if (
+			(limitReached && this.send.counter > 0n) ||
+			this.send.counter === MAX_COUNTER
+		) {
+			this.send = Session.rekey(this.send);
+		}
+
+		this.send.counter++;
+		this.send.bytes += data.length;
+
+		const header = Buffer.alloc(SESSION_HEADER_LENGTH);
+		header.writeUInt32BE(this.send.epoch, 0);
+		header.writeBigUInt64BE(this.send.counter, 4);
+
+		// The header doubles as nonce and additional data
+		const cipher = crypto.createCipheriv("aes-256-gcm", this.send.key, header);
+		cipher.setAAD(header);
+		return Buffer.concat([
+			header,
+			cipher.update(data),
+			cipher.final(),
+			cipher.getAuthTag(),
+		]);
+	}
+
+	/**
+	 * Authenticates and decrypts a message sealed by the peer. Messages have to
+	 * arrive in order, replayed or reordered messages are rejected.
+	 * @param {Buffer} sealed - The sealed message
+	 * @returns {Buffer} The plaintext
+	 */
+	open(sealed) {
+		if (sealed.length < SESSION_HEADER_LENGTH + SESSION_TAG_LENGTH) {
+			throw new Error("Invalid session message");
+		}
+		const header = sealed.subarray(0, SESSION_HEADER_LENGTH);
+		const epoch = header.readUInt32BE(0);
+		const counter = header.readBigUInt64BE(4);
+
+		if (epoch < this.recv.epoch || epoch - this.recv.epoch > MAX_EPOCH_SKIP) {
+			throw new Error("Invalid session message");
+		}
+
+		// Follow the sender's re-keys on a copy, so a forged message can't desync the session
+		let next = this.recv;
+		while (next.epoch < epoch) {
+			next = Session.rekey(next);
+		}
+		if (counter <= next.counter) {
+			throw new Error("Invalid session message");
+		}
+
+		let data;
+		try {
+			const decipher = crypto.createDecipheriv(
+				"aes-256-gcm",
+				next.key,
+				header
+			);
+			decipher.setAAD(header);
+			decipher.setAuthTag(sealed.subarray(sealed.length - SESSION_TAG_LENGTH));
+			data = Buffer.concat([
+				decipher.update(
+					sealed.subarray(
+						SESSION_HEADER_LENGTH,
+						sealed.length - SESSION_TAG_LENGTH
+					)
+				),
+				decipher.final(),
+			]);
+		} catch (err) {
+			throw new Error("Invalid session message");
+		}
+
+		this.recv = { ...next, counter };
+		return data;
+	}
+}
+
+module.exports = {
+	SCHEMES,
+	ENCRYPTION_SCHEMES,
+	SIGNATURE_SCHEMES,
+	strongest,
+	encrypt,
+	decrypt,
+	sign,
+	verify,
+	sealStream,
+	openStream,
+	SessionHandshake,
+	Session,
+};
@@ -1,7 +1,6 @@
 const MessageHandlerBase = require("./messageHandlerBase");
 const knex = require("@container-echoes/core/database");
 const config = require("@container-echoes/core/config").getInstance();
-const rsa = require("trsa");
 const log = require("@vmgware/js-logger").getInstance();
 
 /**
@@ -26,9 +25,7 @@ class HandleHandshake extends MessageHandlerBase {
 	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
 	 */
 	async handle(ws, messageObj) {
-		messageObj.data = JSON.parse(
-			rsa.decrypt(messageObj.data, this.webSocketManager.server.privateKey)
-		);
+		messageObj.data = this.webSocketManager.codec(ws).open(messageObj.data);
 
 		let token = messageObj.data.token;
 		let hostname = messageObj.data.hostname;
@@ -66,8 +63,9 @@ class HandleHandshake extends MessageHandlerBase {
 			}
 		}
 
-		// Store the agent's id
+		// Store the agent's id and the inventory of its host
 		ws.id = agent.agentId;
+		ws.inventory = messageObj.data.inventory;
 
 		this.webSocketManager.agents[agent.agentId] = ws;
 
@@ -81,11 +79,15 @@ class HandleHandshake extends MessageHandlerBase {
 				"agentId",
 				{
 					agentId: agent.agentId,
+					capabilities: ws.capabilities || [],
 				},
 				true,
-				ws.publicKey
+				this.webSocketManager.codec(ws)
 			)
 		);
+
+		// Later payloads use the capabilities the agentId message enabled
+		ws.capabilitiesEnabled = true;
 	}
 }
 
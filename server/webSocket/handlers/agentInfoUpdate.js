@@ -0,0 +1,41 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for the periodic inventory updates of agents.
+ * @extends MessageHandlerBase
+ */
+class HandleAgentInfoUpdate extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleAgentInfoUpdate.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "agentInfoUpdate");
+	}
+
+	/**
+	 * Handles the inventory update of an authenticated agent.
+	 * Keeps the latest host, Docker and agent details on the connection.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Inventory update from unauthenticated agent");
+			return;
+		}
+
+		try {
+			ws.inventory = this.webSocketManager.codec(ws).open(messageObj.data);
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid inventory update from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleAgentInfoUpdate;
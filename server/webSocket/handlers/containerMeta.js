@@ -0,0 +1,62 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const knex = require("@container-echoes/core/database");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for the container metadata sent by agents.
+ * @extends MessageHandlerBase
+ */
+class HandleContainerMeta extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleContainerMeta.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "containerMeta");
+	}
+
+	/**
+	 * Handles the metadata of a container of an authenticated agent.
+	 * Every version is stored, so log batches referencing it by its ref stay
+	 * attributable after the container is deleted.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Container metadata from unauthenticated agent");
+			return;
+		}
+
+		try {
+			const meta = this.webSocketManager.codec(ws).open(messageObj.data);
+
+			await knex("container_meta")
+				.insert({
+					agentId: ws.id,
+					containerId: meta.containerId,
+					ref: meta.ref,
+					name: meta.name,
+					image: meta.image,
+					tag: meta.tag,
+					imageId: meta.imageId,
+					composeProject: meta.composeProject,
+					composeService: meta.composeService,
+					labels: JSON.stringify(meta.labels || {}),
+					restartCount: meta.restartCount,
+					containerCreatedAt: new Date(meta.createdAt),
+					containerStartedAt: new Date(meta.startedAt),
+				})
+				.onConflict(["agentId", "containerId", "ref"])
+				.ignore();
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid container metadata from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleContainerMeta;
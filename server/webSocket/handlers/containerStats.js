@@ -0,0 +1,46 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for the container resource stats sent by agents.
+ * @extends MessageHandlerBase
+ */
+class HandleContainerStats extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleContainerStats.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "containerStats");
+	}
+
+	/**
+	 * Handles a batch of container stats of an authenticated agent.
+	 * Keeps the latest sample of every container on the connection.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Container stats from unauthenticated agent");
+			return;
+		}
+
+		try {
+			const batch = this.webSocketManager.codec(ws).open(messageObj.data);
+
+			ws.stats = ws.stats || {};
+			for (const sample of batch.samples || []) {
+				ws.stats[sample.containerId] = sample;
+			}
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid container stats from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleContainerStats;
@@ -0,0 +1,64 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const knex = require("@container-echoes/core/database");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for the Docker daemon events forwarded by agents.
+ * @extends MessageHandlerBase
+ */
+class HandleDockerEvent extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleDockerEvent.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "dockerEvent");
+	}
+
+	/**
+	 * Handles a batch of Docker events of an authenticated agent.
+	 * The events are stored as the host's timeline next to its container logs.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Docker events from unauthenticated agent");
+			return;
+		}
+
+		try {
+			const batch = this.webSocketManager.codec(ws).open(messageObj.data);
+
+			if (batch.dropped) {
+				log.warn(
+					"WebSocketManager",
+					`Agent ${ws.id} dropped ${batch.dropped} Docker events`
+				);
+			}
+			if (!batch.events || batch.events.length === 0) {
+				return;
+			}
+
+			await knex("docker_event").insert(
+				batch.events.map((event) => ({
+					agentId: ws.id,
+					time: new Date(event.time),
+					type: event.type,
+					action: event.action,
+					actorId: event.actorId,
+					attributes: JSON.stringify(event.attributes || {}),
+					scope: event.scope,
+				}))
+			);
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid Docker events from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleDockerEvent;
@@ -0,0 +1,58 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for exec sessions ended by agents.
+ * @extends MessageHandlerBase
+ */
+class HandleExecClose extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleExecClose.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "execClose");
+	}
+
+	/**
+	 * Handles the end of an exec session, because its command exited, it was closed or it timed out.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Exec session end from unauthenticated agent");
+			return;
+		}
+
+		// Closing a session the agent no longer knows is answered with an error
+		if (messageObj.status === "error") {
+			log.debug(
+				"WebSocketManager",
+				`Agent ${ws.id} could not close exec session: ${messageObj.data}`
+			);
+			return;
+		}
+
+		try {
+			const ended = this.webSocketManager.codec(ws).open(messageObj.data);
+
+			const session = this.webSocketManager.execSessions.get(ended.sessionId);
+			if (session && session.agentId === String(ws.id)) {
+				this.webSocketManager.endExecSession(
+					ended.sessionId,
+					ended.exitCode,
+					ended.reason
+				);
+			}
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid exec session end from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleExecClose;
@@ -0,0 +1,55 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for the output of exec sessions.
+ * @extends MessageHandlerBase
+ */
+class HandleExecOutput extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleExecOutput.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "execOutput");
+	}
+
+	/**
+	 * Handles output of the command of an exec session.
+	 * Passes it to the session, if the session belongs to the agent.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Exec output from unauthenticated agent");
+			return;
+		}
+
+		try {
+			const output = this.webSocketManager.codec(ws).open(messageObj.data);
+
+			const session = this.webSocketManager.execSessions.get(output.sessionId);
+			if (!session || session.agentId !== String(ws.id)) {
+				log.debug(
+					"WebSocketManager",
+					`Exec output for unknown session ${output.sessionId}`
+				);
+				return;
+			}
+
+			session.onOutput(
+				output.stream || "stdout",
+				Buffer.from(output.data || "", "base64")
+			);
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid exec output from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleExecOutput;
@@ -1,4 +1,6 @@
 const MessageHandlerBase = require("./messageHandlerBase");
+const encryption = require("../encryption");
+const log = require("@vmgware/js-logger").getInstance();
 
 /**
  * Represents a handler for the handshake process with agents.
@@ -21,10 +23,64 @@ class HandleHandshake extends MessageHandlerBase {
 	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
 	 */
 	async handle(ws, messageObj) {
+		// Agents predating version negotiation don't send a version and speak version 1
+		const protocolVersion = messageObj.data.protocolVersion || 1;
+		if (protocolVersion < 1) {
+			log.warn(
+				"WebSocketManager",
+				`Agent speaks unsupported protocol version ${protocolVersion}`
+			);
+			ws.close();
+			return;
+		}
+		ws.protocolVersion = Math.min(
+			protocolVersion,
+			this.webSocketManager.protocolVersion
+		);
+
+		ws.agentVersion = messageObj.data.version;
+		ws.capabilities = (messageObj.data.capabilities || []).filter(
+			(capability) => this.webSocketManager.capabilities.includes(capability)
+		);
+
+		// The agent answers with the encryption and signature scheme it picked,
+		// agents predating scheme negotiation only understand the trsa defaults
+		const schemes = messageObj.data.schemes || [];
+		ws.encryptionScheme = encryption.strongest(
+			encryption.ENCRYPTION_SCHEMES,
+			schemes
+		);
+		ws.signatureScheme = encryption.strongest(
+			encryption.SIGNATURE_SCHEMES,
+			schemes
+		);
+
 		ws.publicKey = messageObj.data.publicKey;
+
+		// Agents answering the session offer get ephemeral session keys, older
+		// agents keep using RSA for every message
+		const sessionHandshake = ws.sessionHandshake;
+		delete ws.sessionHandshake;
+		if (messageObj.data.session && sessionHandshake) {
+			try {
+				ws.session = sessionHandshake.complete(
+					messageObj.data.session,
+					ws.publicKey,
+					false
+				);
+			} catch (err) {
+				log.warn(
+					"WebSocketManager",
+					`Invalid session offer from agent: ${err.message}`
+				);
+				ws.close();
+				return;
+			}
+		}
+
 		this.webSocketManager.sendMessage(
 			ws,
-			this.webSocketManager.buildMessage("ok", "agentInfo", true, ws.publicKey)
+			this.webSocketManager.buildMessage("ok", "agentInfo", true, false)
 		);
 	}
 }
@@ -0,0 +1,131 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const knex = require("@container-echoes/core/database");
+const encryption = require("../encryption");
+const Codec = require("../codec");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * The maximum age of a key rotation request in seconds
+ */
+const MAX_PROOF_AGE = 300;
+
+/**
+ * Represents a handler for agent key rotations.
+ * @extends MessageHandlerBase
+ */
+class HandleKeyRotate extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleKeyRotate.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "keyRotate");
+	}
+
+	/**
+	 * Handles the key rotation request from an authenticated agent.
+	 * Verifies that the agent owns both the old and the new private key,
+	 * stores the new public key and acknowledges it encrypted with the new key.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Key rotation from unauthenticated agent");
+			this.reject(ws);
+			return;
+		}
+
+		let request;
+		let proof;
+		try {
+			request = this.webSocketManager.codec(ws).open(messageObj.data);
+			proof = JSON.parse(request.payload);
+		} catch (error) {
+			log.debug("WebSocketManager", "Invalid key rotation request");
+			this.reject(ws);
+			return;
+		}
+
+		// A missing timestamp would make the age NaN, which passes any comparison
+		if (
+			proof.agentId !== ws.id ||
+			!Number.isFinite(proof.timestamp) ||
+			Math.abs(Date.now() / 1000 - proof.timestamp) > MAX_PROOF_AGE
+		) {
+			log.debug("WebSocketManager", `Stale key rotation for agent ${ws.id}`);
+			this.reject(ws);
+			return;
+		}
+
+		// The old key is the one stored for the agent, not the one of this
+		// connection's handshake, which anyone holding the token could make up
+		const agent = await knex("agent").where({ agentId: ws.id }).first();
+		if (!agent || !agent.publickey) {
+			log.debug("WebSocketManager", `No stored key for agent ${ws.id}`);
+			this.reject(ws);
+			return;
+		}
+
+		// The agent has to prove possession of both keys. Key proofs are always
+		// signed with PKCS#1 v1.5, whatever scheme the connection negotiated.
+		const oldKeyValid = encryption.verify(
+			request.payload,
+			request.oldSignature,
+			agent.publickey,
+			encryption.SCHEMES.PKCS1V15
+		);
+		const newKeyValid = encryption.verify(
+			request.payload,
+			request.newSignature,
+			proof.publicKey,
+			encryption.SCHEMES.PKCS1V15
+		);
+		if (!oldKeyValid || !newKeyValid) {
+			log.debug("WebSocketManager", `Invalid key proof for agent ${ws.id}`);
+			this.reject(ws);
+			return;
+		}
+
+		await knex("agent")
+			.where({ agentId: ws.id })
+			.update({ publickey: proof.publicKey });
+		ws.publicKey = proof.publicKey;
+
+		log.debug("WebSocketManager", `Rotated public key of agent ${ws.id}`);
+
+		// The acknowledgement proves the new key works, the agent decrypts it
+		// with the new private key alone
+		const codec = new Codec({
+			peerPublicKey: proof.publicKey,
+			scheme: ws.encryptionScheme,
+		});
+		this.webSocketManager.sendMessage(
+			ws,
+			this.webSocketManager.buildMessage(
+				"ok",
+				"keyRotate",
+				{
+					publicKey: proof.publicKey,
+				},
+				true,
+				codec
+			)
+		);
+	}
+
+	/**
+	 * Tells the agent that the key rotation was rejected.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @returns {void}
+	 */
+	reject(ws) {
+		this.webSocketManager.sendMessage(
+			ws,
+			this.webSocketManager.buildMessage("error", "keyRotate", {}, false)
+		);
+	}
+}
+
+module.exports = HandleKeyRotate;
@@ -0,0 +1,54 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for the live logs of subscribed containers.
+ * @extends MessageHandlerBase
+ */
+class HandleLogBatch extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleLogBatch.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "logBatch");
+	}
+
+	/**
+	 * Handles a batch of log entries of a subscription.
+	 * Passes it to the subscriber, if the subscription belongs to the agent.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Log batch from unauthenticated agent");
+			return;
+		}
+
+		try {
+			const batch = this.webSocketManager.codec(ws).open(messageObj.data);
+
+			const subscription = this.webSocketManager.logSubscriptions.get(
+				batch.subscriptionId
+			);
+			if (!subscription || subscription.agentId !== String(ws.id)) {
+				log.debug(
+					"WebSocketManager",
+					`Log batch for unknown subscription ${batch.subscriptionId}`
+				);
+				return;
+			}
+
+			subscription.onBatch(batch);
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid log batch from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleLogBatch;
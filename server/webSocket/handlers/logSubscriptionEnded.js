@@ -0,0 +1,50 @@
+const MessageHandlerBase = require("./messageHandlerBase");
+const log = require("@vmgware/js-logger").getInstance();
+
+/**
+ * Represents a handler for log subscriptions ended by agents.
+ * @extends MessageHandlerBase
+ */
+class HandleLogSubscriptionEnded extends MessageHandlerBase {
+	/**
+	 * Creates an instance of HandleLogSubscriptionEnded.
+	 * @param {WebSocketManager} webSocketManager - The WebSocket manager instance.
+	 */
+	constructor(webSocketManager) {
+		super(webSocketManager, "logSubscriptionEnded");
+	}
+
+	/**
+	 * Handles the end of a subscription, because it expired or its container stopped.
+	 * @param {WebSocket} ws - The WebSocket connection instance.
+	 * @param {Object} messageObj - The received message object.
+	 * @returns {Promise<void>} A Promise that resolves when the handling is complete.
+	 */
+	async handle(ws, messageObj) {
+		if (!ws.id) {
+			log.debug("WebSocketManager", "Subscription end from unauthenticated agent");
+			return;
+		}
+
+		try {
+			const ended = this.webSocketManager.codec(ws).open(messageObj.data);
+
+			const subscription = this.webSocketManager.logSubscriptions.get(
+				ended.subscriptionId
+			);
+			if (subscription && subscription.agentId === String(ws.id)) {
+				this.webSocketManager.endLogSubscription(
+					ended.subscriptionId,
+					ended.reason
+				);
+			}
+		} catch (err) {
+			log.error(
+				"WebSocketManager",
+				`Invalid subscription end from agent ${ws.id}: ${err.message}`
+			);
+		}
+	}
+}
+
+module.exports = HandleLogSubscriptionEnded;
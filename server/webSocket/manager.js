@@ -1,6 +1,7 @@
 const log = require("@vmgware/js-logger").getInstance();
 const WebSocket = require("ws");
-const rsa = require("trsa");
+const encryption = require("./encryption");
+const Codec = require("./codec");
 const WebSocketMessageHandler = require("./messageHandler");
 
 /**
@@ -12,14 +13,57 @@ class WebSocketManager {
 	 */
 	static instance;
 
+	/**
+	 * The protocol version spoken by the server, see shared/protocol in the agent
+	 */
+	protocolVersion = 1;
+
+	/**
+	 * The optional protocol features the server supports, the server enables
+	 * those an agent offers as well in its agentId message
+	 */
+	capabilities = [
+		"hybridEncryption",
+		"compression",
+		"logStreaming",
+		"stats",
+		"exec",
+		"dockerEvents",
+	];
+
+	/**
+	 * The trsa schemes the server supports, agents answer with the strongest
+	 * encryption and signature scheme they support as well
+	 */
+	schemes = [
+		...encryption.ENCRYPTION_SCHEMES,
+		...encryption.SIGNATURE_SCHEMES,
+	];
+
 	/**
 	 * The events
 	 */
 	events = {
 		HANDSHAKE: "handshake",
 		AGENT_INFO: "agentInfo",
+		AGENT_INFO_UPDATE: "agentInfoUpdate",
 		AGENT_ID: "agentId",
 		CONTAINER_LIST: "containerList",
+		CONTAINER_STATS: "containerStats",
+		CONTAINER_META: "containerMeta",
+		CONTAINER_LOGS: "containerLogs",
+		SUBSCRIBE_LOGS: "subscribeLogs",
+		UNSUBSCRIBE_LOGS: "unsubscribeLogs",
+		LOG_BATCH: "logBatch",
+		LOG_SUBSCRIPTION_ENDED: "logSubscriptionEnded",
+		CONTAINER_ACTION: "containerAction",
+		EXEC_START: "execStart",
+		EXEC_INPUT: "execInput",
+		EXEC_OUTPUT: "execOutput",
+		EXEC_RESIZE: "execResize",
+		EXEC_CLOSE: "execClose",
+		DOCKER_EVENT: "dockerEvent",
+		KEY_ROTATE: "keyRotate",
 	};
 
 	/**
@@ -45,6 +89,21 @@ class WebSocketManager {
 	 */
 	messageResolvers = new Map();
 
+	/**
+	 * The live log subscriptions, by subscription id
+	 */
+	logSubscriptions = new Map();
+
+	/**
+	 * The seconds after which agents end log subscriptions that were not renewed
+	 */
+	logSubscriptionTTL = 60;
+
+	/**
+	 * The exec sessions in containers, by session id
+	 */
+	execSessions = new Map();
+
 	/**
 	 * New WebSocketManager
 	 * @param {*} wss - The WebSocket server
@@ -74,6 +133,13 @@ class WebSocketManager {
 		this.wss.on("connection", (ws) => {
 			log.debug("WebSocketManager", "New WebSocket connection");
 
+			// Offer ephemeral session keys, signed with the signature scheme the
+			// agent will pick out of the advertised ones
+			ws.sessionHandshake = new encryption.SessionHandshake(
+				this.server.privateKey,
+				encryption.SIGNATURE_SCHEMES[0]
+			);
+
 			// Send the initial handshake message
 			this.sendMessage(
 				ws,
@@ -82,6 +148,9 @@ class WebSocketManager {
 					"handshake",
 					{
 						publicKey: this.server.publicKey,
+						protocolVersion: this.protocolVersion,
+						schemes: this.schemes,
+						session: ws.sessionHandshake.offer,
 					},
 					false
 				)
@@ -140,7 +209,7 @@ class WebSocketManager {
 	 * @param {*} event - The event of the message
 	 * @param {*} data - The data to send
 	 * @param {boolean} encrypted - Whether or not the message should be encrypted
-	 * @param {string} publicKey - The public key to encrypt the message with
+	 * @param {Codec} codec - The codec of the agent to encrypt the message for
 	 * @param {string} messageId - The id of the message
 	 * @returns {string} The message to send
 	 */
@@ -149,7 +218,7 @@ class WebSocketManager {
 		event,
 		data = {},
 		encrypted = true,
-		publicKey = "",
+		codec = null,
 		messageId = ""
 	) {
 		let message = {
@@ -162,13 +231,35 @@ class WebSocketManager {
 			message.messageId = messageId;
 		}
 
-		if (encrypted && publicKey) {
-			message.data = rsa.encrypt(JSON.stringify(message.data), publicKey);
+		if (encrypted && codec) {
+			message.data = codec.seal(message.data);
 		}
 
 		return JSON.stringify(message);
 	}
 
+	/**
+	 * Returns the codec encrypting and decrypting the payloads of a connection
+	 * with the schemes negotiated in its handshake. The capabilities apply to
+	 * the payloads after the agentId message only.
+	 * @param {*} ws - The WebSocket connection
+	 * @returns {Codec} The codec
+	 */
+	codec(ws) {
+		const enabled = (capability) =>
+			Boolean(ws.capabilitiesEnabled) &&
+			(ws.capabilities || []).includes(capability);
+
+		return new Codec({
+			privateKey: this.server.privateKey,
+			peerPublicKey: ws.publicKey,
+			scheme: ws.encryptionScheme,
+			session: ws.session,
+			compress: enabled("compression"),
+			hybrid: enabled("hybridEncryption"),
+		});
+	}
+
 	/**
 	 * Sends a message to a specific client
 	 * @param {*} id - The id of the client to send the message to
@@ -181,7 +272,7 @@ class WebSocketManager {
 		if (agent && agent.readyState === WebSocket.OPEN) {
 			this.sendMessage(
 				agent,
-				this.buildMessage("ok", type, data, true, agent.publicKey)
+				this.buildMessage("ok", type, data, true, this.codec(agent))
 			);
 
 			log.debug("WebSocketManager", "Sent message to client " + id);
@@ -210,7 +301,7 @@ class WebSocketManager {
 					type,
 					data,
 					true,
-					agent.publicKey,
+					this.codec(agent),
 					messageId
 				);
 
@@ -221,6 +312,269 @@ class WebSocketManager {
 		});
 	}
 
+	/**
+	 * Sends a message to a specific client and collects the responses it answers with
+	 * in several frames, until the one marked as final or an error. The frames of a
+	 * response arrive in order, as they share the connection
+	 * @param {*} id - The id of the client to send the message to
+	 * @param {*} type - The type of message
+	 * @param {*} data - The data to send
+	 * @returns {Promise<Array>} The responses from the client, in order
+	 */
+	async sendMessageAndCollectResponses(id, type, data) {
+		return new Promise((resolve, reject) => {
+			const messageId = this.generateUniqueId();
+			const responses = [];
+			this.messageResolvers.set(messageId, (messageObj) => {
+				responses.push(messageObj);
+				if (messageObj.status === "error" || messageObj.data.final) {
+					resolve(responses);
+					return true;
+				}
+				return false;
+			});
+
+			const agent = this.agents[id];
+			if (agent && agent.readyState === WebSocket.OPEN) {
+				const message = this.buildMessage(
+					"ok",
+					type,
+					data,
+					true,
+					this.codec(agent),
+					messageId
+				);
+
+				this.sendMessage(agent, message);
+			} else {
+				this.messageResolvers.delete(messageId);
+				reject(new Error("Agent not found or not connected"));
+			}
+		});
+	}
+
+	/**
+	 * Subscribes to the live logs of a container. The subscription is renewed until
+	 * it is unsubscribed or the agent ends it.
+	 * @param {*} id - The id of the agent
+	 * @param {Object} options - The containerId, and optionally a filter regular expression and the streams
+	 * @param {Function} onBatch - Called with every batch of log entries
+	 * @param {Function} onEnd - Called with the reason when the subscription ends without being unsubscribed
+	 * @returns {Promise<string>} The id of the subscription
+	 */
+	async subscribeLogs(id, options, onBatch, onEnd) {
+		const subscriptionId = this.generateUniqueId();
+		const request = {
+			subscriptionId: subscriptionId,
+			containerId: options.containerId,
+			filter: options.filter,
+			streams: options.streams,
+			ttl: this.logSubscriptionTTL,
+		};
+
+		// Register first, the first batch may arrive right after the reply
+		const subscription = { agentId: String(id), onBatch, onEnd };
+		this.logSubscriptions.set(subscriptionId, subscription);
+
+		try {
+			const response = await this.sendMessageAndWaitForResponse(
+				id,
+				this.events.SUBSCRIBE_LOGS,
+				request
+			);
+			if (response.status === "error") {
+				throw new Error(response.data);
+			}
+		} catch (err) {
+			this.logSubscriptions.delete(subscriptionId);
+			throw err;
+		}
+
+		// Renew well before the subscription expires
+		subscription.renewal = setInterval(async () => {
+			try {
+				const response = await this.sendMessageAndWaitForResponse(
+					id,
+					this.events.SUBSCRIBE_LOGS,
+					request
+				);
+				if (response.status === "error") {
+					this.endLogSubscription(subscriptionId, response.data);
+				}
+			} catch (err) {
+				this.endLogSubscription(subscriptionId, err.message);
+			}
+		}, (this.logSubscriptionTTL * 1000) / 2);
+
+		return subscriptionId;
+	}
+
+	/**
+	 * Unsubscribes from the live logs of a container
+	 * @param {string} subscriptionId - The id of the subscription
+	 * @returns {Promise<void>}
+	 */
+	async unsubscribeLogs(subscriptionId) {
+		const subscription = this.logSubscriptions.get(subscriptionId);
+		if (!subscription) {
+			return;
+		}
+
+		clearInterval(subscription.renewal);
+		this.logSubscriptions.delete(subscriptionId);
+
+		try {
+			await this.sendMessageAndWaitForResponse(
+				subscription.agentId,
+				this.events.UNSUBSCRIBE_LOGS,
+				{ subscriptionId: subscriptionId }
+			);
+		} catch (err) {
+			log.debug(
+				"WebSocketManager",
+				`Error unsubscribing from logs: ${err.message}`
+			);
+		}
+	}
+
+	/**
+	 * Ends a log subscription the agent ended or that could not be renewed
+	 * @param {string} subscriptionId - The id of the subscription
+	 * @param {string} reason - Why the subscription ended
+	 * @returns {void}
+	 */
+	endLogSubscription(subscriptionId, reason) {
+		const subscription = this.logSubscriptions.get(subscriptionId);
+		if (!subscription) {
+			return;
+		}
+
+		clearInterval(subscription.renewal);
+		this.logSubscriptions.delete(subscriptionId);
+		subscription.onEnd(reason);
+	}
+
+	/**
+	 * Starts an interactive command in a container, if the agent enabled exec.
+	 * Input and output of the session are exchanged by its session id.
+	 * @param {*} id - The id of the agent
+	 * @param {Object} options - The containerId and cmd, and optionally tty, user, workingDir, env, cols and rows
+	 * @param {Function} onOutput - Called with the stream and the output as a Buffer
+	 * @param {Function} onClose - Called with the exit code, if known, and the reason when the session ends
+	 * @param {*} owner - The user who started the session, only they may use it
+	 * @returns {Promise<string>} The id of the session
+	 */
+	async startExec(id, options, onOutput, onClose, owner) {
+		const sessionId = this.generateUniqueId();
+
+		// Register first, the first output may arrive right after the reply
+		this.execSessions.set(sessionId, {
+			agentId: String(id),
+			owner,
+			onOutput,
+			onClose,
+		});
+
+		try {
+			const response = await this.sendMessageAndWaitForResponse(
+				id,
+				this.events.EXEC_START,
+				{
+					sessionId: sessionId,
+					containerId: options.containerId,
+					cmd: options.cmd,
+					tty: options.tty,
+					user: options.user,
+					workingDir: options.workingDir,
+					env: options.env,
+					cols: options.cols,
+					rows: options.rows,
+				}
+			);
+			if (response.status === "error") {
+				throw new Error(response.data);
+			}
+		} catch (err) {
+			this.execSessions.delete(sessionId);
+			throw err;
+		}
+
+		return sessionId;
+	}
+
+	/**
+	 * Sends input to the command of an exec session
+	 * @param {string} sessionId - The id of the session
+	 * @param {Buffer|string} data - The input
+	 * @param {boolean} eof - Whether this is the end of the input, the agent closes the command's stdin after it
+	 * @returns {void}
+	 */
+	sendExecInput(sessionId, data, eof) {
+		const session = this.execSessions.get(sessionId);
+		if (!session) {
+			return;
+		}
+
+		this.sendMessageToClient(session.agentId, this.events.EXEC_INPUT, {
+			sessionId: sessionId,
+			data: Buffer.from(data).toString("base64"),
+			eof: Boolean(eof),
+		});
+	}
+
+	/**
+	 * Resizes the terminal of an exec session
+	 * @param {string} sessionId - The id of the session
+	 * @param {number} cols - The columns of the terminal
+	 * @param {number} rows - The rows of the terminal
+	 * @returns {void}
+	 */
+	resizeExec(sessionId, cols, rows) {
+		const session = this.execSessions.get(sessionId);
+		if (!session) {
+			return;
+		}
+
+		this.sendMessageToClient(session.agentId, this.events.EXEC_RESIZE, {
+			sessionId: sessionId,
+			cols: cols,
+			rows: rows,
+		});
+	}
+
+	/**
+	 * Closes an exec session, the agent answers with the end of the session
+	 * @param {string} sessionId - The id of the session
+	 * @returns {void}
+	 */
+	closeExec(sessionId) {
+		const session = this.execSessions.get(sessionId);
+		if (!session) {
+			return;
+		}
+
+		this.sendMessageToClient(session.agentId, this.events.EXEC_CLOSE, {
+			sessionId: sessionId,
+		});
+	}
+
+	/**
+	 * Ends an exec session the agent ended
+	 * @param {string} sessionId - The id of the session
+	 * @param {number|undefined} exitCode - The exit code of the command, if known
+	 * @param {string} reason - Why the session ended
+	 * @returns {void}
+	 */
+	endExecSession(sessionId, exitCode, reason) {
+		const session = this.execSessions.get(sessionId);
+		if (!session) {
+			return;
+		}
+
+		this.execSessions.delete(sessionId);
+		session.onClose(exitCode, reason);
+	}
+
 	/**
 	 * Generates a unique id
 	 * @returns {string} The unique id
@@ -231,20 +585,26 @@ class WebSocketManager {
 
 	/**
 	 * Call this method in your message handler when a response is received
+	 * @param {string} messageId - The id of the message the response answers
+	 * @param {Object} messageObj - The response
+	 * @param {*} ws - The WebSocket connection the response arrived on
 	 */
-	handleMessageResponse(messageId, messageObj) {
+	handleMessageResponse(messageId, messageObj, ws) {
 		const resolve = this.messageResolvers.get(messageId);
 		if (resolve) {
 			// Check if the data needs to be decrypted, if it is a hex string
-			if (messageObj.data && messageObj.data.match(/^[0-9a-fA-F]+$/)) {
+			if (
+				typeof messageObj.data === "string" &&
+				messageObj.data.match(/^[0-9a-fA-F]+$/)
+			) {
 				log.debug("WebSocketManager", "Auto decrypting message data");
-				messageObj.data = JSON.parse(
-					rsa.decrypt(messageObj.data, this.server.privateKey)
-				);
+				messageObj.data = this.codec(ws).open(messageObj.data);
 			}
 
-			resolve(messageObj); // Assuming messageObj contains the response data
-			this.messageResolvers.delete(messageId);
+			// Resolvers collecting several frames return false until the last one
+			if (resolve(messageObj) !== false) {
+				this.messageResolvers.delete(messageId);
+			}
 		} else {
 			log.error(
 				"WebSocketManager",
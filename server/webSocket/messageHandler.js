@@ -97,7 +97,8 @@ class WebSocketMessageHandler {
 		if (messageObj.messageId) {
 			this.webSocketManager.handleMessageResponse(
 				messageObj.messageId,
-				messageObj
+				messageObj,
+				ws
 			);
 			return;
 		}
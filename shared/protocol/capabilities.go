@@ -0,0 +1,69 @@
+package protocol
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"fmt"
+)
+
+// Capability names an optional protocol feature. Agents advertise their
+// capabilities in the handshake, the server echoes the ones it supports as
+// well in the agentId message, and only those may be used on the connection.
+type Capability string
+
+const (
+	// CapabilityHybridEncryption allows trsa streams, a RSA encrypted AES key followed by GCM sealed chunks
+	CapabilityHybridEncryption Capability = "hybridEncryption"
+	// CapabilityCompression gzip compresses encrypted payloads before encrypting them
+	CapabilityCompression Capability = "compression"
+	// CapabilityLogStreaming allows the server to request and subscribe to container logs
+	CapabilityLogStreaming Capability = "logStreaming"
+	// CapabilityStats allows the agent to send container resource stats
+	CapabilityStats Capability = "stats"
+	// CapabilityExec allows the server to run commands in containers
+	CapabilityExec Capability = "exec"
+	// CapabilityDockerEvents allows the agent to forward Docker daemon events
+	CapabilityDockerEvents Capability = "dockerEvents"
+)
+
+// Capabilities is a list of negotiated capabilities
+type Capabilities []Capability
+
+// Has reports whether c is in the list
+func (caps Capabilities) Has(c Capability) bool {
+	for _, capability := range caps {
+		if capability == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect returns the capabilities in both lists, in the order of caps
+func (caps Capabilities) Intersect(other Capabilities) Capabilities {
+	result := Capabilities{}
+	for _, c := range caps {
+		if other.Has(c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// CapabilityError is returned when a feature is used without its capability being negotiated
+type CapabilityError struct {
+	Capability Capability
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("the %s capability was not negotiated with the peer", e.Capability)
+}
+
+// Require returns a CapabilityError unless c is in the list
+func (caps Capabilities) Require(c Capability) error {
+	if !caps.Has(c) {
+		return &CapabilityError{Capability: c}
+	}
+	return nil
+}
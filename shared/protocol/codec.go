@@ -0,0 +1,197 @@
+package protocol
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"echoes/shared/trsa"
+)
+
+// maxDecompressedSize limits how large a compressed payload may get when decompressing it
+const maxDecompressedSize = 64 * 1024 * 1024
+
+var (
+	// ErrMissingPeerKey is returned when encrypting before the peer's public key is known
+	ErrMissingPeerKey = errors.New("peer public key is unknown, the handshake is missing")
+	// ErrMissingPrivateKey is returned when decrypting without a private key
+	ErrMissingPrivateKey = errors.New("private key is unknown")
+	// ErrPayloadTooLarge is returned when a compressed payload decompresses to more than maxDecompressedSize
+	ErrPayloadTooLarge = errors.New("decompressed payload is too large")
+)
+
+// Codec encrypts and decrypts message payloads exchanged with one peer. Payloads
+// are JSON encoded, encrypted with the session keys if there are any and with
+// the peer's public key otherwise, and hex encoded.
+type Codec struct {
+	// Keys holds the local private key, used to decrypt payloads from the peer
+	Keys *trsa.Keypair
+	// PeerKeys holds the peer's public key, used to encrypt payloads for the peer
+	PeerKeys *trsa.Keypair
+	// Scheme is the negotiated encryption scheme, the trsa default if empty
+	Scheme trsa.Scheme
+	// Session holds the ephemeral session keys, if the handshake established a session
+	Session *trsa.Session
+	// Compress gzip compresses payloads before encrypting them, if the compression capability was negotiated
+	Compress bool
+	// Hybrid encrypts payloads as a trsa stream instead of block by block with RSA, if the
+	// hybridEncryption capability was negotiated. The session keys take precedence.
+	Hybrid bool
+}
+
+// Seal marshals v to JSON, encrypts it and hex encodes the result
+func (c *Codec) Seal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal error: %w", err)
+	}
+
+	if c.Compress {
+		data, err = compress(data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var encrypted []byte
+	switch {
+	case c.Session != nil:
+		encrypted, err = c.Session.Seal(data)
+	case c.PeerKeys != nil && c.Hybrid:
+		encrypted, err = sealStream(c.PeerKeys, c.Scheme, data)
+	case c.PeerKeys != nil:
+		encrypted, err = c.PeerKeys.Encrypt(data, trsa.WithScheme(c.Scheme))
+	default:
+		return "", ErrMissingPeerKey
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error encrypting message: %w", err)
+	}
+
+	return hex.EncodeToString(encrypted), nil
+}
+
+// Open decodes and decrypts a payload created by Seal and unmarshals it into v
+func (c *Codec) Open(data string, v interface{}) error {
+	encrypted, err := hex.DecodeString(data)
+	if err != nil {
+		return fmt.Errorf("Error decoding hex: %w", err)
+	}
+
+	var decrypted []byte
+	switch {
+	case c.Session != nil:
+		decrypted, err = c.Session.Open(encrypted)
+	case c.Keys != nil && c.Hybrid:
+		decrypted, err = openStream(c.Keys, c.Scheme, encrypted)
+	case c.Keys != nil:
+		decrypted, err = c.Keys.Decrypt(encrypted, trsa.WithScheme(c.Scheme))
+	default:
+		return ErrMissingPrivateKey
+	}
+	if err != nil {
+		return fmt.Errorf("Error decrypting message: %w", err)
+	}
+
+	if c.Compress {
+		decrypted, err = decompress(decrypted)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := json.Unmarshal(decrypted, v); err != nil {
+		return fmt.Errorf("Error unmarshaling JSON: %w", err)
+	}
+
+	return nil
+}
+
+// NewMessage builds a message with an encrypted payload
+func (c *Codec) NewMessage(event string, payload interface{}) (Message, error) {
+	sealed, err := c.Seal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return NewMessage(event, sealed)
+}
+
+// Unmarshal decrypts the payload of the message into v
+func (c *Codec) Unmarshal(msg Message, v interface{}) error {
+	var data string
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		return fmt.Errorf("Invalid %s message format: %w", msg.Event, err)
+	}
+
+	return c.Open(data, v)
+}
+
+// sealStream encrypts data as a trsa stream, which takes a single RSA operation for the data key
+func sealStream(keys *trsa.Keypair, scheme trsa.Scheme, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	encryptor, err := keys.NewEncryptor(&buf, trsa.WithScheme(scheme))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encryptor.Write(data); err != nil {
+		return nil, err
+	}
+	if err := encryptor.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openStream decrypts a trsa stream created by sealStream, a payload is nothing but the stream
+func openStream(keys *trsa.Keypair, scheme trsa.Scheme, encrypted []byte) ([]byte, error) {
+	r := bytes.NewReader(encrypted)
+	decryptor, err := keys.NewDecryptor(r, trsa.WithScheme(scheme))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(decryptor)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, trsa.ErrStreamCorrupt
+	}
+	return data, nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing message: %w", err)
+	}
+	defer r.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing message: %w", err)
+	}
+	if len(decompressed) > maxDecompressedSize {
+		return nil, ErrPayloadTooLarge
+	}
+	return decompressed, nil
+}
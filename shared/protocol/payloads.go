@@ -0,0 +1,316 @@
+package protocol
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"time"
+
+	"echoes/shared/trsa"
+)
+
+// Handshake is sent unencrypted by the server when an agent connects and answered by the agent
+type Handshake struct {
+	PublicKey string `json:"publicKey"`
+	// ProtocolVersion is the highest protocol version the sender speaks, 0 for peers predating it
+	ProtocolVersion int `json:"protocolVersion,omitempty"`
+	// Schemes lists the supported trsa schemes. The agent answers with the encryption and signature scheme it picked.
+	Schemes []trsa.Scheme `json:"schemes,omitempty"`
+	// Session is an optional offer of ephemeral session keys
+	Session *trsa.SessionOffer `json:"session,omitempty"`
+	// Version is the sender's software version
+	Version string `json:"version,omitempty"`
+	// Capabilities lists the optional features the agent supports
+	Capabilities Capabilities `json:"capabilities,omitempty"`
+}
+
+// AgentInfo is the encrypted answer to the server's agentInfo request
+type AgentInfo struct {
+	Token     string     `json:"token"`
+	Hostname  string     `json:"hostname"`
+	Inventory *Inventory `json:"inventory,omitempty"`
+}
+
+// Inventory describes the agent and its host. It is part of AgentInfo and
+// sent again periodically as the encrypted payload of agentInfoUpdate.
+type Inventory struct {
+	Agent  AgentInventory   `json:"agent"`
+	Host   HostInventory    `json:"host"`
+	Docker *DockerInventory `json:"docker,omitempty"`
+}
+
+// AgentInventory describes the agent binary and process
+type AgentInventory struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	StartedAt time.Time `json:"startedAt"`
+	// Uptime is the number of seconds since the agent started
+	Uptime int64 `json:"uptime"`
+}
+
+// HostInventory describes the host the agent runs on
+type HostInventory struct {
+	OS string `json:"os"`
+	// Distribution is the operating system name reported by Docker, e.g. "Ubuntu 22.04.3 LTS"
+	Distribution string `json:"distribution,omitempty"`
+	Kernel       string `json:"kernel,omitempty"`
+	Architecture string `json:"architecture"`
+	CPUs         int    `json:"cpus"`
+	// Memory is the total memory in bytes, 0 if unknown
+	Memory uint64 `json:"memory"`
+}
+
+// DockerInventory describes the Docker engine, it is missing if Docker is unavailable
+type DockerInventory struct {
+	// Runtime is the container engine, docker, podman or containerd. Empty is docker.
+	Runtime       string `json:"runtime,omitempty"`
+	Version       string `json:"version"`
+	APIVersion    string `json:"apiVersion"`
+	StorageDriver string `json:"storageDriver"`
+	Rootless      bool   `json:"rootless"`
+	// Containers counts the containers by state, e.g. "running" or "exited"
+	Containers map[string]int `json:"containers"`
+}
+
+// AgentId is sent encrypted by the server once the agent is authenticated
+type AgentId struct {
+	AgentId int `json:"agentId"`
+	// Capabilities echoes the agent's capabilities the server supports as well.
+	// It is nil for servers predating capability negotiation.
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+// ContainerStats is one resource usage sample of a container
+type ContainerStats struct {
+	ContainerId string    `json:"containerId"`
+	Name        string    `json:"name"`
+	Timestamp   time.Time `json:"timestamp"`
+	// CPUPercent is the CPU usage since the previous sample, 100 per fully used CPU.
+	// It is 0 for the first sample of a container.
+	CPUPercent float64 `json:"cpuPercent"`
+	// MemoryUsage excludes the page cache, like docker stats does
+	MemoryUsage   uint64  `json:"memoryUsage"`
+	MemoryLimit   uint64  `json:"memoryLimit"`
+	MemoryPercent float64 `json:"memoryPercent"`
+	// NetworkRx, NetworkTx, BlockRead and BlockWrite count bytes since the container started
+	NetworkRx  uint64 `json:"networkRx"`
+	NetworkTx  uint64 `json:"networkTx"`
+	BlockRead  uint64 `json:"blockRead"`
+	BlockWrite uint64 `json:"blockWrite"`
+	Pids       uint64 `json:"pids"`
+}
+
+// ContainerStatsBatch is the encrypted payload of containerStats
+type ContainerStatsBatch struct {
+	Samples []ContainerStats `json:"samples"`
+}
+
+// ContainerMeta describes a container, it is sent as containerMeta before the first log batch
+// referencing it. The server keeps it, so logs stay attributable after the container is deleted.
+type ContainerMeta struct {
+	ContainerId string `json:"containerId"`
+	// Ref identifies this version of the metadata, it changes when the container is
+	// renamed or restarted
+	Ref     string `json:"ref"`
+	Name    string `json:"name"`
+	Image   string `json:"image"`
+	Tag     string `json:"tag,omitempty"`
+	ImageId string `json:"imageId"`
+	// ComposeProject and ComposeService are set for containers started by Docker Compose
+	ComposeProject string            `json:"composeProject,omitempty"`
+	ComposeService string            `json:"composeService,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	RestartCount   int               `json:"restartCount"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	StartedAt      time.Time         `json:"startedAt"`
+}
+
+// LogEntry is one line a container wrote to stdout or stderr
+type LogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Stream    string    `json:"stream"`
+	Line      string    `json:"line"`
+}
+
+// LogBatch carries log lines of a container. MetaRef references the ContainerMeta
+// describing the container at the time the batch was shipped.
+type LogBatch struct {
+	ContainerId string     `json:"containerId"`
+	MetaRef     string     `json:"metaRef"`
+	Entries     []LogEntry `json:"entries"`
+}
+
+// ContainerLogsRequest is the encrypted payload of a containerLogs request from the server
+type ContainerLogsRequest struct {
+	ContainerId string `json:"containerId"`
+	// Since and Until limit the lines to a time range, zero values leave it open
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// Tail limits the result to the last lines, 0 returns all lines
+	Tail int `json:"tail"`
+	// Streams selects stdout and/or stderr, empty selects both
+	Streams []string `json:"streams,omitempty"`
+	// MaxBytes caps the size of the returned lines, 0 uses the agent's default
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// ContainerLogsChunk is the encrypted payload of a containerLogs reply. Large results
+// are split into several replies carrying the request's messageId, numbered from 0
+// by Seq, the last one has Final set.
+type ContainerLogsChunk struct {
+	LogBatch
+	Seq   int  `json:"seq"`
+	Final bool `json:"final"`
+	// Truncated is set on the final chunk if MaxBytes cut the result short
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// SubscribeLogsRequest is the encrypted payload of subscribeLogs. Sending it again with the
+// same SubscriptionId renews the subscription and replaces its filter and streams.
+type SubscribeLogsRequest struct {
+	SubscriptionId string `json:"subscriptionId"`
+	ContainerId    string `json:"containerId"`
+	// Filter is a regular expression lines have to match, empty passes all lines
+	Filter string `json:"filter,omitempty"`
+	// Streams selects stdout and/or stderr, empty selects both
+	Streams []string `json:"streams,omitempty"`
+	// TTL is the number of seconds after which the subscription expires unless renewed,
+	// 0 uses the agent's default
+	TTL int `json:"ttl"`
+}
+
+// SubscribeLogsReply is the encrypted payload of the reply to subscribeLogs
+type SubscribeLogsReply struct {
+	SubscriptionId string    `json:"subscriptionId"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+}
+
+// UnsubscribeLogsRequest is the encrypted payload of unsubscribeLogs
+type UnsubscribeLogsRequest struct {
+	SubscriptionId string `json:"subscriptionId"`
+}
+
+// SubscriptionLogBatch is the encrypted payload of logBatch, the lines a subscription received
+type SubscriptionLogBatch struct {
+	SubscriptionId string `json:"subscriptionId"`
+	LogBatch
+}
+
+// LogSubscriptionEnded is the encrypted payload of logSubscriptionEnded, sent when a
+// subscription ends without being unsubscribed
+type LogSubscriptionEnded struct {
+	SubscriptionId string `json:"subscriptionId"`
+	Reason         string `json:"reason"`
+}
+
+// ContainerActionRequest is the encrypted payload of a containerAction request
+type ContainerActionRequest struct {
+	ContainerId string `json:"containerId"`
+	// Action is one of the Action constants
+	Action string `json:"action"`
+	// Signal is sent by the kill action, SIGKILL if empty
+	Signal string `json:"signal,omitempty"`
+	// Timeout is the number of seconds stop and restart wait before killing the container,
+	// nil uses the container's default
+	Timeout *int `json:"timeout,omitempty"`
+}
+
+// ContainerActionResult is the encrypted payload of the reply to a successful containerAction
+type ContainerActionResult struct {
+	ContainerId string `json:"containerId"`
+	Name        string `json:"name"`
+	Action      string `json:"action"`
+	// State is the state of the container after the action, like running or paused
+	State       string    `json:"state"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// ExecStartRequest is the encrypted payload of execStart, which starts a command in a container.
+// The server picks the SessionId, all other exec events refer to the session by it.
+type ExecStartRequest struct {
+	SessionId   string   `json:"sessionId"`
+	ContainerId string   `json:"containerId"`
+	Cmd         []string `json:"cmd"`
+	// Tty allocates a terminal, its output has no separate stderr
+	Tty        bool     `json:"tty"`
+	User       string   `json:"user,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	// Cols and Rows are the initial terminal size
+	Cols uint `json:"cols,omitempty"`
+	Rows uint `json:"rows,omitempty"`
+}
+
+// ExecStarted is the encrypted payload of the reply to execStart
+type ExecStarted struct {
+	SessionId string `json:"sessionId"`
+	ExecId    string `json:"execId"`
+}
+
+// ExecData is the encrypted payload of execInput from the server and execOutput from the agent
+type ExecData struct {
+	SessionId string `json:"sessionId"`
+	// Stream is stdout or stderr for output, empty for input
+	Stream string `json:"stream,omitempty"`
+	Data   []byte `json:"data"`
+	// EOF marks the end of the input, the command's stdin is closed after Data
+	EOF bool `json:"eof,omitempty"`
+}
+
+// ExecResize is the encrypted payload of execResize, which resizes the session's terminal
+type ExecResize struct {
+	SessionId string `json:"sessionId"`
+	Cols      uint   `json:"cols"`
+	Rows      uint   `json:"rows"`
+}
+
+// ExecClose is the encrypted payload of execClose. The server sends it to end a session,
+// the agent when a session ended with the exit code of the command, if it is known.
+type ExecClose struct {
+	SessionId string `json:"sessionId"`
+	ExitCode  *int   `json:"exitCode,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// DockerEvent is an event of the Docker daemon, like a container being killed by the OOM killer
+// or a network being created
+type DockerEvent struct {
+	Time time.Time `json:"time"`
+	// Type is the kind of object, like container, image, network or volume
+	Type string `json:"type"`
+	// Action is the Docker action, like die, oom or health_status: unhealthy
+	Action string `json:"action"`
+	// ActorId is the ID of the object, or the name of volumes
+	ActorId    string            `json:"actorId"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Scope is local, or swarm for events of the cluster
+	Scope string `json:"scope,omitempty"`
+}
+
+// DockerEventBatch is the encrypted payload of dockerEvent, holding the events in order.
+// Dropped counts the events discarded since the previous batch, because the agent's spool was full.
+type DockerEventBatch struct {
+	Events  []DockerEvent `json:"events"`
+	Dropped int           `json:"dropped,omitempty"`
+}
+
+// KeyRotateProof is signed by the agent's current and new key
+type KeyRotateProof struct {
+	AgentId   int    `json:"agentId"`
+	Token     string `json:"token"`
+	PublicKey string `json:"publicKey"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// KeyRotateRequest is sent encrypted by the agent to replace its public key
+type KeyRotateRequest struct {
+	// Payload is the JSON encoded KeyRotateProof, the signatures are made over these bytes
+	Payload      string `json:"payload"`
+	OldSignature string `json:"oldSignature"`
+	NewSignature string `json:"newSignature"`
+}
+
+// KeyRotateAck is sent by the server, encrypted with the agent's new key
+type KeyRotateAck struct {
+	PublicKey string `json:"publicKey"`
+}
@@ -0,0 +1,145 @@
+// Package protocol defines the messages exchanged between the Echoes agent
+// and server over the WebSocket connection.
+package protocol
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// Version is the protocol version spoken by this package
+	Version = 1
+	// MinVersion is the oldest protocol version still understood
+	MinVersion = 1
+
+	// legacyVersion is assumed for peers that predate version negotiation
+	legacyVersion = 1
+)
+
+// Event names, they have to match the events map in server/webSocket/manager.js
+const (
+	EventHandshake            = "handshake"
+	EventAgentInfo            = "agentInfo"
+	EventAgentInfoUpdate      = "agentInfoUpdate"
+	EventAgentId              = "agentId"
+	EventContainerList        = "containerList"
+	EventContainerStats       = "containerStats"
+	EventContainerMeta        = "containerMeta"
+	EventContainerLogs        = "containerLogs"
+	EventSubscribeLogs        = "subscribeLogs"
+	EventUnsubscribeLogs      = "unsubscribeLogs"
+	EventLogBatch             = "logBatch"
+	EventLogSubscriptionEnded = "logSubscriptionEnded"
+	EventContainerAction      = "containerAction"
+	EventExecStart            = "execStart"
+	EventExecInput            = "execInput"
+	EventExecOutput           = "execOutput"
+	EventExecResize           = "execResize"
+	EventExecClose            = "execClose"
+	EventDockerEvent          = "dockerEvent"
+	EventKeyRotate            = "keyRotate"
+)
+
+// Log streams of a container
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Container lifecycle actions of containerAction
+const (
+	ActionStart   = "start"
+	ActionStop    = "stop"
+	ActionRestart = "restart"
+	ActionPause   = "pause"
+	ActionUnpause = "unpause"
+	ActionKill    = "kill"
+)
+
+// Message statuses
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Message is the envelope of everything sent over the connection. Requests
+// carrying a MessageId are answered with a message carrying the same id.
+type Message struct {
+	Status    string          `json:"status"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	MessageId string          `json:"messageId,omitempty"`
+}
+
+// VersionError is returned when a peer speaks a protocol version that is no longer supported
+type VersionError struct {
+	Peer int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d, supported are versions %d to %d", e.Peer, MinVersion, Version)
+}
+
+// Negotiate returns the protocol version to speak with a peer advertising the given version.
+// Both sides pick the lower of their versions, peers without a version speak version 1.
+func Negotiate(peer int) (int, error) {
+	if peer == 0 {
+		peer = legacyVersion
+	}
+	if peer < MinVersion {
+		return 0, &VersionError{Peer: peer}
+	}
+	if peer > Version {
+		return Version, nil
+	}
+	return peer, nil
+}
+
+// NewMessage builds a message with an unencrypted payload
+func NewMessage(event string, payload interface{}) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, fmt.Errorf("json.Marshal error: %w", err)
+	}
+
+	return Message{
+		Status: StatusOK,
+		Event:  event,
+		Data:   data,
+	}, nil
+}
+
+// NewError builds an error reply to the request with the given message id
+func NewError(event string, messageId string, err error) Message {
+	data, _ := json.Marshal(err.Error())
+
+	return Message{
+		Status:    StatusError,
+		Event:     event,
+		Data:      data,
+		MessageId: messageId,
+	}
+}
+
+// Parse parses a message received from a peer
+func Parse(raw []byte) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return Message{}, fmt.Errorf("Error unmarshaling JSON: %w", err)
+	}
+
+	return msg, nil
+}
+
+// Unmarshal decodes the unencrypted payload of the message into v
+func (m Message) Unmarshal(v interface{}) error {
+	if err := json.Unmarshal(m.Data, v); err != nil {
+		return fmt.Errorf("Invalid %s message format: %w", m.Event, err)
+	}
+
+	return nil
+}
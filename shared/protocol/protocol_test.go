@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"echoes/shared/trsa"
+)
+
+func newKeys(tb testing.TB) *trsa.Keypair {
+	keys, err := trsa.GenerateKeypair(1024)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	return keys
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		peer    int
+		version int
+		err     bool
+	}{
+		{0, legacyVersion, false},
+		{1, 1, false},
+		{Version + 1, Version, false},
+		{-1, 0, true},
+	}
+
+	for _, test := range tests {
+		version, err := Negotiate(test.peer)
+		if test.err {
+			var versionErr *VersionError
+			if !errors.As(err, &versionErr) || versionErr.Peer != test.peer {
+				t.Fatal(test.peer, "expected a VersionError, got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(test.peer, err.Error())
+		}
+		if version != test.version {
+			t.Fatal(test.peer, "negotiated version", version)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg, err := NewMessage(EventAgentId, AgentId{AgentId: 7})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(raw) != `{"status":"ok","event":"agentId","data":{"agentId":7,"capabilities":null}}` {
+		t.Fatal("unexpected encoding", string(raw))
+	}
+
+	parsed, err := Parse(raw)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var agentId AgentId
+	if err := parsed.Unmarshal(&agentId); err != nil {
+		t.Fatal(err.Error())
+	}
+	if agentId.AgentId != 7 {
+		t.Fatal("agentId", agentId.AgentId)
+	}
+
+	reply := NewError(EventContainerList, "1234", errors.New("docker is unavailable"))
+	if reply.Status != StatusError || reply.MessageId != "1234" || string(reply.Data) != `"docker is unavailable"` {
+		t.Fatal("unexpected error reply", reply)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	agentKeys, serverKeys := newKeys(t), newKeys(t)
+
+	for _, scheme := range trsa.EncryptionSchemes {
+		t.Run(string(scheme), func(t *testing.T) {
+			agent := &Codec{Keys: agentKeys, PeerKeys: serverKeys, Scheme: scheme}
+			server := &Codec{Keys: serverKeys, PeerKeys: agentKeys, Scheme: scheme}
+
+			msg, err := agent.NewMessage(EventAgentInfo, AgentInfo{Token: "token", Hostname: "host"})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			var info AgentInfo
+			if err := server.Unmarshal(msg, &info); err != nil {
+				t.Fatal(err.Error())
+			}
+			if info.Token != "token" || info.Hostname != "host" {
+				t.Fatal("unexpected agent info", info)
+			}
+
+			// The agent can't read what it encrypted for the server
+			if err := agent.Unmarshal(msg, &info); err == nil {
+				t.Fatal("payload decrypted with the wrong key")
+			}
+		})
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	codec := &Codec{}
+	if _, err := codec.Seal(true); err != ErrMissingPeerKey {
+		t.Fatal("expected ErrMissingPeerKey, got", err)
+	}
+	if err := codec.Open("00", new(bool)); err != ErrMissingPrivateKey {
+		t.Fatal("expected ErrMissingPrivateKey, got", err)
+	}
+
+	codec.Keys = newKeys(t)
+	for _, data := range []string{`"zz"`, `{"agentId":1}`, `"00"`} {
+		if err := codec.Unmarshal(Message{Event: EventAgentId, Data: json.RawMessage(data)}, new(AgentId)); err == nil {
+			t.Fatal("invalid payload", data, "accepted")
+		}
+	}
+}
+
+func FuzzCodecOpen(f *testing.F) {
+	keys := newKeys(f)
+	codec := &Codec{Keys: keys, PeerKeys: keys}
+
+	sealed, err := codec.Seal([]interface{}{1, "two"})
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	f.Add(sealed)
+	f.Add("0")
+	f.Add("zz")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		var v interface{}
+		codec.Open(data, &v)
+	})
+}
+
+func TestCapabilities(t *testing.T) {
+	caps := Capabilities{CapabilityCompression, CapabilityStats}
+
+	if !caps.Has(CapabilityStats) || caps.Has(CapabilityExec) {
+		t.Fatal("Has reports wrong capabilities")
+	}
+	if err := caps.Require(CapabilityCompression); err != nil {
+		t.Fatal(err.Error())
+	}
+	var capabilityErr *CapabilityError
+	if err := caps.Require(CapabilityExec); !errors.As(err, &capabilityErr) || capabilityErr.Capability != CapabilityExec {
+		t.Fatal("expected a CapabilityError, got", err)
+	}
+
+	intersection := caps.Intersect(Capabilities{CapabilityExec, CapabilityStats})
+	if len(intersection) != 1 || intersection[0] != CapabilityStats {
+		t.Fatal("unexpected intersection", intersection)
+	}
+	if intersection := caps.Intersect(nil); intersection == nil || len(intersection) != 0 {
+		t.Fatal("intersection with nothing has to be empty, not nil")
+	}
+}
+
+func TestCodecCompression(t *testing.T) {
+	agentKeys, serverKeys := newKeys(t), newKeys(t)
+	agent := &Codec{Keys: agentKeys, PeerKeys: serverKeys, Compress: true}
+	server := &Codec{Keys: serverKeys, PeerKeys: agentKeys, Compress: true}
+
+	payload := strings.Repeat("compressible ", 1000)
+	compressed, err := agent.Seal(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	agent.Compress = false
+	uncompressed, err := agent.Seal(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(compressed) >= len(uncompressed) {
+		t.Fatal("compressed payload is not smaller")
+	}
+
+	var opened string
+	if err := server.Open(compressed, &opened); err != nil {
+		t.Fatal(err.Error())
+	}
+	if opened != payload {
+		t.Fatal("compressed payload differs after opening")
+	}
+	if err := server.Open(uncompressed, &opened); err == nil {
+		t.Fatal("uncompressed payload accepted by a compressing codec")
+	}
+}
+
+func TestCodecHybrid(t *testing.T) {
+	agentKeys, serverKeys := newKeys(t), newKeys(t)
+	agent := &Codec{Keys: agentKeys, PeerKeys: serverKeys, Hybrid: true}
+	server := &Codec{Keys: serverKeys, PeerKeys: agentKeys, Hybrid: true}
+
+	payload := strings.Repeat("log line ", 100000)
+	sealed, err := agent.Seal(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var opened string
+	if err := server.Open(sealed, &opened); err != nil {
+		t.Fatal(err.Error())
+	}
+	if opened != payload {
+		t.Fatal("hybrid payload differs after opening")
+	}
+
+	// A payload is a single stream, nothing may follow it
+	if err := server.Open(sealed+"00", &opened); !errors.Is(err, trsa.ErrStreamCorrupt) {
+		t.Fatal("expected ErrStreamCorrupt for trailing data, got", err)
+	}
+
+	// Codecs that didn't negotiate hybrid encryption read RSA blocks
+	server.Hybrid = false
+	if err := server.Open(sealed, &opened); err == nil {
+		t.Fatal("hybrid payload accepted by a RSA codec")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	bomb, err := compress(make([]byte, maxDecompressedSize+1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := decompress(bomb); err != ErrPayloadTooLarge {
+		t.Fatal("expected ErrPayloadTooLarge, got", err)
+	}
+}
@@ -0,0 +1,113 @@
+package trsa
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func FuzzDecrypt(f *testing.F) {
+	keypair, err := loadKey()
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	encrypted, err := keypair.Encrypt([]byte("container echoes"))
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	f.Add(encrypted)
+	f.Add(encrypted[:100])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		keypair.Decrypt(data)
+		keypair.Decrypt(data, WithScheme(SchemeOAEPSHA256))
+	})
+}
+
+func FuzzVerify(f *testing.F) {
+	keypair, err := loadKey()
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	signature, err := keypair.Sign([]byte("container echoes"))
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	edPublic, _, err := GenerateSigningKeys(KeyTypeEd25519)
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	f.Add([]byte("container echoes"), signature, keypair.Public)
+	f.Add([]byte("container echoes"), []byte("zz"), keypair.Public)
+	f.Add([]byte(""), []byte(""), edPublic)
+	f.Add([]byte(""), []byte(""), []byte("-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n"))
+
+	f.Fuzz(func(t *testing.T, data, signature, publicKey []byte) {
+		Verify(data, signature, publicKey)
+		Verify(data, signature, publicKey, WithScheme(SchemePSS))
+	})
+}
+
+func FuzzSplit(f *testing.F) {
+	f.Add([]byte("container echoes"), 4)
+	f.Add([]byte{}, 1)
+	f.Add([]byte("x"), 0)
+	f.Add([]byte("x"), -1)
+
+	f.Fuzz(func(t *testing.T, buf []byte, lim int) {
+		chunks := split(buf, lim)
+		if lim <= 0 {
+			if chunks != nil {
+				t.Fatal("split with a non-positive limit returned chunks")
+			}
+			return
+		}
+		for _, chunk := range chunks {
+			if len(chunk) == 0 || len(chunk) > lim {
+				t.Fatal("chunk of length", len(chunk), "with limit", lim)
+			}
+		}
+		if !bytes.Equal(bytes.Join(chunks, nil), buf) {
+			t.Fatal("chunks do not add up to the input")
+		}
+	})
+}
+
+func FuzzDecryptor(f *testing.F) {
+	keypair, err := loadKey()
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	var stream bytes.Buffer
+	encryptor, err := keypair.NewEncryptor(&stream, WithChunkSize(8))
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	encryptor.Write([]byte("container echoes"))
+	encryptor.Close()
+	f.Add(stream.Bytes())
+	f.Add([]byte(streamMagic))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decryptor, err := keypair.NewDecryptor(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, decryptor)
+	})
+}
+
+func FuzzSessionOpen(f *testing.F) {
+	agent, server := newSessionPair(f)
+	sealed, err := agent.Seal([]byte("container echoes"))
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	f.Add(sealed)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server.Open(data)
+	})
+}
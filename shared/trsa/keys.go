@@ -0,0 +1,185 @@
+package trsa
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// KeyType identifies the algorithm of a key
+type KeyType string
+
+const (
+	KeyTypeRSA     KeyType = "rsa"
+	KeyTypeECDSA   KeyType = "ecdsa-p256"
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+// ErrUnsupportedKeyType is returned when a pem block holds a key of an unknown algorithm or curve
+var ErrUnsupportedKeyType = errors.New("unsupported key type")
+
+// ErrVerification is returned when a signature does not match, whatever the key type
+var ErrVerification = errors.New("verification error")
+
+// UnsupportedOperationError is returned when an operation is not available for a key type,
+// e.g. encrypting with an Ed25519 key
+type UnsupportedOperationError struct {
+	Op      string
+	KeyType KeyType
+}
+
+func (e *UnsupportedOperationError) Error() string {
+	return fmt.Sprintf("%s is not supported by %s keys", e.Op, e.KeyType)
+}
+
+// GenerateSigningKeys return public (first) and private (second) key as pem for the given key type.
+// RSA keys are generated with 2048 bits, use GenerateKeys for other sizes.
+func GenerateSigningKeys(keyType KeyType) ([]byte, []byte, error) {
+	var signer crypto.Signer
+	var err error
+	switch keyType {
+	case KeyTypeRSA:
+		return GenerateKeys(2048)
+	case KeyTypeECDSA:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, nil, ErrUnsupportedKeyType
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+	return publicKey, privateKey, nil
+}
+
+// DetectKeyType returns the type of a pem encoded public or private key
+func DetectKeyType(keyPem []byte) (KeyType, error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return "", errors.New("could not decode key pem")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY", "RSA PUBLIC KEY":
+		key, err = decodePublicKey(block)
+	default:
+		key, err = decodePrivateKey(block)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return keyTypeOf(key)
+}
+
+// keyTypeOf maps a parsed key to its KeyType
+func keyTypeOf(key interface{}) (KeyType, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey, *rsa.PrivateKey:
+		return KeyTypeRSA, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", ErrUnsupportedKeyType
+		}
+		return KeyTypeECDSA, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return "", ErrUnsupportedKeyType
+		}
+		return KeyTypeECDSA, nil
+	case ed25519.PublicKey, ed25519.PrivateKey:
+		return KeyTypeEd25519, nil
+	default:
+		return "", ErrUnsupportedKeyType
+	}
+}
+
+// parseAnyPublicKey parses a PKIX or PKCS#1 public key of any supported type
+func parseAnyPublicKey(publicKeyPem []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyPem)
+	if block == nil {
+		return nil, errors.New("could not decode public key pem")
+	}
+
+	publicKey, err := decodePublicKey(block)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := keyTypeOf(publicKey); err != nil {
+		return nil, err
+	}
+
+	return publicKey, nil
+}
+
+// parseAnyPrivateKey parses a PKCS#1, PKCS#8 or SEC1 private key of any supported type
+func parseAnyPrivateKey(privateKeyPem []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privateKeyPem)
+	if block == nil {
+		return nil, errors.New("could not decode private key pem")
+	}
+
+	privateKey, err := decodePrivateKey(block)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := keyTypeOf(privateKey); err != nil {
+		return nil, err
+	}
+
+	return privateKey, nil
+}
+
+func decodePublicKey(block *pem.Block) (crypto.PublicKey, error) {
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func decodePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		p, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := p.(crypto.Signer)
+		if !ok {
+			return nil, ErrUnsupportedKeyType
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("%w: pem block %q", ErrUnsupportedKeyType, block.Type)
+	}
+}
@@ -0,0 +1,104 @@
+package trsa
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"time"
+)
+
+// Scheme identifies the padding used for RSA encryption or signatures
+type Scheme string
+
+const (
+	// SchemeOAEPSHA1 is the default encryption scheme, compatible with the Node trsa library
+	SchemeOAEPSHA1 Scheme = "rsa-oaep-sha1"
+	// SchemeOAEPSHA256 uses OAEP with SHA-256 as hash and mask generation function
+	SchemeOAEPSHA256 Scheme = "rsa-oaep-sha256"
+	// SchemePKCS1v15 is the default signature scheme, compatible with the Node trsa library
+	SchemePKCS1v15 Scheme = "rsa-pkcs1v15-sha256"
+	// SchemePSS signs with RSA-PSS over SHA-256, using a salt as long as the hash
+	SchemePSS Scheme = "rsa-pss-sha256"
+)
+
+// EncryptionSchemes lists the supported encryption schemes, strongest first
+var EncryptionSchemes = []Scheme{SchemeOAEPSHA256, SchemeOAEPSHA1}
+
+// SignatureSchemes lists the supported signature schemes, strongest first
+var SignatureSchemes = []Scheme{SchemePSS, SchemePKCS1v15}
+
+// Option configures Encrypt, Decrypt, Sign and Verify
+type Option func(*options)
+
+type options struct {
+	encryption    Scheme
+	signature     Scheme
+	rekeyBytes    int64
+	rekeyInterval time.Duration
+	chunkSize     int
+}
+
+// WithScheme selects the encryption or signature scheme, depending on which kind s is.
+// Signature schemes only apply to RSA keys, ECDSA and Ed25519 keys have a single scheme.
+func WithScheme(s Scheme) Option {
+	return func(o *options) {
+		switch s {
+		case SchemeOAEPSHA1, SchemeOAEPSHA256:
+			o.encryption = s
+		case SchemePKCS1v15, SchemePSS:
+			o.signature = s
+		}
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		encryption:    SchemeOAEPSHA1,
+		signature:     SchemePKCS1v15,
+		rekeyBytes:    DefaultRekeyBytes,
+		rekeyInterval: DefaultRekeyInterval,
+		chunkSize:     DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// oaepHash returns the hash used by the encryption scheme
+func (o *options) oaepHash() hash.Hash {
+	if o.encryption == SchemeOAEPSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// oaepChunkSize returns how many plaintext bytes fit into one encrypted block of a key with the given bit length
+func (o *options) oaepChunkSize(bitLen int) int {
+	if o.encryption == SchemeOAEPSHA256 {
+		// two hashes and two bytes of OAEP padding
+		return bitLen/8 - 2*sha256.Size - 2
+	}
+	// 11 is part of the rsa chunk, 32 the length of a sha1 hash
+	return bitLen/8 - 11 - 32
+}
+
+// Strongest picks the strongest encryption and signature scheme out of the advertised ones.
+// If a peer advertises nothing usable the wire compatible defaults are returned.
+func Strongest(advertised []Scheme) (Scheme, Scheme) {
+	return strongestOf(EncryptionSchemes, advertised), strongestOf(SignatureSchemes, advertised)
+}
+
+func strongestOf(supported, advertised []Scheme) Scheme {
+	for _, s := range supported {
+		for _, a := range advertised {
+			if s == a {
+				return s
+			}
+		}
+	}
+	return supported[len(supported)-1]
+}
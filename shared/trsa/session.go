@@ -0,0 +1,269 @@
+package trsa
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionHeaderLen is the length of the epoch and counter prefixed to every sealed message
+	sessionHeaderLen = 12
+	// maxEpochSkip limits how many re-keys a single received message can trigger
+	maxEpochSkip = 64
+
+	// DefaultRekeyBytes is the amount of plaintext sealed under one key before re-keying
+	DefaultRekeyBytes = 1 << 30
+	// DefaultRekeyInterval is the maximum lifetime of one key before re-keying
+	DefaultRekeyInterval = time.Hour
+)
+
+var (
+	sessionSignatureLabel = []byte("echoes session offer v1\n")
+	sessionKeyInfo        = []byte("echoes session keys v1")
+	sessionRekeyInfo      = []byte("echoes session rekey v1")
+)
+
+// ErrSessionMessage is returned when a sealed message is malformed, replayed or fails authentication
+var ErrSessionMessage = errors.New("invalid session message")
+
+// SessionOffer is an ephemeral X25519 public key signed by a long-term key
+type SessionOffer struct {
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// SessionHandshake holds the ephemeral key of one side until the peer's offer arrives
+type SessionHandshake struct {
+	private *ecdh.PrivateKey
+	offer   SessionOffer
+	opts    []Option
+}
+
+// NewSessionHandshake creates an ephemeral X25519 key and signs it with the long-term private key.
+// The options select the signature scheme and the re-keying limits of the resulting session.
+func NewSessionHandshake(longTermPrivateKeyPem []byte, opts ...Option) (*SessionHandshake, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey := hex.EncodeToString(private.PublicKey().Bytes())
+	signature, err := Sign(sessionSignedData(publicKey), longTermPrivateKeyPem, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionHandshake{
+		private: private,
+		offer: SessionOffer{
+			PublicKey: publicKey,
+			Signature: string(signature),
+		},
+		opts: opts,
+	}, nil
+}
+
+// Offer returns the signed ephemeral public key to send to the peer
+func (h *SessionHandshake) Offer() SessionOffer {
+	return h.offer
+}
+
+// Complete verifies the peer's offer against its long-term public key and derives the session keys.
+// Exactly one side of a connection must pass initiator as true.
+func (h *SessionHandshake) Complete(peer SessionOffer, peerLongTermPublicKeyPem []byte, initiator bool) (*Session, error) {
+	err := Verify(sessionSignedData(peer.PublicKey), []byte(peer.Signature), peerLongTermPublicKeyPem, h.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	peerKeyBytes, err := hex.DecodeString(peer.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(peerKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := h.private.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bind the keys to both ephemeral public keys, in initiator-responder order
+	own := h.private.PublicKey().Bytes()
+	salt := append(append([]byte{}, peerKeyBytes...), own...)
+	if initiator {
+		salt = append(append([]byte{}, own...), peerKeyBytes...)
+	}
+	keys := hkdf(secret, salt, sessionKeyInfo, 64)
+
+	initiatorKey, responderKey := keys[:32], keys[32:]
+	if !initiator {
+		initiatorKey, responderKey = responderKey, initiatorKey
+	}
+
+	o := newOptions(h.opts)
+	return &Session{
+		send:          newSessionDirection(initiatorKey),
+		recv:          newSessionDirection(responderKey),
+		rekeyBytes:    o.rekeyBytes,
+		rekeyInterval: o.rekeyInterval,
+	}, nil
+}
+
+// Session encrypts messages with AES-256-GCM under keys derived from an X25519 key agreement.
+// Each direction re-keys independently by ratcheting its key forward once the byte or time
+// limit is reached, the epoch in every message tells the receiver to follow.
+// A Session is safe for concurrent use.
+type Session struct {
+	mu            sync.Mutex
+	send          *sessionDirection
+	recv          *sessionDirection
+	rekeyBytes    int64
+	rekeyInterval time.Duration
+}
+
+type sessionDirection struct {
+	key     []byte
+	aead    cipher.AEAD
+	epoch   uint32
+	counter uint64
+	bytes   int64
+	since   time.Time
+}
+
+func newSessionDirection(key []byte) *sessionDirection {
+	d := &sessionDirection{}
+	d.setKey(key)
+	return d
+}
+
+func (d *sessionDirection) setKey(key []byte) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// key is always 32 bytes long
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	d.key = key
+	d.aead = aead
+	d.counter = 0
+	d.bytes = 0
+	d.since = time.Now()
+}
+
+// rekey ratchets the key forward, the previous key can not be recovered from the new one
+func (d *sessionDirection) rekey() {
+	d.epoch++
+	d.setKey(hkdf(d.key, nil, sessionRekeyInfo, 32))
+}
+
+// Seal encrypts and authenticates data for the peer
+func (s *Session) Seal(data []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.send
+	limitReached := d.bytes+int64(len(data)) > s.rekeyBytes || time.Since(d.since) > s.rekeyInterval
+	if (limitReached && d.counter > 0) || d.counter == ^uint64(0) {
+		d.rekey()
+	}
+
+	d.counter++
+	d.bytes += int64(len(data))
+
+	header := make([]byte, sessionHeaderLen)
+	binary.BigEndian.PutUint32(header[:4], d.epoch)
+	binary.BigEndian.PutUint64(header[4:], d.counter)
+
+	// The header doubles as nonce and additional data
+	return d.aead.Seal(header, header, data, header), nil
+}
+
+// Open authenticates and decrypts a message sealed by the peer.
+// Messages have to arrive in order, replayed or reordered messages are rejected.
+func (s *Session) Open(sealed []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(sealed) < sessionHeaderLen+s.recv.aead.Overhead() {
+		return nil, ErrSessionMessage
+	}
+	header := sealed[:sessionHeaderLen]
+	epoch := binary.BigEndian.Uint32(header[:4])
+	counter := binary.BigEndian.Uint64(header[4:])
+
+	d := s.recv
+	if epoch < d.epoch || epoch-d.epoch > maxEpochSkip {
+		return nil, ErrSessionMessage
+	}
+
+	// Follow the sender's re-keys on a copy, so a forged message can't desync the session
+	next := *d
+	for next.epoch < epoch {
+		next.rekey()
+	}
+	if counter <= next.counter {
+		return nil, ErrSessionMessage
+	}
+
+	data, err := next.aead.Open(nil, header, sealed[sessionHeaderLen:], header)
+	if err != nil {
+		return nil, ErrSessionMessage
+	}
+
+	next.counter = counter
+	*s.recv = next
+	return data, nil
+}
+
+// WithRekeyLimits sets after how many plaintext bytes or how much time a session re-keys
+func WithRekeyLimits(bytes int64, interval time.Duration) Option {
+	return func(o *options) {
+		o.rekeyBytes = bytes
+		o.rekeyInterval = interval
+	}
+}
+
+// sessionSignedData returns the data signed to prove ownership of an ephemeral key
+func sessionSignedData(publicKey string) []byte {
+	return append(append([]byte{}, sessionSignatureLabel...), publicKey...)
+}
+
+// hkdf derives length bytes from secret using HKDF-SHA256 (RFC 5869)
+func hkdf(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+
+	out := make([]byte, 0, length+sha256.Size)
+	var block []byte
+	for i := byte(1); len(out) < length; i++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(block)
+		expander.Write(info)
+		expander.Write([]byte{i})
+		block = expander.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
@@ -0,0 +1,142 @@
+package trsa
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func newSessionPair(tb testing.TB, opts ...Option) (*Session, *Session) {
+	agentPublic, agentPrivate, err := GenerateKeys(1024)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	serverPublic, serverPrivate, err := GenerateSigningKeys(KeyTypeEd25519)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+
+	agent, err := NewSessionHandshake(agentPrivate, opts...)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	server, err := NewSessionHandshake(serverPrivate, opts...)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+
+	agentSession, err := agent.Complete(server.Offer(), serverPublic, true)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	serverSession, err := server.Complete(agent.Offer(), agentPublic, false)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	return agentSession, serverSession
+}
+
+func TestSessionSealOpen(t *testing.T) {
+	agent, server := newSessionPair(t)
+
+	for _, message := range []string{"", "agentInfo", "containerList"} {
+		sealed, err := agent.Seal([]byte(message))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		opened, err := server.Open(sealed)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(opened) != message {
+			t.Fatal("unequal ", string(opened), "--", message)
+		}
+
+		reply, err := server.Seal([]byte(message))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if bytes.Equal(reply, sealed) {
+			t.Error("both directions use the same key")
+		}
+		if _, err := agent.Open(reply); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestSessionRejectsReplayAndTampering(t *testing.T) {
+	agent, server := newSessionPair(t)
+
+	sealed, err := agent.Seal([]byte("containerList"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := server.Open(tampered); err != ErrSessionMessage {
+		t.Error("opened a tampered message")
+	}
+	if _, err := server.Open(sealed); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := server.Open(sealed); err != ErrSessionMessage {
+		t.Error("opened a replayed message")
+	}
+	if _, err := server.Open(sealed[:5]); err != ErrSessionMessage {
+		t.Error("opened a truncated message")
+	}
+}
+
+func TestSessionRekey(t *testing.T) {
+	agent, server := newSessionPair(t, WithRekeyLimits(16, time.Hour))
+
+	for i := 0; i < 10; i++ {
+		sealed, err := agent.Seal([]byte("0123456789"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := server.Open(sealed); err != nil {
+			t.Fatal(i, err.Error())
+		}
+	}
+	if agent.send.epoch == 0 || server.recv.epoch != agent.send.epoch {
+		t.Error("sessions did not re-key in step", agent.send.epoch, server.recv.epoch)
+	}
+}
+
+func TestSessionRejectsForgedOffer(t *testing.T) {
+	_, agentPrivate, err := GenerateKeys(1024)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	otherPublic, _, err := GenerateKeys(1024)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	agent, err := NewSessionHandshake(agentPrivate)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server, err := NewSessionHandshake(agentPrivate)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := agent.Complete(server.Offer(), otherPublic, true); err == nil {
+		t.Error("accepted an offer signed by the wrong key")
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869, test case 1
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+
+	if got := hex.EncodeToString(hkdf(ikm, salt, info, 42)); got != okm {
+		t.Fatal("unexpected okm ", got)
+	}
+}
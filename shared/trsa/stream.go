@@ -0,0 +1,312 @@
+package trsa
+
+// This file is part of Container Echoes, under the Apache License 2.0.
+// See the LICENSE file in the root directory of this source tree for license information.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A stream starts with a header holding the magic, the length of the RSA
+// encrypted data key and the data key itself. It is followed by chunks, each
+// prefixed with the length of its ciphertext. Every chunk is sealed with
+// AES-256-GCM, the nonce holds the chunk counter and a flag marking the
+// final chunk, so reordered, dropped or truncated chunks fail authentication.
+const (
+	streamMagic       = "TRS1"
+	streamKeyLen      = 32
+	streamLengthLen   = 4
+	streamFinalFlag   = 1
+	DefaultChunkSize  = 64 * 1024
+	maxStreamChunkLen = 16 * 1024 * 1024
+)
+
+var (
+	// ErrStreamTruncated is returned when a stream ends before its final chunk
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+	// ErrStreamCorrupt is returned when a stream header or chunk is malformed or fails authentication
+	ErrStreamCorrupt = errors.New("encrypted stream is corrupt")
+	// ErrStreamClosed is returned when writing to a closed Encryptor
+	ErrStreamClosed = errors.New("encrypted stream is closed")
+)
+
+// WithChunkSize sets how many plaintext bytes an Encryptor seals per chunk
+func WithChunkSize(size int) Option {
+	return func(o *options) {
+		o.chunkSize = size
+	}
+}
+
+// Encryptor encrypts everything written to it in authenticated chunks.
+// Close must be called to write the final chunk, otherwise the stream is
+// reported as truncated when decrypting.
+type Encryptor struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+	err     error
+}
+
+// NewEncryptor writes the stream header to w and returns an Encryptor that
+// encrypts for the owner of the given RSA public key
+func NewEncryptor(w io.Writer, publicKeyPem []byte, opts ...Option) (*Encryptor, error) {
+	publicKey, err := parsePublicKey(publicKeyPem)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptor(w, publicKey, newOptions(opts))
+}
+
+// NewEncryptor returns an Encryptor using the keypair's public key
+func (key *Keypair) NewEncryptor(w io.Writer, opts ...Option) (*Encryptor, error) {
+	p, err := key.parsedPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := rsaPublicKey(p)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptor(w, publicKey, newOptions(opts))
+}
+
+func newEncryptor(w io.Writer, publicKey *rsa.PublicKey, o *options) (*Encryptor, error) {
+	if o.chunkSize <= 0 || o.chunkSize > maxStreamChunkLen {
+		return nil, errors.New("invalid chunk size")
+	}
+
+	key := make([]byte, streamKeyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(o.oaepHash(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(streamMagic)+streamLengthLen+len(encryptedKey))
+	header = append(header, streamMagic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(encryptedKey)))
+	header = append(header, encryptedKey...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Encryptor{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, o.chunkSize),
+	}, nil
+}
+
+// Write buffers p and writes every full chunk to the underlying writer
+func (e *Encryptor) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, ErrStreamClosed
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+
+		// Keep a full buffer around until more data arrives, it might be the final chunk
+		if len(e.buf) == cap(e.buf) && len(p) > 0 {
+			if err := e.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close writes the buffered data as the final chunk. It does not close the underlying writer.
+func (e *Encryptor) Close() error {
+	if e.closed {
+		return nil
+	}
+	if e.err != nil {
+		return e.err
+	}
+	e.closed = true
+	return e.writeChunk(true)
+}
+
+func (e *Encryptor) writeChunk(final bool) error {
+	nonce := streamNonce(e.counter, final)
+	e.counter++
+
+	frame := make([]byte, streamLengthLen, streamLengthLen+len(e.buf)+e.aead.Overhead())
+	frame = e.aead.Seal(frame, nonce, e.buf, nil)
+	binary.BigEndian.PutUint32(frame[:streamLengthLen], uint32(len(frame)-streamLengthLen))
+
+	e.buf = e.buf[:0]
+	if _, err := e.w.Write(frame); err != nil {
+		e.err = err
+		return err
+	}
+	return nil
+}
+
+// Decryptor decrypts a stream written by an Encryptor, verifying every chunk before returning its data.
+// It reads no further than the final chunk, so a stream can be followed by other data. Whether
+// that is allowed is up to the caller.
+type Decryptor struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	out     []byte
+	chunk   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// NewDecryptor reads the stream header from r and returns a Decryptor using the given RSA private key
+func NewDecryptor(r io.Reader, privateKeyPem []byte, opts ...Option) (*Decryptor, error) {
+	privateKey, err := parsePrivateKey(privateKeyPem)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptor(r, privateKey, newOptions(opts))
+}
+
+// NewDecryptor returns a Decryptor using the keypair's private key
+func (key *Keypair) NewDecryptor(r io.Reader, opts ...Option) (*Decryptor, error) {
+	p, err := key.parsedPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := rsaPrivateKey(p)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptor(r, privateKey, newOptions(opts))
+}
+
+func newDecryptor(r io.Reader, privateKey *rsa.PrivateKey, o *options) (*Decryptor, error) {
+	header := make([]byte, len(streamMagic)+streamLengthLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrStreamTruncated
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrStreamCorrupt
+	}
+
+	keyLen := binary.BigEndian.Uint32(header[len(streamMagic):])
+	if int(keyLen) != privateKey.Size() {
+		return nil, ErrStreamCorrupt
+	}
+	encryptedKey := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, encryptedKey); err != nil {
+		return nil, ErrStreamTruncated
+	}
+	key, err := rsa.DecryptOAEP(o.oaepHash(), rand.Reader, privateKey, encryptedKey, nil)
+	if err != nil || len(key) != streamKeyLen {
+		return nil, ErrStreamCorrupt
+	}
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Decryptor{
+		r:    r,
+		aead: aead,
+	}, nil
+}
+
+// Read returns decrypted data. It returns io.EOF only after the final chunk was verified,
+// and ErrStreamTruncated if the underlying reader ends before that.
+func (d *Decryptor) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.readChunk()
+	}
+
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+func (d *Decryptor) readChunk() error {
+	length := make([]byte, streamLengthLen)
+	if _, err := io.ReadFull(d.r, length); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+
+	chunkLen := int(binary.BigEndian.Uint32(length))
+	if chunkLen < d.aead.Overhead() || chunkLen > maxStreamChunkLen+d.aead.Overhead() {
+		return ErrStreamCorrupt
+	}
+	if cap(d.buf) < chunkLen {
+		d.buf = make([]byte, chunkLen)
+	}
+	sealed := d.buf[:chunkLen]
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+
+	// Try the chunk as a regular chunk first, then as the final one. The plaintext
+	// goes to its own buffer, as a failed Open clears its output.
+	chunk, err := d.aead.Open(d.out[:0], streamNonce(d.counter, false), sealed, nil)
+	if err != nil {
+		chunk, err = d.aead.Open(d.out[:0], streamNonce(d.counter, true), sealed, nil)
+		if err != nil {
+			return ErrStreamCorrupt
+		}
+		d.done = true
+	}
+
+	d.counter++
+	d.out = chunk
+	d.chunk = chunk
+	return nil
+}
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// streamNonce builds the nonce of a chunk from its counter and the final flag
+func streamNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[len(nonce)-1] = streamFinalFlag
+	}
+	return nonce
+}
@@ -0,0 +1,136 @@
+package trsa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encryptStream(t *testing.T, keypair *Keypair, data []byte, chunkSize int) []byte {
+	var out bytes.Buffer
+	encryptor, err := NewEncryptor(&out, keypair.Public, WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Write in uneven pieces to exercise the buffering
+	for len(data) > 0 {
+		n := len(data)
+		if n > 7 {
+			n = 7
+		}
+		if _, err := encryptor.Write(data[:n]); err != nil {
+			t.Fatal(err.Error())
+		}
+		data = data[n:]
+	}
+	if err := encryptor.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return out.Bytes()
+}
+
+func decryptStream(keypair *Keypair, encrypted []byte) ([]byte, error) {
+	decryptor, err := NewDecryptor(bytes.NewReader(encrypted), keypair.Private)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(decryptor)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	const chunkSize = 32
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 1000} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		decrypted, err := decryptStream(keypair, encryptStream(t, keypair, data, chunkSize))
+		if err != nil {
+			t.Fatal(size, err.Error())
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Fatal(size, "unequal after stream round trip")
+		}
+	}
+}
+
+func TestStreamDetectsTruncation(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	const chunkSize = 32
+	encrypted := encryptStream(t, keypair, bytes.Repeat([]byte("x"), 3*chunkSize), chunkSize)
+	header := len(streamMagic) + streamLengthLen + 256
+	frame := streamLengthLen + chunkSize + 16
+
+	// Cut at chunk boundaries and in the middle of chunks
+	for _, cut := range []int{header, header + frame, header + 2*frame, header + frame + 5, len(encrypted) - 1} {
+		_, err := decryptStream(keypair, encrypted[:cut])
+		if !errors.Is(err, ErrStreamTruncated) {
+			t.Error(cut, "expected ErrStreamTruncated, got", err)
+		}
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	const chunkSize = 32
+	encrypted := encryptStream(t, keypair, bytes.Repeat([]byte("x"), 3*chunkSize), chunkSize)
+	header := len(streamMagic) + streamLengthLen + 256
+	frame := streamLengthLen + chunkSize + 16
+
+	flipped := append([]byte{}, encrypted...)
+	flipped[header+frame+10] ^= 1
+
+	swapped := append([]byte{}, encrypted[:header]...)
+	swapped = append(swapped, encrypted[header+frame:header+2*frame]...)
+	swapped = append(swapped, encrypted[header:header+frame]...)
+	swapped = append(swapped, encrypted[header+2*frame:]...)
+
+	for name, stream := range map[string][]byte{"flipped": flipped, "swapped": swapped} {
+		_, err := decryptStream(keypair, stream)
+		if !errors.Is(err, ErrStreamCorrupt) {
+			t.Error(name, "expected ErrStreamCorrupt, got", err)
+		}
+	}
+}
+
+func TestStreamFollowedByData(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The decryptor stops after the final chunk, even if the reader would block afterwards
+	encrypted := encryptStream(t, keypair, []byte("hello"), 32)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(encrypted)
+		pw.Write([]byte("next"))
+	}()
+	decryptor, err := NewDecryptor(pr, keypair.Private)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decrypted, err := io.ReadAll(decryptor)
+	if err != nil || string(decrypted) != "hello" {
+		t.Fatal("decrypted", string(decrypted), err)
+	}
+
+	next := make([]byte, 4)
+	if _, err := io.ReadFull(pr, next); err != nil || string(next) != "next" {
+		t.Fatal("data after the stream", string(next), err)
+	}
+}
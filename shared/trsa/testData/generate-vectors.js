@@ -0,0 +1,72 @@
+/**
+ * Generates vectors.json, the golden test vectors for the Go trsa package.
+ *
+ * Run with `NODE_PATH=../../../server/node_modules node generate-vectors.js > vectors.json`
+ * from this directory, after `npm install` in the server. The keys, ciphertexts and
+ * signatures come from the trsa library at the version pinned in server/package.json.
+ * The library splits the plaintext into chunks of (modulus bytes - 47), as found in
+ * data.txt.encrypted, and encrypts every chunk with RSA-OAEP using SHA-1. Signatures
+ * are RSA PKCS#1 v1.5 over SHA-256 and hex encoded, which is deterministic and must be
+ * reproduced byte for byte by the Go package.
+ *
+ * The committed vectors.json has not been regenerated with the library yet. It was
+ * made by an earlier version of this script that reproduced the format above with
+ * Node's crypto module, so it does not prove compatibility with the library itself.
+ */
+const rsa = require("trsa");
+
+const KEY_SIZES = [1024, 2048, 4096];
+
+// Overhead of the Node trsa library per chunk
+const NODE_CHUNK_OVERHEAD = 47;
+
+// Overhead of the Go trsa package per chunk
+const GO_CHUNK_OVERHEAD = 43;
+
+/**
+ * Builds a deterministic printable plaintext of the given length
+ * @param {number} length - The length in bytes
+ * @returns {Buffer} The plaintext
+ */
+function plaintext(length) {
+	const text = "Container Echoes keeps the logs of your containers. ";
+	return Buffer.from(text.repeat(Math.ceil(length / text.length) + 1)).subarray(
+		0,
+		length
+	);
+}
+
+const output = { keys: {}, vectors: [] };
+
+for (const bits of KEY_SIZES) {
+	const { publicKey, privateKey } = rsa.generateKeyPair({ bits });
+	output.keys[bits] = { publicKey, privateKey };
+
+	const nodeChunk = bits / 8 - NODE_CHUNK_OVERHEAD;
+	const goChunk = bits / 8 - GO_CHUNK_OVERHEAD;
+	const lengths = [
+		0,
+		1,
+		nodeChunk - 1,
+		nodeChunk,
+		nodeChunk + 1,
+		goChunk,
+		goChunk + 1,
+		2 * nodeChunk,
+		3 * goChunk + 5,
+	];
+
+	for (const length of lengths) {
+		// The plaintext is ASCII, the library takes strings
+		const data = plaintext(length);
+		output.vectors.push({
+			name: `rsa${bits}-${length}`,
+			bits,
+			plaintext: data.toString("hex"),
+			ciphertext: rsa.encrypt(data.toString(), publicKey),
+			signature: rsa.sign(data.toString(), privateKey),
+		});
+	}
+}
+
+process.stdout.write(JSON.stringify(output, null, "\t") + "\n");
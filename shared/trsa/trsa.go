@@ -12,19 +12,34 @@ import (
 	"bufio"
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
-	"errors"
+	"sync"
 )
 
-// Keypair holds the public and the private rsa key
+// pssOptions are used for RSA-PSS signatures
+var pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+
+// Keypair holds the public and the private key as pem, together with the parsed keys.
+// The keys are parsed once, so a Keypair should be reused for every message.
+// Public and Private must not be modified after creating the Keypair.
+// A Keypair is safe for concurrent use.
 type Keypair struct {
 	Public  []byte
 	Private []byte
+
+	publicOnce  sync.Once
+	publicKey   crypto.PublicKey
+	publicErr   error
+	privateOnce sync.Once
+	privateKey  crypto.Signer
+	privateErr  error
 }
 
 // GenerateKeypair generate a keyPair and return a Keypair
@@ -43,13 +58,44 @@ func GenerateKeys(bitLength int) ([]byte, []byte, error) {
 		return nil, nil, err
 	}
 
+	return encodeKeys(privKey)
+}
+
+// ImportPrivateKey parses a PKCS#1 or PKCS#8 encoded RSA private key and returns
+// the public (first) and private (second) key as pem, in the same format as GenerateKeys
+func ImportPrivateKey(privateKeyPem []byte) ([]byte, []byte, error) {
+	privKey, err := parsePrivateKey(privateKeyPem)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodeKeys(privKey)
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of the DER encoded public key
+func Fingerprint(publicKeyPem []byte) (string, error) {
+	publicKey, err := parseAnyPublicKey(publicKeyPem)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// encodeKeys returns the PKIX public (first) and PKCS#1 private (second) key as pem
+func encodeKeys(privKey *rsa.PrivateKey) ([]byte, []byte, error) {
 	privBlock := pem.Block{}
 	privBlock.Type = "RSA PRIVATE KEY"
 	privBlock.Bytes = x509.MarshalPKCS1PrivateKey(privKey)
 
 	var privateKeyBuffer bytes.Buffer
 	privateKeyBufferWriter := bufio.NewWriter(&privateKeyBuffer)
-	err = pem.Encode(privateKeyBufferWriter, &privBlock)
+	err := pem.Encode(privateKeyBufferWriter, &privBlock)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -90,58 +136,114 @@ func GenerateKeys(bitLength int) ([]byte, []byte, error) {
 // but the methods needing the missing keys will fail.
 // This is useful when you only have the public key, and need to encrypt or verify
 func NewKeypair(publicKey, privateKey []byte) (*Keypair, error) {
-	return &Keypair{
+	key := &Keypair{
 		Public:  publicKey,
 		Private: privateKey,
-	}, nil
+	}
+
+	// Parse the given keys right away, so malformed keys are reported here
+	if publicKey != nil {
+		if _, err := key.parsedPublicKey(); err != nil {
+			return nil, err
+		}
+	}
+	if privateKey != nil {
+		if _, err := key.parsedPrivateKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
 }
 
+// parsedPublicKey returns the parsed public key, parsing it on first use
+func (key *Keypair) parsedPublicKey() (crypto.PublicKey, error) {
+	key.publicOnce.Do(func() {
+		key.publicKey, key.publicErr = parseAnyPublicKey(key.Public)
+	})
+	return key.publicKey, key.publicErr
+}
+
+// parsedPrivateKey returns the parsed private key, parsing and precomputing it on first use
+func (key *Keypair) parsedPrivateKey() (crypto.Signer, error) {
+	key.privateOnce.Do(func() {
+		key.privateKey, key.privateErr = parseAnyPrivateKey(key.Private)
+		if privateKey, ok := key.privateKey.(*rsa.PrivateKey); ok && key.privateErr == nil {
+			privateKey.Precompute()
+		}
+	})
+	return key.privateKey, key.privateErr
+}
+
+// parsePublicKey parses a public key used for encryption, which requires an RSA key
 func parsePublicKey(publicKeyPem []byte) (*rsa.PublicKey, error) {
-	block, _ := pem.Decode(publicKeyPem)
-	if block == nil {
-		return nil, errors.New("could not decode public key pem")
+	p, err := parseAnyPublicKey(publicKeyPem)
+	if err != nil {
+		return nil, err
 	}
-	p, err := x509.ParsePKIXPublicKey(block.Bytes)
+	return rsaPublicKey(p)
+}
+
+// parsePrivateKey parses a private key used for decryption, which requires an RSA key
+func parsePrivateKey(privateKeyPem []byte) (*rsa.PrivateKey, error) {
+	p, err := parseAnyPrivateKey(privateKeyPem)
 	if err != nil {
 		return nil, err
 	}
+	return rsaPrivateKey(p)
+}
+
+func rsaPublicKey(p crypto.PublicKey) (*rsa.PublicKey, error) {
 	publicKey, ok := p.(*rsa.PublicKey)
 	if !ok {
-		return nil, errors.New("public key has the wrong type")
+		keyType, _ := keyTypeOf(p)
+		return nil, &UnsupportedOperationError{Op: "encryption", KeyType: keyType}
 	}
 	return publicKey, nil
 }
 
-func parsePrivateKey(privateKeyPem []byte) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode(privateKeyPem)
-	if block == nil {
-		return nil, errors.New("could not decode private key pem")
-	}
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
+func rsaPrivateKey(p crypto.Signer) (*rsa.PrivateKey, error) {
+	privateKey, ok := p.(*rsa.PrivateKey)
+	if !ok {
+		keyType, _ := keyTypeOf(p)
+		return nil, &UnsupportedOperationError{Op: "decryption", KeyType: keyType}
 	}
 	return privateKey, nil
 }
 
 // Encrypt quick method to encrypt using the public key
-func (key *Keypair) Encrypt(data []byte) ([]byte, error) {
-	return Encrypt(data, key.Public)
+func (key *Keypair) Encrypt(data []byte, opts ...Option) ([]byte, error) {
+	p, err := key.parsedPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := rsaPublicKey(p)
+	if err != nil {
+		return nil, err
+	}
+	return encrypt(data, publicKey, newOptions(opts))
 }
 
-// Encrypt using the public key without creating a keypair
-func Encrypt(data, publicKeyPem []byte) ([]byte, error) {
+// Encrypt using the public key without creating a keypair.
+// Without options OAEP with SHA-1 is used, as expected by the Node trsa library.
+func Encrypt(data, publicKeyPem []byte, opts ...Option) ([]byte, error) {
 	publicKey, err := parsePublicKey(publicKeyPem)
 	if err != nil {
 		return nil, err
 	}
-	// 11 is part of the rsa chunk, 32 the length of a sha1 hash
-	partLen := publicKey.N.BitLen()/8 - 11 - 32
+	return encrypt(data, publicKey, newOptions(opts))
+}
+
+func encrypt(data []byte, publicKey *rsa.PublicKey, o *options) ([]byte, error) {
+	partLen := o.oaepChunkSize(publicKey.N.BitLen())
+	if partLen <= 0 {
+		return nil, rsa.ErrMessageTooLong
+	}
 	chunks := split(data, partLen)
 
 	buffer := bytes.NewBuffer([]byte{})
 	for _, chunk := range chunks {
-		bts, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, publicKey, chunk, nil)
+		bts, err := rsa.EncryptOAEP(o.oaepHash(), rand.Reader, publicKey, chunk, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -152,22 +254,34 @@ func Encrypt(data, publicKeyPem []byte) ([]byte, error) {
 }
 
 // Decrypt using the keypairs privateKey
-func (key *Keypair) Decrypt(encrypted []byte) ([]byte, error) {
-	return Decrypt(encrypted, key.Private)
+func (key *Keypair) Decrypt(encrypted []byte, opts ...Option) ([]byte, error) {
+	p, err := key.parsedPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := rsaPrivateKey(p)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(encrypted, privateKey, newOptions(opts))
 }
 
 // Decrypt using a privatekey without creating a keypair
-func Decrypt(encrypted, privateKeyPem []byte) ([]byte, error) {
+func Decrypt(encrypted, privateKeyPem []byte, opts ...Option) ([]byte, error) {
 	privateKey, err := parsePrivateKey(privateKeyPem)
 	if err != nil {
 		return nil, err
 	}
-	partLen := privateKey.N.BitLen() / 8
+	return decrypt(encrypted, privateKey, newOptions(opts))
+}
+
+func decrypt(encrypted []byte, privateKey *rsa.PrivateKey, o *options) ([]byte, error) {
+	partLen := privateKey.Size()
 	chunks := split(encrypted, partLen)
 
 	buffer := bytes.NewBuffer([]byte{})
 	for _, chunk := range chunks {
-		decrypted, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, privateKey, chunk, nil)
+		decrypted, err := rsa.DecryptOAEP(o.oaepHash(), rand.Reader, privateKey, chunk, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -178,21 +292,44 @@ func Decrypt(encrypted, privateKeyPem []byte) ([]byte, error) {
 }
 
 // Sign data
-func (key *Keypair) Sign(data []byte) ([]byte, error) {
-	return Sign(data, key.Private)
+func (key *Keypair) Sign(data []byte, opts ...Option) ([]byte, error) {
+	privateKey, err := key.parsedPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return sign(data, privateKey, newOptions(opts))
 }
 
-// Sign data
-func Sign(data, privateKeyPem []byte) ([]byte, error) {
-	privateKey, err := parsePrivateKey(privateKeyPem)
+// Sign data with an RSA (PKCS#1 v1.5), ECDSA P-256 (ASN.1) or Ed25519 private key.
+// RSA and ECDSA sign the SHA-256 hash of data, Ed25519 signs data directly.
+// RSA keys use PKCS#1 v1.5 unless SchemePSS is selected.
+func Sign(data, privateKeyPem []byte, opts ...Option) ([]byte, error) {
+	privateKey, err := parseAnyPrivateKey(privateKeyPem)
 	if err != nil {
 		return nil, err
 	}
+	return sign(data, privateKey, newOptions(opts))
+}
+
+func sign(data []byte, privateKey crypto.Signer, o *options) ([]byte, error) {
 	h := crypto.SHA256.New()
 	h.Write([]byte(data))
 	hashed := h.Sum(nil)
 
-	sign, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed)
+	var sign []byte
+	var err error
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if o.signature == SchemePSS {
+			sign, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, hashed, pssOptions)
+		} else {
+			sign, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hashed)
+		}
+	case *ecdsa.PrivateKey:
+		sign, err = ecdsa.SignASN1(rand.Reader, k, hashed)
+	case ed25519.PrivateKey:
+		sign = ed25519.Sign(k, data)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -200,16 +337,24 @@ func Sign(data, privateKeyPem []byte) ([]byte, error) {
 }
 
 // Verify data's signature
-func (key *Keypair) Verify(data, signature []byte) error {
-	return Verify(data, signature, key.Public)
+func (key *Keypair) Verify(data, signature []byte, opts ...Option) error {
+	publicKey, err := key.parsedPublicKey()
+	if err != nil {
+		return err
+	}
+	return verify(data, signature, publicKey, newOptions(opts))
 }
 
-// Verify data's signature
-func Verify(data, signature, publicKeyPem []byte) error {
-	publicKey, err := parsePublicKey(publicKeyPem)
+// Verify data's signature made by Sign with the same options
+func Verify(data, signature, publicKeyPem []byte, opts ...Option) error {
+	publicKey, err := parseAnyPublicKey(publicKeyPem)
 	if err != nil {
 		return err
 	}
+	return verify(data, signature, publicKey, newOptions(opts))
+}
+
+func verify(data, signature []byte, publicKey crypto.PublicKey, o *options) error {
 	h := crypto.SHA256.New()
 	h.Write([]byte(data))
 	hashed := h.Sum(nil)
@@ -219,11 +364,33 @@ func Verify(data, signature, publicKeyPem []byte) error {
 		return err
 	}
 
-	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed, decodedSign)
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		if o.signature == SchemePSS {
+			err = rsa.VerifyPSS(k, crypto.SHA256, hashed, decodedSign, pssOptions)
+		} else {
+			err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, decodedSign)
+		}
+		if err != nil {
+			return ErrVerification
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, hashed, decodedSign) {
+			return ErrVerification
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, decodedSign) {
+			return ErrVerification
+		}
+	}
+	return nil
 }
 
 // https://gist.github.com/xlab/6e204ef96b4433a697b3
 func split(buf []byte, lim int) [][]byte {
+	if lim <= 0 {
+		return nil
+	}
 	var chunk []byte
 	chunks := make([][]byte, 0, len(buf)/lim+1)
 	for len(buf) >= lim {
@@ -2,8 +2,18 @@ package trsa
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -93,3 +103,304 @@ func TestSignVerify(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 }
+
+func TestImportPrivateKey(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	privateKey, err := parsePrivateKey(keypair.Private)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	for name, key := range map[string][]byte{"pkcs1": keypair.Private, "pkcs8": pkcs8} {
+		publicKey, imported, err := ImportPrivateKey(key)
+		if err != nil {
+			t.Fatal(name, err.Error())
+		}
+		if !bytes.Equal(imported, keypair.Private) {
+			t.Error(name, "imported private key differs")
+		}
+		if !bytes.Equal(publicKey, keypair.Public) {
+			t.Error(name, "derived public key differs")
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	block, _ := pem.Decode(keypair.Public)
+	sum := sha256.Sum256(block.Bytes)
+
+	fingerprint, err := Fingerprint(keypair.Public)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fingerprint != hex.EncodeToString(sum[:]) {
+		t.Fatal("unexpected fingerprint ", fingerprint)
+	}
+}
+
+func TestSigningKeyTypes(t *testing.T) {
+	data := []byte("container echoes")
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		publicKey, privateKey, err := GenerateSigningKeys(keyType)
+		if err != nil {
+			t.Fatal(keyType, err.Error())
+		}
+
+		for _, key := range [][]byte{publicKey, privateKey} {
+			detected, err := DetectKeyType(key)
+			if err != nil {
+				t.Fatal(keyType, err.Error())
+			}
+			if detected != keyType {
+				t.Error(keyType, "detected as", detected)
+			}
+		}
+
+		signature, err := Sign(data, privateKey)
+		if err != nil {
+			t.Fatal(keyType, err.Error())
+		}
+		if err := Verify(data, signature, publicKey); err != nil {
+			t.Error(keyType, err.Error())
+		}
+		if err := Verify([]byte("tampered"), signature, publicKey); !errors.Is(err, ErrVerification) {
+			t.Error(keyType, "verified tampered data:", err)
+		}
+	}
+}
+
+func TestUnsupportedOperation(t *testing.T) {
+	publicKey, privateKey, err := GenerateSigningKeys(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var opErr *UnsupportedOperationError
+	_, err = Encrypt([]byte("data"), publicKey)
+	if !errors.As(err, &opErr) || opErr.KeyType != KeyTypeEd25519 {
+		t.Error("expected UnsupportedOperationError for encryption, got", err)
+	}
+	_, err = Decrypt([]byte("data"), privateKey)
+	if !errors.As(err, &opErr) || opErr.Op != "decryption" {
+		t.Error("expected UnsupportedOperationError for decryption, got", err)
+	}
+}
+
+func TestUnsupportedCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = DetectKeyType(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if !errors.Is(err, ErrUnsupportedKeyType) {
+		t.Error("expected ErrUnsupportedKeyType, got", err)
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := bytes.Repeat([]byte("container echoes "), 64)
+
+	encrypted, err := keypair.Encrypt(data, WithScheme(SchemeOAEPSHA256))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decrypted, err := keypair.Decrypt(encrypted, WithScheme(SchemeOAEPSHA256))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Fatal("unequal after OAEP SHA-256 round trip")
+	}
+	if _, err := keypair.Decrypt(encrypted); err == nil {
+		t.Error("decrypted OAEP SHA-256 data with the default scheme")
+	}
+
+	signature, err := keypair.Sign(data, WithScheme(SchemePSS))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := keypair.Verify(data, signature, WithScheme(SchemePSS)); err != nil {
+		t.Error(err.Error())
+	}
+	if err := keypair.Verify(data, signature); !errors.Is(err, ErrVerification) {
+		t.Error("verified a PSS signature as PKCS#1 v1.5:", err)
+	}
+}
+
+func TestStrongest(t *testing.T) {
+	tests := []struct {
+		advertised []Scheme
+		encryption Scheme
+		signature  Scheme
+	}{
+		{nil, SchemeOAEPSHA1, SchemePKCS1v15},
+		{[]Scheme{"unknown"}, SchemeOAEPSHA1, SchemePKCS1v15},
+		{[]Scheme{SchemeOAEPSHA1, SchemeOAEPSHA256}, SchemeOAEPSHA256, SchemePKCS1v15},
+		{[]Scheme{SchemePKCS1v15, SchemePSS, SchemeOAEPSHA1}, SchemeOAEPSHA1, SchemePSS},
+	}
+
+	for _, test := range tests {
+		encryption, signature := Strongest(test.advertised)
+		if encryption != test.encryption || signature != test.signature {
+			t.Error(test.advertised, "picked", encryption, signature)
+		}
+	}
+}
+
+var benchmarkSizes = []int{64, 1024, 16 * 1024}
+
+func BenchmarkEncrypt(b *testing.B) {
+	keypair, err := loadKey()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	for _, size := range benchmarkSizes {
+		data := bytes.Repeat([]byte("x"), size)
+		b.Run(fmt.Sprintf("pem/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := Encrypt(data, keypair.Public); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("keypair/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := keypair.Encrypt(data); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	keypair, err := loadKey()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	for _, size := range benchmarkSizes {
+		encrypted, err := keypair.Encrypt(bytes.Repeat([]byte("x"), size))
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		b.Run(fmt.Sprintf("pem/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := Decrypt(encrypted, keypair.Private); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("keypair/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := keypair.Decrypt(encrypted); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSign(b *testing.B) {
+	keypair, err := loadKey()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	data := bytes.Repeat([]byte("x"), 1024)
+
+	b.Run("pem", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Sign(data, keypair.Private); err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+	})
+	b.Run("keypair", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := keypair.Sign(data); err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+	})
+}
+
+func BenchmarkStream(b *testing.B) {
+	keypair, err := loadKey()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	data := bytes.Repeat([]byte("x"), 1024*1024)
+
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		encryptor, err := keypair.NewEncryptor(io.Discard)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		if _, err := encryptor.Write(data); err != nil {
+			b.Fatal(err.Error())
+		}
+		if err := encryptor.Close(); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func TestKeypairConcurrentUse(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			encrypted, err := keypair.Encrypt([]byte("container echoes"))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			if _, err := keypair.Decrypt(encrypted); err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNewKeypairRejectsMalformedKeys(t *testing.T) {
+	if _, err := NewKeypair([]byte("not a key"), nil); err == nil {
+		t.Error("accepted a malformed public key")
+	}
+	if _, err := NewKeypair(nil, []byte("not a key")); err == nil {
+		t.Error("accepted a malformed private key")
+	}
+}
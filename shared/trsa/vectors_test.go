@@ -0,0 +1,181 @@
+package trsa
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testVectors mirrors testData/vectors.json, see testData/generate-vectors.js
+type testVectors struct {
+	Keys map[string]struct {
+		PublicKey  string `json:"publicKey"`
+		PrivateKey string `json:"privateKey"`
+	} `json:"keys"`
+	Vectors []struct {
+		Name       string `json:"name"`
+		Bits       int    `json:"bits"`
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+		Signature  string `json:"signature"`
+	} `json:"vectors"`
+}
+
+func loadVectors(t *testing.T) *testVectors {
+	data, err := os.ReadFile("./testData/vectors.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var vectors testVectors
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(vectors.Vectors) == 0 {
+		t.Fatal("no test vectors")
+	}
+	return &vectors
+}
+
+func TestVectors(t *testing.T) {
+	vectors := loadVectors(t)
+
+	for _, v := range vectors.Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			key := vectors.Keys[strconv.Itoa(v.Bits)]
+			keypair, err := NewKeypair([]byte(key.PublicKey), []byte(key.PrivateKey))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			plaintext, _ := hex.DecodeString(v.Plaintext)
+			ciphertext, _ := hex.DecodeString(v.Ciphertext)
+
+			decrypted, err := keypair.Decrypt(ciphertext)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("decrypted data differs from the plaintext")
+			}
+
+			if err := keypair.Verify(plaintext, []byte(v.Signature)); err != nil {
+				t.Fatal(err.Error())
+			}
+
+			// PKCS#1 v1.5 signatures are deterministic
+			signature, err := keypair.Sign(plaintext)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(signature) != v.Signature {
+				t.Fatal("signature differs from the golden signature")
+			}
+		})
+	}
+}
+
+// TestEncryptLayout pins the layout of the ciphertext, every chunk of the
+// plaintext becomes one block as long as the modulus, which is how peers split it
+func TestEncryptLayout(t *testing.T) {
+	vectors := loadVectors(t)
+
+	for _, v := range vectors.Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			key := vectors.Keys[strconv.Itoa(v.Bits)]
+			keypair, err := NewKeypair([]byte(key.PublicKey), []byte(key.PrivateKey))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			plaintext, _ := hex.DecodeString(v.Plaintext)
+
+			encrypted, err := keypair.Encrypt(plaintext)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			blockLen := v.Bits / 8
+			chunkLen := blockLen - 11 - 32
+			blocks := (len(plaintext) + chunkLen - 1) / chunkLen
+			if len(encrypted) != blocks*blockLen {
+				t.Fatalf("expected %d blocks of %d bytes, got %d bytes", blocks, blockLen, len(encrypted))
+			}
+
+			// Every block has to decrypt on its own to its chunk of the plaintext
+			for i, block := range split(encrypted, blockLen) {
+				decrypted, err := keypair.Decrypt(block)
+				if err != nil {
+					t.Fatal(i, err.Error())
+				}
+				end := (i + 1) * chunkLen
+				if end > len(plaintext) {
+					end = len(plaintext)
+				}
+				if !bytes.Equal(decrypted, plaintext[i*chunkLen:end]) {
+					t.Fatal("block", i, "does not hold its chunk of the plaintext")
+				}
+			}
+		})
+	}
+}
+
+func TestDataFile(t *testing.T) {
+	keypair, err := loadKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := os.ReadFile("./testData/data.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// data.txt.encrypted and data.txt.signature were made from a copy of data.txt
+	// with CRLF line endings and no final newline, the repository stores it with LF
+	data = bytes.ReplaceAll(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"), []byte("\r\n"))
+	encrypted, err := os.ReadFile("./testData/data.txt.encrypted")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signature, err := os.ReadFile("./testData/data.txt.signature")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	decrypted, err := keypair.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Fatal("decrypted data.txt.encrypted differs from data.txt")
+	}
+	if err := keypair.Verify(data, []byte(strings.TrimSpace(string(signature)))); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		length int
+		limit  int
+		chunks []int
+	}{
+		{0, 4, []int{}},
+		{3, 4, []int{3}},
+		{4, 4, []int{4}},
+		{5, 4, []int{4, 1}},
+		{8, 4, []int{4, 4}},
+	}
+
+	for _, test := range tests {
+		chunks := split(make([]byte, test.length), test.limit)
+		if len(chunks) != len(test.chunks) {
+			t.Fatal(test.length, "split into", len(chunks), "chunks")
+		}
+		for i, chunk := range chunks {
+			if len(chunk) != test.chunks[i] {
+				t.Error(test.length, "chunk", i, "has length", len(chunk))
+			}
+		}
+	}
+}
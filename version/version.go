@@ -14,6 +14,8 @@
 
 package version
 
+import "runtime/debug"
+
 // Version of Woodpecker, set with ldflags, from Git tag
 var Version string
 
@@ -25,3 +27,24 @@ func String() string {
 
 	return Version
 }
+
+// Commit the binary was built from, set with ldflags
+var Commit string
+
+// GitCommit returns the Commit set at build time, the VCS revision recorded by
+// the Go toolchain or "unknown"
+func GitCommit() string {
+	if Commit != "" {
+		return Commit
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+
+	return "unknown"
+}